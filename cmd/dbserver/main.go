@@ -0,0 +1,84 @@
+// Serve a database file over TCP; see pkg/server for the protocol.
+package main
+
+import (
+	"database-go/pkg/kv"
+	"database-go/pkg/server"
+	"database-go/pkg/trace"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:7070", "address to listen on")
+	respAddr := flag.String("resp", "", "address to serve the Redis protocol on as well, if set")
+	pgAddr := flag.String("pg", "", "address to serve SQL over the Postgres protocol on as well, if set")
+	httpAddr := flag.String("http", "", "address to serve the JSON HTTP API on as well, if set")
+	path := flag.String("db", "data.db", "database file, created if it doesn't exist")
+	archive := flag.String("wal-archive", "", "directory to archive every commit in for point-in-time recovery, if set")
+	var limits server.LoadLimits
+	flag.IntVar(&limits.MaxInFlight, "max-in-flight", 0, "requests to run at once, queueing or shedding the rest; 0 for no limit")
+	flag.Float64Var(&limits.MaxCPU, "max-cpu", 0, "fraction of the CPUs above which batch requests are shed; 0 for no limit")
+	flag.Uint64Var(&limits.MaxHeapBytes, "max-heap", 0, "heap bytes above which batch requests are shed; 0 for no limit")
+	flag.DurationVar(&limits.MaxWriteLatency, "max-write-latency", 0, "average write time above which batch requests are shed; 0 for no limit")
+	traceLog := flag.Bool("trace", false, "log every span of every request, for following one through the engine")
+	flag.Parse()
+
+	if *traceLog {
+		trace.SetExporter(func(span *trace.Span) {
+			log.Printf("trace %x span %x parent %x %s %v %v err=%v", span.Context.TraceID, span.Context.SpanID,
+				span.Parent, span.Name, span.Duration, span.Attrs, span.Err)
+		})
+	}
+	db, err := kv.Open(*path, kv.Options{WALArchive: *archive})
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := server.New(db)
+	srv.SetLoadLimits(limits)
+
+	// Shut down cleanly on SIGINT and SIGTERM, rolling back open transactions
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+
+	if *respAddr != "" {
+		go func() {
+			if err := srv.ListenAndServeRESP(*respAddr); !errors.Is(err, server.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		log.Printf("serving the Redis protocol on %s", *respAddr)
+	}
+	if *pgAddr != "" {
+		go func() {
+			if err := srv.ListenAndServePG(*pgAddr); !errors.Is(err, server.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		log.Printf("serving the Postgres protocol on %s", *pgAddr)
+	}
+	if *httpAddr != "" {
+		go func() {
+			if err := srv.ListenAndServeREST(*httpAddr); !errors.Is(err, server.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+		log.Printf("serving the HTTP API on %s", *httpAddr)
+	}
+	log.Printf("serving %s on %s", *path, *addr)
+	err = srv.ListenAndServe(*addr)
+	if cerr := db.Close(); err == nil || errors.Is(err, server.ErrServerClosed) {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Lines of history kept, in memory and in the file
+const HISTORY_MAX_LINES = 1000
+
+/*
+Reads command lines. On a terminal it puts it in raw mode for the length of each
+line and does the editing itself: arrows, Home/End, ^A ^E ^U ^K ^W, Up/Down through
+the history and Tab to complete the command name. Anywhere else it just reads lines.
+*/
+type lineReader struct {
+	in   *bufio.Reader
+	fd   int
+	term bool
+	out  io.Writer
+
+	history  []string
+	histFile string
+	// Command names for completion, sorted
+	words []string
+}
+
+func newLineReader(in *os.File, out io.Writer, histFile string, words []string) *lineReader {
+	r := &lineReader{
+		in:       bufio.NewReader(in),
+		fd:       int(in.Fd()),
+		term:     isTerminal(int(in.Fd())),
+		out:      out,
+		histFile: histFile,
+		words:    words,
+	}
+	r.loadHistory()
+	return r
+}
+
+// Read the next line without its newline. Returns io.EOF at the end of input or on ^D.
+func (r *lineReader) ReadLine(prompt string) (string, error) {
+	if !r.term {
+		line, err := r.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	restore, err := makeRaw(r.fd)
+	if err != nil {
+		return "", err
+	}
+	line, err := r.edit(prompt)
+	restore()
+	if err == nil && strings.TrimSpace(line) != "" {
+		r.addHistory(line)
+	}
+	return line, err
+}
+
+// The editing loop, in raw mode.
+func (r *lineReader) edit(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	// Position in the history, len(history) for the line being typed, which is kept in typed
+	hist, typed := len(r.history), ""
+	redraw := func() {
+		// Start of the line, prompt and text, clear the rest, then back to the cursor
+		fmt.Fprintf(r.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(r.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(to int) {
+		if to < 0 || to > len(r.history) || to == hist {
+			return
+		}
+		if hist == len(r.history) {
+			typed = string(buf)
+		}
+		hist = to
+		if hist == len(r.history) {
+			buf = []rune(typed)
+		} else {
+			buf = []rune(r.history[hist])
+		}
+		pos = len(buf)
+	}
+	redraw()
+
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Fprint(r.out, "\r\n")
+			return string(buf), nil
+		case 3: // ^C drops the line
+			fmt.Fprint(r.out, "^C\r\n")
+			return "", nil
+		case 4: // ^D ends the input on an empty line, and deletes forward otherwise
+			if len(buf) == 0 {
+				fmt.Fprint(r.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // ^A
+			pos = 0
+		case 5: // ^E
+			pos = len(buf)
+		case 11: // ^K
+			buf = buf[:pos]
+		case 21: // ^U
+			buf = append(buf[:0], buf[pos:]...)
+			pos = 0
+		case 23: // ^W deletes the word before the cursor
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 16: // ^P
+			recall(hist - 1)
+		case 14: // ^N
+			recall(hist + 1)
+		case '\t':
+			buf, pos = r.complete(buf, pos, prompt)
+		case 27:
+			switch r.escape() {
+			case 'A':
+				recall(hist - 1)
+			case 'B':
+				recall(hist + 1)
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '3': // Delete
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if !unicode.IsPrint(c) {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{c}, buf[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+/*
+Read the rest of an escape sequence after ESC, returning its final letter for the
+arrows, Home and End, or the number for Delete (ESC [ 3 ~). Anything else comes
+back as 0 and is ignored.
+*/
+func (r *lineReader) escape() rune {
+	c, _, err := r.in.ReadRune()
+	if err != nil || (c != '[' && c != 'O') {
+		return 0
+	}
+	c, _, err = r.in.ReadRune()
+	if err != nil {
+		return 0
+	}
+	if c >= '0' && c <= '9' {
+		// ESC [ n ~, where n is 1 or 7 for Home, 4 or 8 for End and 3 for Delete
+		end, _, err := r.in.ReadRune()
+		if err != nil || end != '~' {
+			return 0
+		}
+		switch c {
+		case '1', '7':
+			return 'H'
+		case '4', '8':
+			return 'F'
+		}
+		return c
+	}
+	return c
+}
+
+/*
+Complete the command name under the cursor. One match is filled in in full; several
+are filled in as far as they agree, and listed if that adds nothing. Only the first
+word is completed.
+*/
+func (r *lineReader) complete(buf []rune, pos int, prompt string) ([]rune, int) {
+	word := string(buf[:pos])
+	if strings.ContainsAny(word, " \t") {
+		return buf, pos
+	}
+	var matches []string
+	for _, w := range r.words {
+		if strings.HasPrefix(w, word) {
+			matches = append(matches, w)
+		}
+	}
+	if len(matches) == 0 {
+		return buf, pos
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		n := 0
+		for n < len(common) && n < len(m) && common[n] == m[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	if len(matches) == 1 {
+		common += " "
+	}
+	if len(common) == len(word) {
+		fmt.Fprintf(r.out, "\r\n%s\r\n", strings.Join(matches, "  "))
+		return buf, pos
+	}
+	fill := []rune(common[len(word):])
+	buf = append(buf[:pos], append(fill, buf[pos:]...)...)
+	return buf, pos + len(fill)
+}
+
+func (r *lineReader) addHistory(line string) {
+	if n := len(r.history); n > 0 && r.history[n-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if len(r.history) > HISTORY_MAX_LINES {
+		r.history = r.history[len(r.history)-HISTORY_MAX_LINES:]
+	}
+	r.saveHistory()
+}
+
+func (r *lineReader) loadHistory() {
+	if r.histFile == "" {
+		return
+	}
+	data, err := os.ReadFile(r.histFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+	if len(r.history) > HISTORY_MAX_LINES {
+		r.history = r.history[len(r.history)-HISTORY_MAX_LINES:]
+	}
+}
+
+// Write the whole history out after every line; it's small. Failing to is not worth stopping for.
+func (r *lineReader) saveHistory() {
+	if r.histFile == "" {
+		return
+	}
+	os.WriteFile(r.histFile, []byte(strings.Join(r.history, "\n")+"\n"), 0600)
+}
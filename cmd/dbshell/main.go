@@ -0,0 +1,363 @@
+/*
+Interactive shell over a database file.
+
+	dbshell [-readonly] [-history file] FILE
+
+Commands are read one per line; "help" lists them. Keys and values are words, or
+Go-quoted strings for anything with spaces or binary bytes in it, and are printed
+back quoted the same way. On a terminal the line can be edited, Up and Down go
+through the history, which is kept between runs, and Tab completes command names.
+*/
+package main
+
+import (
+	"database-go/pkg/kv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Most keys scan prints unless given a limit
+const SCAN_DEFAULT_LIMIT = 100
+
+type command struct {
+	usage string
+	help  string
+	run   func(sh *shell, args [][]byte) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":   {"get KEY", "print the value of KEY", (*shell).get},
+		"set":   {"set KEY VALUE", "set KEY to VALUE", (*shell).set},
+		"del":   {"del KEY", "delete KEY", (*shell).del},
+		"scan":  {"scan [PREFIX [LIMIT]]", "list the keys starting with PREFIX and their values", (*shell).scan},
+		"range": {"range START END [LIMIT]", "list the keys in [START, END) and their values", (*shell).scanRange},
+		"stats": {"stats", "show the state of the handle", (*shell).stats},
+		"check": {"check", "verify the whole file", (*shell).check},
+		"help":  {"help", "list the commands", (*shell).help},
+		"exit":  {"exit", "leave the shell (or ^D)", nil},
+	}
+}
+
+// Returned by parseLine for a quoted word that doesn't end
+var errUnterminated = errors.New("unterminated quoted string")
+
+type shell struct {
+	db  *kv.DB
+	out io.Writer
+}
+
+func main() {
+	readOnly := flag.Bool("readonly", false, "open the file read-only, alongside another process writing it")
+	history := flag.String("history", defaultHistory(), "file to keep the command history in, none if empty")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dbshell [-readonly] [-history file] FILE")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var db *kv.DB
+	var err error
+	if *readOnly {
+		db, err = kv.OpenReadOnly(flag.Arg(0))
+	} else {
+		db, err = kv.Open(flag.Arg(0), kv.Options{})
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := newLineReader(os.Stdin, os.Stdout, *history, names)
+	sh := &shell{db: db, out: os.Stdout}
+	if err := sh.run(lines, filepath.Base(flag.Arg(0))+"> "); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Read and run lines until exit or the end of the input.
+func (sh *shell) run(lines *lineReader, prompt string) error {
+	for {
+		line, err := lines.ReadLine(prompt)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !sh.exec(line) {
+			return nil
+		}
+	}
+}
+
+// Run one line, printing any error. Returns false to leave the shell.
+func (sh *shell) exec(line string) bool {
+	words, err := parseLine(line)
+	if err != nil {
+		fmt.Fprintln(sh.out, "error:", err)
+		return true
+	}
+	if len(words) == 0 {
+		return true
+	}
+	name := string(words[0])
+	if name == "exit" || name == "quit" {
+		return false
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(sh.out, "error: unknown command %q, try help\n", name)
+		return true
+	}
+	if err := cmd.run(sh, words[1:]); err != nil {
+		fmt.Fprintln(sh.out, "error:", err)
+	}
+	return true
+}
+
+/*
+Split a line into words at spaces. A word starting with a double quote runs to the
+closing one and is unquoted as a Go string, so it can hold spaces and any bytes.
+*/
+func parseLine(line string) ([][]byte, error) {
+	var words [][]byte
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return words, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			words = append(words, []byte(line[:end]))
+			line = line[end:]
+			continue
+		}
+
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil, errUnterminated
+		}
+		word, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", line[:end+1], err)
+		}
+		words = append(words, []byte(word))
+		line = line[end+1:]
+	}
+}
+
+func (sh *shell) get(args [][]byte) error {
+	if len(args) != 1 {
+		return usage("get")
+	}
+	val, err := sh.db.Get(args[0])
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		fmt.Fprintln(sh.out, "(not found)")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%q\n", val)
+	return nil
+}
+
+func (sh *shell) set(args [][]byte) error {
+	if len(args) != 2 {
+		return usage("set")
+	}
+	if err := sh.db.Set(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Fprintln(sh.out, "OK")
+	return nil
+}
+
+func (sh *shell) del(args [][]byte) error {
+	if len(args) != 1 {
+		return usage("del")
+	}
+	deleted, err := sh.db.Del(args[0])
+	if err != nil {
+		return err
+	}
+	if deleted {
+		fmt.Fprintln(sh.out, "deleted")
+	} else {
+		fmt.Fprintln(sh.out, "(not found)")
+	}
+	return nil
+}
+
+func (sh *shell) scan(args [][]byte) error {
+	if len(args) > 2 {
+		return usage("scan")
+	}
+	var prefix []byte
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	limit, err := parseLimit(args, 1)
+	if err != nil {
+		return err
+	}
+	snap, err := sh.db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return sh.list(limit, func(fn func(key, val []byte) error) error {
+		return snap.Scan(prefix, fn)
+	})
+}
+
+func (sh *shell) scanRange(args [][]byte) error {
+	if len(args) < 2 || len(args) > 3 {
+		return usage("range")
+	}
+	limit, err := parseLimit(args, 2)
+	if err != nil {
+		return err
+	}
+	snap, err := sh.db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return sh.list(limit, func(fn func(key, val []byte) error) error {
+		return snap.Range(args[0], args[1], fn)
+	})
+}
+
+// Returned from inside a scan to stop it at the limit
+var errLimit = errors.New("limit reached")
+
+// Print the pairs a scan produces, up to limit of them.
+func (sh *shell) list(limit int, scan func(fn func(key, val []byte) error) error) error {
+	n := 0
+	err := scan(func(key, val []byte) error {
+		if n == limit {
+			return errLimit
+		}
+		n++
+		fmt.Fprintf(sh.out, "%q = %q\n", key, val)
+		return nil
+	})
+	if errors.Is(err, errLimit) {
+		fmt.Fprintf(sh.out, "(first %d keys; give a limit to see more)\n", limit)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "(%d keys)\n", n)
+	return nil
+}
+
+// The limit at args[i], if there is one.
+func parseLimit(args [][]byte, i int) (int, error) {
+	if len(args) <= i {
+		return SCAN_DEFAULT_LIMIT, nil
+	}
+	limit, err := strconv.Atoi(string(args[i]))
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("bad limit %q", args[i])
+	}
+	return limit, nil
+}
+
+func (sh *shell) stats(args [][]byte) error {
+	if len(args) != 0 {
+		return usage("stats")
+	}
+	s, err := sh.db.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "version            %d\n", s.Version)
+	fmt.Fprintf(sh.out, "pages              %d of %d bytes\n", s.Pages, s.PageSize)
+	fmt.Fprintf(sh.out, "cache              %+v\n", s.Cache)
+	fmt.Fprintf(sh.out, "readers            %d, holding %d pages\n", s.Readers, s.HeldPages)
+	fmt.Fprintf(sh.out, "transactions       %d running\n", s.Running)
+	fmt.Fprintf(sh.out, "retained versions  %d\n", s.RetainedVersions)
+	fmt.Fprintf(sh.out, "key versions       %t\n", s.KeyVersions)
+	fmt.Fprintf(sh.out, "read-only          %t\n", s.ReadOnly)
+	return nil
+}
+
+func (sh *shell) check(args [][]byte) error {
+	if len(args) != 0 {
+		return usage("check")
+	}
+	r, err := sh.db.Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "depth %d, %d nodes, %d leaves, %d keys, %d overflow pages\n",
+		r.Depth, r.Nodes, r.Leaves, r.Keys, r.OverflowPages)
+	fmt.Fprintf(sh.out, "%d free pages on %d list pages, %d leaked\n",
+		r.FreeList.Free, r.FreeList.ListPages, r.FreeList.Leaked)
+	for _, v := range r.Violations {
+		fmt.Fprintln(sh.out, "violation:", v)
+	}
+	if r.OK() {
+		fmt.Fprintln(sh.out, "OK")
+	} else {
+		fmt.Fprintf(sh.out, "%d violations\n", len(r.Violations))
+	}
+	return nil
+}
+
+func (sh *shell) help(args [][]byte) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(sh.out, "  %-26s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+func usage(name string) error {
+	return fmt.Errorf("usage: %s", commands[name].usage)
+}
+
+// ~/.dbshell_history, or nothing if there's no home directory.
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".dbshell_history")
+}
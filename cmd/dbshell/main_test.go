@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"database-go/pkg/kv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run the lines of input through the shell's command loop over a pipe, as from a script, and return what it printed.
+func runShell(t *testing.T, db *kv.DB, input string) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.WriteString(input)
+		w.Close()
+	}()
+
+	var out bytes.Buffer
+	sh := &shell{db: db, out: &out}
+	if err := sh.run(newLineReader(r, &out, "", nil), "> "); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestShell(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"empty", "", ""},
+		{"blank lines", "\n  \n\t\n", ""},
+		{"set and get", "set k v\nget k\nget missing\n", "OK\n\"v\"\n(not found)\n"},
+		{"no final newline", "set k v\nget k", "OK\n\"v\"\n"},
+		{"crlf", "set k v\r\nget k\r\n", "OK\n\"v\"\n"},
+		{"quoted words", `set "a key" "a\x00value"` + "\nget \"a key\"\n", "OK\n\"a\\x00value\"\n"},
+		{"unterminated", "get \"k\n", "error: unterminated quoted string\n"},
+		{"bad quote", `get "\q"` + "\n", "error: \"\\q\": invalid syntax\n"},
+		{"del", "set k v\ndel k\ndel k\nget k\n", "OK\ndeleted\n(not found)\n(not found)\n"},
+		{"scan", "set a1 x\nset a2 y\nset b1 z\nscan a\n",
+			"OK\nOK\nOK\n\"a1\" = \"x\"\n\"a2\" = \"y\"\n(2 keys)\n"},
+		{"scan limit", "set a1 x\nset a2 y\nscan \"\" 1\n",
+			"OK\nOK\n\"a1\" = \"x\"\n(first 1 keys; give a limit to see more)\n"},
+		{"range", "set a x\nset b y\nset c z\nrange b c\n", "OK\nOK\nOK\n\"b\" = \"y\"\n(1 keys)\n"},
+		{"usage", "get\nset k\nrange a\nscan a 0\n",
+			"error: usage: get KEY\nerror: usage: set KEY VALUE\nerror: usage: range START END [LIMIT]\nerror: bad limit \"0\"\n"},
+		{"reserved key", "set \"\\x00k\" v\n", "error: kv: keys starting with 0x00 are reserved\n"},
+		{"unknown", "frob\n", "error: unknown command \"frob\", try help\n"},
+		{"exit", "set k v\nexit\nget k\n", "OK\n"},
+		{"quit", "quit\nset k v\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := runShell(t, db, tt.input); got != tt.want {
+				t.Errorf("input %q printed\n%s\nwant\n%s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellInspect(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	out := runShell(t, db, "set k v\nstats\ncheck\nhelp\n")
+	for _, want := range []string{"version            1\n", "key versions       false\n", "OK\n", "  get KEY ", "  exit "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "error") || strings.Contains(out, "violation") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
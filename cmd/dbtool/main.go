@@ -0,0 +1,252 @@
+/*
+Offline tools for database files.
+
+	dbtool diff [-values] A B
+	dbtool dump FILE > DUMP
+	dbtool restore [-page-size N] FILE < DUMP
+	dbtool backup [-since VERSION] FILE > BACKUP
+	dbtool apply BASE < INCREMENTAL
+	dbtool recover [-version N] [-time RFC3339] ARCHIVE BASE
+
+diff lists the keys that differ from file A to file B, one per line: "+" for a key
+only B has, "-" for one only A has and "~" for one in both with different values,
+with a count of each at the end. Exits 1 if the files differ and 0 if they hold the
+same keys and values, like diff. Files are opened read-only, so a live database can
+be compared with its replica or a backup of it.
+
+dump writes a database to standard output in the format of kv.DB.Dump, and restore
+creates a new database from one, with a different page size if asked, which is how
+to move a database to other tree options.
+
+backup writes a copy of a database to standard output, as kv.DB.Backup does, or
+with -since an incremental backup from that version, printing the version it
+reaches for the next -since. A full copy's version is the one dbshell's stats shows
+for it. apply brings a copy up to date with an incremental that starts at its
+version; see kv.ApplyIncremental.
+
+recover brings a copy forward by replaying the commits in a WAL archive (dbserver's
+-wal-archive) up to the version or time given, or to the end of the archive, so a
+database can be restored to just before a bad write; see kv.RecoverTo.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/btree"
+	"database-go/pkg/kv"
+	"database-go/pkg/pager"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "diff":
+		os.Exit(diff(os.Args[2:]))
+	case "dump":
+		os.Exit(dump(os.Args[2:]))
+	case "restore":
+		os.Exit(restore(os.Args[2:]))
+	case "backup":
+		os.Exit(backup(os.Args[2:]))
+	case "apply":
+		os.Exit(apply(os.Args[2:]))
+	case "recover":
+		os.Exit(recoverTo(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbtool diff [-values] A B")
+	fmt.Fprintln(os.Stderr, "       dbtool dump FILE > DUMP")
+	fmt.Fprintln(os.Stderr, "       dbtool restore [-page-size N] FILE < DUMP")
+	fmt.Fprintln(os.Stderr, "       dbtool backup [-since VERSION] FILE > BACKUP")
+	fmt.Fprintln(os.Stderr, "       dbtool apply BASE < INCREMENTAL")
+	fmt.Fprintln(os.Stderr, "       dbtool recover [-version N] [-time RFC3339] ARCHIVE BASE")
+	os.Exit(2)
+}
+
+func diff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	values := flags.Bool("values", false, "print the values as well as the keys")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+
+	snaps := make([]*kv.Snapshot, 2)
+	for i, path := range flags.Args() {
+		db, err := kv.OpenReadOnly(path)
+		if err != nil {
+			return fail(err)
+		}
+		defer db.Close()
+		if snaps[i], err = db.Snapshot(); err != nil {
+			return fail(err)
+		}
+		defer snaps[i].Release()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	counts := map[btree.DiffKind]int{}
+	err := snaps[0].Diff(snaps[1], func(kind btree.DiffKind, key, a, b []byte) error {
+		counts[kind]++
+		switch kind {
+		case btree.DIFF_ADDED:
+			fmt.Fprintf(out, "+ %q", key)
+			if *values {
+				fmt.Fprintf(out, " %q", b)
+			}
+		case btree.DIFF_REMOVED:
+			fmt.Fprintf(out, "- %q", key)
+			if *values {
+				fmt.Fprintf(out, " %q", a)
+			}
+		case btree.DIFF_CHANGED:
+			fmt.Fprintf(out, "~ %q", key)
+			if *values {
+				fmt.Fprintf(out, " %q -> %q", a, b)
+			}
+		}
+		_, err := fmt.Fprintln(out)
+		return err
+	})
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d added, %d removed, %d changed\n",
+		counts[btree.DIFF_ADDED], counts[btree.DIFF_REMOVED], counts[btree.DIFF_CHANGED])
+	if len(counts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func dump(args []string) int {
+	if len(args) != 1 {
+		usage()
+	}
+	db, err := kv.OpenReadOnly(args[0])
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	if err := db.Dump(os.Stdout); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	pageSize := flags.Int("page-size", 0, "page size of the new file, the default if 0")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	path := flags.Arg(0)
+	if _, err := os.Stat(path); err == nil {
+		return fail(fmt.Errorf("%s: %w", path, fs.ErrExist))
+	}
+
+	db, err := kv.Open(path, kv.Options{Options: btree.Options{PageSize: *pageSize}})
+	if err != nil {
+		return fail(err)
+	}
+	err = db.Restore(os.Stdin)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		os.Remove(path + pager.WAL_SUFFIX)
+		return fail(err)
+	}
+	return 0
+}
+
+func backup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	since := flags.Int64("since", -1, "write an incremental backup from this version")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	db, err := kv.OpenReadOnly(flags.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	var version uint64
+	if *since < 0 {
+		err = db.Backup(context.Background(), out, nil)
+	} else {
+		version, err = db.IncrementalBackup(context.Background(), out, uint64(*since), nil)
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if *since >= 0 {
+		fmt.Fprintf(os.Stderr, "backed up to version %d\n", version)
+	}
+	return 0
+}
+
+func apply(args []string) int {
+	if len(args) != 1 {
+		usage()
+	}
+	version, err := kv.ApplyIncremental(args[0], os.Stdin)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "now at version %d\n", version)
+	return 0
+}
+
+func recoverTo(args []string) int {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	version := flags.Uint64("version", 0, "stop at this version")
+	at := flags.String("time", "", "stop at the last commit made by this time, as RFC 3339")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	target := kv.RecoveryTarget{Version: *version}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return fail(err)
+		}
+		target.Time = t
+	}
+	got, err := kv.RecoverTo(flags.Arg(1), flags.Arg(0), target)
+	if err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "now at version %d\n", got)
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "dbtool:", err)
+	return 2
+}
@@ -0,0 +1,223 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A pair of a node on its way into a new page: a leaf pair, or a key and kid pointer.
+type entry struct {
+	key, val []byte
+	ptr      uint64
+	overflow bool
+}
+
+// Bytes the entry takes up in a node: pointer, offset, lengths, key and value.
+func (e entry) size() int {
+	return 8 + 2 + 4 + len(e.key) + len(e.val)
+}
+
+/*
+Insert many pairs in one pass down the tree. keys must be sorted; where a key is
+repeated the last value wins.
+
+Insert copies every page from the root to the leaf for each key, so n keys landing
+in the same leaf copy it, and its ancestors, n times. InsertBatch instead visits
+each page at most once, merging in all the pairs that belong under it, and writes
+the result straight out as however many pages it needs. Pages are filled evenly
+rather than split in half, so a batch going into an empty tree packs them full.
+
+Like Insert, the storage behind the tree should be rolled back on error.
+*/
+func (tree *BTree) InsertBatch(keys, vals [][]byte) error {
+	if len(keys) != len(vals) {
+		return fmt.Errorf("btree: batch has %d keys and %d values", len(keys), len(vals))
+	}
+	for i := range keys {
+		if i > 0 && bytes.Compare(keys[i-1], keys[i]) > 0 {
+			return fmt.Errorf("%w: %q comes after %q", ErrUnsorted, keys[i], keys[i-1])
+		}
+		if err := tree.CheckLimit(keys[i], vals[i]); err != nil {
+			return err
+		}
+	}
+
+	var pairs []entry
+	for i := range keys {
+		if i+1 < len(keys) && bytes.Equal(keys[i], keys[i+1]) {
+			continue
+		}
+		e := entry{key: keys[i], val: vals[i]}
+		if len(e.val) > tree.opts.MaxInlineValSize {
+			e.val, e.overflow = writeOverflow(tree, e.val), true
+		}
+		pairs = append(pairs, e)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	var level []entry
+	var err error
+	if tree.root == 0 {
+		// Sentinel value, so every key has a lower bound in the tree
+		level, err = tree.pack(LEAF, append([]entry{{key: []byte{}}}, pairs...))
+	} else {
+		level, err = treeInsertBatch(tree, tree.root, pairs)
+	}
+	if err != nil {
+		return err
+	}
+	// Add levels on top until there is a single root
+	for len(level) > 1 {
+		if level, err = tree.pack(NODE, level); err != nil {
+			return err
+		}
+	}
+	tree.root = level[0].ptr
+	return nil
+}
+
+/*
+Merge pairs, which all belong under it, into the subtree at ptr. Returns the pages
+replacing it, as entries for its parent.
+*/
+func treeInsertBatch(tree *BTree, ptr uint64, pairs []entry) ([]entry, error) {
+	node := BNode(tree.get(ptr))
+	var merged []entry
+	switch node.btype() {
+	case LEAF:
+		i := uint16(0)
+		for _, pair := range pairs {
+			for ; i < node.nkeys(); i++ {
+				old, err := nodeEntry(node, i)
+				if err != nil {
+					return nil, err
+				}
+				if cmp := bytes.Compare(old.key, pair.key); cmp > 0 {
+					break
+				} else if cmp == 0 {
+					// The old value's overflow pages are no longer referenced
+					if old.overflow {
+						if err := freeOverflow(tree, old.val); err != nil {
+							return nil, err
+						}
+					}
+					i++
+					break
+				}
+				merged = append(merged, old)
+			}
+			merged = append(merged, pair)
+		}
+		for ; i < node.nkeys(); i++ {
+			old, err := nodeEntry(node, i)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, old)
+		}
+	case NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid, err := nodeEntry(node, i)
+			if err != nil {
+				return nil, err
+			}
+			// The pairs before the next kid's key go under this one
+			n := len(pairs)
+			if i+1 < node.nkeys() {
+				next, err := node.getKey(i + 1)
+				if err != nil {
+					return nil, err
+				}
+				n = 0
+				for n < len(pairs) && bytes.Compare(pairs[n].key, next) < 0 {
+					n++
+				}
+			}
+			if n == 0 {
+				merged = append(merged, kid)
+				continue
+			}
+			kids, err := treeInsertBatch(tree, kid.ptr, pairs[:n])
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, kids...)
+			pairs = pairs[n:]
+		}
+	default:
+		return nil, fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
+	}
+
+	packed, err := tree.pack(node.btype(), merged)
+	if err != nil {
+		return nil, err
+	}
+	tree.del(ptr)
+	return packed, nil
+}
+
+// The pair at index of node as an entry.
+func nodeEntry(node BNode, index uint16) (entry, error) {
+	key, err := node.getKey(index)
+	if err != nil {
+		return entry{}, err
+	}
+	val, err := node.getValue(index)
+	if err != nil {
+		return entry{}, err
+	}
+	ptr, err := node.getPtr(index)
+	if err != nil {
+		return entry{}, err
+	}
+	return entry{key: key, val: val, ptr: ptr, overflow: node.isOverflow(index)}, nil
+}
+
+/*
+Write entries out as the fewest nodes of type btype they fit in, each about as full
+as the others. Returns an entry for each new page, for the level above.
+*/
+func (tree *BTree) pack(btype uint16, entries []entry) ([]entry, error) {
+	capacity := tree.opts.usableSize() - HEADER_SIZE
+	total := 0
+	for _, e := range entries {
+		total += e.size()
+	}
+	target := total / ((total + capacity - 1) / capacity)
+
+	var pages []entry
+	for start := 0; start < len(entries); {
+		end, used := start, 0
+		for end < len(entries) && used < target && used+entries[end].size() <= capacity {
+			used += entries[end].size()
+			end++
+		}
+
+		ptr, err := tree.writeNode(btype, entries[start:end])
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, entry{key: entries[start].key, ptr: ptr})
+		start = end
+	}
+	return pages, nil
+}
+
+// Write entries, which must fit, to a new page. Returns its page number.
+func (tree *BTree) writeNode(btype uint16, entries []entry) (uint64, error) {
+	node := BNode(make([]byte, tree.opts.PageSize))
+	node.setHeader(btype, uint16(len(entries)))
+	for i, e := range entries {
+		if err := nodeAppendKeyVal(node, uint16(i), e.ptr, e.key, e.val); err != nil {
+			return 0, err
+		}
+		if e.overflow {
+			if err := node.setOverflow(uint16(i)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return tree.create(node), nil
+}
@@ -0,0 +1,131 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// How full BulkLoad packs pages when not told otherwise, leaving room for later inserts
+	DEFAULT_BULK_FILL = 0.9
+)
+
+/*
+Build the tree from pairs in strictly increasing key order, as returned by next
+until it reports ok false. The tree must be empty. Returns the number of pairs.
+
+Rather than inserting one key at a time, BulkLoad fills leaves left to right, each
+up to fill (a fraction of a page; DEFAULT_BULK_FILL if zero), and adds each finished
+page to the level above, which fills up the same way. Every page is written exactly
+once and only the rightmost page of each level is held in memory, so any number of
+pairs can be loaded. The last page of each level may be less full than the rest.
+
+Like Insert, the storage behind the tree should be rolled back on error.
+*/
+func (tree *BTree) BulkLoad(fill float64, next func() (key, val []byte, ok bool, err error)) (int, error) {
+	if tree.root != 0 {
+		return 0, ErrNotEmpty
+	}
+	if fill == 0 {
+		fill = DEFAULT_BULK_FILL
+	}
+	if fill < 0 || fill > 1 {
+		return 0, fmt.Errorf("%w: fill factor %v is not in (0, 1]", ErrBadOptions, fill)
+	}
+
+	b := &bulkBuilder{tree: tree, limit: int(fill * float64(tree.opts.usableSize()-HEADER_SIZE))}
+	// Sentinel value, so every key has a lower bound in the tree
+	if err := b.add(0, entry{key: []byte{}}); err != nil {
+		return 0, err
+	}
+	n := 0
+	var last []byte
+	for {
+		key, val, ok, err := next()
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			break
+		}
+		if n > 0 && bytes.Compare(last, key) >= 0 {
+			return n, fmt.Errorf("%w: %q comes after %q", ErrUnsorted, key, last)
+		}
+		if err := tree.CheckLimit(key, val); err != nil {
+			return n, err
+		}
+		e := entry{key: append([]byte{}, key...), val: append([]byte{}, val...)}
+		if len(e.val) > tree.opts.MaxInlineValSize {
+			e.val, e.overflow = writeOverflow(tree, e.val), true
+		}
+		if err := b.add(0, e); err != nil {
+			return n, err
+		}
+		last = e.key
+		n++
+	}
+
+	root, err := b.finish()
+	if err != nil {
+		return n, err
+	}
+	tree.root = root
+	return n, nil
+}
+
+// The unfinished rightmost page of each level, leaves first.
+type bulkBuilder struct {
+	tree   *BTree
+	limit  int
+	levels [][]entry
+	sizes  []int
+}
+
+/*
+Add e to the page being filled at level, writing the page out first if e would take
+it over the limit. Pages get at least two entries when they fit, however low the
+limit, so each level is smaller than the one below.
+*/
+func (b *bulkBuilder) add(level int, e entry) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, nil)
+		b.sizes = append(b.sizes, 0)
+	}
+	n, size := len(b.levels[level]), b.sizes[level]+e.size()
+	if n > 0 && (size > b.tree.opts.usableSize()-HEADER_SIZE || (n >= 2 && size > b.limit)) {
+		if err := b.flush(level); err != nil {
+			return err
+		}
+	}
+	b.levels[level] = append(b.levels[level], e)
+	b.sizes[level] += e.size()
+	return nil
+}
+
+// Write out the page being filled at level and add it to the level above.
+func (b *bulkBuilder) flush(level int) error {
+	btype := uint16(NODE)
+	if level == 0 {
+		btype = LEAF
+	}
+	entries := b.levels[level]
+	ptr, err := b.tree.writeNode(btype, entries)
+	if err != nil {
+		return err
+	}
+	b.levels[level], b.sizes[level] = nil, 0
+	return b.add(level+1, entry{key: entries[0].key, ptr: ptr})
+}
+
+// Write out the remaining pages bottom up, returning the root.
+func (b *bulkBuilder) finish() (uint64, error) {
+	for level := 0; ; level++ {
+		if level == len(b.levels)-1 && len(b.levels[level]) == 1 && level > 0 {
+			// A level holding a single page is the root
+			return b.levels[level][0].ptr, nil
+		}
+		if err := b.flush(level); err != nil {
+			return 0, err
+		}
+	}
+}
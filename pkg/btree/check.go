@@ -0,0 +1,227 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// One thing Check found wrong with a tree.
+type Violation struct {
+	// The page it was found in, or 0 if it isn't about a single page
+	Page    uint64
+	Problem string
+}
+
+func (v Violation) String() string {
+	if v.Page == 0 {
+		return v.Problem
+	}
+	return fmt.Sprintf("page %d: %s", v.Page, v.Problem)
+}
+
+// What Check found: the shape of the tree, and everything wrong with it.
+type CheckReport struct {
+	// Levels from the root to the leaves, 0 for an empty tree
+	Depth  int
+	Nodes  int
+	Leaves int
+	// Pairs in the leaves, the sentinel included
+	Keys          int
+	OverflowPages int
+	// Every page the tree uses, in order
+	Pages      []uint64
+	Violations []Violation
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+/*
+Walk the whole tree, checking every page it can read, and report what is wrong with
+it rather than stopping at the first problem:
+
+  - node types, and every leaf at the same depth
+  - node sizes against the page, and key and value sizes against the options
+  - keys strictly increasing within a node, and each kid's keys within the range
+    its parent gives it: starting at the parent's key, below the next one
+  - overflow chains holding exactly the length their stub records
+  - no page used twice
+
+Pages that can't be read, like ones failing the pager's checksum, are reported too,
+along with the subtree they would have led to.
+*/
+func (tree *BTree) Check() *CheckReport {
+	c := &checker{tree: tree, report: &CheckReport{}, seen: map[uint64]bool{}}
+	if tree.root != 0 {
+		c.visit(tree.root, 1, []byte{}, nil)
+	}
+	for ptr := range c.seen {
+		c.report.Pages = append(c.report.Pages, ptr)
+	}
+	sort.Slice(c.report.Pages, func(i, j int) bool { return c.report.Pages[i] < c.report.Pages[j] })
+	return c.report
+}
+
+type checker struct {
+	tree   *BTree
+	report *CheckReport
+	seen   map[uint64]bool
+}
+
+func (c *checker) fail(ptr uint64, format string, args ...interface{}) {
+	c.report.Violations = append(c.report.Violations, Violation{Page: ptr, Problem: fmt.Sprintf(format, args...)})
+}
+
+// Read a page, reporting it if it is out of place or can't be read.
+func (c *checker) page(ptr uint64) (page []byte, ok bool) {
+	if ptr == 0 {
+		c.fail(0, "pointer to page 0")
+		return nil, false
+	}
+	if c.seen[ptr] {
+		c.fail(ptr, "used more than once")
+		return nil, false
+	}
+	c.seen[ptr] = true
+
+	// The page callbacks panic on errors
+	defer func() {
+		if r := recover(); r != nil {
+			c.fail(ptr, "unreadable: %v", r)
+			page, ok = nil, false
+		}
+	}()
+	return c.tree.get(ptr), true
+}
+
+// Check the subtree at ptr, whose keys must be in [lo, hi), or unbounded above if hi is nil.
+func (c *checker) visit(ptr uint64, depth int, lo, hi []byte) {
+	page, ok := c.page(ptr)
+	if !ok {
+		return
+	}
+	node := BNode(page)
+	if len(node) < HEADER_SIZE {
+		c.fail(ptr, "%d bytes is too short for a node", len(node))
+		return
+	}
+
+	btype, nkeys := node.btype(), node.nkeys()
+	switch btype {
+	case LEAF:
+		c.report.Leaves++
+		if c.report.Depth == 0 {
+			c.report.Depth = depth
+		} else if depth != c.report.Depth {
+			c.fail(ptr, "leaf at depth %d, others are at %d", depth, c.report.Depth)
+		}
+	case NODE:
+		c.report.Nodes++
+	default:
+		c.fail(ptr, "bad node type %d", btype)
+		return
+	}
+	if nkeys == 0 {
+		c.fail(ptr, "node has no keys")
+		return
+	}
+	size, err := node.kvPos(nkeys)
+	if err != nil {
+		c.fail(ptr, "%v", err)
+		return
+	}
+	if int(size) > c.tree.opts.usableSize() {
+		c.fail(ptr, "node of %d bytes, pages hold %d", size, c.tree.opts.usableSize())
+	}
+
+	keys := make([][]byte, nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		key, err := node.getKey(i)
+		if err != nil {
+			c.fail(ptr, "key %d: %v", i, err)
+			return
+		}
+		keys[i] = key
+		if len(key) > c.tree.opts.MaxKeySize {
+			c.fail(ptr, "key %d is %d bytes, the limit is %d", i, len(key), c.tree.opts.MaxKeySize)
+		}
+		switch {
+		case i == 0 && !bytes.Equal(key, lo):
+			c.fail(ptr, "first key %q does not match %q in the parent", key, lo)
+		case i > 0 && bytes.Compare(keys[i-1], key) >= 0:
+			c.fail(ptr, "key %d %q is not after %q", i, key, keys[i-1])
+		}
+		if hi != nil && bytes.Compare(key, hi) >= 0 {
+			c.fail(ptr, "key %d %q is not below %q in the parent", i, key, hi)
+		}
+	}
+
+	if btype == LEAF {
+		c.report.Keys += int(nkeys)
+		for i := uint16(0); i < nkeys; i++ {
+			c.checkValue(ptr, node, i)
+		}
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		kid, err := node.getPtr(i)
+		if err != nil {
+			c.fail(ptr, "pointer %d: %v", i, err)
+			continue
+		}
+		khi := hi
+		if i+1 < nkeys {
+			khi = keys[i+1]
+		}
+		c.visit(kid, depth+1, keys[i], khi)
+	}
+}
+
+// Check the size of a leaf value, and the overflow chain holding it if there is one.
+func (c *checker) checkValue(ptr uint64, node BNode, index uint16) {
+	val, err := node.getValue(index)
+	if err != nil {
+		c.fail(ptr, "value %d: %v", index, err)
+		return
+	}
+	if !node.isOverflow(index) {
+		if len(val) > c.tree.opts.MaxInlineValSize {
+			c.fail(ptr, "value %d is %d bytes inline, the limit is %d", index, len(val), c.tree.opts.MaxInlineValSize)
+		}
+		return
+	}
+	if len(val) != OVERFLOW_STUB_SIZE {
+		c.fail(ptr, "value %d: overflow stub of %d bytes", index, len(val))
+		return
+	}
+
+	total := int(binary.LittleEndian.Uint32(val[0:4]))
+	if total <= c.tree.opts.MaxInlineValSize || total > c.tree.opts.MaxValSize {
+		c.fail(ptr, "value %d: overflow value of %d bytes", index, total)
+	}
+	held := 0
+	for next := binary.LittleEndian.Uint64(val[4:12]); next != 0; {
+		page, ok := c.page(next)
+		if !ok {
+			return
+		}
+		c.report.OverflowPages++
+		if binary.LittleEndian.Uint16(page[0:2]) != OVERFLOW {
+			c.fail(next, "not an overflow page, but in the chain of a value in page %d", ptr)
+			return
+		}
+		used := int(binary.LittleEndian.Uint16(page[2:4]))
+		if used == 0 || used > c.tree.overflowCapacity() {
+			c.fail(next, "overflow page claims %d bytes", used)
+			return
+		}
+		held += used
+		next = binary.LittleEndian.Uint64(page[4:12])
+	}
+	if held != total {
+		c.fail(ptr, "value %d: overflow chain holds %d bytes, the stub says %d", index, held, total)
+	}
+}
@@ -0,0 +1,188 @@
+package btree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+Cursor for iterating the tree in sorted key order.
+
+The cursor remembers the whole path from the root down to the current leaf, so
+moving off either end of a leaf walks back up to the nearest ancestor with a
+sibling to move into, then down again.
+
+Typical range scan over [start, end):
+
+	c := tree.NewCursor()
+	for err := c.Seek(start); err == nil && c.Valid(); err = c.Next() {
+		if bytes.Compare(c.Key(), end) >= 0 {
+			break
+		}
+		...
+	}
+*/
+type Cursor struct {
+	tree *BTree
+	// Nodes from the root down to the current leaf
+	path []BNode
+	// Position within each node of path
+	pos   []uint16
+	valid bool
+}
+
+func (tree *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: tree}
+}
+
+// Whether the cursor is positioned on a key.
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+// Key at the current position, or nil if the cursor is not valid.
+func (c *Cursor) Key() []byte {
+	if !c.valid {
+		return nil
+	}
+	last := len(c.path) - 1
+	key, _ := c.path[last].getKey(c.pos[last])
+	return key
+}
+
+// Value at the current position, or nil if the cursor is not valid.
+func (c *Cursor) Value() []byte {
+	if !c.valid {
+		return nil
+	}
+	last := len(c.path) - 1
+	val, _ := leafValue(c.tree, c.path[last], c.pos[last])
+	return val
+}
+
+// Position the cursor on the first key greater than or equal to key.
+func (c *Cursor) Seek(key []byte) error {
+	if err := c.seekLE(key); err != nil {
+		return err
+	}
+	if !c.valid {
+		return nil
+	}
+	if c.atSentinel() || bytes.Compare(c.Key(), key) < 0 {
+		return c.Next()
+	}
+	return nil
+}
+
+// Position the cursor on the last key less than or equal to key.
+func (c *Cursor) SeekLE(key []byte) error {
+	if err := c.seekLE(key); err != nil {
+		return err
+	}
+	if c.valid && c.atSentinel() {
+		c.valid = false
+	}
+	return nil
+}
+
+func (c *Cursor) seekLE(key []byte) error {
+	c.path = c.path[:0]
+	c.pos = c.pos[:0]
+	c.valid = false
+	if c.tree.root == 0 {
+		return nil
+	}
+
+	for node := BNode(c.tree.get(c.tree.root)); ; {
+		index, err := nodeLookupLE(node, key)
+		if err != nil {
+			return err
+		}
+		c.path = append(c.path, node)
+		c.pos = append(c.pos, index)
+		switch node.btype() {
+		case LEAF:
+			c.valid = true
+			return nil
+		case NODE:
+			kptr, err := node.getPtr(index)
+			if err != nil {
+				return err
+			}
+			node = c.tree.get(kptr)
+		default:
+			return fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
+		}
+	}
+}
+
+// Move to the next key. The cursor becomes invalid after the last key.
+func (c *Cursor) Next() error {
+	if !c.valid {
+		return nil
+	}
+
+	level := len(c.path) - 1
+	for level >= 0 && c.pos[level]+1 >= c.path[level].nkeys() {
+		level--
+	}
+	if level < 0 {
+		c.valid = false
+		return nil
+	}
+
+	c.pos[level]++
+	return c.descend(level, false)
+}
+
+// Move to the previous key. The cursor becomes invalid before the first key.
+func (c *Cursor) Prev() error {
+	if !c.valid {
+		return nil
+	}
+
+	level := len(c.path) - 1
+	for level >= 0 && c.pos[level] == 0 {
+		level--
+	}
+	if level < 0 {
+		c.valid = false
+		return nil
+	}
+
+	c.pos[level]--
+	if err := c.descend(level, true); err != nil {
+		return err
+	}
+	if c.atSentinel() {
+		c.valid = false
+	}
+	return nil
+}
+
+// Reload the path below level, taking either the first or last kid at each step.
+func (c *Cursor) descend(level int, last bool) error {
+	for l := level + 1; l < len(c.path); l++ {
+		kptr, err := c.path[l-1].getPtr(c.pos[l-1])
+		if err != nil {
+			c.valid = false
+			return err
+		}
+		c.path[l] = c.tree.get(kptr)
+		c.pos[l] = 0
+		if last {
+			c.pos[l] = c.path[l].nkeys() - 1
+		}
+	}
+	return nil
+}
+
+// The first key of the leftmost leaf is the empty sentinel, which is never returned.
+func (c *Cursor) atSentinel() bool {
+	for _, p := range c.pos {
+		if p != 0 {
+			return false
+		}
+	}
+	return true
+}
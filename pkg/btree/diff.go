@@ -0,0 +1,278 @@
+package btree
+
+import (
+	"bytes"
+)
+
+// How a key differs between two trees
+type DiffKind int
+
+const (
+	// Only in the second tree
+	DIFF_ADDED DiffKind = iota + 1
+	// Only in the first tree
+	DIFF_REMOVED
+	// In both, with different values
+	DIFF_CHANGED
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DIFF_ADDED:
+		return "added"
+	case DIFF_REMOVED:
+		return "removed"
+	case DIFF_CHANGED:
+		return "changed"
+	}
+	return "unknown"
+}
+
+/*
+Compare the keys from start on in trees a and b, calling fn in key order for every
+key that differs: aval is nil for an added key and bval for a removed one. Stops
+early if fn returns an error, returning that error. The slices passed to fn are only
+valid until it returns.
+
+Both trees are walked together, and a subtree that is the same in both is stepped
+over without being read. With shared set, a and b read the same pages, as two
+versions of one copy-on-write store do, and a page both reach is the same subtree:
+only the paths down to what changed between them get read. Otherwise page numbers
+mean nothing across the two, and only leaves with the same contents are skipped,
+which still saves decoding and comparing their values one by one.
+*/
+func Diff(a, b *BTree, start []byte, shared bool, fn func(kind DiffKind, key, aval, bval []byte) error) error {
+	ca, err := newDiffCursor(a, start)
+	if err != nil {
+		return err
+	}
+	cb, err := newDiffCursor(b, start)
+	if err != nil {
+		return err
+	}
+
+	for ca.Valid() || cb.Valid() {
+		if ca.Valid() && cb.Valid() {
+			skipped, err := skipIdentical(ca, cb, shared)
+			if err != nil {
+				return err
+			}
+			if skipped {
+				continue
+			}
+		}
+		if err := ca.load(); err != nil {
+			return err
+		}
+		if err := cb.load(); err != nil {
+			return err
+		}
+
+		cmp := 0
+		switch {
+		case !cb.Valid():
+			cmp = -1
+		case !ca.Valid():
+			cmp = 1
+		default:
+			cmp = bytes.Compare(ca.Key(), cb.Key())
+		}
+		switch {
+		case cmp < 0:
+			aval, err := ca.value()
+			if err != nil {
+				return err
+			}
+			if err := fn(DIFF_REMOVED, ca.Key(), aval, nil); err != nil {
+				return err
+			}
+			if err := ca.Next(); err != nil {
+				return err
+			}
+		case cmp > 0:
+			bval, err := cb.value()
+			if err != nil {
+				return err
+			}
+			if err := fn(DIFF_ADDED, cb.Key(), nil, bval); err != nil {
+				return err
+			}
+			if err := cb.Next(); err != nil {
+				return err
+			}
+		default:
+			aval, err := ca.value()
+			if err != nil {
+				return err
+			}
+			bval, err := cb.value()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(aval, bval) {
+				if err := fn(DIFF_CHANGED, ca.Key(), aval, bval); err != nil {
+					return err
+				}
+			}
+			if err := ca.Next(); err != nil {
+				return err
+			}
+			if err := cb.Next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+If both cursors are at the start of subtrees that are the same, move both past
+them. Subtrees are matched by height above the leaves, so trees of different depth
+can still share them, and the highest match is taken. Pages are read one level at a
+time, and only as far down as it takes to find a match or reach the leaves.
+*/
+func skipIdentical(ca, cb *diffCursor, shared bool) (bool, error) {
+	for {
+		lowA, lowB := len(ca.path)-1-ca.known(), len(cb.path)-1-cb.known()
+		full := ca.loaded == len(ca.path) && cb.loaded == len(cb.path)
+		for h := min(len(ca.path), len(cb.path)) - 1; h >= max(lowA, lowB); h-- {
+			la, lb := len(ca.path)-1-h, len(cb.path)-1-h
+			if !ca.atStart(la) || !cb.atStart(lb) {
+				continue
+			}
+
+			same := false
+			if shared {
+				pa, err := ca.ptr(la)
+				if err != nil {
+					return false, err
+				}
+				pb, err := cb.ptr(lb)
+				if err != nil {
+					return false, err
+				}
+				same = pa == pb
+			} else if h == 0 && full {
+				same = sameLeaf(ca.path[la], cb.path[lb])
+			}
+			if same {
+				ca.skip(la)
+				cb.skip(lb)
+				return true, nil
+			}
+		}
+		if full {
+			return false, nil
+		}
+
+		// Read a level further down whichever knows less
+		if lowA >= lowB && ca.loaded < len(ca.path) {
+			if err := ca.loadLevel(); err != nil {
+				return false, err
+			}
+		}
+		if lowB >= lowA && cb.loaded < len(cb.path) {
+			if err := cb.loadLevel(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+/*
+A cursor that can move past a subtree without reading the one after it: only
+path[:loaded] has been read, and the levels below are at the first kid of each.
+*/
+type diffCursor struct {
+	*Cursor
+	loaded int
+}
+
+func newDiffCursor(tree *BTree, start []byte) (*diffCursor, error) {
+	c := &diffCursor{Cursor: tree.NewCursor()}
+	if err := c.Seek(start); err != nil {
+		return nil, err
+	}
+	c.loaded = len(c.path)
+	return c, nil
+}
+
+// The deepest level whose page number is known without reading anything more.
+func (c *diffCursor) known() int {
+	return min(c.loaded, len(c.path)-1)
+}
+
+// Whether the cursor is on the first key of the subtree under path[level], for level <= known.
+func (c *diffCursor) atStart(level int) bool {
+	for _, p := range c.pos[level:c.loaded] {
+		if p != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// The page number of path[level], for level <= known.
+func (c *diffCursor) ptr(level int) (uint64, error) {
+	if level == 0 {
+		return c.tree.root, nil
+	}
+	return c.path[level-1].getPtr(c.pos[level-1])
+}
+
+// Move to the first key after the subtree under path[level], without reading it.
+func (c *diffCursor) skip(level int) {
+	for l := level - 1; l >= 0; l-- {
+		if c.pos[l]+1 < c.path[l].nkeys() {
+			c.pos[l]++
+			c.loaded = l + 1
+			return
+		}
+	}
+	c.valid = false
+}
+
+// Read the next level of the path.
+func (c *diffCursor) loadLevel() error {
+	ptr, err := c.ptr(c.loaded)
+	if err != nil {
+		c.valid = false
+		return err
+	}
+	c.path[c.loaded] = c.tree.get(ptr)
+	c.pos[c.loaded] = 0
+	c.loaded++
+	return nil
+}
+
+// Read the rest of the path down to the leaf, so the cursor can be used as it is.
+func (c *diffCursor) load() error {
+	for c.valid && c.loaded < len(c.path) {
+		if err := c.loadLevel(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *diffCursor) value() ([]byte, error) {
+	last := len(c.path) - 1
+	return leafValue(c.tree, c.path[last], c.pos[last])
+}
+
+/*
+Whether two leaves from different stores hold the same pairs. Overflow stubs point
+into their own store, so leaves with any never match.
+*/
+func sameLeaf(a, b BNode) bool {
+	n := a.nbytes()
+	if n == 0 || int(n) > len(a) || n != b.nbytes() || int(n) > len(b) || !bytes.Equal(a[:n], b[:n]) {
+		return false
+	}
+	for i := uint16(0); i < a.nkeys(); i++ {
+		if a.isOverflow(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package btree
+
+import "errors"
+
+// Errors returned by the tree. Most are wrapped with more detail, so compare with errors.Is.
+var (
+	// An index past the number of keys in a node
+	ErrIndexOutOfRange = errors.New("btree: index out of range")
+	// A node (or overflow page) whose contents don't make sense
+	ErrNodeCorrupt = errors.New("btree: corrupt node")
+	// Returned by callers that prefer an error to the found flag of Get and Delete
+	ErrKeyNotFound = errors.New("btree: key not found")
+	ErrBadOptions  = errors.New("btree: invalid options")
+
+	// Empty keys are reserved for the sentinel entry at the start of the leftmost leaf
+	ErrEmptyKey    = errors.New("btree: key is empty")
+	ErrKeyTooLarge = errors.New("btree: key is too large")
+	ErrValTooLarge = errors.New("btree: value is too large")
+	// InsertBatch or BulkLoad was given keys out of order
+	ErrUnsorted = errors.New("btree: batch keys are not sorted")
+	// BulkLoad only builds a tree from scratch
+	ErrNotEmpty = errors.New("btree: tree is not empty")
+)
@@ -3,7 +3,7 @@ package btree
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
+	"fmt"
 )
 
 const (
@@ -52,7 +52,7 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 
 func (node BNode) getPtr(index uint16) (uint64, error) {
 	if !node.isValidIndex(index) {
-		return 0, errors.New("out of range index")
+		return 0, fmt.Errorf("%w: pointer %d of %d", ErrIndexOutOfRange, index, node.nkeys())
 	}
 	pos := HEADER_SIZE + 8*index
 	return binary.LittleEndian.Uint64(node[pos:]), nil
@@ -60,7 +60,7 @@ func (node BNode) getPtr(index uint16) (uint64, error) {
 
 func (node BNode) setPtr(index uint16, val uint64) error {
 	if !node.isValidIndex(index) {
-		return errors.New("out of range index")
+		return fmt.Errorf("%w: pointer %d of %d", ErrIndexOutOfRange, index, node.nkeys())
 	}
 	pos := HEADER_SIZE + 8*index
 	binary.LittleEndian.PutUint64(node[pos:], val)
@@ -77,45 +77,68 @@ func (node BNode) getOffset(index uint16) uint16 {
 	return binary.LittleEndian.Uint16(node[pos:])
 }
 
+// Set the offset of the 'index'th kv pair. The offset of the first pair is always 0 and isn't stored.
+func (node BNode) setOffset(index uint16, offset uint16) {
+	pos := HEADER_SIZE + 8*node.nkeys() + 2*(index-1)
+	binary.LittleEndian.PutUint16(node[pos:], offset)
+}
+
 // Return the raw position of the 'index'th key
 func (node BNode) kvPos(index uint16) (uint16, error) {
 	nkeys := node.nkeys()
 	if !(index <= nkeys) {
-		return 0, errors.New("invalid index")
+		return 0, fmt.Errorf("%w: kv position %d of %d", ErrIndexOutOfRange, index, nkeys)
+	}
+	// The pointer and offset tables have to fit before anything in them can be read
+	if HEADER_SIZE+10*int(nkeys) > len(node) {
+		return 0, fmt.Errorf("%w: %d keys do not fit in %d bytes", ErrNodeCorrupt, nkeys, len(node))
 	}
 
-	return HEADER_SIZE + 8*nkeys + 2*nkeys + node.getOffset(index), nil
+	pos := HEADER_SIZE + 10*int(nkeys) + int(node.getOffset(index))
+	if pos > len(node) || pos > 0xffff {
+		return 0, fmt.Errorf("%w: kv position %d past the end of the node", ErrNodeCorrupt, pos)
+	}
+	return uint16(pos), nil
 }
 
-// Get a value located at index, as a slice. Reminder that slices are references.
-func (node BNode) getValue(index uint16) ([]byte, error) {
+// Position and lengths of the 'index'th kv pair, checked against the size of the node
+func (node BNode) kvHeader(index uint16) (pos, keylen, vallen uint16, err error) {
 	if index >= node.nkeys() {
-		return nil, errors.New("index out of bounds when accessing key")
+		return 0, 0, 0, fmt.Errorf("%w: pair %d of %d", ErrIndexOutOfRange, index, node.nkeys())
 	}
 
-	pos, err := node.kvPos(index)
+	pos, err = node.kvPos(index)
 	if err != nil {
-		return nil, err
+		return 0, 0, 0, err
+	}
+	if int(pos)+4 > len(node) {
+		return 0, 0, 0, fmt.Errorf("%w: pair %d header past the end of the node", ErrNodeCorrupt, index)
 	}
 
-	keylength := binary.LittleEndian.Uint16(node[pos:])
-	vallen := binary.LittleEndian.Uint16(node[pos+2:])
-	return node[pos+4+keylength:][:vallen], nil
+	keylen = binary.LittleEndian.Uint16(node[pos:])
+	vallen = binary.LittleEndian.Uint16(node[pos+2:]) &^ OVERFLOW_FLAG
+	if int(pos)+4+int(keylen)+int(vallen) > len(node) {
+		return 0, 0, 0, fmt.Errorf("%w: pair %d of %d bytes past the end of the node",
+			ErrNodeCorrupt, index, 4+int(keylen)+int(vallen))
+	}
+	return pos, keylen, vallen, nil
+}
 
+// Get a value located at index, as a slice. Reminder that slices are references.
+func (node BNode) getValue(index uint16) ([]byte, error) {
+	pos, keylen, vallen, err := node.kvHeader(index)
+	if err != nil {
+		return nil, err
+	}
+	return node[pos+4+keylen:][:vallen], nil
 }
 
 // Grabs the key located at index
 func (node BNode) getKey(index uint16) ([]byte, error) {
-	if index >= node.nkeys() {
-		return nil, errors.New("index out of bounds when accessing key")
-	}
-
-	pos, err := node.kvPos(index)
+	pos, keylen, _, err := node.kvHeader(index)
 	if err != nil {
 		return nil, err
 	}
-
-	keylen := binary.LittleEndian.Uint16(node[pos:])
 	return node[pos+4:][:keylen], nil
 }
 
@@ -125,56 +148,104 @@ func (node BNode) isValidIndex(index uint16) bool {
 }
 
 // Insert a new key at position index
-func leafInsert(next BNode, old BNode, index uint16, key []byte, val []byte) {
+func leafInsert(next BNode, old BNode, index uint16, key []byte, val []byte) error {
 	next.setHeader(LEAF, old.nkeys()+1)
-	nodeAppendAcrossRange(next, old, 0, 0, index)
+	if err := nodeAppendAcrossRange(next, old, 0, 0, index); err != nil {
+		return err
+	}
+	if err := nodeAppendKeyVal(next, index, 0, key, val); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(next, old, index+1, index, old.nkeys()-index)
 }
 
 // Append n keys to next from old,
-func nodeAppendAcrossRange(next BNode, old BNode, dest uint16, src uint16, n uint16) {
+func nodeAppendAcrossRange(next BNode, old BNode, dest uint16, src uint16, n uint16) error {
 	for i := uint16(0); i < n; i++ {
 		dst, source := dest+i, src+i
-		// Placeholder; not sure what to do with error for now; probably propagate?
-		oldPtr, _ := old.getPtr(source)
-		oldKey, _ := old.getKey(source)
-		oldVal, _ := old.getValue(source)
-		nodeAppendKeyVal(next, dst, oldPtr, oldKey, oldVal)
+		oldPtr, err := old.getPtr(source)
+		if err != nil {
+			return err
+		}
+		oldKey, err := old.getKey(source)
+		if err != nil {
+			return err
+		}
+		oldVal, err := old.getValue(source)
+		if err != nil {
+			return err
+		}
+		if err := nodeAppendKeyVal(next, dst, oldPtr, oldKey, oldVal); err != nil {
+			return err
+		}
+		if old.isOverflow(source) {
+			if err := next.setOverflow(dst); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
-func nodeAppendKeyVal(next BNode, destination uint16, ptr uint64, key []byte, val []byte) {
+/*
+Write a kv pair (and child pointer) at position destination of next.
+Pairs must be appended in order, since the position of each one comes from the offset of the one before.
+*/
+func nodeAppendKeyVal(next BNode, destination uint16, ptr uint64, key []byte, val []byte) error {
+	if err := next.setPtr(destination, ptr); err != nil {
+		return err
+	}
+
+	pos, err := next.kvPos(destination)
+	if err != nil {
+		return err
+	}
+	if int(pos)+4+len(key)+len(val) > len(next) {
+		return fmt.Errorf("%w: pair %d of %d bytes does not fit in the node", ErrNodeCorrupt, destination, 4+len(key)+len(val))
+	}
+	binary.LittleEndian.PutUint16(next[pos:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(next[pos+2:], uint16(len(val)))
+	copy(next[pos+4:], key)
+	copy(next[pos+4+uint16(len(key)):], val)
 
+	next.setOffset(destination+1, next.getOffset(destination)+4+uint16(len(key)+len(val)))
+	return nil
 }
 
 // Update the given new leaf to
-func leafUpdate(next, old BNode, index uint16, key, val []byte) {
+func leafUpdate(next, old BNode, index uint16, key, val []byte) error {
 	next.setHeader(LEAF, old.nkeys())
-	nodeAppendAcrossRange(next, old, 0, 0, index)
-	nodeAppendKeyVal(next, index, 0, key, val)
-	nodeAppendAcrossRange(next, old, index+1, index+1, old.nkeys()-(index+1))
+	if err := nodeAppendAcrossRange(next, old, 0, 0, index); err != nil {
+		return err
+	}
+	if err := nodeAppendKeyVal(next, index, 0, key, val); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(next, old, index+1, index+1, old.nkeys()-(index+1))
 }
 
 // Find the last position less than or equal to the given key; used to maintain sorted order when updating keys
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	var i uint16
-	// TODO: Change to binary search eventually. Probably not a huge issue considering would need thousand+ keys to make diff
-	for i = 0; i < nkeys; i++ {
-		// For now just discard any errors, future me problem
-		compkey, _ := node.getKey(i)
-		cmp := bytes.Compare(compkey, key)
-		// Equal
-		if cmp == 0 {
-			return i
+func nodeLookupLE(node BNode, key []byte) (uint16, error) {
+	if node.nkeys() == 0 {
+		return 0, fmt.Errorf("%w: lookup in an empty node", ErrNodeCorrupt)
+	}
+
+	// The first key is always <= key (the sentinel in leaves, the lower bound of the kid in internal nodes),
+	// so binary search the rest for the first key greater than key.
+	lo, hi := uint16(1), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		compkey, err := node.getKey(mid)
+		if err != nil {
+			return 0, err
 		}
-		// key is bigger than i
-		if cmp > 0 {
-			return i - 1
+		if bytes.Compare(compkey, key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-
-	// We iterated through every position, means key is greater than every other key
-	return i - 1
+	return lo - 1, nil
 }
 
 /*
@@ -183,10 +254,10 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 Split them among left and right respectively.
 N.B: This can mutate left and right.
 */
-func nodeSplitInHalf(left, right, old BNode) error {
+func nodeSplitInHalf(left, right, old BNode, pageSize uint16) error {
 	nkeys := old.nkeys()
 	if nkeys < 2 {
-		return errors.New("placeholder error for when splitting a node in half; number of keys in old less than 2")
+		return fmt.Errorf("%w: splitting a node with %d keys", ErrNodeCorrupt, nkeys)
 	}
 
 	// Try to slice the keys in half, stuff it into a page size
@@ -196,36 +267,36 @@ func nodeSplitInHalf(left, right, old BNode) error {
 		return 4 + 8*numleft + 2*numleft + old.getOffset(numleft)
 	}
 
-	for left_bytes() > BTREE_PAGE_SIZE_BYTES {
+	for left_bytes() > pageSize {
 		numleft--
 	}
 
 	if numleft < 1 {
 		// Placeholderish
-		return errors.New("error: number of keys on the left after split attempt was 0.")
+		return fmt.Errorf("%w: no keys left on the left after splitting", ErrNodeCorrupt)
 	}
 
 	// Do the same for the right. Start from where numleft left off.
 	right_bytes := func() uint16 {
-		return old.nbytes() - left_bytes()*4
+		return old.nbytes() - left_bytes() + HEADER_SIZE
 	}
 
-	for right_bytes() > BTREE_PAGE_SIZE_BYTES {
+	for numleft < nkeys && right_bytes() > pageSize {
 		numleft++
 	}
 
 	if numleft >= nkeys {
-		return errors.New("error when shifting keys")
+		return fmt.Errorf("%w: no keys left on the right after splitting", ErrNodeCorrupt)
 	}
 
 	numRight := nkeys - numleft
 
 	left.setHeader(old.btype(), numleft)
 	right.setHeader(old.btype(), numRight)
-	nodeAppendAcrossRange(left, old, 0, 0, numleft)
-	nodeAppendAcrossRange(right, old, 0, 0, numRight)
-
-	return nil
+	if err := nodeAppendAcrossRange(left, old, 0, 0, numleft); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(right, old, 0, numleft, numRight)
 }
 
 /*
@@ -234,48 +305,82 @@ Returns:
 
 	The number of nodes created from the split.
 	A slice containing said created nodes.
+	Error (if any) encountered
 */
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE_BYTES {
-		old = old[:BTREE_PAGE_SIZE_BYTES]
-		return 1, [3]BNode{old}
+func nodeSplit3(old BNode, pageSize uint16) (uint16, [3]BNode, error) {
+	if old.nbytes() <= pageSize {
+		old = old[:pageSize]
+		return 1, [3]BNode{old}, nil
 	}
 
-	// We allocate 2*BTREE_PAGE_SIZE_BYTES because left might need to get split
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE_BYTES))
-	right := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
-	nodeSplitInHalf(left, right, old)
+	// We allocate 2*pageSize because left might need to get split
+	left := BNode(make([]byte, 2*int(pageSize)))
+	right := BNode(make([]byte, pageSize))
+	if err := nodeSplitInHalf(left, right, old, pageSize); err != nil {
+		return 0, [3]BNode{}, err
+	}
 	// If left is big enough to fit into ine page, we can just move on with our life.
-	if left.nbytes() <= BTREE_PAGE_SIZE_BYTES {
-		left = left[:BTREE_PAGE_SIZE_BYTES]
-		return 2, [3]BNode{left, right}
+	if left.nbytes() <= pageSize {
+		left = left[:pageSize]
+		return 2, [3]BNode{left, right}, nil
 	}
 
 	// Otherwise, we need to split again....
-	leftmost := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
-	middle := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
-	nodeSplitInHalf(leftmost, middle, left)
-	// TODO: Error if leftmost still does not fit in a page somehow (Should be impossible)
-	return 3, [3]BNode{leftmost, middle, right}
+	leftmost := BNode(make([]byte, pageSize))
+	middle := BNode(make([]byte, pageSize))
+	if err := nodeSplitInHalf(leftmost, middle, left, pageSize); err != nil {
+		return 0, [3]BNode{}, err
+	}
+	if leftmost.nbytes() > pageSize {
+		return 0, [3]BNode{}, fmt.Errorf("%w: node still %d bytes after splitting", ErrNodeCorrupt, leftmost.nbytes())
+	}
+	return 3, [3]BNode{leftmost, middle, right}, nil
 }
 
-func nodeReplaceKidN(tree *BTree, new, old BNode, index uint16, kids []BNode) {
+func nodeReplaceKidN(tree *BTree, new, old BNode, index uint16, kids []BNode) error {
 	increment := uint16(len(kids))
 	new.setHeader(NODE, old.nkeys()+increment-1)
-	nodeAppendAcrossRange(new, old, 0, 0, index)
+	if err := nodeAppendAcrossRange(new, old, 0, 0, index); err != nil {
+		return err
+	}
 	for i, node := range kids {
-		key, _ := node.getKey(0)
-		nodeAppendKeyVal(new, index+uint16(i), tree.create(node), key, nil)
+		key, err := node.getKey(0)
+		if err != nil {
+			return err
+		}
+		if err := nodeAppendKeyVal(new, index+uint16(i), tree.create(node), key, nil); err != nil {
+			return err
+		}
 	}
-	nodeAppendAcrossRange(new, old, index+increment, index+1, old.nkeys()-(index+1))
+	return nodeAppendAcrossRange(new, old, index+increment, index+1, old.nkeys()-(index+1))
 }
 
 // Remove a given key from a leaf node
-func leafDelete(new BNode, old BNode, index uint16)
+func leafDelete(new BNode, old BNode, index uint16) error {
+	new.setHeader(LEAF, old.nkeys()-1)
+	if err := nodeAppendAcrossRange(new, old, 0, 0, index); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(new, old, index, index+1, old.nkeys()-(index+1))
+}
 
 // Merge 'left' and 'right' into 'new'
-func nodeMerge(new, left, right BNode)
-
-func nodeReplace2Kids(new, old BNode, index uint16, ptr uint64, key []byte) {
+func nodeMerge(new, left, right BNode) error {
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	if err := nodeAppendAcrossRange(new, left, 0, 0, left.nkeys()); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(new, right, left.nkeys(), 0, right.nkeys())
+}
 
+// Replace the two adjacent kids at index and index+1 with a single (merged) kid
+func nodeReplace2Kids(new, old BNode, index uint16, ptr uint64, key []byte) error {
+	new.setHeader(NODE, old.nkeys()-1)
+	if err := nodeAppendAcrossRange(new, old, 0, 0, index); err != nil {
+		return err
+	}
+	if err := nodeAppendKeyVal(new, index, ptr, key, nil); err != nil {
+		return err
+	}
+	return nodeAppendAcrossRange(new, old, index+1, index+2, old.nkeys()-(index+2))
 }
@@ -0,0 +1,859 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNodeAppendKeyValRoundTrip(t *testing.T) {
+	node := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	keys := [][]byte{[]byte("a"), []byte("bb"), []byte("ccc"), {}}
+	vals := [][]byte{[]byte("1"), {}, []byte("333"), []byte("4444")}
+
+	node.setHeader(LEAF, uint16(len(keys)))
+	for i := range keys {
+		nodeAppendKeyVal(node, uint16(i), uint64(100+i), keys[i], vals[i])
+	}
+
+	for i := range keys {
+		key, err := node.getKey(uint16(i))
+		if err != nil {
+			t.Fatalf("getKey(%d): %v", i, err)
+		}
+		val, err := node.getValue(uint16(i))
+		if err != nil {
+			t.Fatalf("getValue(%d): %v", i, err)
+		}
+		ptr, err := node.getPtr(uint16(i))
+		if err != nil {
+			t.Fatalf("getPtr(%d): %v", i, err)
+		}
+		if !bytes.Equal(key, keys[i]) || !bytes.Equal(val, vals[i]) || ptr != uint64(100+i) {
+			t.Errorf("pair %d: got (%q, %q, %d), want (%q, %q, %d)", i, key, val, ptr, keys[i], vals[i], 100+i)
+		}
+	}
+
+	want := uint16(HEADER_SIZE + 8*4 + 2*4 + 4*4 + (1 + 2 + 3) + (1 + 3 + 4))
+	if node.nbytes() != want {
+		t.Errorf("nbytes = %d, want %d", node.nbytes(), want)
+	}
+}
+
+func TestLeafInsertAndUpdate(t *testing.T) {
+	old := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	old.setHeader(LEAF, 2)
+	nodeAppendKeyVal(old, 0, 0, []byte("a"), []byte("1"))
+	nodeAppendKeyVal(old, 1, 0, []byte("c"), []byte("3"))
+
+	inserted := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	if err := leafInsert(inserted, old, 1, []byte("b"), []byte("2")); err != nil {
+		t.Fatalf("leafInsert: %v", err)
+	}
+	checkLeaf(t, inserted, []string{"a", "b", "c"}, []string{"1", "2", "3"})
+
+	updated := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	if err := leafUpdate(updated, inserted, 2, []byte("c"), []byte("three")); err != nil {
+		t.Fatalf("leafUpdate: %v", err)
+	}
+	checkLeaf(t, updated, []string{"a", "b", "c"}, []string{"1", "2", "three"})
+
+	deleted := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	if err := leafDelete(deleted, updated, 0); err != nil {
+		t.Fatalf("leafDelete: %v", err)
+	}
+	checkLeaf(t, deleted, []string{"b", "c"}, []string{"2", "three"})
+}
+
+func TestTreeInsertRoundTrip(t *testing.T) {
+	tree := newMemTree()
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := tree.Insert(key, bytes.Repeat(key, 3)); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		val, ok, err := tree.Get(key)
+		if err != nil || !ok || !bytes.Equal(val, bytes.Repeat(key, 3)) {
+			t.Fatalf("Get(%s) = %q, %v, %v", key, val, ok, err)
+		}
+	}
+}
+
+func TestTreeGet(t *testing.T) {
+	tree, pages := newMemTreePages()
+	if val, ok, err := tree.Get([]byte("key")); err != nil || ok || val != nil {
+		t.Fatalf("Get from an empty tree = %q, %v, %v", val, ok, err)
+	}
+
+	limit := tree.Options().MaxInlineValSize
+	want := map[string][]byte{
+		"a":        []byte("1"),
+		"empty":    {},
+		"inline":   bytes.Repeat([]byte("i"), limit),
+		"overflow": bytes.Repeat([]byte("o"), limit+1),
+		// Spread over several overflow pages
+		"long": bytes.Repeat([]byte("0123456789"), 3*BTREE_PAGE_SIZE_BYTES/10),
+	}
+	for i := 0; i < 1000; i++ {
+		want[fmt.Sprintf("key%05d", i*2)] = []byte(fmt.Sprint(i))
+	}
+	for key, val := range want {
+		if err := tree.Insert([]byte(key), val); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+	if r := tree.Check(); !r.OK() || r.Depth < 2 || r.OverflowPages < 4 {
+		t.Fatalf("tree: depth %d, %d overflow pages, %v", r.Depth, r.OverflowPages, r.Violations)
+	}
+	for key, val := range want {
+		got, ok, err := tree.Get([]byte(key))
+		if err != nil || !ok || !bytes.Equal(got, val) {
+			t.Fatalf("Get(%s) = %d bytes, %v, %v; want %d bytes", key, len(got), ok, err, len(val))
+		}
+	}
+
+	// Keys either side of ones in the tree, and before everything but the sentinel
+	for _, key := range []string{"\x00", "\x01", "0", "b", "key00001", "key00999", "key01999", "key5", "longer", "overflow\x00", "zzz"} {
+		if val, ok, err := tree.Get([]byte(key)); err != nil || ok || val != nil {
+			t.Fatalf("Get(%q) = %q, %v, %v", key, val, ok, err)
+		}
+	}
+	// The empty key is the sentinel's, and never a user's
+	for _, key := range [][]byte{nil, {}} {
+		if _, ok, err := tree.Get(key); !errors.Is(err, ErrEmptyKey) || ok {
+			t.Fatalf("Get(%q) = %v, %v, want %v", key, ok, err, ErrEmptyKey)
+		}
+	}
+	if _, _, err := tree.Get(make([]byte, tree.Options().MaxKeySize+1)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Get of an oversized key = %v, want %v", err, ErrKeyTooLarge)
+	}
+
+	// Replacing an overflow value frees its old chain
+	before := len(pages)
+	if err := tree.Insert([]byte("long"), []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := tree.Get([]byte("long")); err != nil || !ok || string(val) != "short" {
+		t.Fatalf("Get(long) after update = %q, %v, %v", val, ok, err)
+	}
+	if len(pages) >= before-2 {
+		t.Fatalf("%d pages before replacing the overflow value, %d after", before, len(pages))
+	}
+}
+
+func TestTreeDelete(t *testing.T) {
+	tree, pages := newMemTreePages()
+	if ok, err := tree.Delete([]byte("key")); err != nil || ok {
+		t.Fatalf("Delete from an empty tree = %v, %v", ok, err)
+	}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := tree.Insert(key, bytes.Repeat(key, 3)); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+	}
+	full := tree.Check()
+	if !full.OK() || full.Depth < 2 {
+		t.Fatalf("full tree: depth %d, %v", full.Depth, full.Violations)
+	}
+
+	// Missing keys leave the tree as it is
+	root := tree.Root()
+	for _, key := range []string{"key", "key00000x", "key99999", "zzz"} {
+		if ok, err := tree.Delete([]byte(key)); err != nil || ok {
+			t.Fatalf("Delete(%s) = %v, %v", key, ok, err)
+		}
+	}
+	if tree.Root() != root {
+		t.Fatal("deleting missing keys moved the root")
+	}
+	if _, err := tree.Delete(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("Delete(nil) = %v, want %v", err, ErrEmptyKey)
+	}
+
+	// Every key but one in ten, so that leaves fall under the merge threshold
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if ok, err := tree.Delete(key); err != nil || !ok {
+			t.Fatalf("Delete(%s) = %v, %v", key, ok, err)
+		}
+		if ok, _ := tree.Delete(key); ok {
+			t.Fatalf("Delete(%s) found it twice", key)
+		}
+	}
+	merged := tree.Check()
+	if !merged.OK() {
+		t.Fatalf("after deletes: %v", merged.Violations)
+	}
+	if merged.Keys != n/10+1 || merged.Leaves*4 > full.Leaves || len(merged.Pages) != len(pages) {
+		t.Fatalf("after deletes: %d keys in %d leaves (from %d), %d of %d pages",
+			merged.Keys, merged.Leaves, full.Leaves, len(merged.Pages), len(pages))
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if _, ok, err := tree.Get(key); err != nil || ok != (i%10 == 0) {
+			t.Fatalf("Get(%s) after deletes = %v, %v", key, ok, err)
+		}
+	}
+
+	// Down to a few keys the internal levels collapse into a single leaf root
+	for i := 10; i < n; i += 10 {
+		if ok, err := tree.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil || !ok {
+			t.Fatalf("Delete(key%05d) = %v, %v", i, ok, err)
+		}
+	}
+	r := tree.Check()
+	if !r.OK() || r.Depth != 1 || r.Keys != 2 || len(pages) != 1 {
+		t.Fatalf("after collapsing: depth %d, %d keys, %d pages, %v", r.Depth, r.Keys, len(pages), r.Violations)
+	}
+	if val, ok, err := tree.Get([]byte("key00000")); err != nil || !ok || !bytes.Equal(val, bytes.Repeat([]byte("key00000"), 3)) {
+		t.Fatalf("Get(key00000) = %q, %v, %v", val, ok, err)
+	}
+}
+
+func TestScanAndDeletePrefix(t *testing.T) {
+	tree := newMemTree()
+	for _, ns := range []string{"user:1:", "user:2:", "user:\xff:", "users"} {
+		for i := 0; i < 300; i++ {
+			if err := tree.Insert([]byte(fmt.Sprintf("%s%03d", ns, i)), []byte(ns)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func(prefix string) int {
+		n := 0
+		err := tree.Scan([]byte(prefix), func(key, val []byte) error {
+			if !bytes.HasPrefix(key, []byte(prefix)) {
+				t.Fatalf("Scan(%q) returned %q", prefix, key)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := count("user:2:"); n != 300 {
+		t.Errorf("Scan(user:2:) found %d keys, want 300", n)
+	}
+	if n := count("user"); n != 1200 {
+		t.Errorf("Scan(user) found %d keys, want 1200", n)
+	}
+	if n := count(""); n != 1200 {
+		t.Errorf("Scan() found %d keys, want 1200", n)
+	}
+	if n, err := tree.DeletePrefix([]byte("user:")); err != nil || n != 900 {
+		t.Fatalf("DeletePrefix(user:) = %d, %v", n, err)
+	}
+	if n := count("user"); n != 300 {
+		t.Errorf("Scan(user) after DeletePrefix found %d keys, want 300", n)
+	}
+
+	for prefix, want := range map[string]string{"ab": "ac", "a\xff": "b", "\xff\xff": "", "": ""} {
+		if end := PrefixEnd([]byte(prefix)); string(end) != want {
+			t.Errorf("PrefixEnd(%q) = %q, want %q", prefix, end, want)
+		}
+	}
+}
+
+func TestInsertBatch(t *testing.T) {
+	batched, pages := newMemTreePages()
+	single := newMemTree()
+	insert := func(keys, vals [][]byte) {
+		t.Helper()
+		if err := batched.InsertBatch(keys, vals); err != nil {
+			t.Fatal(err)
+		}
+		for i := range keys {
+			if err := single.Insert(keys[i], vals[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Into an empty tree, then over the top of it with updates, new keys and big values
+	var keys, vals [][]byte
+	for i := 0; i < 3000; i += 2 {
+		keys = append(keys, []byte(fmt.Sprintf("key%05d", i)))
+		vals = append(vals, []byte(fmt.Sprintf("val%d", i)))
+	}
+	insert(keys, vals)
+	keys, vals = nil, nil
+	for i := 1000; i < 5000; i += 3 {
+		val := []byte(fmt.Sprintf("new%d", i))
+		if i%100 == 1 {
+			val = bytes.Repeat(val, 2000)
+		}
+		keys = append(keys, []byte(fmt.Sprintf("key%05d", i)))
+		vals = append(vals, val)
+	}
+	insert(keys, vals)
+	// A repeated key takes the last value
+	insert([][]byte{[]byte("dup"), []byte("dup")}, [][]byte{[]byte("first"), []byte("last")})
+
+	want, got := single.NewCursor(), batched.NewCursor()
+	errw, errg := want.Seek(nil), got.Seek(nil)
+	n := 0
+	for ; errw == nil && errg == nil && want.Valid(); errw, errg = want.Next(), got.Next() {
+		if !got.Valid() || !bytes.Equal(got.Key(), want.Key()) || !bytes.Equal(got.Value(), want.Value()) {
+			t.Fatalf("pair %d: got %q, want %q", n, got.Key(), want.Key())
+		}
+		n++
+	}
+	if errw != nil || errg != nil || got.Valid() {
+		t.Fatalf("batched tree has more pairs than %d, or errors %v, %v", n, errw, errg)
+	}
+
+	// Every page left is reachable; the ones replaced were all freed
+	reachable := 0
+	var walk func(ptr uint64)
+	walk = func(ptr uint64) {
+		reachable++
+		node := BNode(pages[ptr])
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.btype() == NODE {
+				kid, _ := node.getPtr(i)
+				walk(kid)
+			} else if node.isOverflow(i) {
+				stub, _ := node.getValue(i)
+				reachable += (int(binary.LittleEndian.Uint32(stub)) + batched.overflowCapacity() - 1) / batched.overflowCapacity()
+			}
+		}
+	}
+	walk(batched.Root())
+	if reachable != len(pages) {
+		t.Errorf("%d pages allocated, %d reachable", len(pages), reachable)
+	}
+
+	if err := batched.InsertBatch([][]byte{[]byte("b"), []byte("a")}, [][]byte{nil, nil}); !errors.Is(err, ErrUnsorted) {
+		t.Errorf("InsertBatch out of order = %v, want %v", err, ErrUnsorted)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, fill := range []float64{0, 0.5, 1, 0.01} {
+		tree, pages := newMemTreePages()
+		const n = 20000
+		i := 0
+		loaded, err := tree.BulkLoad(fill, func() ([]byte, []byte, bool, error) {
+			if i == n {
+				return nil, nil, false, nil
+			}
+			i++
+			val := []byte(fmt.Sprint(i))
+			if i%1000 == 0 {
+				val = bytes.Repeat(val, 3000)
+			}
+			return []byte(fmt.Sprintf("key%06d", i)), val, true, nil
+		})
+		if err != nil || loaded != n {
+			t.Fatalf("fill %v: BulkLoad = %d, %v", fill, loaded, err)
+		}
+		for i := 1; i <= n; i += 7 {
+			key := []byte(fmt.Sprintf("key%06d", i))
+			if val, ok, err := tree.Get(key); err != nil || !ok || !bytes.HasPrefix(val, []byte(fmt.Sprint(i))) {
+				t.Fatalf("fill %v: Get(%s) = %.10q, %v, %v", fill, key, val, ok, err)
+			}
+		}
+		// The tree still takes ordinary inserts and deletes
+		if err := tree.Insert([]byte("key000000"), []byte("first")); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := tree.Delete([]byte("key010000")); err != nil || !ok {
+			t.Fatalf("Delete = %v, %v", ok, err)
+		}
+
+		full := 0
+		for _, page := range pages {
+			if node := BNode(page); node.btype() == LEAF && int(node.nbytes()) > tree.opts.PageSize*9/10 {
+				full++
+			}
+		}
+		if fill < 0.95 && full > 2 {
+			t.Errorf("fill %v: %d leaves more than 90%% full", fill, full)
+		}
+	}
+
+	tree := newMemTree()
+	keys := []string{"b", "a"}
+	_, err := tree.BulkLoad(0, func() ([]byte, []byte, bool, error) {
+		if len(keys) == 0 {
+			return nil, nil, false, nil
+		}
+		key := keys[0]
+		keys = keys[1:]
+		return []byte(key), nil, true, nil
+	})
+	if !errors.Is(err, ErrUnsorted) {
+		t.Errorf("BulkLoad out of order = %v, want %v", err, ErrUnsorted)
+	}
+}
+
+func checkLeaf(t *testing.T, node BNode, keys, vals []string) {
+	t.Helper()
+	if int(node.nkeys()) != len(keys) {
+		t.Fatalf("nkeys = %d, want %d", node.nkeys(), len(keys))
+	}
+	for i := range keys {
+		key, _ := node.getKey(uint16(i))
+		val, _ := node.getValue(uint16(i))
+		if string(key) != keys[i] || string(val) != vals[i] {
+			t.Errorf("pair %d: got (%q, %q), want (%q, %q)", i, key, val, keys[i], vals[i])
+		}
+	}
+}
+
+// A tree over an in-memory page map
+func newMemTree() *BTree {
+	tree, _ := newMemTreePages()
+	return tree
+}
+
+// A tree over an in-memory page map, and the map
+func newMemTreePages() (*BTree, map[uint64][]byte) {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	tree, _ := NewBTree(0, Options{},
+		func(ptr uint64) []byte {
+			page, ok := pages[ptr]
+			if !ok {
+				panic(fmt.Sprintf("bad page %d", ptr))
+			}
+			return page
+		},
+		func(node []byte) uint64 {
+			page := make([]byte, len(node))
+			copy(page, node)
+			pages[next] = page
+			next++
+			return next - 1
+		},
+		func(ptr uint64) {
+			delete(pages, ptr)
+		},
+	)
+	return tree, pages
+}
+
+// The linear scan nodeLookupLE used to do, kept for comparison
+func nodeLookupLELinear(node BNode, key []byte) uint16 {
+	nkeys := node.nkeys()
+	var i uint16
+	for i = 1; i < nkeys; i++ {
+		compkey, _ := node.getKey(i)
+		if bytes.Compare(compkey, key) > 0 {
+			break
+		}
+	}
+	return i - 1
+}
+
+// A leaf packed with as many 8 byte keys and empty values as fit in a page
+func packedLeaf() (BNode, [][]byte) {
+	// header + pointer + offset + kv header + key
+	const perKey = 8 + 2 + 4 + 8
+	n := uint16((BTREE_PAGE_SIZE_BYTES - HEADER_SIZE) / perKey)
+
+	node := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+	node.setHeader(LEAF, n)
+	keys := make([][]byte, n)
+	for i := uint16(0); i < n; i++ {
+		keys[i] = []byte(fmt.Sprintf("k%07d", i))
+		nodeAppendKeyVal(node, i, 0, keys[i], nil)
+	}
+	return node, keys
+}
+
+func TestCheck(t *testing.T) {
+	tree, pages := newMemTreePages()
+	if r := tree.Check(); !r.OK() || r.Depth != 0 || len(r.Pages) != 0 {
+		t.Fatalf("empty tree: %+v", r)
+	}
+	for i := 0; i < 3000; i++ {
+		val := []byte(fmt.Sprintf("val%d", i))
+		if i%200 == 0 {
+			val = bytes.Repeat(val, 2000)
+		}
+		if err := tree.Insert([]byte(fmt.Sprintf("key%05d", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3000; i += 3 {
+		if _, err := tree.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := tree.Check()
+	if !r.OK() {
+		t.Fatalf("healthy tree: %v", r.Violations)
+	}
+	if r.Depth < 2 || r.Keys != 2001 || r.OverflowPages == 0 || len(r.Pages) != len(pages) {
+		t.Fatalf("healthy tree: depth %d, %d keys, %d overflow pages, %d of %d pages",
+			r.Depth, r.Keys, r.OverflowPages, len(r.Pages), len(pages))
+	}
+
+	// Swap two keys of a leaf, and lose a page
+	leaf := r.Pages[len(r.Pages)-1]
+	for _, ptr := range r.Pages {
+		if node := BNode(pages[ptr]); node.btype() == LEAF && node.nkeys() > 2 {
+			leaf = ptr
+			break
+		}
+	}
+	node := BNode(pages[leaf])
+	k1, _ := node.getKey(1)
+	k2, _ := node.getKey(2)
+	k1[len(k1)-1], k2[len(k2)-1] = k2[len(k2)-1], k1[len(k1)-1]
+	lost := tree.Root()
+	for ptr := range pages {
+		if ptr != tree.Root() && ptr != leaf {
+			lost = ptr
+			break
+		}
+	}
+	delete(pages, lost)
+
+	r = tree.Check()
+	found := map[uint64]bool{}
+	for _, v := range r.Violations {
+		found[v.Page] = true
+	}
+	if !found[leaf] || !found[lost] {
+		t.Fatalf("expected violations in pages %d and %d, got %v", leaf, lost, r.Violations)
+	}
+}
+
+func TestNodeLookupLEMatchesLinear(t *testing.T) {
+	node, keys := packedLeaf()
+	for _, key := range keys {
+		probes := [][]byte{key, append(append([]byte{}, key...), 0), key[:len(key)-1]}
+		for _, probe := range probes {
+			got, err := nodeLookupLE(node, probe)
+			if err != nil {
+				t.Fatalf("nodeLookupLE(%q): %v", probe, err)
+			}
+			if want := nodeLookupLELinear(node, probe); got != want {
+				t.Fatalf("nodeLookupLE(%q) = %d, want %d", probe, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	node, keys := packedLeaf()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nodeLookupLE(node, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkNodeLookupLELinear(b *testing.B) {
+	node, keys := packedLeaf()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nodeLookupLELinear(node, keys[i%len(keys)])
+	}
+}
+
+func TestCheckLimit(t *testing.T) {
+	tree := newMemTree()
+	cases := []struct {
+		key, val []byte
+		want     error
+	}{
+		{nil, []byte("v"), ErrEmptyKey},
+		{[]byte{}, nil, ErrEmptyKey},
+		{make([]byte, BTREE_MAX_KEY_SIZE_BYTES+1), nil, ErrKeyTooLarge},
+		{[]byte("k"), make([]byte, BTREE_MAX_OVERFLOW_VAL_SIZE_BYTES+1), ErrValTooLarge},
+		{make([]byte, BTREE_MAX_KEY_SIZE_BYTES), make([]byte, BREE_MAX_VAL_SIZE_BYTES), nil},
+	}
+	for _, c := range cases {
+		if err := tree.Insert(c.key, c.val); !errors.Is(err, c.want) {
+			t.Errorf("Insert(%d byte key, %d byte val) = %v, want %v", len(c.key), len(c.val), err, c.want)
+		}
+	}
+	if _, _, err := tree.Get(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Get(nil) = %v, want %v", err, ErrEmptyKey)
+	}
+}
+
+// Corrupt the root leaf of a small tree in place and check every operation reports it.
+func TestCorruptNodes(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(node BNode)
+	}{
+		{"bad type", func(node BNode) {
+			node.setHeader(7, node.nkeys())
+		}},
+		{"too many keys", func(node BNode) {
+			node.setHeader(LEAF, 0xffff)
+		}},
+		{"empty", func(node BNode) {
+			node.setHeader(LEAF, 0)
+		}},
+		{"offset past end", func(node BNode) {
+			for i := uint16(1); i <= node.nkeys(); i++ {
+				node.setOffset(i, 0xfff0)
+			}
+		}},
+		{"key length past end", func(node BNode) {
+			for i := uint16(1); i < node.nkeys(); i++ {
+				pos, _ := node.kvPos(i)
+				binary.LittleEndian.PutUint16(node[pos:], 0xfff0)
+			}
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tree := newMemTree()
+			for _, key := range []string{"a", "b", "c"} {
+				if err := tree.Insert([]byte(key), []byte(key)); err != nil {
+					t.Fatalf("Insert(%s): %v", key, err)
+				}
+			}
+			root := tree.Root()
+			c.corrupt(BNode(tree.get(root)))
+
+			if _, _, err := tree.Get([]byte("b")); !errors.Is(err, ErrNodeCorrupt) {
+				t.Errorf("Get = %v, want %v", err, ErrNodeCorrupt)
+			}
+			if err := tree.Insert([]byte("d"), nil); !errors.Is(err, ErrNodeCorrupt) {
+				t.Errorf("Insert = %v, want %v", err, ErrNodeCorrupt)
+			}
+			if _, err := tree.Delete([]byte("b")); !errors.Is(err, ErrNodeCorrupt) {
+				t.Errorf("Delete = %v, want %v", err, ErrNodeCorrupt)
+			}
+			if err := tree.NewCursor().Seek([]byte("b")); !errors.Is(err, ErrNodeCorrupt) {
+				t.Errorf("Seek = %v, want %v", err, ErrNodeCorrupt)
+			}
+			if tree.Root() != root {
+				t.Errorf("root moved from %d to %d after failed operations", root, tree.Root())
+			}
+		})
+	}
+}
+
+// A corrupt pair deep in a node surfaces from the copy rather than being copied as garbage.
+func TestNodeAppendAcrossRangeCorrupt(t *testing.T) {
+	old, _ := packedLeaf()
+	pos, err := old.kvPos(old.nkeys() - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(old[pos:], 0xfff0)
+
+	next := BNode(make([]byte, 2*BTREE_PAGE_SIZE_BYTES))
+	if err := leafInsert(next, old, 0, []byte("a"), nil); !errors.Is(err, ErrNodeCorrupt) {
+		t.Errorf("leafInsert = %v, want %v", err, ErrNodeCorrupt)
+	}
+	if _, _, err := nodeSplit3(old, BTREE_PAGE_SIZE_BYTES/2); !errors.Is(err, ErrNodeCorrupt) {
+		t.Errorf("nodeSplit3 = %v, want %v", err, ErrNodeCorrupt)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	build := func(tree *BTree) {
+		for i := 0; i < 3000; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			if err := tree.Insert(key, bytes.Repeat(key, 3)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Large enough for overflow pages
+		if err := tree.Insert([]byte("key01000"), bytes.Repeat([]byte("v"), 20000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	change := func(tree *BTree) {
+		for _, key := range []string{"key00000", "key01500", "key02999"} {
+			if _, err := tree.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range []string{"key00010", "key02000"} {
+			if err := tree.Insert([]byte(key), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Insert([]byte("key01500a"), []byte("added")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"removed key00000", "changed key00010", "removed key01500", "added key01500a", "changed key02000", "removed key02999"}
+	diff := func(a, b *BTree, shared bool) []string {
+		var got []string
+		err := Diff(a, b, nil, shared, func(kind DiffKind, key, aval, bval []byte) error {
+			got = append(got, kind.String()+" "+string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// Two versions of one store, keeping the old pages; count the pages read
+	tree, pages := newMemTreePages()
+	build(tree)
+	tree.del = func(uint64) {}
+	old := tree.root
+	change(tree)
+	reads := 0
+	before, _ := NewBTree(old, Options{}, func(ptr uint64) []byte { reads++; return pages[ptr] }, nil, nil)
+	if got := diff(before, tree, true); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("shared diff = %v, want %v", got, want)
+	}
+	if reads > len(pages)/4 {
+		t.Fatalf("shared diff read %d of %d pages", reads, len(pages))
+	}
+	if got := diff(tree, tree, true); len(got) != 0 {
+		t.Fatalf("diff against itself = %v", got)
+	}
+
+	// Separate stores only match by content
+	a, b := newMemTree(), newMemTree()
+	build(a)
+	build(b)
+	change(b)
+	if got := diff(a, b, false); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("diff = %v, want %v", got, want)
+	}
+	if got := diff(b, b, false); len(got) != 0 {
+		t.Fatalf("diff against itself = %v", got)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	// Keys long enough that a few thousand need internal levels
+	keyOf := func(i int) string { return fmt.Sprintf("%05d", i) + strings.Repeat("-", 100) }
+	insert := func(t *testing.T, tree *BTree, from, to int) {
+		for i := from; i < to; i++ {
+			if err := tree.Insert([]byte(keyOf(i)), []byte(keyOf(i)[:5])); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	del := func(t *testing.T, tree *BTree, keep func(i int) bool, from, to int) {
+		for i := from; i < to; i++ {
+			if keep(i) {
+				continue
+			}
+			if ok, err := tree.Delete([]byte(keyOf(i))); err != nil || !ok {
+				t.Fatalf("Delete(%d) = %v, %v", i, ok, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		build    func(t *testing.T, tree *BTree)
+		minDepth int
+	}{
+		{"empty", func(t *testing.T, tree *BTree) {}, 0},
+		{"sentinel only", func(t *testing.T, tree *BTree) {
+			insert(t, tree, 0, 1)
+			del(t, tree, func(int) bool { return false }, 0, 1)
+		}, 1},
+		{"one leaf", func(t *testing.T, tree *BTree) { insert(t, tree, 0, 10) }, 1},
+		{"deep", func(t *testing.T, tree *BTree) { insert(t, tree, 0, 3000) }, 3},
+		// Both ends move, and most leaves merge
+		{"after deletes", func(t *testing.T, tree *BTree) {
+			insert(t, tree, 0, 3000)
+			del(t, tree, func(i int) bool { return i >= 100 && i < 2900 && i%7 == 0 }, 0, 3000)
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := newMemTree()
+			tt.build(t, tree)
+			r := tree.Check()
+			if !r.OK() || r.Depth < tt.minDepth {
+				t.Fatalf("tree: depth %d, want at least %d, %v", r.Depth, tt.minDepth, r.Violations)
+			}
+			var keys []string
+			for i := 0; i < 3000; i++ {
+				if _, ok, _ := tree.Get([]byte(keyOf(i))); ok {
+					keys = append(keys, keyOf(i))
+				}
+			}
+
+			c := tree.NewCursor()
+			// The cursor is on keys[i], or invalid if i is off either end
+			at := func(op string, i int) {
+				t.Helper()
+				if i < 0 || i >= len(keys) {
+					if c.Valid() || c.Key() != nil || c.Value() != nil {
+						t.Fatalf("%s: on %.5q, want invalid", op, c.Key())
+					}
+					return
+				}
+				if !c.Valid() || string(c.Key()) != keys[i] || string(c.Value()) != keys[i][:5] {
+					t.Fatalf("%s: on %.5q (valid %v), want %.5q", op, c.Key(), c.Valid(), keys[i])
+				}
+			}
+			step := func(op string, move func() error, i int) {
+				t.Helper()
+				if err := move(); err != nil {
+					t.Fatalf("%s: %v", op, err)
+				}
+				at(op, i)
+			}
+
+			// Every key forwards and backwards, crossing every leaf
+			step("Seek(\"\")", func() error { return c.Seek(nil) }, 0)
+			for i := 1; i <= len(keys); i++ {
+				step("Next", c.Next, i)
+			}
+			step("Next past the end", c.Next, len(keys))
+			step("SeekLE(\"\\xff\")", func() error { return c.SeekLE([]byte{0xff}) }, len(keys)-1)
+			for i := len(keys) - 2; i >= -1; i-- {
+				step("Prev", c.Prev, i)
+			}
+			step("Prev before the start", c.Prev, -1)
+
+			// Seeking to each key, and between each key and the one before, then a step either way
+			probes := []string{"\x00", "\x01", "zzz"}
+			for i := 0; i < 3000; i++ {
+				probes = append(probes, keyOf(i), keyOf(i)[:5])
+			}
+			for _, probe := range probes {
+				ge := sort.SearchStrings(keys, probe)
+				le := sort.Search(len(keys), func(i int) bool { return keys[i] > probe }) - 1
+				op := fmt.Sprintf("Seek(%.5q)", probe)
+				step(op, func() error { return c.Seek([]byte(probe)) }, ge)
+				if ge < len(keys) {
+					step(op+" Next", c.Next, ge+1)
+					if ge+1 < len(keys) {
+						step(op+" Next Prev", c.Prev, ge)
+					}
+				}
+				op = fmt.Sprintf("SeekLE(%.5q)", probe)
+				step(op, func() error { return c.SeekLE([]byte(probe)) }, le)
+				if le >= 0 {
+					step(op+" Prev", c.Prev, le-1)
+					if le > 0 {
+						step(op+" Prev Next", c.Next, le)
+					}
+				}
+			}
+		})
+	}
+}
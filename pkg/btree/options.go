@@ -0,0 +1,87 @@
+package btree
+
+import "fmt"
+
+/*
+Size settings for a tree. Zero fields take the defaults from DefaultOptions.
+
+Offsets within a node are 16 bits and a node being split can be up to two pages
+long, so pages are limited to 16KB. A key and an inline value always have to fit in
+one page together with the node header, leaving out the page trailer.
+*/
+type Options struct {
+	// Bytes per page: 4096, 8192 or 16384
+	PageSize int
+	// Longest key accepted
+	MaxKeySize int
+	// Values longer than this are moved to overflow pages
+	MaxInlineValSize int
+	// Longest value accepted, including overflow
+	MaxValSize int
+}
+
+const (
+	// Space a single pair takes in a node besides the key and value: pointer, offset and kv header
+	PAIR_OVERHEAD_BYTES = 8 + 2 + 4
+	// Bytes at the end of every page the tree never uses; the pager keeps an LSN and a checksum there
+	PAGE_TRAILER_SIZE = 8 + 4
+)
+
+func DefaultOptions() Options {
+	return Options{
+		PageSize:         BTREE_PAGE_SIZE_BYTES,
+		MaxKeySize:       BTREE_MAX_KEY_SIZE_BYTES,
+		MaxInlineValSize: BREE_MAX_VAL_SIZE_BYTES,
+		MaxValSize:       BTREE_MAX_OVERFLOW_VAL_SIZE_BYTES,
+	}
+}
+
+// Fill in zero fields. The inline value limit grows with the page size.
+func (opts Options) WithDefaults() Options {
+	def := DefaultOptions()
+	if opts.PageSize == 0 {
+		opts.PageSize = def.PageSize
+	}
+	if opts.MaxKeySize == 0 {
+		opts.MaxKeySize = def.MaxKeySize
+	}
+	if opts.MaxInlineValSize == 0 {
+		opts.MaxInlineValSize = def.MaxInlineValSize * opts.PageSize / BTREE_PAGE_SIZE_BYTES
+	}
+	if opts.MaxValSize == 0 {
+		opts.MaxValSize = def.MaxValSize
+	}
+	return opts
+}
+
+func (opts Options) Validate() error {
+	switch opts.PageSize {
+	case 4096, 8192, 16384:
+	default:
+		return fmt.Errorf("%w: page size %d is not one of 4096, 8192, 16384", ErrBadOptions, opts.PageSize)
+	}
+	if opts.MaxKeySize < 1 || opts.MaxInlineValSize < OVERFLOW_STUB_SIZE {
+		return fmt.Errorf("%w: key and inline value limits must be positive", ErrBadOptions)
+	}
+	if HEADER_SIZE+PAIR_OVERHEAD_BYTES+opts.MaxKeySize+opts.MaxInlineValSize > opts.usableSize() {
+		return fmt.Errorf("%w: a %d byte key and %d byte value do not fit in a %d byte page",
+			ErrBadOptions, opts.MaxKeySize, opts.MaxInlineValSize, opts.PageSize)
+	}
+	if opts.MaxValSize < opts.MaxInlineValSize || opts.MaxValSize > 1<<31 {
+		return fmt.Errorf("%w: value limit %d out of range", ErrBadOptions, opts.MaxValSize)
+	}
+	return nil
+}
+
+func (tree *BTree) Options() Options {
+	return tree.opts
+}
+
+// Bytes of a page a node or overflow chunk can fill.
+func (opts Options) usableSize() int {
+	return opts.PageSize - PAGE_TRAILER_SIZE
+}
+
+func (tree *BTree) pageSize() uint16 {
+	return uint16(tree.opts.usableSize())
+}
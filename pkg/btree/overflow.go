@@ -0,0 +1,129 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Node type for pages holding part of a large value
+	OVERFLOW = 4
+
+	// Default upper limit on a value stored through overflow pages
+	BTREE_MAX_OVERFLOW_VAL_SIZE_BYTES = 64 << 20
+
+	// Set in the value length of a leaf entry whose value lives in overflow pages
+	OVERFLOW_FLAG = 0x8000
+	// What the leaf stores instead of the value: | total length | first overflow page |
+	OVERFLOW_STUB_SIZE = 4 + 8
+
+	// Overflow page layout: | type | bytes used | next page | data |
+	OVERFLOW_HEADER_SIZE = 2 + 2 + 8
+)
+
+// Value bytes held by one overflow page
+func (tree *BTree) overflowCapacity() int {
+	return tree.opts.usableSize() - OVERFLOW_HEADER_SIZE
+}
+
+// Whether the value at index is an overflow stub rather than the value itself
+func (node BNode) isOverflow(index uint16) bool {
+	if index >= node.nkeys() {
+		return false
+	}
+	pos, err := node.kvPos(index)
+	if err != nil || int(pos)+4 > len(node) {
+		return false
+	}
+	return binary.LittleEndian.Uint16(node[pos+2:])&OVERFLOW_FLAG != 0
+}
+
+// Mark the value at index as an overflow stub
+func (node BNode) setOverflow(index uint16) error {
+	pos, _, _, err := node.kvHeader(index)
+	if err != nil {
+		return err
+	}
+	vallen := binary.LittleEndian.Uint16(node[pos+2:])
+	binary.LittleEndian.PutUint16(node[pos+2:], vallen|OVERFLOW_FLAG)
+	return nil
+}
+
+// Write val across a chain of overflow pages, returning the stub to store in the leaf.
+func writeOverflow(tree *BTree, val []byte) []byte {
+	// Build the chain back to front so each page knows the page after it.
+	var next uint64
+	capacity := tree.overflowCapacity()
+	for end := len(val); end > 0; {
+		start := ((end - 1) / capacity) * capacity
+		page := make([]byte, tree.opts.PageSize)
+		binary.LittleEndian.PutUint16(page[0:2], OVERFLOW)
+		binary.LittleEndian.PutUint16(page[2:4], uint16(end-start))
+		binary.LittleEndian.PutUint64(page[4:12], next)
+		copy(page[OVERFLOW_HEADER_SIZE:], val[start:end])
+		next = tree.create(page)
+		end = start
+	}
+
+	stub := make([]byte, OVERFLOW_STUB_SIZE)
+	binary.LittleEndian.PutUint32(stub[0:4], uint32(len(val)))
+	binary.LittleEndian.PutUint64(stub[4:12], next)
+	return stub
+}
+
+// Reassemble a value from its overflow stub.
+func readOverflow(tree *BTree, stub []byte) ([]byte, error) {
+	if len(stub) != OVERFLOW_STUB_SIZE {
+		return nil, fmt.Errorf("%w: overflow stub of %d bytes", ErrNodeCorrupt, len(stub))
+	}
+	total := int(binary.LittleEndian.Uint32(stub[0:4]))
+	ptr := binary.LittleEndian.Uint64(stub[4:12])
+
+	val := make([]byte, 0, total)
+	for ptr != 0 && len(val) < total {
+		page := tree.get(ptr)
+		if binary.LittleEndian.Uint16(page[0:2]) != OVERFLOW {
+			return nil, fmt.Errorf("%w: page %d is not an overflow page", ErrNodeCorrupt, ptr)
+		}
+		used := binary.LittleEndian.Uint16(page[2:4])
+		if int(used) > tree.overflowCapacity() {
+			return nil, fmt.Errorf("%w: overflow page %d claims %d bytes", ErrNodeCorrupt, ptr, used)
+		}
+		val = append(val, page[OVERFLOW_HEADER_SIZE:OVERFLOW_HEADER_SIZE+used]...)
+		ptr = binary.LittleEndian.Uint64(page[4:12])
+	}
+	if len(val) != total {
+		return nil, fmt.Errorf("%w: overflow chain holds %d bytes, expected %d", ErrNodeCorrupt, len(val), total)
+	}
+	return val, nil
+}
+
+// Deallocate every page of an overflow chain.
+func freeOverflow(tree *BTree, stub []byte) error {
+	if len(stub) != OVERFLOW_STUB_SIZE {
+		return fmt.Errorf("%w: overflow stub of %d bytes", ErrNodeCorrupt, len(stub))
+	}
+	ptr := binary.LittleEndian.Uint64(stub[4:12])
+	for ptr != 0 {
+		page := tree.get(ptr)
+		if binary.LittleEndian.Uint16(page[0:2]) != OVERFLOW {
+			return fmt.Errorf("%w: page %d is not an overflow page", ErrNodeCorrupt, ptr)
+		}
+		next := binary.LittleEndian.Uint64(page[4:12])
+		tree.del(ptr)
+		ptr = next
+	}
+	return nil
+}
+
+// The value stored at index of a leaf, following overflow pages if needed.
+func leafValue(tree *BTree, node BNode, index uint16) ([]byte, error) {
+	val, err := node.getValue(index)
+	if err != nil {
+		return nil, err
+	}
+	if node.isOverflow(index) {
+		return readOverflow(tree, val)
+	}
+	return val, nil
+}
@@ -0,0 +1,55 @@
+package btree
+
+import (
+	"bytes"
+)
+
+/*
+The first key after every key starting with prefix, for the end of a range scan:
+prefix with its last byte below 0xff incremented and what follows dropped. Nil when
+there is no such key (prefix is empty or all 0xff), meaning the scan has no end.
+*/
+func PrefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// Call fn on every pair whose key starts with prefix, in key order. Stops at the first error from fn.
+func (tree *BTree) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	c := tree.NewCursor()
+	var err error
+	for err = c.Seek(prefix); err == nil && c.Valid(); err = c.Next() {
+		if !bytes.HasPrefix(c.Key(), prefix) {
+			return nil
+		}
+		if err := fn(c.Key(), c.Value()); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Delete every key starting with prefix. Returns how many there were.
+func (tree *BTree) DeletePrefix(prefix []byte) (int, error) {
+	n := 0
+	c := tree.NewCursor()
+	for {
+		// Deleting replaces the nodes the cursor is on, so seek again each time
+		if err := c.Seek(prefix); err != nil {
+			return n, err
+		}
+		if !c.Valid() || !bytes.HasPrefix(c.Key(), prefix) {
+			return n, nil
+		}
+		if _, err := tree.Delete(append([]byte{}, c.Key()...)); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,56 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+/*
+Pick a leaf by taking a kid at random at every level, and call fn on each of its pairs
+(the empty sentinel included). Returns the page number of the leaf and an estimate of
+the number of leaves in the tree: the product of the fanouts on the way down.
+
+The estimate is unbiased, so it converges on the real count when averaged over many
+calls. Leaves aren't picked uniformly though; one under a node with few kids is more
+likely than one under a node with many, which is fine for a B+tree whose nodes are
+all within a factor of a few of each other in size.
+*/
+func (tree *BTree) RandomLeaf(rng *rand.Rand, fn func(key, val []byte) error) (uint64, float64, error) {
+	if tree.root == 0 {
+		return 0, 0, nil
+	}
+
+	ptr, estimate := tree.root, 1.0
+	for {
+		node := BNode(tree.get(ptr))
+		switch node.btype() {
+		case LEAF:
+			for i := uint16(0); i < node.nkeys(); i++ {
+				key, err := node.getKey(i)
+				if err != nil {
+					return 0, 0, err
+				}
+				val, err := leafValue(tree, node, i)
+				if err != nil {
+					return 0, 0, err
+				}
+				if err := fn(key, val); err != nil {
+					return 0, 0, err
+				}
+			}
+			return ptr, estimate, nil
+		case NODE:
+			if node.nkeys() == 0 {
+				return 0, 0, fmt.Errorf("%w: internal node %d has no kids", ErrNodeCorrupt, ptr)
+			}
+			kptr, err := node.getPtr(uint16(rng.Intn(int(node.nkeys()))))
+			if err != nil {
+				return 0, 0, err
+			}
+			estimate *= float64(node.nkeys())
+			ptr = kptr
+		default:
+			return 0, 0, fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
+		}
+	}
+}
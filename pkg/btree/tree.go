@@ -1,9 +1,13 @@
 package btree
 
-import "bytes"
+import (
+	"bytes"
+	"fmt"
+)
 
 type BTree struct {
 	root uint64
+	opts Options
 	// Read data from a given page number
 	get func(uint64) []byte
 	// Create a new page with given data
@@ -13,71 +17,156 @@ type BTree struct {
 }
 
 const (
-	MERGE_THRESHOLD_BTYES = BTREE_PAGE_SIZE_BYTES / 4
+	// Nodes smaller than this fraction of a page get merged with a sibling
+	MERGE_THRESHOLD_FRACTION = 4
 )
 
-func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
-	next := BNode(make([]byte, 2*BTREE_PAGE_SIZE_BYTES))
+/*
+Create a tree over the given page callbacks, starting from root (0 for an empty tree).
+Page 0 is never a valid node, so storage backends can use it for their own metadata.
+Zero fields of opts take their defaults.
+*/
+func NewBTree(root uint64, opts Options, get func(uint64) []byte, create func([]byte) uint64, del func(uint64)) (*BTree, error) {
+	opts = opts.WithDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &BTree{root: root, opts: opts, get: get, create: create, del: del}, nil
+}
 
-	index := nodeLookupLE(node, key)
+// The page number of the current root, for persisting between runs.
+func (tree *BTree) Root() uint64 {
+	return tree.root
+}
+
+// Insert key into the subtree rooted at node. overflow marks val as an overflow stub.
+func treeInsert(tree *BTree, node BNode, key, val []byte, overflow bool) (BNode, error) {
+	next := BNode(make([]byte, 2*tree.opts.PageSize))
+
+	index, err := nodeLookupLE(node, key)
+	if err != nil {
+		return nil, err
+	}
 	switch node.btype() {
 	case LEAF:
-		// TODO: Error handling
-		key, _ := node.getKey(index)
-		if bytes.Equal(key, key) {
-			leafUpdate(next, node, index, key, val)
+		found, err := node.getKey(index)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(key, found) {
+			// The old value's overflow pages are no longer referenced
+			if node.isOverflow(index) {
+				stub, err := node.getValue(index)
+				if err != nil {
+					return nil, err
+				}
+				if err := freeOverflow(tree, stub); err != nil {
+					return nil, err
+				}
+			}
+			err = leafUpdate(next, node, index, key, val)
 		} else {
-			leafInsert(next, node, index+1, key, val)
+			index++
+			err = leafInsert(next, node, index, key, val)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if overflow {
+			if err := next.setOverflow(index); err != nil {
+				return nil, err
+			}
 		}
 	case NODE: // Internal node, walk into the child node
-		// TODO: Error handling
 		// Recursively insert into child node
-		kptr, _ := node.getPtr(index)
-		knode := treeInsert(tree, tree.get(kptr), key, val)
+		kptr, err := node.getPtr(index)
+		if err != nil {
+			return nil, err
+		}
+		knode, err := treeInsert(tree, tree.get(kptr), key, val, overflow)
+		if err != nil {
+			return nil, err
+		}
 		// After we insert, split
-		numsplits, splitNodes := nodeSplit3(knode)
+		numsplits, splitNodes, err := nodeSplit3(knode, tree.pageSize())
+		if err != nil {
+			return nil, err
+		}
 		tree.del(kptr)
-		nodeReplaceKidN(tree, next, node, index, splitNodes[:numsplits])
+		if err := nodeReplaceKidN(tree, next, node, index, splitNodes[:numsplits]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
 	}
-	return next
+	return next, nil
 }
 
 /*
 Insert key into tree, with the associated val.
 Returns the error, if any, encountered during.
+
+The root only moves once the whole insert has succeeded, but pages may already have
+been freed by then, so the storage behind the tree should be rolled back on error.
 */
 func (tree *BTree) Insert(key []byte, val []byte) error {
-	if err := checkLimit(key, val); err != nil {
+	if err := tree.CheckLimit(key, val); err != nil {
 		return err
 	}
 
+	// Large values are stored out of line, with a stub in the leaf
+	overflow := len(val) > tree.opts.MaxInlineValSize
+	if overflow {
+		val = writeOverflow(tree, val)
+	}
+
 	// The case where the tree is empty
 	if tree.root == 0 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+		root := BNode(make([]byte, tree.opts.PageSize))
 		root.setHeader(LEAF, 2)
-		// Sentinel value
-		nodeAppendKeyVal(root, 0, 0, nil, nil)
-		nodeAppendKeyVal(root, 1, 1, nil, nil)
+		// Sentinel value, so every key has a lower bound in the tree
+		if err := nodeAppendKeyVal(root, 0, 0, nil, nil); err != nil {
+			return err
+		}
+		if err := nodeAppendKeyVal(root, 1, 0, key, val); err != nil {
+			return err
+		}
+		if overflow {
+			if err := root.setOverflow(1); err != nil {
+				return err
+			}
+		}
 		tree.root = tree.create(root)
 		return nil
 	}
 
 	// The case where the tree root is not empty.
-	node := treeInsert(tree, tree.get(tree.root), key, val)
+	node, err := treeInsert(tree, tree.get(tree.root), key, val, overflow)
+	if err != nil {
+		return err
+	}
 
 	// If the root splits as a result of said insert, grow the tree.
-	numSplits, splitNodes := nodeSplit3(node)
-	tree.del(tree.root)
+	numSplits, splitNodes, err := nodeSplit3(node, tree.pageSize())
+	if err != nil {
+		return err
+	}
 	if numSplits > 1 {
-		root := BNode(make([]byte, BTREE_PAGE_SIZE_BYTES))
+		root := BNode(make([]byte, tree.opts.PageSize))
 		root.setHeader(NODE, numSplits)
 		for i, knode := range splitNodes[:numSplits] {
-			ptr := tree.create(knode)
-			key, _ := knode.getKey(0)
-			nodeAppendKeyVal(root, uint16(i), ptr, key, nil)
+			key, err := knode.getKey(0)
+			if err != nil {
+				return err
+			}
+			if err := nodeAppendKeyVal(root, uint16(i), tree.create(knode), key, nil); err != nil {
+				return err
+			}
 		}
+		tree.del(tree.root)
 		tree.root = tree.create(root)
 	} else {
+		tree.del(tree.root)
 		tree.root = tree.create(splitNodes[0])
 	}
 	return nil
@@ -90,7 +179,140 @@ Returns:
 	Whether the deletion was successful
 	Error (if any) encountered
 */
-func (tree *BTree) Delete(key []byte) (bool, error)
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := tree.CheckLimit(key, nil); err != nil {
+		return false, err
+	}
+
+	if tree.root == 0 {
+		return false, nil
+	}
+
+	updated, err := treeDelete(tree, tree.get(tree.root), key)
+	if err != nil {
+		return false, err
+	}
+	// Key not found
+	if len(updated) == 0 {
+		return false, nil
+	}
+
+	// If the root is an internal node left with a single child, collapse a level.
+	if updated.btype() == NODE && updated.nkeys() == 1 {
+		kptr, err := updated.getPtr(0)
+		if err != nil {
+			return false, err
+		}
+		tree.del(tree.root)
+		tree.root = kptr
+	} else {
+		tree.del(tree.root)
+		tree.root = tree.create(updated)
+	}
+	return true, nil
+}
+
+/*
+Delete key from the subtree rooted at node.
+Returns the updated node, or an empty node if the key was not found.
+*/
+func treeDelete(tree *BTree, node BNode, key []byte) (BNode, error) {
+	index, err := nodeLookupLE(node, key)
+	if err != nil {
+		return nil, err
+	}
+	switch node.btype() {
+	case LEAF:
+		found, err := node.getKey(index)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(key, found) {
+			return BNode{}, nil
+		}
+		next := BNode(make([]byte, tree.opts.PageSize))
+		if err := leafDelete(next, node, index); err != nil {
+			return nil, err
+		}
+		if node.isOverflow(index) {
+			stub, err := node.getValue(index)
+			if err != nil {
+				return nil, err
+			}
+			if err := freeOverflow(tree, stub); err != nil {
+				return nil, err
+			}
+		}
+		return next, nil
+	case NODE:
+		return nodeDelete(tree, node, index, key)
+	}
+	return nil, fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
+}
+
+// Delete key from the kid at index, merging the kid with a sibling if it gets too small
+func nodeDelete(tree *BTree, node BNode, index uint16, key []byte) (BNode, error) {
+	kptr, err := node.getPtr(index)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := treeDelete(tree, tree.get(kptr), key)
+	if err != nil || len(updated) == 0 {
+		return updated, err
+	}
+
+	next := BNode(make([]byte, tree.opts.PageSize))
+	mergeDir, sibling, err := shouldMerge(tree, node, index, updated)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case mergeDir < 0: // Merge with the left sibling
+		merged := BNode(make([]byte, tree.opts.PageSize))
+		if err := nodeMerge(merged, sibling, updated); err != nil {
+			return nil, err
+		}
+		sptr, err := node.getPtr(index - 1)
+		if err != nil {
+			return nil, err
+		}
+		mkey, err := merged.getKey(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := nodeReplace2Kids(next, node, index-1, tree.create(merged), mkey); err != nil {
+			return nil, err
+		}
+		tree.del(sptr)
+	case mergeDir > 0: // Merge with the right sibling
+		merged := BNode(make([]byte, tree.opts.PageSize))
+		if err := nodeMerge(merged, updated, sibling); err != nil {
+			return nil, err
+		}
+		sptr, err := node.getPtr(index + 1)
+		if err != nil {
+			return nil, err
+		}
+		mkey, err := merged.getKey(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := nodeReplace2Kids(next, node, index, tree.create(merged), mkey); err != nil {
+			return nil, err
+		}
+		tree.del(sptr)
+	case updated.nkeys() == 0:
+		// The kid is empty and has no sibling to merge into, so this node is empty too.
+		// The parent (or Delete, for the root) deals with it.
+		next.setHeader(NODE, 0)
+	default:
+		if err := nodeReplaceKidN(tree, next, node, index, []BNode{updated}); err != nil {
+			return nil, err
+		}
+	}
+	tree.del(kptr)
+	return next, nil
+}
 
 /*
 	Should the updated child node be merged with a sibling node.
@@ -99,30 +321,89 @@ Returns:
 
 	An int representing the offset
 	The sibling that should be merged with
+	Error (if any) encountered
 */
-func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNode) {
+func shouldMerge(tree *BTree, node BNode, index uint16, updated BNode) (int, BNode, error) {
 
-	if updated.nbytes() > MERGE_THRESHOLD_BTYES {
-		return 0, BNode{}
+	if updated.nbytes() > tree.pageSize()/MERGE_THRESHOLD_FRACTION {
+		return 0, BNode{}, nil
 	}
 
 	if index > 0 {
-		ptr, _ := node.getPtr(index - 1)
+		ptr, err := node.getPtr(index - 1)
+		if err != nil {
+			return 0, BNode{}, err
+		}
 		sibling := BNode(tree.get(ptr))
 		mergedSize := sibling.nbytes() + updated.nbytes() - HEADER_SIZE
-		if mergedSize <= BTREE_PAGE_SIZE_BYTES {
-			return -1, sibling
+		if mergedSize <= tree.pageSize() {
+			return -1, sibling, nil
 		}
 	}
 
 	if index+1 < node.nkeys() {
-		ptr, _ := node.getPtr(index + 1)
+		ptr, err := node.getPtr(index + 1)
+		if err != nil {
+			return 0, BNode{}, err
+		}
 		sibling := BNode(tree.get(ptr))
 		mergedSize := sibling.nbytes() + updated.nbytes() - HEADER_SIZE
-		if mergedSize <= BTREE_PAGE_SIZE_BYTES {
-			return +1, sibling
+		if mergedSize <= tree.pageSize() {
+			return +1, sibling, nil
 		}
 	}
 
-	return 0, BNode{}
+	return 0, BNode{}, nil
+}
+
+/*
+Look up key in the tree.
+Returns:
+
+	The value associated with key
+	Whether the key was found
+	Error (if any) encountered
+*/
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	if err := tree.CheckLimit(key, nil); err != nil {
+		return nil, false, err
+	}
+
+	if tree.root == 0 {
+		return nil, false, nil
+	}
+	return treeGet(tree, tree.get(tree.root), key)
+}
+
+// Walk down from node to the leaf that could contain key
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
+	for {
+		index, err := nodeLookupLE(node, key)
+		if err != nil {
+			return nil, false, err
+		}
+		switch node.btype() {
+		case LEAF:
+			found, err := node.getKey(index)
+			if err != nil {
+				return nil, false, err
+			}
+			if !bytes.Equal(key, found) {
+				return nil, false, nil
+			}
+			val, err := leafValue(tree, node, index)
+			if err != nil {
+				return nil, false, err
+			}
+			return val, true, nil
+		case NODE:
+			kptr, err := node.getPtr(index)
+			if err != nil {
+				return nil, false, err
+			}
+			node = tree.get(kptr)
+		default:
+			return nil, false, fmt.Errorf("%w: bad node type %d", ErrNodeCorrupt, node.btype())
+		}
+	}
 }
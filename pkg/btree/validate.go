@@ -0,0 +1,18 @@
+package btree
+
+import "fmt"
+
+// Check key and val against the tree's limits before they go anywhere near a node.
+// Insert, Delete and Get all do this; callers that queue up writes can check early.
+func (tree *BTree) CheckLimit(key, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > tree.opts.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), tree.opts.MaxKeySize)
+	}
+	if len(val) > tree.opts.MaxValSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValTooLarge, len(val), tree.opts.MaxValSize)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package bufpool
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+)
+
+var ErrPoolFull = errors.New("bufpool: every frame is pinned")
+
+/*
+Fixed-size cache of pages sitting between the tree callbacks and the file.
+
+Frames are kept in least-recently-used order and the coldest unpinned frame is
+evicted when a new page needs room. Pinned frames are never evicted. Dirty frames
+(pages written since the last flush) are pinned until they are written back, so
+none of a transaction's pages are lost before it commits; the pool may go over
+capacity while that many dirty pages are outstanding.
+
+Pages are never recycled between frames, so a slice handed out by Get stays valid
+after its frame is evicted.
+*/
+type Pool struct {
+	capacity int
+	// Reads a page that isn't cached
+	load func(ptr uint64) ([]byte, error)
+	// Front is the most recently used
+	lru    *list.List
+	frames map[uint64]*list.Element
+	stats  Stats
+}
+
+type frame struct {
+	ptr   uint64
+	page  []byte
+	pins  int
+	dirty bool
+}
+
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Resident  int
+	Dirty     int
+}
+
+// A pool holding up to capacity pages, reading misses through load.
+func New(capacity int, load func(ptr uint64) ([]byte, error)) *Pool {
+	return &Pool{
+		capacity: capacity,
+		load:     load,
+		lru:      list.New(),
+		frames:   map[uint64]*list.Element{},
+	}
+}
+
+// Fetch a page, loading it on a miss.
+func (p *Pool) Get(ptr uint64) ([]byte, error) {
+	if elem, ok := p.frames[ptr]; ok {
+		p.stats.Hits++
+		p.lru.MoveToFront(elem)
+		return elem.Value.(*frame).page, nil
+	}
+
+	p.stats.Misses++
+	page, err := p.load(ptr)
+	if err != nil {
+		return nil, err
+	}
+	// If every frame is pinned the page is still returned, just not cached.
+	p.insert(&frame{ptr: ptr, page: page})
+	return page, nil
+}
+
+// Fetch a page and pin it so it stays resident until Unpin.
+func (p *Pool) Pin(ptr uint64) ([]byte, error) {
+	page, err := p.Get(ptr)
+	if err != nil {
+		return nil, err
+	}
+	elem, ok := p.frames[ptr]
+	if !ok {
+		return nil, ErrPoolFull
+	}
+	elem.Value.(*frame).pins++
+	return page, nil
+}
+
+func (p *Pool) Unpin(ptr uint64) {
+	if elem, ok := p.frames[ptr]; ok {
+		f := elem.Value.(*frame)
+		if f.pins > 0 {
+			f.pins--
+		}
+	}
+}
+
+// Install a newly written page. It stays pinned until Flush writes it back.
+func (p *Pool) PutDirty(ptr uint64, page []byte) {
+	if elem, ok := p.frames[ptr]; ok {
+		f := elem.Value.(*frame)
+		f.page = page
+		if !f.dirty {
+			f.dirty = true
+			f.pins++
+		}
+		p.lru.MoveToFront(elem)
+		return
+	}
+	// Dirty frames are allowed to go over capacity, so this can't fail.
+	p.evict()
+	p.frames[ptr] = p.lru.PushFront(&frame{ptr: ptr, page: page, pins: 1, dirty: true})
+}
+
+// Whether ptr holds a page written since the last flush.
+func (p *Pool) IsDirty(ptr uint64) bool {
+	elem, ok := p.frames[ptr]
+	return ok && elem.Value.(*frame).dirty
+}
+
+// Drop a page from the cache, dirty or not.
+func (p *Pool) Remove(ptr uint64) {
+	if elem, ok := p.frames[ptr]; ok {
+		p.lru.Remove(elem)
+		delete(p.frames, ptr)
+	}
+}
+
+// Every dirty page, by page number.
+func (p *Pool) Dirty() map[uint64][]byte {
+	dirty := map[uint64][]byte{}
+	for ptr, elem := range p.frames {
+		if f := elem.Value.(*frame); f.dirty {
+			dirty[ptr] = f.page
+		}
+	}
+	return dirty
+}
+
+/*
+Write back every dirty page with write, in page order. Pages that were written
+successfully become clean and evictable.
+*/
+func (p *Pool) Flush(write func(ptr uint64, page []byte) error) error {
+	dirty := p.Dirty()
+	ptrs := make([]uint64, 0, len(dirty))
+	for ptr := range dirty {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+
+	for _, ptr := range ptrs {
+		if err := write(ptr, dirty[ptr]); err != nil {
+			return err
+		}
+		f := p.frames[ptr].Value.(*frame)
+		f.dirty = false
+		f.pins--
+	}
+	p.evict()
+	return nil
+}
+
+// Drop every dirty page without writing it, for rolling back.
+func (p *Pool) DiscardDirty() {
+	for ptr, elem := range p.frames {
+		if elem.Value.(*frame).dirty {
+			p.lru.Remove(elem)
+			delete(p.frames, ptr)
+		}
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	stats := p.stats
+	stats.Resident = len(p.frames)
+	for _, elem := range p.frames {
+		if elem.Value.(*frame).dirty {
+			stats.Dirty++
+		}
+	}
+	return stats
+}
+
+func (p *Pool) insert(f *frame) error {
+	p.evict()
+	if len(p.frames) >= p.capacity {
+		return ErrPoolFull
+	}
+	p.frames[f.ptr] = p.lru.PushFront(f)
+	return nil
+}
+
+// Evict unpinned frames from the cold end until there is room for one more.
+func (p *Pool) evict() {
+	for elem := p.lru.Back(); elem != nil && len(p.frames) >= p.capacity; {
+		prev := elem.Prev()
+		if f := elem.Value.(*frame); f.pins == 0 {
+			p.lru.Remove(elem)
+			delete(p.frames, f.ptr)
+			p.stats.Evictions++
+		}
+		elem = prev
+	}
+}
@@ -0,0 +1,216 @@
+package bufpool
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A pool over pages that hold their own number, and the page numbers it loaded, in order.
+func newTestPool(capacity int) (*Pool, *[]uint64) {
+	var loads []uint64
+	pool := New(capacity, func(ptr uint64) ([]byte, error) {
+		loads = append(loads, ptr)
+		return []byte(fmt.Sprint(ptr)), nil
+	})
+	return pool, &loads
+}
+
+// The page numbers the pool holds, in order.
+func resident(p *Pool) []uint64 {
+	var ptrs []uint64
+	for ptr := range p.frames {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+	return ptrs
+}
+
+func checkResident(t *testing.T, p *Pool, want ...uint64) {
+	t.Helper()
+	if got := resident(p); !reflect.DeepEqual(got, want) {
+		t.Fatalf("resident pages %v, want %v", got, want)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	pool, loads := newTestPool(3)
+	for _, ptr := range []uint64{1, 2, 3, 1} {
+		page, err := pool.Get(ptr)
+		if err != nil || string(page) != fmt.Sprint(ptr) {
+			t.Fatalf("Get(%d) = %q, %v", ptr, page, err)
+		}
+	}
+	checkResident(t, pool, 1, 2, 3)
+
+	// 2 is now the least recently used, then 3
+	pool.Get(4)
+	checkResident(t, pool, 1, 3, 4)
+	pool.Get(5)
+	checkResident(t, pool, 1, 4, 5)
+	pool.Get(1)
+	pool.Get(6)
+	checkResident(t, pool, 1, 5, 6)
+
+	if want := []uint64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(*loads, want) {
+		t.Fatalf("loaded %v, want %v", *loads, want)
+	}
+	stats := pool.Stats()
+	if stats.Hits != 2 || stats.Misses != 6 || stats.Evictions != 3 || stats.Resident != 3 || stats.Dirty != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// A load error is returned and nothing is cached
+	failing := New(3, func(uint64) ([]byte, error) { return nil, errors.New("bad page") })
+	if _, err := failing.Get(1); err == nil || len(failing.frames) != 0 {
+		t.Fatalf("Get with a failing load = %v, %d frames", err, len(failing.frames))
+	}
+}
+
+func TestPinnedFrames(t *testing.T) {
+	pool, _ := newTestPool(2)
+	if _, err := pool.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	for ptr := uint64(2); ptr < 10; ptr++ {
+		pool.Get(ptr)
+	}
+	checkResident(t, pool, 1, 9)
+
+	// With every frame pinned pages are still read, just not cached
+	if _, err := pool.Pin(9); err != nil {
+		t.Fatal(err)
+	}
+	if page, err := pool.Get(10); err != nil || string(page) != "10" {
+		t.Fatalf("Get(10) with every frame pinned = %q, %v", page, err)
+	}
+	if _, err := pool.Pin(11); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("Pin(11) with every frame pinned = %v, want %v", err, ErrPoolFull)
+	}
+	checkResident(t, pool, 1, 9)
+
+	pool.Unpin(1)
+	pool.Get(12)
+	checkResident(t, pool, 9, 12)
+}
+
+func TestDirtyFramesStayPinned(t *testing.T) {
+	pool, _ := newTestPool(3)
+	pool.Get(1)
+	pool.Get(2)
+
+	// Writing over a cached clean page makes it dirty in place
+	pool.PutDirty(1, []byte("new1"))
+	pool.PutDirty(1, []byte("newer1"))
+	if page, _ := pool.Get(1); !pool.IsDirty(1) || string(page) != "newer1" {
+		t.Fatalf("page 1 = %q after PutDirty", page)
+	}
+	if pins := pool.frames[1].Value.(*frame).pins; pins != 1 {
+		t.Fatalf("page 1 dirtied twice has %d pins, want 1", pins)
+	}
+
+	// Dirty frames go over capacity rather than be evicted
+	for ptr := uint64(10); ptr < 13; ptr++ {
+		pool.PutDirty(ptr, []byte(fmt.Sprint("new", ptr)))
+	}
+	checkResident(t, pool, 1, 10, 11, 12)
+	// and while they fill the pool, clean pages are read but not cached
+	for ptr := uint64(2); ptr < 6; ptr++ {
+		if page, err := pool.Get(ptr); err != nil || string(page) != fmt.Sprint(ptr) {
+			t.Fatalf("Get(%d) = %q, %v", ptr, page, err)
+		}
+	}
+	checkResident(t, pool, 1, 10, 11, 12)
+	stats := pool.Stats()
+	if stats.Dirty != 4 || stats.Resident != 4 || stats.Evictions != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	for _, ptr := range []uint64{10, 11, 12} {
+		if page, err := pool.Get(ptr); !pool.IsDirty(ptr) || err != nil || string(page) != fmt.Sprint("new", ptr) {
+			t.Fatalf("Get(%d) = %q, %v", ptr, page, err)
+		}
+	}
+	if pool.IsDirty(2) {
+		t.Fatal("clean page 2 is dirty")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	pool, _ := newTestPool(3)
+	pool.Get(1)
+	for _, ptr := range []uint64{7, 5, 6, 1} {
+		pool.PutDirty(ptr, []byte(fmt.Sprint("new", ptr)))
+	}
+
+	// A failed write leaves that page and the ones after it dirty
+	var written []uint64
+	failAt := uint64(6)
+	err := pool.Flush(func(ptr uint64, page []byte) error {
+		if ptr == failAt {
+			return errors.New("disk full")
+		}
+		if string(page) != fmt.Sprint("new", ptr) {
+			t.Fatalf("page %d written as %q", ptr, page)
+		}
+		written = append(written, ptr)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Flush with a failing write succeeded")
+	}
+	if want := []uint64{1, 5}; !reflect.DeepEqual(written, want) {
+		t.Fatalf("wrote %v before failing, want %v", written, want)
+	}
+	if dirty := pool.Dirty(); len(dirty) != 2 || dirty[6] == nil || dirty[7] == nil {
+		t.Fatalf("dirty after a failed flush: %v", dirty)
+	}
+
+	// Written back in page order, then clean and evicted down to capacity
+	written = nil
+	failAt = 0
+	if err := pool.Flush(func(ptr uint64, page []byte) error {
+		written = append(written, ptr)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{6, 7}; !reflect.DeepEqual(written, want) {
+		t.Fatalf("wrote %v, want %v", written, want)
+	}
+	if stats := pool.Stats(); stats.Dirty != 0 || stats.Resident != 2 {
+		t.Fatalf("stats after Flush %+v", stats)
+	}
+	// The most recently used stay, with their new contents
+	checkResident(t, pool, 1, 6)
+	if page, _ := pool.Get(1); string(page) != "new1" {
+		t.Fatalf("page 1 = %q after Flush", page)
+	}
+}
+
+func TestDiscardDirty(t *testing.T) {
+	pool, loads := newTestPool(5)
+	pool.Get(1)
+	pool.Get(2)
+	pool.Get(3)
+	pool.PutDirty(3, []byte("new3"))
+	pool.PutDirty(10, []byte("new10"))
+	pool.PutDirty(11, []byte("new11"))
+
+	pool.DiscardDirty()
+	checkResident(t, pool, 1, 2)
+	if stats := pool.Stats(); stats.Dirty != 0 || len(pool.Dirty()) != 0 {
+		t.Fatalf("stats after DiscardDirty %+v", stats)
+	}
+	// A clean page that was written over comes back as it was before
+	*loads = nil
+	if page, err := pool.Get(3); err != nil || string(page) != "3" {
+		t.Fatalf("Get(3) after DiscardDirty = %q, %v", page, err)
+	}
+	pool.Get(1)
+	pool.Get(2)
+	if want := []uint64{3}; !reflect.DeepEqual(*loads, want) {
+		t.Fatalf("loaded %v after DiscardDirty, want %v", *loads, want)
+	}
+}
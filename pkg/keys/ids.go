@@ -0,0 +1,123 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+/*
+Identifier helpers for generating B-tree keys.
+
+Random identifiers (UUIDv4) scatter inserts across every leaf of the tree, so each
+insert copies a different leaf and the working set is the whole tree. Time-ordered
+identifiers (UUIDv7, ULID) start with a millisecond timestamp, so new keys land in
+the rightmost leaves and consecutive inserts touch the same few pages. Prefer the
+time-ordered forms for primary keys unless the key must not leak creation time.
+The insert benchmarks in ids_test.go measure this as the pages of an existing tree
+that a run of inserts replaces.
+*/
+
+// 16 byte identifier, shared by all of the generators below.
+type ID [16]byte
+
+// Which generator to use, for options that pick one, like kv.Options.AutoKey.
+type IDKind int
+
+const (
+	// No generator; the zero value
+	ID_NONE IDKind = iota
+	ID_UUIDV4
+	ID_UUIDV7
+	ID_ULID
+)
+
+// A new identifier of kind k, or false for ID_NONE or an unknown kind.
+func (k IDKind) New() (ID, bool) {
+	switch k {
+	case ID_UUIDV4:
+		return NewUUIDv4(), true
+	case ID_UUIDV7:
+		return NewUUIDv7(), true
+	case ID_ULID:
+		return NewULID(), true
+	}
+	return ID{}, false
+}
+
+// Random (version 4) UUID. No locality between consecutive ids.
+func NewUUIDv4() ID {
+	var id ID
+	fillRandom(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+// Time-ordered (version 7) UUID: 48 bits of unix milliseconds followed by random bits.
+func NewUUIDv7() ID {
+	var id ID
+	putMillis(id[:], time.Now())
+	fillRandom(id[6:])
+	id[6] = (id[6] & 0x0f) | 0x70
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id
+}
+
+// ULID: 48 bits of unix milliseconds followed by 80 random bits.
+func NewULID() ID {
+	var id ID
+	putMillis(id[:], time.Now())
+	fillRandom(id[6:])
+	return id
+}
+
+// The canonical 8-4-4-4-12 hex form of a UUID.
+func (id ID) String() string {
+	var out [36]byte
+	hex.Encode(out[0:8], id[0:4])
+	out[8] = '-'
+	hex.Encode(out[9:13], id[4:6])
+	out[13] = '-'
+	hex.Encode(out[14:18], id[6:8])
+	out[18] = '-'
+	hex.Encode(out[19:23], id[8:10])
+	out[23] = '-'
+	hex.Encode(out[24:], id[10:])
+	return string(out[:])
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// The 26 character Crockford base32 form used for ULIDs. Sorts the same as the raw bytes.
+func (id ID) ULIDString() string {
+	var out [26]byte
+	// 128 bits as 26 groups of 5, with 2 bits of zero padding at the front
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// The creation time embedded in a UUIDv7 or ULID.
+func (id ID) Time() time.Time {
+	var raw [8]byte
+	copy(raw[2:], id[0:6])
+	return time.UnixMilli(int64(binary.BigEndian.Uint64(raw[:])))
+}
+
+func putMillis(b []byte, t time.Time) {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(t.UnixMilli()))
+	copy(b[0:6], raw[2:])
+}
+
+func fillRandom(b []byte) {
+	// crypto/rand.Read never returns an error on supported platforms
+	rand.Read(b)
+}
@@ -0,0 +1,137 @@
+package keys
+
+import (
+	"bytes"
+	"database-go/pkg/btree"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeOrderedIDs(t *testing.T) {
+	for _, kind := range []IDKind{ID_UUIDV7, ID_ULID} {
+		before := time.Now().Truncate(time.Millisecond)
+		first, _ := kind.New()
+		time.Sleep(2 * time.Millisecond)
+		second, _ := kind.New()
+		after := time.Now()
+
+		if bytes.Compare(first[:], second[:]) >= 0 {
+			t.Errorf("kind %d: %x does not sort before the later %x", kind, first, second)
+		}
+		if first.ULIDString() >= second.ULIDString() {
+			t.Errorf("kind %d: %s does not sort before the later %s", kind, first.ULIDString(), second.ULIDString())
+		}
+		if at := first.Time(); at.Before(before) || at.After(after) {
+			t.Errorf("kind %d: Time() = %v, want between %v and %v", kind, at, before, after)
+		}
+	}
+
+	v7 := NewUUIDv7()
+	if v7[6]>>4 != 7 || v7[8]>>6 != 2 {
+		t.Errorf("UUIDv7 %s has the wrong version or variant", v7)
+	}
+	v4 := NewUUIDv4()
+	if v4[6]>>4 != 4 || v4[8]>>6 != 2 {
+		t.Errorf("UUIDv4 %s has the wrong version or variant", v4)
+	}
+	if _, ok := ID_NONE.New(); ok {
+		t.Error("ID_NONE generated an ID")
+	}
+}
+
+func TestIDStrings(t *testing.T) {
+	var id ID
+	for i := range id {
+		id[i] = byte(i * 17)
+	}
+	if got, want := id.String(), "00112233-4455-6677-8899-aabbccddeeff"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+	if got, want := (ID{}).ULIDString(), strings.Repeat("0", 26); got != want {
+		t.Errorf("ULIDString() of zero = %s, want %s", got, want)
+	}
+	var max ID
+	for i := range max {
+		max[i] = 0xff
+	}
+	if got, want := max.ULIDString(), "7"+strings.Repeat("Z", 25); got != want {
+		t.Errorf("ULIDString() of all ones = %s, want %s", got, want)
+	}
+	if got, want := (ID{0, 0, 0, 0, 0, 1}).ULIDString(), "0000000001"+strings.Repeat("0", 16); got != want {
+		t.Errorf("ULIDString() of 1ms = %s, want %s", got, want)
+	}
+}
+
+/*
+Insert preload keys from newID, then n more, and return how many of the pages the
+tree had after the preload the n inserts replaced. Copy-on-write rewrites a path per
+insert either way; what locality changes is how much of the existing tree a run of
+inserts disturbs, which is the working set a cache has to hold and the pages a
+batched commit has to write.
+*/
+func disturbedPages(tb testing.TB, newID func() ID, preload, n int) int {
+	pages := map[uint64][]byte{}
+	next := uint64(1)
+	// The pages after the preload, and how many of them have been freed since
+	old := map[uint64]bool{}
+	disturbed := 0
+	tree, err := btree.NewBTree(0, btree.Options{},
+		func(ptr uint64) []byte { return pages[ptr] },
+		func(node []byte) uint64 {
+			pages[next] = append([]byte{}, node...)
+			next++
+			return next - 1
+		},
+		func(ptr uint64) {
+			if old[ptr] {
+				disturbed++
+			}
+			delete(pages, ptr)
+		},
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	val := make([]byte, 64)
+	insert := func() {
+		id := newID()
+		if err := tree.Insert(id[:], val); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for i := 0; i < preload; i++ {
+		insert()
+	}
+	// Freed pages are deleted, so what is left is the tree
+	for ptr := range pages {
+		old[ptr] = true
+	}
+	// Keep the time-ordered keys to come after the preloaded ones
+	time.Sleep(2 * time.Millisecond)
+	if b, ok := tb.(*testing.B); ok {
+		b.ResetTimer()
+	}
+	for i := 0; i < n; i++ {
+		insert()
+	}
+	return disturbed
+}
+
+func TestTimeOrderedLocality(t *testing.T) {
+	random := disturbedPages(t, NewUUIDv4, 5000, 500)
+	ordered := disturbedPages(t, NewUUIDv7, 5000, 500)
+	if ordered*5 > random {
+		t.Fatalf("500 UUIDv7 inserts replaced %d existing pages, UUIDv4 %d", ordered, random)
+	}
+}
+
+func benchmarkLocality(b *testing.B, newID func() ID) {
+	disturbed := disturbedPages(b, newID, 20000, b.N)
+	b.ReportMetric(float64(disturbed)/float64(b.N), "old-pages/op")
+}
+
+func BenchmarkInsertUUIDv4(b *testing.B) { benchmarkLocality(b, NewUUIDv4) }
+func BenchmarkInsertUUIDv7(b *testing.B) { benchmarkLocality(b, NewUUIDv7) }
+func BenchmarkInsertULID(b *testing.B)   { benchmarkLocality(b, NewULID) }
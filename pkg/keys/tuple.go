@@ -0,0 +1,312 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+Tuple encoding, following the FoundationDB layout. Every element is written as a
+type code followed by a payload, chosen so that comparing two packed tuples with
+bytes.Compare gives the same order as comparing the tuples element by element.
+*/
+
+const (
+	NIL_CODE    = 0x00
+	BYTES_CODE  = 0x01
+	STRING_CODE = 0x02
+	NESTED_CODE = 0x05
+	// Integers use 0x0c..0x1c, with INT_ZERO_CODE +/- the number of payload bytes
+	INT_ZERO_CODE = 0x14
+	FLOAT64_CODE  = 0x21
+	FALSE_CODE    = 0x26
+	TRUE_CODE     = 0x27
+
+	// Byte strings are terminated by 0x00, so an embedded 0x00 is written as 0x00 0xff
+	ESCAPE_BYTE = 0xff
+)
+
+// A Tuple is an ordered list of elements. Supported element types are nil, []byte,
+// string, int, int64, uint64, float64, bool and nested Tuples.
+type Tuple []interface{}
+
+var (
+	ErrUnsupportedType = errors.New("keys: unsupported tuple element type")
+	ErrMalformedTuple  = errors.New("keys: malformed packed tuple")
+)
+
+// Pack the tuple into its order-preserving byte representation.
+func (t Tuple) Pack() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeTuple(&buf, t, false); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Pack a tuple, for when the element types are known to be valid. Panics otherwise.
+func MustPack(t Tuple) []byte {
+	packed, err := t.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+/*
+Range returns the begin (inclusive) and end (exclusive) keys covering every tuple
+that has t as a strict prefix.
+*/
+func (t Tuple) Range() ([]byte, []byte, error) {
+	packed, err := t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	begin := append(append([]byte{}, packed...), 0x00)
+	end := append(append([]byte{}, packed...), 0xff)
+	return begin, end, nil
+}
+
+// Decode a tuple produced by Pack.
+func Unpack(packed []byte) (Tuple, error) {
+	t, rest, err := decodeTuple(packed, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrMalformedTuple
+	}
+	return t, nil
+}
+
+func encodeTuple(buf *bytes.Buffer, t Tuple, nested bool) error {
+	for _, elem := range t {
+		if err := encodeElem(buf, elem, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeElem(buf *bytes.Buffer, elem interface{}, nested bool) error {
+	switch v := elem.(type) {
+	case nil:
+		buf.WriteByte(NIL_CODE)
+		// Inside a nested tuple a bare 0x00 would terminate it
+		if nested {
+			buf.WriteByte(ESCAPE_BYTE)
+		}
+	case []byte:
+		buf.WriteByte(BYTES_CODE)
+		writeEscaped(buf, v)
+	case string:
+		buf.WriteByte(STRING_CODE)
+		writeEscaped(buf, []byte(v))
+	case Tuple:
+		buf.WriteByte(NESTED_CODE)
+		if err := encodeTuple(buf, v, true); err != nil {
+			return err
+		}
+		buf.WriteByte(0x00)
+	case int:
+		encodeInt(buf, int64(v))
+	case int64:
+		encodeInt(buf, v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			encodeInt(buf, int64(v))
+		} else {
+			buf.WriteByte(INT_ZERO_CODE + 8)
+			var raw [8]byte
+			binary.BigEndian.PutUint64(raw[:], v)
+			buf.Write(raw[:])
+		}
+	case float64:
+		bits := math.Float64bits(v)
+		// Flip the sign bit for positives and every bit for negatives so byte order matches numeric order
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf.WriteByte(FLOAT64_CODE)
+		var raw [8]byte
+		binary.BigEndian.PutUint64(raw[:], bits)
+		buf.Write(raw[:])
+	case bool:
+		if v {
+			buf.WriteByte(TRUE_CODE)
+		} else {
+			buf.WriteByte(FALSE_CODE)
+		}
+	default:
+		return fmt.Errorf("%w: %T", ErrUnsupportedType, elem)
+	}
+	return nil
+}
+
+func writeEscaped(buf *bytes.Buffer, b []byte) {
+	for _, c := range b {
+		buf.WriteByte(c)
+		if c == 0x00 {
+			buf.WriteByte(ESCAPE_BYTE)
+		}
+	}
+	buf.WriteByte(0x00)
+}
+
+// Number of bytes needed to hold v, at least one.
+func byteLen(v uint64) int {
+	n := 1
+	for v > 0xff {
+		v >>= 8
+		n++
+	}
+	return n
+}
+
+/*
+Integers are written big-endian in as few bytes as possible. Negative values store
+the one's complement of their magnitude so that they sort below zero and below each
+other correctly.
+*/
+func encodeInt(buf *bytes.Buffer, v int64) {
+	if v == 0 {
+		buf.WriteByte(INT_ZERO_CODE)
+		return
+	}
+
+	var raw [8]byte
+	if v > 0 {
+		n := byteLen(uint64(v))
+		binary.BigEndian.PutUint64(raw[:], uint64(v))
+		buf.WriteByte(byte(INT_ZERO_CODE + n))
+		buf.Write(raw[8-n:])
+		return
+	}
+
+	mag := uint64(-v)
+	n := byteLen(mag)
+	binary.BigEndian.PutUint64(raw[:], ^mag)
+	buf.WriteByte(byte(INT_ZERO_CODE - n))
+	buf.Write(raw[8-n:])
+}
+
+func decodeTuple(b []byte, nested bool) (Tuple, []byte, error) {
+	t := Tuple{}
+	for len(b) > 0 {
+		if nested && b[0] == 0x00 {
+			// Escaped nil inside a nested tuple
+			if len(b) > 1 && b[1] == ESCAPE_BYTE {
+				t = append(t, nil)
+				b = b[2:]
+				continue
+			}
+			// End of the nested tuple
+			return t, b[1:], nil
+		}
+
+		elem, rest, err := decodeElem(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		t = append(t, elem)
+		b = rest
+	}
+
+	if nested {
+		return nil, nil, ErrMalformedTuple
+	}
+	return t, b, nil
+}
+
+func decodeElem(b []byte) (interface{}, []byte, error) {
+	code := b[0]
+	switch {
+	case code == NIL_CODE:
+		return nil, b[1:], nil
+	case code == BYTES_CODE:
+		raw, rest, err := readEscaped(b[1:])
+		return raw, rest, err
+	case code == STRING_CODE:
+		raw, rest, err := readEscaped(b[1:])
+		return string(raw), rest, err
+	case code == NESTED_CODE:
+		return decodeTuple(b[1:], true)
+	case code >= INT_ZERO_CODE-8 && code <= INT_ZERO_CODE+8:
+		return decodeInt(b)
+	case code == FLOAT64_CODE:
+		if len(b) < 9 {
+			return nil, nil, ErrMalformedTuple
+		}
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), b[9:], nil
+	case code == FALSE_CODE:
+		return false, b[1:], nil
+	case code == TRUE_CODE:
+		return true, b[1:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown type code 0x%02x", ErrMalformedTuple, code)
+}
+
+func readEscaped(b []byte) ([]byte, []byte, error) {
+	out := []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			out = append(out, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == ESCAPE_BYTE {
+			out = append(out, 0x00)
+			i++
+			continue
+		}
+		return out, b[i+1:], nil
+	}
+	return nil, nil, ErrMalformedTuple
+}
+
+// Decodes to int64, or uint64 for positive values that do not fit in an int64.
+func decodeInt(b []byte) (interface{}, []byte, error) {
+	code := int(b[0])
+	if code == INT_ZERO_CODE {
+		return int64(0), b[1:], nil
+	}
+
+	n := code - INT_ZERO_CODE
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	if len(b) < 1+n {
+		return nil, nil, ErrMalformedTuple
+	}
+
+	var raw [8]byte
+	copy(raw[8-n:], b[1:1+n])
+	v := binary.BigEndian.Uint64(raw[:])
+	rest := b[1+n:]
+
+	if !neg {
+		if v > math.MaxInt64 {
+			return v, rest, nil
+		}
+		return int64(v), rest, nil
+	}
+
+	// Undo the one's complement within the n bytes that were written
+	mask := uint64(math.MaxUint64)
+	if n < 8 {
+		mask = (uint64(1) << (8 * n)) - 1
+	}
+	mag := ^v & mask
+	return -int64(mag), rest, nil
+}
@@ -0,0 +1,173 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTupleRoundTrip(t *testing.T) {
+	tests := []struct {
+		in, want Tuple
+	}{
+		{Tuple{}, Tuple{}},
+		{Tuple{nil}, Tuple{nil}},
+		{Tuple{[]byte("raw"), []byte{}}, Tuple{[]byte("raw"), []byte{}}},
+		{Tuple{"text", ""}, Tuple{"text", ""}},
+		// Every integer comes back as int64, or uint64 past math.MaxInt64
+		{Tuple{0, 1, -1, 255, -256, math.MaxInt64, math.MinInt64 + 1}, Tuple{int64(0), int64(1), int64(-1), int64(255), int64(-256), int64(math.MaxInt64), int64(math.MinInt64 + 1)}},
+		{Tuple{int64(1 << 40), uint64(7), uint64(math.MaxUint64)}, Tuple{int64(1 << 40), int64(7), uint64(math.MaxUint64)}},
+		{Tuple{0.0, -1.5, math.Inf(1), math.Inf(-1)}, Tuple{0.0, -1.5, math.Inf(1), math.Inf(-1)}},
+		{Tuple{true, false}, Tuple{true, false}},
+		{Tuple{"a", Tuple{nil, "b", Tuple{nil}}, nil}, Tuple{"a", Tuple{nil, "b", Tuple{nil}}, nil}},
+		{Tuple{Tuple{}}, Tuple{Tuple{}}},
+	}
+	for _, tt := range tests {
+		packed, err := tt.in.Pack()
+		if err != nil {
+			t.Fatalf("Pack(%v): %v", tt.in, err)
+		}
+		got, err := Unpack(packed)
+		if err != nil {
+			t.Fatalf("Unpack(Pack(%v)): %v", tt.in, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unpack(Pack(%v)) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTupleEscaping(t *testing.T) {
+	packed := MustPack(Tuple{[]byte{0x00, 'a', 0x00}, "\x00"})
+	want := []byte{BYTES_CODE, 0x00, ESCAPE_BYTE, 'a', 0x00, ESCAPE_BYTE, 0x00, STRING_CODE, 0x00, ESCAPE_BYTE, 0x00}
+	if !bytes.Equal(packed, want) {
+		t.Fatalf("Pack = %x, want %x", packed, want)
+	}
+
+	// nil is a bare 0x00 at the top level, and escaped inside a nested tuple where 0x00 ends it
+	if packed, want := MustPack(Tuple{nil}), []byte{NIL_CODE}; !bytes.Equal(packed, want) {
+		t.Fatalf("Pack(nil) = %x, want %x", packed, want)
+	}
+	packed = MustPack(Tuple{Tuple{nil}, nil})
+	want = []byte{NESTED_CODE, NIL_CODE, ESCAPE_BYTE, 0x00, NIL_CODE}
+	if !bytes.Equal(packed, want) {
+		t.Fatalf("Pack of a nested nil = %x, want %x", packed, want)
+	}
+}
+
+// Tuples in the order Pack must keep.
+var orderedTuples = []Tuple{
+	{nil},
+	{[]byte{}},
+	{[]byte{0x00}},
+	{[]byte{0x00, 0x00}},
+	{[]byte{0x01}},
+	{""},
+	{"\x00"},
+	{"a"},
+	{"a", nil},
+	{"a", int64(0)},
+	{"a\x00"},
+	{"ab"},
+	{Tuple{}},
+	{Tuple{nil}},
+	{Tuple{nil, nil}},
+	{Tuple{int64(1)}},
+	{int64(math.MinInt64 + 1)},
+	{int64(-70000)},
+	{int64(-256)},
+	{int64(-255)},
+	{int64(-1)},
+	{int64(0)},
+	{int64(1)},
+	{int64(255)},
+	{int64(256)},
+	{int64(math.MaxInt64)},
+	{uint64(math.MaxUint64)},
+	{math.Inf(-1)},
+	{-1e10},
+	{-0.5},
+	{0.0},
+	{0.5},
+	{1e10},
+	{math.Inf(1)},
+	{false},
+	{true},
+}
+
+func TestTupleOrder(t *testing.T) {
+	packed := make([][]byte, len(orderedTuples))
+	for i, tuple := range orderedTuples {
+		packed[i] = MustPack(tuple)
+	}
+	for i := 1; i < len(packed); i++ {
+		if bytes.Compare(packed[i-1], packed[i]) >= 0 {
+			t.Errorf("Pack(%v) = %x does not sort before Pack(%v) = %x", orderedTuples[i-1], packed[i-1], orderedTuples[i], packed[i])
+		}
+	}
+
+	// Shuffled and sorted by their packed form, they come back in order
+	shuffled := append([][]byte{}, packed...)
+	for i := range shuffled {
+		j := (i * 7919) % len(shuffled)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	sort.Slice(shuffled, func(i, j int) bool { return bytes.Compare(shuffled[i], shuffled[j]) < 0 })
+	for i := range shuffled {
+		if !bytes.Equal(shuffled[i], packed[i]) {
+			t.Fatalf("sorted position %d holds %x, want %x", i, shuffled[i], packed[i])
+		}
+	}
+}
+
+func TestTupleRange(t *testing.T) {
+	prefix := Tuple{"users", int64(7)}
+	begin, end, err := prefix.Range()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside := []Tuple{
+		{"users", int64(7), nil},
+		{"users", int64(7), ""},
+		{"users", int64(7), "zzz", int64(1)},
+		{"users", int64(7), Tuple{nil}},
+		{"users", int64(7), true},
+	}
+	outside := []Tuple{
+		prefix,
+		{"users", int64(6), "zzz"},
+		{"users", int64(8)},
+		{"users"},
+		{"usersx"},
+	}
+	for _, tuple := range inside {
+		if k := MustPack(tuple); bytes.Compare(k, begin) < 0 || bytes.Compare(k, end) >= 0 {
+			t.Errorf("%v is outside the range of %v", tuple, prefix)
+		}
+	}
+	for _, tuple := range outside {
+		if k := MustPack(tuple); bytes.Compare(k, begin) >= 0 && bytes.Compare(k, end) < 0 {
+			t.Errorf("%v is inside the range of %v", tuple, prefix)
+		}
+	}
+}
+
+func TestTupleErrors(t *testing.T) {
+	if _, err := (Tuple{int32(1)}).Pack(); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("Pack(int32) = %v, want %v", err, ErrUnsupportedType)
+	}
+	for _, bad := range [][]byte{
+		{BYTES_CODE, 'a'},
+		{NESTED_CODE, STRING_CODE, 'a', 0x00},
+		{INT_ZERO_CODE + 2, 0x01},
+		{FLOAT64_CODE, 0x00},
+		{0x30},
+	} {
+		if _, err := Unpack(bad); !errors.Is(err, ErrMalformedTuple) {
+			t.Errorf("Unpack(%x) = %v, want %v", bad, err, ErrMalformedTuple)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package kv
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/pager"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Pages Backup and IncrementalBackup go through between calls to their progress callback
+	BACKUP_PROGRESS_PAGES = 1024
+
+	INCREMENTAL_MAGIC   = "kvincr"
+	INCREMENTAL_VERSION = 1
+	// Fixed part of an incremental backup before the pages
+	INCREMENTAL_HEADER_SIZE = len(INCREMENTAL_MAGIC) + 2 + 4 + 8 + 8
+)
+
+var (
+	// Returned by ApplyIncremental for a stream that isn't an incremental backup, or is damaged
+	ErrBadIncremental = errors.New("kv: bad incremental backup")
+	// Returned by ApplyIncremental when the base isn't at the version the incremental starts from
+	ErrIncrementalBase = errors.New("kv: incremental backup does not start at the base's version")
+)
+
+/*
+Stream a consistent copy of the database file, as of the last commit, to w while
+commits carry on. The copy is a database file in its own right: write it to disk
+and Open it. It has the pages of the commit at the same numbers, a free list for
+the rest, and no log; page checksums are kept, so a damaged copy is caught when it
+is read. Nothing is compacted; see ExportCheckpoint for that.
+
+The commit is pinned like a snapshot, which copy-on-write makes enough to keep its
+pages as they are, and the database lock is only held for one page at a time. The
+tree is walked and checked first, and a copy of a tree with problems is refused.
+progress, if not nil, is called every BACKUP_PROGRESS_PAGES pages and at the end
+with the pages written so far and the total. Stops with ctx's error if it is done.
+*/
+func (db *DB) Backup(ctx context.Context, w io.Writer, progress func(done, total uint64)) error {
+	snap, report, err := db.backupSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	p := db.pager
+	meta, list := p.ImagePages(snap.meta, report.Pages)
+	zero := make([]byte, len(meta))
+	used := report.Pages
+	total := snap.meta.NPages
+	for ptr := uint64(0); ptr < total; ptr++ {
+		if ptr%BACKUP_PROGRESS_PAGES == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if progress != nil && ptr > 0 {
+				progress(ptr, total)
+			}
+		}
+
+		page := zero
+		switch {
+		case ptr == 0:
+			page = meta
+		case list[ptr] != nil:
+			page = list[ptr]
+		case len(used) > 0 && used[0] == ptr:
+			used = used[1:]
+			if page, err = snap.imagePage(ptr); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(page); err != nil {
+			return err
+		}
+	}
+	if err := snap.lockedStale(); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(total, total)
+	}
+	return nil
+}
+
+// A snapshot of the last commit for a backup, with the tree checked.
+func (db *DB) backupSnapshot() (*Snapshot, *VerifyReport, error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	var report *VerifyReport
+	err = func() (err error) {
+		defer recoverPageError(&err)
+		report = &VerifyReport{CheckReport: *snap.lockedTree().Check()}
+		return nil
+	}()
+	if err == nil && !report.OK() {
+		err = fmt.Errorf("kv: not backing up a tree with problems: %v", report.Violations[0])
+	}
+	if err == nil {
+		err = snap.lockedStale()
+	}
+	if err != nil {
+		snap.Release()
+		return nil, nil, err
+	}
+	return snap, report, nil
+}
+
+/*
+An incremental backup carries a copy made by Backup from the version it was taken
+at, or from an earlier incremental's version, to a later one. It holds the pages
+the later commit's tree uses that were written since (those with a higher LSN; see
+pager.PAGE_TRAILER_SIZE), then its free list and meta page, which come last:
+
+	| "kvincr" | format version (2) | page size (4) | from version (8) | to version (8) |
+	| page... | crc32 (4) |
+
+Each page is its number (8) and the page as it goes in the file, checksum and all;
+the meta page is page 0. The crc32 covers everything before it. Numbers are
+little-endian.
+
+Every page the tree uses is still read to find the ones that changed, but only
+those are written, so an incremental is about as big as the changes since the last
+backup rather than the database.
+*/
+
+/*
+Write an incremental backup from version since to the last commit, for a copy made
+by Backup at since, or brought to since by ApplyIncremental. Otherwise as Backup.
+Returns the version it goes up to, the since for the next one.
+*/
+func (db *DB) IncrementalBackup(ctx context.Context, w io.Writer, since uint64, progress func(done, total uint64)) (uint64, error) {
+	snap, report, err := db.backupSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	if snap.meta.Seq < since {
+		return 0, fmt.Errorf("%w: want %d, at %d", ErrVersionAhead, since, snap.meta.Seq)
+	}
+
+	crc := crc32.NewIEEE()
+	out := bufio.NewWriter(io.MultiWriter(w, crc))
+	header := []byte(INCREMENTAL_MAGIC)
+	header = binary.LittleEndian.AppendUint16(header, INCREMENTAL_VERSION)
+	header = binary.LittleEndian.AppendUint32(header, uint32(db.pager.PageSize()))
+	header = binary.LittleEndian.AppendUint64(header, since)
+	header = binary.LittleEndian.AppendUint64(header, snap.meta.Seq)
+	out.Write(header)
+	writePage := func(ptr uint64, page []byte) error {
+		out.Write(binary.LittleEndian.AppendUint64(nil, ptr))
+		_, err := out.Write(page)
+		return err
+	}
+
+	total := uint64(len(report.Pages))
+	for i, ptr := range report.Pages {
+		if i%BACKUP_PROGRESS_PAGES == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+			if progress != nil && i > 0 {
+				progress(uint64(i), total)
+			}
+		}
+		page, err := snap.imagePage(ptr)
+		if err != nil {
+			return 0, err
+		}
+		if pager.PageLSN(page) <= since {
+			continue
+		}
+		if err := writePage(ptr, page); err != nil {
+			return 0, err
+		}
+	}
+
+	meta, list := db.pager.ImagePages(snap.meta, report.Pages)
+	for ptr, page := range list {
+		if err := writePage(ptr, page); err != nil {
+			return 0, err
+		}
+	}
+	if err := writePage(pager.META_PAGE, meta); err != nil {
+		return 0, err
+	}
+	if err := out.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return 0, err
+	}
+	if err := snap.lockedStale(); err != nil {
+		return 0, err
+	}
+	if progress != nil {
+		progress(total, total)
+	}
+	return snap.meta.Seq, nil
+}
+
+/*
+Bring the copy of a database at path, made by Backup, up to date with an
+incremental backup from IncrementalBackup, which has to start at the copy's
+version. Apply several in the order they were taken. The copy must not be open.
+Returns the version the copy is now at.
+
+The pages are written in place and the copy only moves to the new version once the
+whole incremental has been read and its checksum found to match. Until then the
+copy is in between: if this fails part way, say on a damaged incremental, the copy
+still claims its old version but may have some of the new pages, and needs a good
+copy of the same incremental applied before it can be opened.
+*/
+func ApplyIncremental(path string, r io.Reader) (uint64, error) {
+	in := bufio.NewReader(r)
+	crc := crc32.NewIEEE()
+	body := io.TeeReader(in, crc)
+	read := func(b []byte) error {
+		_, err := io.ReadFull(body, b)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: truncated", ErrBadIncremental)
+		}
+		return err
+	}
+
+	header := make([]byte, INCREMENTAL_HEADER_SIZE)
+	if err := read(header); err != nil {
+		return 0, err
+	}
+	if string(header[:len(INCREMENTAL_MAGIC)]) != INCREMENTAL_MAGIC {
+		return 0, fmt.Errorf("%w: not an incremental backup", ErrBadIncremental)
+	}
+	fields := header[len(INCREMENTAL_MAGIC):]
+	if v := binary.LittleEndian.Uint16(fields); v != INCREMENTAL_VERSION {
+		return 0, fmt.Errorf("%w: format version %d, expected %d", ErrBadIncremental, v, INCREMENTAL_VERSION)
+	}
+	pageSize := int(binary.LittleEndian.Uint32(fields[2:]))
+	since, version := binary.LittleEndian.Uint64(fields[6:]), binary.LittleEndian.Uint64(fields[14:])
+
+	image, err := pager.OpenImage(path)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+	base := image.Meta()
+	if base.Seq != since {
+		return 0, fmt.Errorf("%w: base is at %d, incremental goes from %d to %d", ErrIncrementalBase, base.Seq, since, version)
+	}
+	if pageSize != base.Options.PageSize {
+		return 0, fmt.Errorf("%w: %d byte pages, base has %d", ErrBadIncremental, pageSize, base.Options.PageSize)
+	}
+
+	entry := make([]byte, 8+pageSize)
+	for {
+		if err := read(entry); err != nil {
+			return 0, err
+		}
+		ptr, page := binary.LittleEndian.Uint64(entry), entry[8:]
+		if ptr != pager.META_PAGE {
+			// Nothing to write when the incremental is empty, but it is still checked
+			if version == since {
+				continue
+			}
+			if err := image.WritePage(ptr, page); err != nil {
+				return 0, fmt.Errorf("%w: %w", ErrBadIncremental, err)
+			}
+			continue
+		}
+
+		sum := crc.Sum32()
+		var b [4]byte
+		if _, err := io.ReadFull(in, b[:]); err != nil {
+			return 0, fmt.Errorf("%w: truncated", ErrBadIncremental)
+		}
+		if binary.LittleEndian.Uint32(b[:]) != sum {
+			return 0, fmt.Errorf("%w: checksum mismatch", ErrBadIncremental)
+		}
+		if _, err := in.ReadByte(); err != io.EOF {
+			return 0, fmt.Errorf("%w: data after the end", ErrBadIncremental)
+		}
+		if version == since {
+			return since, nil
+		}
+		if err := image.Finish(page); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrBadIncremental, err)
+		}
+		return image.Meta().Seq, nil
+	}
+}
+
+// A copy of one of the snapshot's pages for Backup, read under the lock.
+func (s *Snapshot) imagePage(ptr uint64) (page []byte, err error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	defer recoverPageError(&err)
+	return s.db.pager.ImagePage(ptr, s.db.pager.PageGet(ptr)), nil
+}
@@ -0,0 +1,109 @@
+package kv
+
+import (
+	"errors"
+)
+
+// Returned by BulkLoad on a database that already has something in it
+var ErrNotEmpty = errors.New("kv: database is not empty")
+
+/*
+Writes collected to be applied together by WriteBatch. Later writes to a key replace
+earlier ones. Not safe for concurrent use.
+*/
+type Batch struct {
+	// By key; a nil entry is a delete
+	writes map[string]*[]byte
+}
+
+func (b *Batch) Set(key, val []byte) {
+	if b.writes == nil {
+		b.writes = map[string]*[]byte{}
+	}
+	val = append([]byte{}, val...)
+	b.writes[string(key)] = &val
+}
+
+func (b *Batch) Del(key []byte) {
+	if b.writes == nil {
+		b.writes = map[string]*[]byte{}
+	}
+	b.writes[string(key)] = nil
+}
+
+// The number of keys written.
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+/*
+Apply every write in the batch in one commit, returning its version. Nothing is read,
+so unlike a transaction it never conflicts. The pairs go into the tree in key order
+in a single pass (see btree.InsertBatch), so a large batch copies far fewer pages
+than the same writes made one Set at a time.
+*/
+func (db *DB) WriteBatch(b *Batch) (uint64, error) {
+	return db.Update(func(tx *Tx) error {
+		for key, val := range b.writes {
+			if err := tx.write([]byte(key), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+Fill an empty database with pairs in increasing key order, as returned by next until
+it reports ok false, and commit them all at once. Returns the number of pairs.
+
+The tree is built bottom up with pages packed to fill (a fraction of a page, or
+btree.DEFAULT_BULK_FILL if zero), writing each page once, which makes loading
+millions of pairs far cheaper than setting them one at a time. The database must be
+new: no keys, indexes or key versions. The database is locked while next is called,
+so it must not use it.
+*/
+func (db *DB) BulkLoad(fill float64, next func() (key, val []byte, ok bool, err error)) (n int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return 0, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+	if err := db.waitForWriter(nil); err != nil {
+		return 0, err
+	}
+	if db.tree.Root() != 0 {
+		return 0, ErrNotEmpty
+	}
+
+	defer func() {
+		if err != nil {
+			db.pager.Rollback()
+		}
+	}()
+	defer recoverPageError(&err)
+
+	tree := db.pager.Tree()
+	n, err = tree.BulkLoad(fill, func() ([]byte, []byte, bool, error) {
+		key, val, ok, err := next()
+		if err == nil && ok {
+			err = checkUserKey(key)
+		}
+		return key, val, ok, err
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := db.pager.Commit(tree.Root()); err != nil {
+		return n, err
+	}
+	if len(db.active) > 0 {
+		// Too many keys to list; running transactions that read anything conflict
+		db.commits = append(db.commits, committedWrites{seq: db.pager.Meta().Seq, all: true})
+	}
+	db.committed()
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package kv
+
+import (
+	"database-go/pkg/pager"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+/*
+Write the last commit to a new file at path, compacted: every page packed full, no
+free pages and no history, just the one commit. Everything in the store goes across,
+indexes and key versions included. Pages carry checksums like any database file, and
+the file is left read-only (mode 0444), so it can be shipped around and served with
+OpenReadOnly as it is, or copied and made writable to open with Open.
+
+The file is built beside path and renamed into place once complete, so path never
+holds half a checkpoint; it must not exist already. The export reads a snapshot, so
+commits carry on while it runs.
+*/
+func (db *DB) ExportCheckpoint(path string) (err error) {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("kv: checkpoint %s: %w", path, fs.ErrExist)
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	os.Remove(tmp + pager.WAL_SUFFIX)
+	p, err := pager.Open(tmp, snap.meta.Options)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p != nil {
+			p.Close()
+		}
+		os.Remove(tmp + pager.WAL_SUFFIX)
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	// Every pair in key order, reserved ones too, skipping the tree's empty sentinel key
+	c := snap.tree.NewCursor()
+	move := func() error { return c.Seek(nil) }
+	next := func() ([]byte, []byte, bool, error) {
+		key, val, err := snap.step(move, c)
+		move = c.Next
+		if err == nil && key != nil && len(key) == 0 {
+			key, val, err = snap.step(move, c)
+		}
+		return key, val, key != nil, err
+	}
+	err = func() (err error) {
+		defer recoverPageError(&err)
+		tree := p.Tree()
+		if _, err := tree.BulkLoad(1, next); err != nil {
+			return err
+		}
+		return p.Commit(tree.Root())
+	}()
+	if err != nil {
+		return err
+	}
+	cerr := p.Close()
+	p = nil
+	if cerr != nil {
+		return cerr
+	}
+	if err := os.Chmod(tmp, 0444); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,104 @@
+package kv
+
+import (
+	"database-go/pkg/btree"
+)
+
+/*
+Compare the user keys of two snapshots, calling fn in key order for every key that
+differs from s to other: a is nil for a key only other has, and b for one only s
+has. Stops early if fn returns an error, returning that error. The key and values
+passed to fn are copies the caller may keep.
+
+The snapshots may come from different handles, even different files, such as a
+replica or a backup and the original. Two snapshots of one handle share the pages of
+everything not written between them, and only the parts that changed are read;
+across files only leaves holding exactly the same pairs are skipped without
+comparing them key by key, so the whole of both files gets read.
+
+Like a scan, the database locks are only held for one page read at a time.
+*/
+func (s *Snapshot) Diff(other *Snapshot, fn func(kind btree.DiffKind, key, a, b []byte) error) error {
+	if err := s.lockedCheck(); err != nil {
+		return err
+	}
+	if err := other.lockedCheck(); err != nil {
+		return err
+	}
+
+	err := func() (err error) {
+		defer recoverPageError(&err)
+		return btree.Diff(s.lockedTree(), other.lockedTree(), userKeysStart(), s.db == other.db,
+			func(kind btree.DiffKind, key, a, b []byte) error {
+				if a != nil {
+					a = append([]byte{}, a...)
+				}
+				if b != nil {
+					b = append([]byte{}, b...)
+				}
+				return fn(kind, append([]byte{}, key...), a, b)
+			})
+	}()
+	for _, snap := range []*Snapshot{s, other} {
+		if serr := snap.lockedStale(); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// Diff between two versions kept by the handle, as SnapshotAt sees them.
+func (db *DB) Diff(from, to uint64, fn func(kind btree.DiffKind, key, a, b []byte) error) error {
+	a, err := db.SnapshotAt(from)
+	if err != nil {
+		return err
+	}
+	defer a.Release()
+	b, err := db.SnapshotAt(to)
+	if err != nil {
+		return err
+	}
+	defer b.Release()
+	return a.Diff(b, fn)
+}
+
+func (s *Snapshot) lockedCheck() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.check()
+}
+
+// The snapshot's tree, taking the database lock for each page read.
+func (s *Snapshot) lockedTree() *btree.BTree {
+	get := func(ptr uint64) []byte {
+		s.db.mu.Lock()
+		defer s.db.mu.Unlock()
+		if err := s.check(); err != nil {
+			panic(err)
+		}
+		return s.db.pager.PageGet(ptr)
+	}
+	// The options were validated when the file was opened
+	tree, _ := btree.NewBTree(s.meta.Root, s.meta.Options, get, nil, nil)
+	return tree
+}
+
+// ErrStale if the writer has moved on over the snapshot's pages; see read.
+func (s *Snapshot) lockedStale() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return err
+	}
+	if !s.db.pager.ReadOnly() {
+		return nil
+	}
+	stale, err := s.db.pager.Stale(s.meta)
+	if err != nil {
+		return err
+	}
+	if stale {
+		return ErrStale
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package kv
+
+import (
+	"bufio"
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+/*
+A dump is the whole store as a stream of records, independent of the page layout,
+so it can be restored into a file with different options, kept as a backup or
+compared with another. The layout:
+
+	| "kvdump" | format version (2) | record... | end record | crc32 (4) |
+
+A record is its type byte followed by its fields, each a uvarint length and the
+bytes. Records come in key order of what they stand for, the reserved part of the
+key space first, so Restore can stream them straight into a new tree:
+
+	DUMP_INDEX_ENTRY   index name, indexed value, key
+	DUMP_INDEX_DEF     index name
+	DUMP_KEY_VERSION   key, for a file with key versions
+	DUMP_KEY_VERSIONS  no fields; key versions are on
+	DUMP_PAIR          key, value
+
+and the end record holds the number of records before it, followed by the crc32 of
+everything before the checksum. Tables (see pkg/table) keep their definitions in
+ordinary pairs, so a dump includes them without anything special. Numbers are
+little-endian.
+*/
+const (
+	DUMP_MAGIC   = "kvdump"
+	DUMP_VERSION = 1
+
+	DUMP_INDEX_ENTRY  = 'e'
+	DUMP_INDEX_DEF    = 'i'
+	DUMP_KEY_VERSION  = 'v'
+	DUMP_KEY_VERSIONS = 'V'
+	DUMP_PAIR         = 'p'
+	DUMP_END          = 'z'
+)
+
+// Returned by Restore for a stream that isn't a dump it can read, or is damaged
+var ErrBadDump = errors.New("kv: bad dump")
+
+/*
+Write the last commit to w as a dump. It reads a snapshot, so commits carry on
+while it runs, and the database lock is only held for one step at a time.
+*/
+func (db *DB) Dump(w io.Writer) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	d := &dumpWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	d.write([]byte(DUMP_MAGIC))
+	d.write(binary.LittleEndian.AppendUint16(nil, DUMP_VERSION))
+
+	c := snap.tree.NewCursor()
+	move := func() error { return c.Seek(nil) }
+	for {
+		key, val, err := snap.step(move, c)
+		move = c.Next
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+		if len(key) == 0 {
+			// The tree's sentinel
+			continue
+		}
+		typ, fields, err := dumpRecord(key, val)
+		if err != nil {
+			return err
+		}
+		d.record(typ, fields...)
+	}
+
+	d.write([]byte{DUMP_END})
+	d.write(binary.AppendUvarint(nil, uint64(d.n)))
+	d.write(binary.LittleEndian.AppendUint32(nil, d.crc.Sum32()))
+	if d.err != nil {
+		return d.err
+	}
+	return d.w.Flush()
+}
+
+// The record for a pair of the tree.
+func dumpRecord(key, val []byte) (byte, [][]byte, error) {
+	if key[0] != RESERVED_PREFIX {
+		return DUMP_PAIR, [][]byte{key, val}, nil
+	}
+	bad := fmt.Errorf("%w: reserved key %q not known to dump", btree.ErrNodeCorrupt, key)
+	t, err := keys.Unpack(key[1:])
+	if err != nil || len(t) == 0 {
+		return 0, nil, bad
+	}
+	kind, _ := t[0].(string)
+	switch {
+	case kind == "index" && len(t) == 4:
+		name, ok1 := t[1].(string)
+		v, ok2 := t[2].([]byte)
+		k, ok3 := t[3].([]byte)
+		if ok1 && ok2 && ok3 {
+			return DUMP_INDEX_ENTRY, [][]byte{[]byte(name), v, k}, nil
+		}
+	case kind == "indexdef" && len(t) == 2:
+		if name, ok := t[1].(string); ok {
+			return DUMP_INDEX_DEF, [][]byte{[]byte(name)}, nil
+		}
+	case kind == "keyversion" && len(t) == 2:
+		if k, ok := t[1].([]byte); ok {
+			return DUMP_KEY_VERSION, [][]byte{k}, nil
+		}
+	case kind == "keyversions" && len(t) == 1:
+		return DUMP_KEY_VERSIONS, nil, nil
+	}
+	return 0, nil, bad
+}
+
+// Writes a dump, keeping the first error, the checksum and the number of records.
+type dumpWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	n   int
+	err error
+}
+
+func (d *dumpWriter) write(b []byte) {
+	if d.err != nil {
+		return
+	}
+	d.crc.Write(b)
+	_, d.err = d.w.Write(b)
+}
+
+func (d *dumpWriter) record(typ byte, fields ...[]byte) {
+	d.write([]byte{typ})
+	for _, f := range fields {
+		d.write(binary.AppendUvarint(nil, uint64(len(f))))
+		d.write(f)
+	}
+	d.n++
+}
+
+/*
+Load a dump written by Dump into an empty database, which may have different tree
+options, such as a bigger page size, from the one it was taken from. The database
+must be new, as for BulkLoad. Everything goes in as one commit, with pages packed
+to btree.DEFAULT_BULK_FILL, and only once the whole dump has been read and its
+checksum found to match, so a damaged or truncated dump leaves the database empty.
+
+Index definitions and entries are restored as they were; the index functions have
+to be registered with CreateIndex after Restore as after Open. Key versions stay on
+if they were, but every key gets the version of the restoring commit, since a key's
+version has to keep going up within a file and this file's commits started over.
+
+The database is locked for the whole restore, including reading r.
+*/
+func (db *DB) Restore(r io.Reader) (err error) {
+	d := &dumpReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	if err := d.header(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		return ErrReadOnly
+	}
+	if err := db.waitForWriter(nil); err != nil {
+		return err
+	}
+	if db.tree.Root() != 0 {
+		return ErrNotEmpty
+	}
+
+	defer func() {
+		if err != nil {
+			db.pager.Rollback()
+		}
+	}()
+	defer recoverPageError(&err)
+
+	tree := db.pager.Tree()
+	d.limit = tree.Options().MaxValSize
+	version := db.nextKeyVersion()
+	defs := map[string]struct{}{}
+	keyVersions := false
+	_, err = tree.BulkLoad(0, func() (key, val []byte, ok bool, err error) {
+		typ, fields, err := d.next()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		switch typ {
+		case DUMP_END:
+			return nil, nil, false, nil
+		case DUMP_INDEX_ENTRY:
+			key = indexEntryKey(string(fields[0]), fields[1], fields[2])
+		case DUMP_INDEX_DEF:
+			key = indexDefKey(string(fields[0]))
+			defs[string(fields[0])] = struct{}{}
+		case DUMP_KEY_VERSION:
+			key, val = keyVersionKey(fields[0]), version
+		case DUMP_KEY_VERSIONS:
+			key = keyVersionsDefKey()
+			keyVersions = true
+		case DUMP_PAIR:
+			if err := checkUserKey(fields[0]); err != nil {
+				return nil, nil, false, fmt.Errorf("%w: %v", ErrBadDump, err)
+			}
+			key, val = fields[0], fields[1]
+		}
+		return key, val, true, nil
+	})
+	if errors.Is(err, btree.ErrUnsorted) {
+		err = fmt.Errorf("%w: %v", ErrBadDump, err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.end(); err != nil {
+		return err
+	}
+
+	if err := db.pager.Commit(tree.Root()); err != nil {
+		return err
+	}
+	if len(db.active) > 0 {
+		db.commits = append(db.commits, committedWrites{seq: db.pager.Meta().Seq, all: true})
+	}
+	db.committed()
+	db.indexDefs = defs
+	db.keyVersions = keyVersions
+	return nil
+}
+
+// Reads a dump record by record, checking it as it goes.
+type dumpReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	n   int
+	// Longest field accepted, so a damaged length can't ask for any amount of memory
+	limit int
+}
+
+func (d *dumpReader) read(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, d.eof(err)
+	}
+	d.crc.Write(b)
+	return b, nil
+}
+
+func (d *dumpReader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, d.eof(err)
+	}
+	d.crc.Write(binary.AppendUvarint(nil, v))
+	return v, nil
+}
+
+// A dump ending early is damaged, not finished.
+func (d *dumpReader) eof(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrBadDump)
+	}
+	return err
+}
+
+func (d *dumpReader) header() error {
+	b, err := d.read(len(DUMP_MAGIC) + 2)
+	if err != nil {
+		return err
+	}
+	if string(b[:len(DUMP_MAGIC)]) != DUMP_MAGIC {
+		return fmt.Errorf("%w: not a dump", ErrBadDump)
+	}
+	if v := binary.LittleEndian.Uint16(b[len(DUMP_MAGIC):]); v != DUMP_VERSION {
+		return fmt.Errorf("%w: format version %d, expected %d", ErrBadDump, v, DUMP_VERSION)
+	}
+	return nil
+}
+
+// The next record; DUMP_END has no fields, and is followed by a call to end.
+func (d *dumpReader) next() (byte, [][]byte, error) {
+	t, err := d.read(1)
+	if err != nil {
+		return 0, nil, err
+	}
+	typ := t[0]
+	nfields := 0
+	switch typ {
+	case DUMP_END:
+		return typ, nil, nil
+	case DUMP_INDEX_ENTRY:
+		nfields = 3
+	case DUMP_INDEX_DEF, DUMP_KEY_VERSION:
+		nfields = 1
+	case DUMP_KEY_VERSIONS:
+	case DUMP_PAIR:
+		nfields = 2
+	default:
+		return 0, nil, fmt.Errorf("%w: unknown record type %q", ErrBadDump, typ)
+	}
+
+	fields := make([][]byte, nfields)
+	for i := range fields {
+		n, err := d.uvarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		if n > uint64(d.limit) {
+			return 0, nil, fmt.Errorf("%w: %d byte field", ErrBadDump, n)
+		}
+		if fields[i], err = d.read(int(n)); err != nil {
+			return 0, nil, err
+		}
+	}
+	d.n++
+	return typ, fields, nil
+}
+
+// Check the end record's count and the checksum, and that nothing follows.
+func (d *dumpReader) end() error {
+	n, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	if n != uint64(d.n) {
+		return fmt.Errorf("%w: %d records, end says %d", ErrBadDump, d.n, n)
+	}
+	sum := d.crc.Sum32()
+	var b [4]byte
+	if _, err := io.ReadFull(d.r, b[:]); err != nil {
+		return d.eof(err)
+	}
+	if binary.LittleEndian.Uint32(b[:]) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadDump)
+	}
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: data after the end", ErrBadDump)
+	}
+	return nil
+}
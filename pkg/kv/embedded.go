@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"bytes"
+	"database-go/pkg/pager"
+	"io"
+	"io/fs"
+)
+
+/*
+Datasets can ship inside a program, say as a checkpoint (see ExportCheckpoint)
+included with go:embed, and be queried where they are without writing them out to
+disk first:
+
+	//go:embed cities.db
+	var data embed.FS
+
+	db, err := kv.OpenFS(data, "cities.db")
+
+These handles are read-only like those from OpenReadOnly.
+*/
+
+// Open a database held by r for reading only. Close closes r if it is an io.Closer.
+func OpenReaderAt(r io.ReaderAt) (*DB, error) {
+	p, err := pager.OpenReaderAt(r)
+	if err != nil {
+		return nil, err
+	}
+	return openReadOnly(p), nil
+}
+
+/*
+Open the database file name in fsys for reading only. Files from embed.FS, and
+others that implement io.ReaderAt, are read in place; any other file is read into
+memory first.
+*/
+func OpenFS(fsys fs.FS, name string) (*DB, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := f.(io.ReaderAt); ok {
+		db, err := OpenReaderAt(r)
+		if err != nil {
+			f.Close()
+		}
+		return db, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return OpenReaderAt(bytes.NewReader(data))
+}
@@ -0,0 +1,333 @@
+package kv
+
+import (
+	"bytes"
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrNoIndex     = errors.New("kv: no such index")
+	ErrIndexExists = errors.New("kv: index is already registered")
+	// The file has an index this handle hasn't registered, so writes would leave it out of date
+	ErrIndexNotRegistered = errors.New("kv: index must be registered with CreateIndex before writing")
+)
+
+/*
+Extracts the values a pair is indexed under; a pair can have any number, including
+none. It must be deterministic, since it is called again on the old value to find
+the entries to remove when the pair changes.
+*/
+type IndexFunc func(key, val []byte) [][]byte
+
+/*
+Secondary indexes live in the reserved part of the key space, next to the data.
+Each indexed value of a pair gets an entry whose key packs the index name, the value
+and the primary key, so all the primary keys for one value are a contiguous range:
+
+	reserved | ("index", name, value, primary key)  ->  empty
+	reserved | ("indexdef", name)                    ->  empty
+
+Entries are updated by the same commit as the pair, against the latest state rather
+than the one the transaction read, so concurrent transactions never leave them
+behind. The index functions themselves can't be stored, so every handle that writes
+has to register all the file's indexes again after Open.
+*/
+
+func indexEntryKey(name string, val, key []byte) []byte {
+	return internalKey(keys.Tuple{"index", name, val, key})
+}
+
+func indexDefKey(name string) []byte {
+	return internalKey(keys.Tuple{"indexdef", name})
+}
+
+/*
+Register an index under name. If the file doesn't have it yet it is built from the
+existing pairs and committed; otherwise it is assumed to have been built with the
+same fn, and only registered.
+*/
+func (db *DB) CreateIndex(name string, fn IndexFunc) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		return ErrReadOnly
+	}
+	if err := db.waitForWriter(nil); err != nil {
+		return err
+	}
+	if _, ok := db.indexes[name]; ok {
+		return fmt.Errorf("%w: %s", ErrIndexExists, name)
+	}
+	if _, ok := db.indexDefs[name]; ok {
+		db.indexes[name] = fn
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			db.pager.Rollback()
+		}
+	}()
+	defer recoverPageError(&err)
+
+	// Read the committed tree while writing the new entries into a copy of it
+	committed := db.pager.TreeAt(db.pager.Meta())
+	tree := db.pager.Tree()
+	err = scanTree(committed, userKeysStart(), nil, func(key, val []byte) error {
+		for _, v := range fn(key, val) {
+			if err := tree.Insert(indexEntryKey(name, v, key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tree.Insert(indexDefKey(name), nil); err != nil {
+		return err
+	}
+	if err := db.pager.Commit(tree.Root()); err != nil {
+		return err
+	}
+	db.committed()
+	db.indexes[name] = fn
+	db.indexDefs[name] = struct{}{}
+	return nil
+}
+
+// Remove an index and all its entries from the file.
+func (db *DB) DropIndex(name string) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		return ErrReadOnly
+	}
+	if err := db.waitForWriter(nil); err != nil {
+		return err
+	}
+	if _, ok := db.indexDefs[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoIndex, name)
+	}
+
+	defer func() {
+		if err != nil {
+			db.pager.Rollback()
+		}
+	}()
+	defer recoverPageError(&err)
+
+	committed := db.pager.TreeAt(db.pager.Meta())
+	tree := db.pager.Tree()
+	begin, end := internalRange(keys.Tuple{"index", name})
+	err = scanTree(committed, begin, end, func(key, _ []byte) error {
+		_, err := tree.Delete(key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tree.Delete(indexDefKey(name)); err != nil {
+		return err
+	}
+	if err := db.pager.Commit(tree.Root()); err != nil {
+		return err
+	}
+	db.committed()
+	delete(db.indexes, name)
+	delete(db.indexDefs, name)
+	return nil
+}
+
+// The primary keys indexed under val, in order.
+func (db *DB) Lookup(name string, val []byte) (pks [][]byte, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		err = db.readLatest(func() error {
+			pks, err = lookupIn(db.tree, name, val)
+			return err
+		})
+		return pks, err
+	}
+	return lookupIn(db.tree, name, val)
+}
+
+// The primary keys indexed under val as of the snapshot.
+func (s *Snapshot) Lookup(name string, val []byte) (pks [][]byte, err error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	err = s.read(func() (err error) {
+		pks, err = lookupIn(s.tree, name, val)
+		return err
+	})
+	return pks, err
+}
+
+func lookupIn(tree *btree.BTree, name string, val []byte) (pks [][]byte, err error) {
+	if _, err := getFrom(tree, indexDefKey(name)); err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNoIndex, name)
+		}
+		return nil, err
+	}
+
+	begin, end := internalRange(keys.Tuple{"index", name, val})
+	err = scanTree(tree, begin, end, func(key, _ []byte) error {
+		t, err := keys.Unpack(key[1:])
+		if err != nil || len(t) != 4 {
+			return fmt.Errorf("%w: bad index entry %q", btree.ErrNodeCorrupt, key)
+		}
+		pk, ok := t[3].([]byte)
+		if !ok {
+			return fmt.Errorf("%w: bad index entry %q", btree.ErrNodeCorrupt, key)
+		}
+		pks = append(pks, pk)
+		return nil
+	})
+	return pks, err
+}
+
+// Names of the indexes recorded in the tree.
+func loadIndexDefs(tree *btree.BTree) (map[string]struct{}, error) {
+	defs := map[string]struct{}{}
+	begin, end := internalRange(keys.Tuple{"indexdef"})
+	err := scanTree(tree, begin, end, func(key, _ []byte) error {
+		t, err := keys.Unpack(key[1:])
+		if err != nil || len(t) != 2 {
+			return fmt.Errorf("%w: bad index definition %q", btree.ErrNodeCorrupt, key)
+		}
+		name, ok := t[1].(string)
+		if !ok {
+			return fmt.Errorf("%w: bad index definition %q", btree.ErrNodeCorrupt, key)
+		}
+		defs[name] = struct{}{}
+		return nil
+	})
+	return defs, err
+}
+
+// Check key against the limits of the tree, including the index entries val would add and its version.
+func (db *DB) checkIndexLimits(tree *btree.BTree, key, val []byte) error {
+	if db.keyVersions {
+		if err := tree.CheckLimit(keyVersionKey(key), nil); err != nil {
+			return fmt.Errorf("version: %w", err)
+		}
+	}
+	for name, fn := range db.indexes {
+		for _, v := range fn(key, val) {
+			if err := tree.CheckLimit(indexEntryKey(name, v, key), nil); err != nil {
+				return fmt.Errorf("index %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Write pairs to tree along with their index entries and versions, removing the
+entries of the values they replace. keys are sorted, and a nil value deletes its key.
+Deletes go one at a time, then everything written goes in with one InsertBatch.
+*/
+func (db *DB) applyWrites(tree *btree.BTree, keys []string, writes map[string]*[]byte) error {
+	if len(db.indexes) < len(db.indexDefs) {
+		return ErrIndexNotRegistered
+	}
+
+	var dels [][]byte
+	var batch []pair
+	names := sortedNames(db.indexes)
+	for _, k := range keys {
+		key, val := []byte(k), writes[k]
+		if len(db.indexes) > 0 {
+			old, err := getFrom(tree, key)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+			if err == nil {
+				for _, name := range names {
+					for _, v := range db.indexes[name](key, old) {
+						dels = append(dels, indexEntryKey(name, v, key))
+					}
+				}
+			}
+		}
+		if db.keyVersions {
+			if val == nil {
+				dels = append(dels, keyVersionKey(key))
+			} else {
+				batch = append(batch, pair{keyVersionKey(key), db.nextKeyVersion()})
+			}
+		}
+		if val == nil {
+			dels = append(dels, key)
+			continue
+		}
+		batch = append(batch, pair{key, *val})
+		for _, name := range names {
+			for _, v := range db.indexes[name](key, *val) {
+				batch = append(batch, pair{indexEntryKey(name, v, key), nil})
+			}
+		}
+	}
+
+	// An index entry of the old value that the new one has too is deleted, then put back
+	for _, key := range dels {
+		if _, err := tree.Delete(key); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(batch, func(i, j int) bool {
+		return bytes.Compare(batch[i].key, batch[j].key) < 0
+	})
+	bkeys, bvals := make([][]byte, len(batch)), make([][]byte, len(batch))
+	for i, p := range batch {
+		bkeys[i], bvals[i] = p.key, p.val
+	}
+	return tree.InsertBatch(bkeys, bvals)
+}
+
+type pair struct {
+	key, val []byte
+}
+
+func sortedNames(indexes map[string]IndexFunc) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Call fn on every pair of tree in [begin, end), or to the end if end is nil.
+func scanTree(tree *btree.BTree, begin, end []byte, fn func(key, val []byte) error) (err error) {
+	defer recoverPageError(&err)
+
+	c := tree.NewCursor()
+	for err = c.Seek(begin); err == nil && c.Valid(); err = c.Next() {
+		if end != nil && bytes.Compare(c.Key(), end) >= 0 {
+			return nil
+		}
+		if err := fn(c.Key(), c.Value()); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+How much a transaction is protected from the ones running alongside it. Each level
+allows anomalies the ones after it in this list don't:
+
+  - ISOLATION_READ_COMMITTED: every read sees the latest commit, so reading a key
+    twice can give two answers (non-repeatable reads), and a scan only sees one
+    commit throughout but the next read may see another. Nothing is checked at
+    Commit, so two transactions incrementing a counter can lose an update. Checks
+    made by SetIfVersion and DelIfVersion only hold as of when they ran.
+  - ISOLATION_SNAPSHOT: every read sees the commit the transaction began at.
+    Commit fails with ErrConflict if a concurrent commit wrote any key this one
+    writes (first committer wins), so no updates are lost. Two transactions that
+    read each other's keys and write disjoint ones can both commit though (write
+    skew): each checks "at least one doctor stays on call", then takes a different
+    doctor off.
+  - ISOLATION_SERIALIZABLE, the default: a snapshot, first committer wins, and Commit
+    also fails if the reads of the transactions running with it leave no serial order
+    for them all (see ssi.go). That rules out write skew, and phantoms: inserting a
+    key into a range another transaction scanned counts as changing what it read.
+  - ISOLATION_SINGLE_WRITER: serializable by exclusion rather than validation.
+    Begin waits until no other single-writer transaction is running, and while one
+    is, every other commit on the DB waits for it to finish. It reads the latest
+    commit and never gets ErrConflict. Don't write through the DB from the goroutine
+    holding one; the write would wait for the transaction, forever.
+*/
+type IsolationLevel int
+
+const (
+	ISOLATION_SERIALIZABLE IsolationLevel = iota
+	ISOLATION_SNAPSHOT
+	ISOLATION_READ_COMMITTED
+	ISOLATION_SINGLE_WRITER
+)
+
+func (l IsolationLevel) String() string {
+	switch l {
+	case ISOLATION_SERIALIZABLE:
+		return "serializable"
+	case ISOLATION_SNAPSHOT:
+		return "snapshot"
+	case ISOLATION_READ_COMMITTED:
+		return "read committed"
+	case ISOLATION_SINGLE_WRITER:
+		return "single writer"
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", int(l))
+}
+
+// Start a transaction at the given isolation level.
+func (db *DB) BeginLevel(level IsolationLevel) (*Tx, error) {
+	if level < ISOLATION_SERIALIZABLE || level > ISOLATION_SINGLE_WRITER {
+		return nil, fmt.Errorf("kv: unknown isolation level %d", int(level))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	if level == ISOLATION_SINGLE_WRITER {
+		if err := db.waitForWriter(nil); err != nil {
+			return nil, err
+		}
+	}
+
+	start := db.pager.Acquire()
+	db.active[start.Seq]++
+	tx := &Tx{
+		db:     db,
+		level:  level,
+		start:  start,
+		tree:   db.pager.TreeAt(start),
+		writes: map[string]*[]byte{},
+		reads:  map[string]struct{}{},
+	}
+	if level == ISOLATION_SINGLE_WRITER {
+		db.writer = tx
+	}
+	if tx.ssi() {
+		db.clock++
+		tx.begun = db.clock
+		db.running[tx] = struct{}{}
+	}
+	return tx, nil
+}
+
+// Update at the given isolation level, retrying on ErrConflict.
+func (db *DB) UpdateLevel(level IsolationLevel, change func(tx *Tx) error) (uint64, error) {
+	for {
+		tx, err := db.BeginLevel(level)
+		if err != nil {
+			return 0, err
+		}
+		err = change(tx)
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if err == nil {
+			return tx.Version(), nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return 0, err
+		}
+	}
+}
+
+// The isolation level the transaction was started with.
+func (tx *Tx) Level() IsolationLevel {
+	return tx.level
+}
+
+/*
+Wait until no single-writer transaction other than tx is running, so a commit can go
+ahead. Called with db.mu held, which is released while waiting.
+*/
+func (db *DB) waitForWriter(tx *Tx) error {
+	for db.writer != nil && db.writer != tx {
+		db.writerDone.Wait()
+		if db.pager == nil {
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// Move a read-committed transaction up to the latest commit. Called with db.mu held.
+func (tx *Tx) refresh() {
+	if tx.level != ISOLATION_READ_COMMITTED || tx.start.Seq == tx.db.pager.Meta().Seq {
+		return
+	}
+	tx.unpin()
+	tx.start = tx.db.pager.Acquire()
+	tx.db.active[tx.start.Seq]++
+	tx.tree = tx.db.pager.TreeAt(tx.start)
+}
@@ -0,0 +1,214 @@
+package kv
+
+import (
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"errors"
+	"fmt"
+)
+
+var (
+	// Returned by SetIfVersion when the key was written after the version the caller read
+	ErrVersionMismatch = errors.New("kv: key has been written since the expected version")
+	ErrNoKeyVersions   = errors.New("kv: key versions are not enabled for this file")
+)
+
+/*
+With Options.KeyVersions, every key carries the version of the commit that last
+wrote it, so a key's version only ever goes up, and doubles as an ETag. GetWithVersion returns it and SetIfVersion only writes if it hasn't
+changed, so two clients doing read-modify-write with bare Get and Set can't silently
+overwrite each other's updates. The versions are kept in the reserved part of the
+key space and written by the same commit as the key:
+
+	reserved | ("keyversion", key)  ->  (commit sequence)
+	reserved | ("keyversions")       ->  empty, once turned on
+
+Once turned on for a file it stays on, for every handle that writes to it.
+*/
+
+func keyVersionKey(key []byte) []byte {
+	return internalKey(keys.Tuple{"keyversion", key})
+}
+
+func keyVersionsDefKey() []byte {
+	return internalKey(keys.Tuple{"keyversions"})
+}
+
+// Look up key along with its version.
+func (db *DB) GetWithVersion(key []byte) (val []byte, version uint64, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, 0, ErrClosed
+	}
+	if err := checkUserKey(key); err != nil {
+		return nil, 0, err
+	}
+	get := func() error {
+		if _, err := getFrom(db.tree, keyVersionsDefKey()); errors.Is(err, ErrKeyNotFound) {
+			return ErrNoKeyVersions
+		}
+		if val, err = getFrom(db.tree, key); err != nil {
+			return err
+		}
+		version, err = versionIn(db.tree, key)
+		return err
+	}
+	if db.pager.ReadOnly() {
+		err = db.readLatest(get)
+	} else {
+		err = get()
+	}
+	return val, version, err
+}
+
+/*
+Store val under key if it is still at the version expected, as returned by
+GetWithVersion; 0 means the key must not exist. Returns its new version, or
+ErrVersionMismatch if it was written in the meantime.
+*/
+func (db *DB) SetIfVersion(key, val []byte, expected uint64) (uint64, error) {
+	return db.Update(func(tx *Tx) error {
+		return tx.SetIfVersion(key, val, expected)
+	})
+}
+
+// Remove key if it is still at the version expected. Returns the version of the commit.
+func (db *DB) DelIfVersion(key []byte, expected uint64) (uint64, error) {
+	return db.Update(func(tx *Tx) error {
+		return tx.DelIfVersion(key, expected)
+	})
+}
+
+/*
+Look up key along with its version as of the commit the transaction reads. For a key
+the transaction has written, the value is its own but the version is still the
+committed one, since its own write doesn't have a version until it commits.
+*/
+func (tx *Tx) GetWithVersion(key []byte) (val []byte, version uint64, err error) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return nil, 0, err
+	}
+	if err := checkUserKey(key); err != nil {
+		return nil, 0, err
+	}
+	if !tx.db.keyVersions {
+		return nil, 0, ErrNoKeyVersions
+	}
+	defer tx.traced()()
+	if val, err = tx.get(key); err != nil {
+		return nil, 0, err
+	}
+	version, err = versionIn(tx.tree, key)
+	return val, version, err
+}
+
+/*
+Store val under key if it is at the version expected, as of the commit the
+transaction reads. The check counts as a read, so if another commit writes the key
+before this one, Commit returns ErrConflict, and running the transaction again
+gives ErrVersionMismatch.
+*/
+func (tx *Tx) SetIfVersion(key, val []byte, expected uint64) error {
+	if err := tx.checkVersion(key, expected); err != nil {
+		return err
+	}
+	return tx.Set(key, val)
+}
+
+// Remove key if it is at the version expected; see SetIfVersion.
+func (tx *Tx) DelIfVersion(key []byte, expected uint64) error {
+	if err := tx.checkVersion(key, expected); err != nil {
+		return err
+	}
+	_, err := tx.Del(key)
+	return err
+}
+
+// Check key hasn't been written since version expected, recording it as read.
+func (tx *Tx) checkVersion(key []byte, expected uint64) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if !tx.db.keyVersions {
+		return ErrNoKeyVersions
+	}
+	if _, ok := tx.writes[string(key)]; ok {
+		// Its version will be that of this commit, which nobody can have read yet
+		return fmt.Errorf("%w: %q was written by this transaction", ErrVersionMismatch, key)
+	}
+
+	// Reading the key makes a concurrent write to it conflict
+	if _, err := tx.get(key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	version, err := versionIn(tx.tree, key)
+	if err != nil {
+		return err
+	}
+	if version != expected {
+		return fmt.Errorf("%w: %q is at version %d, not %d", ErrVersionMismatch, key, version, expected)
+	}
+	return nil
+}
+
+// The version of key in tree, or 0 if it isn't there.
+func versionIn(tree *btree.BTree, key []byte) (uint64, error) {
+	packed, err := getFrom(tree, keyVersionKey(key))
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	t, err := keys.Unpack(packed)
+	if err == nil && len(t) == 1 {
+		switch v := t[0].(type) {
+		case int64:
+			return uint64(v), nil
+		case uint64:
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: bad version of %q", btree.ErrNodeCorrupt, key)
+}
+
+// The version of a key written by the commit being made.
+func (db *DB) nextKeyVersion() []byte {
+	return keys.MustPack(keys.Tuple{db.pager.Meta().Seq + 1})
+}
+
+// Turn key versions on for the file, giving every existing key the version of this commit.
+func (db *DB) enableKeyVersions() (err error) {
+	defer func() {
+		if err != nil {
+			db.pager.Rollback()
+		}
+	}()
+	defer recoverPageError(&err)
+
+	committed := db.pager.TreeAt(db.pager.Meta())
+	tree := db.pager.Tree()
+	err = scanTree(committed, userKeysStart(), nil, func(key, _ []byte) error {
+		return tree.Insert(keyVersionKey(key), db.nextKeyVersion())
+	})
+	if err != nil {
+		return err
+	}
+	if err := tree.Insert(keyVersionsDefKey(), nil); err != nil {
+		return err
+	}
+	if err := db.pager.Commit(tree.Root()); err != nil {
+		return err
+	}
+	db.committed()
+	db.keyVersions = true
+	return nil
+}
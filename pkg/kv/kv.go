@@ -0,0 +1,315 @@
+package kv
+
+import (
+	"context"
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"database-go/pkg/pager"
+	"database-go/pkg/wal"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// Returned by Get for a key that isn't in the database
+	ErrKeyNotFound = btree.ErrKeyNotFound
+	ErrClosed      = errors.New("kv: database is closed")
+	// Returned by every write to a handle from OpenReadOnly
+	ErrReadOnly = errors.New("kv: database is opened read-only")
+	// A read-only handle couldn't read a consistent commit because the writer kept overwriting it
+	ErrStale       = errors.New("kv: commit was overwritten while reading it")
+	ErrReservedKey = errors.New("kv: keys starting with 0x00 are reserved")
+	// Returned by Insert for a nil key when Options.AutoKey isn't set
+	ErrNoAutoKey = errors.New("kv: no key given and no AutoKey generator set")
+)
+
+const (
+	// Times a read through a read-only handle is retried against newer commits
+	MAX_READ_ATTEMPTS = 16
+
+	// Keys starting with this byte belong to the store itself, for index entries and the like
+	RESERVED_PREFIX = 0x00
+)
+
+/*
+A key-value store in a single file. Keys are kept sorted in a copy-on-write B+tree,
+and every Set and Del is committed to disk before it returns. Use Begin to apply
+several changes atomically; any number of transactions can run concurrently.
+
+A DB is safe for use from multiple goroutines.
+*/
+type DB struct {
+	// Guards everything below; held for single operations
+	mu    sync.Mutex
+	pager *pager.Pager
+	// The committed tree
+	tree *btree.BTree
+
+	// Running transactions, counted by the commit they began at
+	active map[uint64]int
+	// Keys written by commits since the oldest running transaction began
+	commits []committedWrites
+	// Serializable transactions running, and finished ones that one of them overlapped,
+	// in the order they finished
+	running  map[*Tx]struct{}
+	finished []*Tx
+	// Ticks at every serializable Begin and finish, to tell which overlapped
+	clock uint64
+
+	// Indexes registered on this handle
+	indexes map[string]IndexFunc
+	// Indexes recorded in the file
+	indexDefs map[string]struct{}
+	// Whether the file tracks key versions
+	keyVersions bool
+	// The running ISOLATION_SINGLE_WRITER transaction, if any; other commits wait for it
+	writer *Tx
+	// Broadcast on db.mu when writer finishes, or the DB is closed
+	writerDone *sync.Cond
+
+	opts Options
+	// Recent commits kept readable through SnapshotAt, oldest first
+	versions []version
+	// Closed to stop the version garbage collector
+	stop chan struct{}
+}
+
+/*
+Open the database at path, creating it if it does not exist.
+The tree options only matter when creating the file, see pager.Open.
+*/
+func Open(path string, opts Options) (*DB, error) {
+	opts = opts.withDefaults()
+	p, err := pager.Open(path, opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	if opts.WALArchive != "" {
+		archive, err := wal.OpenArchive(opts.WALArchive)
+		if err == nil {
+			err = p.SetArchive(archive)
+		}
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	db := &DB{
+		pager:   p,
+		tree:    p.Tree(),
+		opts:    opts,
+		active:  map[uint64]int{},
+		running: map[*Tx]struct{}{},
+		indexes: map[string]IndexFunc{},
+		stop:    make(chan struct{}),
+	}
+	db.writerDone = sync.NewCond(&db.mu)
+	if db.indexDefs, err = loadIndexDefs(db.tree); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if _, err = getFrom(db.tree, keyVersionsDefKey()); err == nil {
+		db.keyVersions = true
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		p.Close()
+		return nil, err
+	}
+	if opts.KeyVersions && !db.keyVersions {
+		if err := db.enableKeyVersions(); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	if opts.RetainFor > 0 {
+		db.retain(time.Now())
+		go db.collect()
+	}
+	return db, nil
+}
+
+/*
+Open a database another handle (in this process or another) is writing, for reading
+only. Each read sees the latest commit in the file at the time; see pager.OpenReadOnly.
+*/
+func OpenReadOnly(path string) (*DB, error) {
+	p, err := pager.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	return openReadOnly(p), nil
+}
+
+func openReadOnly(p *pager.Pager) *DB {
+	db := &DB{pager: p, tree: p.Tree(), stop: make(chan struct{})}
+	db.writerDone = sync.NewCond(&db.mu)
+	return db
+}
+
+// Look up the value stored under key. Returns ErrKeyNotFound if there is none.
+func (db *DB) Get(key []byte) (val []byte, err error) {
+	return db.GetContext(context.Background(), key)
+}
+
+// Get, as part of the request in ctx; see Tx.SetContext.
+func (db *DB) GetContext(ctx context.Context, key []byte) (val []byte, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+	defer db.pager.Trace(ctx)()
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	if db.pager.ReadOnly() {
+		err = db.readLatest(func() error {
+			val, err = getFrom(db.tree, key)
+			return err
+		})
+		return val, err
+	}
+	return getFrom(db.tree, key)
+}
+
+func checkUserKey(key []byte) error {
+	if len(key) > 0 && key[0] == RESERVED_PREFIX {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// The first key that isn't reserved
+func userKeysStart() []byte {
+	return []byte{RESERVED_PREFIX + 1}
+}
+
+// A key in the reserved part of the key space.
+func internalKey(t keys.Tuple) []byte {
+	return append([]byte{RESERVED_PREFIX}, keys.MustPack(t)...)
+}
+
+// The reserved keys that have t as a strict prefix.
+func internalRange(t keys.Tuple) ([]byte, []byte) {
+	begin, end, err := t.Range()
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{RESERVED_PREFIX}, begin...), append([]byte{RESERVED_PREFIX}, end...)
+}
+
+// Look key up in tree, turning a missing key into ErrKeyNotFound.
+func getFrom(tree *btree.BTree, key []byte) (val []byte, err error) {
+	defer recoverPageError(&err)
+
+	val, ok, err := tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+/*
+Run read against the latest commit of a read-only handle, retrying it if the writer
+overwrote pages of that commit in the meantime. Called with db.mu held.
+*/
+func (db *DB) readLatest(read func() error) error {
+	for attempt := 0; attempt < MAX_READ_ATTEMPTS; attempt++ {
+		moved, err := db.pager.Refresh()
+		if err != nil {
+			return err
+		}
+		if moved {
+			db.tree = db.pager.Tree()
+		}
+
+		err = read()
+		stale, serr := db.pager.Stale(db.pager.Meta())
+		if serr != nil {
+			return serr
+		}
+		if !stale {
+			return err
+		}
+	}
+	return ErrStale
+}
+
+// Store val under key, replacing any existing value.
+func (db *DB) Set(key, val []byte) error {
+	_, err := db.Update(func(tx *Tx) error {
+		return tx.Set(key, val)
+	})
+	return err
+}
+
+// Insert in its own transaction; see Tx.Insert.
+func (db *DB) Insert(key, val []byte) ([]byte, error) {
+	if key == nil {
+		var err error
+		if key, err = db.autoKey(); err != nil {
+			return nil, err
+		}
+	}
+	return key, db.Set(key, val)
+}
+
+// A new key as Options.AutoKey says, never one in the reserved range.
+func (db *DB) autoKey() ([]byte, error) {
+	for {
+		id, ok := db.opts.AutoKey.New()
+		if !ok {
+			return nil, ErrNoAutoKey
+		}
+		if id[0] != RESERVED_PREFIX {
+			return id[:], nil
+		}
+	}
+}
+
+// Remove key. Returns whether it was there.
+func (db *DB) Del(key []byte) (bool, error) {
+	var deleted bool
+	_, err := db.Update(func(tx *Tx) (err error) {
+		deleted, err = tx.Del(key)
+		return err
+	})
+	return deleted, err
+}
+
+/*
+Run change in its own transaction and commit it, running it again from the start if
+the commit conflicts. change may be called more than once, so it should have no
+other side effects. Returns the version of the commit, which reads can ask to see
+with BeginAtLeast or SnapshotAtLeast.
+*/
+func (db *DB) Update(change func(tx *Tx) error) (uint64, error) {
+	return db.UpdateLevel(ISOLATION_SERIALIZABLE, change)
+}
+
+// The pager reports I/O errors inside the tree callbacks by panicking with them.
+func recoverPageError(err *error) {
+	if r := recover(); r != nil {
+		perr, ok := r.(error)
+		if !ok {
+			panic(r)
+		}
+		*err = perr
+	}
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return ErrClosed
+	}
+	close(db.stop)
+	err := db.pager.Close()
+	db.pager, db.tree, db.versions = nil, nil, nil
+	db.writerDone.Broadcast()
+	return err
+}
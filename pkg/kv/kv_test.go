@@ -0,0 +1,1796 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"database-go/pkg/pager"
+	"database-go/pkg/wal"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestSetGetDelAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if err := db.Set([]byte(key), []byte("val"+key)); err != nil {
+			t.Fatalf("Set(%s): %v", key, err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		key := fmt.Sprintf("key%04d", i)
+		if ok, err := db.Del([]byte(key)); err != nil || !ok {
+			t.Fatalf("Del(%s) = %v, %v", key, ok, err)
+		}
+	}
+	if ok, err := db.Del([]byte("missing")); err != nil || ok {
+		t.Fatalf("Del(missing) = %v, %v", ok, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		val, err := db.Get([]byte(key))
+		if i%2 == 0 {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Get(%s) = %q, %v, want %v", key, val, err, ErrKeyNotFound)
+			}
+		} else if err != nil || string(val) != "val"+key {
+			t.Errorf("Get(%s) = %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestCorruptPageFailsChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first commit put the only leaf in page 1; flip a bit in the middle of it
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(btree.BTREE_PAGE_SIZE_BYTES + 100)
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x10
+	if _, err := file.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	db, err = Open(path, Options{})
+	if err == nil {
+		defer db.Close()
+		_, err = db.Get([]byte("key"))
+	}
+	if !errors.Is(err, pager.ErrChecksumMismatch) || !strings.Contains(err.Error(), "page 1") {
+		t.Fatalf("reading corrupt page: %v, want %v for page 1", err, pager.ErrChecksumMismatch)
+	}
+}
+
+func TestFailedSetRollsBack(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(nil, []byte("2")); !errors.Is(err, btree.ErrEmptyKey) {
+		t.Fatalf("Set(nil) = %v, want %v", err, btree.ErrEmptyKey)
+	}
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "1" {
+		t.Fatalf("Get(a) = %q, %v", val, err)
+	}
+}
+
+func TestTxCommitAndRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("committed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not visible outside the transaction until it commits
+	if _, err := db.Get([]byte("key0000")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get before commit = %v, want %v", err, ErrKeyNotFound)
+	}
+	if val, err := tx.Get([]byte("key0000")); err != nil || string(val) != "committed" {
+		t.Fatalf("tx.Get = %q, %v", val, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("late"), nil); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("Set after commit = %v, want %v", err, ErrTxDone)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i%2 == 0 {
+			_, err = tx.Del(key)
+		} else {
+			err = tx.Set(key, []byte("rolled back"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Rollback()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if val, err := db.Get(key); err != nil || string(val) != "committed" {
+			t.Fatalf("Get(%s) = %q, %v", key, val, err)
+		}
+	}
+}
+
+func TestTxRangeSeesOwnWrites(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "c", "e", "g"} {
+		if err := db.Set([]byte(key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, key := range []string{"b", "c", "h"} {
+		if err := tx.Set([]byte(key), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Del([]byte("e")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = tx.Range([]byte("b"), []byte("h"), func(key, val []byte) error {
+		got = append(got, string(key)+"="+string(val))
+		// Writes made during the scan don't show up in it
+		return tx.Set([]byte("d"), []byte("during"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[b=new c=new g=old]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Range = %v, want %v", got, want)
+	}
+}
+
+func TestScanAndDeletePrefix(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, ns := range []string{"user:1:", "user:12:", "user:2:"} {
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("%s%03d", ns, i)), []byte(ns)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	count := func(prefix string) int {
+		n := 0
+		err := db.Scan([]byte(prefix), func(key, val []byte) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := count("user:1"); n != 200 {
+		t.Errorf("Scan(user:1) found %d keys, want 200", n)
+	}
+	if n, err := db.DeletePrefix([]byte("user:1:")); err != nil || n != 100 {
+		t.Fatalf("DeletePrefix(user:1:) = %d, %v", n, err)
+	}
+	if n := count("user:1"); n != 100 {
+		t.Errorf("Scan(user:1) after DeletePrefix found %d keys, want 100", n)
+	}
+	if n := count(""); n != 200 {
+		t.Errorf("Scan() found %d keys, want 200", n)
+	}
+}
+
+func TestKeyVersionsDetectLostUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("existing"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.GetWithVersion([]byte("existing")); !errors.Is(err, ErrNoKeyVersions) {
+		t.Fatalf("GetWithVersion without KeyVersions = %v, want %v", err, ErrNoKeyVersions)
+	}
+	db.Close()
+
+	// Turning versions on gives existing keys one, and a later handle keeps them up to date
+	if db, err = Open(path, Options{KeyVersions: true}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if db, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val, v1, err := db.GetWithVersion([]byte("existing"))
+	if err != nil || string(val) != "1" || v1 == 0 {
+		t.Fatalf("GetWithVersion(existing) = %q, %d, %v", val, v1, err)
+	}
+	// Two clients read the same version; the second write is refused
+	v2, err := db.SetIfVersion([]byte("existing"), []byte("2"), v1)
+	if err != nil || v2 <= v1 {
+		t.Fatalf("first SetIfVersion = %d, %v", v2, err)
+	}
+	if _, err := db.SetIfVersion([]byte("existing"), []byte("3"), v1); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("second SetIfVersion = %v, want %v", err, ErrVersionMismatch)
+	}
+	// A bare Set changes the version too
+	if err := db.Set([]byte("existing"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, err := db.GetWithVersion([]byte("existing")); err != nil || v <= v2 {
+		t.Fatalf("version after Set = %d, %v, want more than %d", v, err, v2)
+	}
+
+	// Version 0 means the key mustn't exist yet
+	if _, err := db.SetIfVersion([]byte("new"), []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SetIfVersion([]byte("new"), []byte("b"), 0); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("SetIfVersion(new, 0) again = %v, want %v", err, ErrVersionMismatch)
+	}
+	if _, err := db.Del([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, v, err := db.GetWithVersion([]byte("new")); !errors.Is(err, ErrKeyNotFound) || v != 0 {
+		t.Fatalf("GetWithVersion after Del = %d, %v", v, err)
+	}
+
+	// In a transaction, a write between the check and the commit conflicts
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, v, err := tx.GetWithVersion([]byte("existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DelIfVersion([]byte("existing"), v); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("existing"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit after a concurrent write = %v, want %v", err, ErrConflict)
+	}
+	if _, err := db.DelIfVersion([]byte("existing"), v); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("DelIfVersion with the old version = %v, want %v", err, ErrVersionMismatch)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.CreateIndex("by_val", func(key, val []byte) [][]byte { return [][]byte{val} }); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	for i := 0; i < 5000; i++ {
+		b.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprint(i%10)))
+	}
+	if _, err := db.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	b = Batch{}
+	for i := 0; i < 5000; i += 10 {
+		b.Set([]byte(fmt.Sprintf("key%05d", i)), []byte("x"))
+		b.Del([]byte(fmt.Sprintf("key%05d", i+1)))
+	}
+	b.Set([]byte("key00002"), []byte("replaced"))
+	b.Set([]byte("key00002"), []byte("y"))
+	if _, err := db.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for val, want := range map[string]int{"0": 0, "1": 0, "2": 499, "3": 500, "x": 500, "y": 1} {
+		if pks, err := db.Lookup("by_val", []byte(val)); err != nil || len(pks) != want {
+			t.Errorf("Lookup(%s) found %d keys, %v, want %d", val, len(pks), err, want)
+		}
+	}
+	if val, err := db.Get([]byte("key04990")); err != nil || string(val) != "x" {
+		t.Errorf("Get(key04990) = %q, %v", val, err)
+	}
+	if _, err := db.Get([]byte("key04991")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(key04991) = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A transaction that read the empty database conflicts with the load
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Get([]byte("key000001")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+
+	const n = 50000
+	i := 0
+	loaded, err := db.BulkLoad(0, func() ([]byte, []byte, bool, error) {
+		if i == n {
+			return nil, nil, false, nil
+		}
+		i++
+		return []byte(fmt.Sprintf("key%06d", i)), []byte(fmt.Sprint(i)), true, nil
+	})
+	if err != nil || loaded != n {
+		t.Fatalf("BulkLoad = %d, %v", loaded, err)
+	}
+	if err := tx.Set([]byte("key000001"), []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit of a transaction begun before BulkLoad = %v, want %v", err, ErrConflict)
+	}
+	if _, err := db.BulkLoad(0, nil); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("second BulkLoad = %v, want %v", err, ErrNotEmpty)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := 0
+	err = db.Scan(nil, func(key, val []byte) error {
+		count++
+		if want := fmt.Sprintf("key%06d", count); string(key) != want || string(val) != fmt.Sprint(count) {
+			return fmt.Errorf("pair %d is %q = %q, want %s", count, key, val, want)
+		}
+		return nil
+	})
+	if err != nil || count != n {
+		t.Fatalf("Scan after reopen found %d pairs, %v", count, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One commit, so every page in the file is live and each value is in exactly one of them
+	var b Batch
+	for i := 0; i < 1000; i++ {
+		b.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value-%04d-", i)))
+	}
+	if _, err := db.WriteBatch(&b); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := db.Verify(); err != nil || !r.OK() || r.Keys != 1001 || r.Leaves < 2 {
+		t.Fatalf("Verify = %+v, %v", r, err)
+	}
+
+	// Pages freed under an open snapshot are on the list too
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i += 7 {
+		if _, err := db.Del([]byte(fmt.Sprintf("key%04d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := db.Verify()
+	if err != nil || !r.OK() || r.FreeList.Free == 0 || r.FreeList.Leaked != 0 {
+		t.Fatalf("Verify with a snapshot open = %+v, %v", r, err)
+	}
+	snap.Release()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the live leaf holding a value near the end, away from anything Open reads
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := map[uint64]bool{}
+	for _, ptr := range r.Pages {
+		used[ptr] = true
+	}
+	var page uint64
+	for off := 0; ; off++ {
+		i := bytes.Index(data[off:], []byte("value-0990-"))
+		if i < 0 {
+			t.Fatal("value not found in a live page")
+		}
+		off += i
+		if page = uint64(off / btree.BTREE_PAGE_SIZE_BYTES); used[page] {
+			data[off] ^= 0x10
+			break
+		}
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Violations) == 0 || r.Violations[0].Page != page || !strings.Contains(r.Violations[0].Problem, "checksum") {
+		t.Fatalf("Verify after corrupting page %d: %v", page, r.Violations)
+	}
+}
+
+func TestSnapshotSurvivesLaterCommits(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite and delete everything while a reader scans the snapshot alongside.
+	done := make(chan error)
+	go func() {
+		count := 0
+		err := snap.Range(nil, nil, func(key, val []byte) error {
+			if string(val) != "old" {
+				return fmt.Errorf("%s = %q in snapshot", key, val)
+			}
+			count++
+			return nil
+		})
+		if err == nil && count != n {
+			err = fmt.Errorf("snapshot scan saw %d keys, want %d", count, n)
+		}
+		done <- err
+	}()
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		if i%2 == 0 {
+			_, err = db.Del(key)
+		} else {
+			err = db.Set(key, []byte("new"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := snap.Get([]byte("key0000")); err != nil || string(val) != "old" {
+		t.Fatalf("snapshot Get = %q, %v", val, err)
+	}
+	if _, err := db.Get([]byte("key0000")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get = %v, want %v", err, ErrKeyNotFound)
+	}
+	if _, held := db.pager.ReaderStats(); held == 0 {
+		t.Error("no pages held back for the open snapshot")
+	}
+
+	snap.Release()
+	if _, err := snap.Get([]byte("key0000")); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("Get after Release = %v, want %v", err, ErrSnapshotReleased)
+	}
+	if readers, held := db.pager.ReaderStats(); readers != 0 || held != 0 {
+		t.Errorf("after Release: %d readers, %d held pages", readers, held)
+	}
+}
+
+func TestSnapshotAtRetainedVersions(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{RetainFor: time.Hour, GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var versions []uint64
+	for i := 0; i < 20; i++ {
+		if err := db.Set([]byte("key"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		v, err := db.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+
+	for i, v := range versions {
+		snap, err := db.SnapshotAt(v)
+		if err != nil {
+			t.Fatalf("SnapshotAt(%d): %v", v, err)
+		}
+		if val, err := snap.Get([]byte("key")); err != nil || string(val) != fmt.Sprint(i) {
+			t.Errorf("version %d: Get = %q, %v, want %d", v, val, err, i)
+		}
+		snap.Release()
+	}
+
+	// Everything but the latest version falls out of the window
+	db.mu.Lock()
+	dropped := db.expire(time.Now().Add(2 * time.Hour))
+	db.mu.Unlock()
+	if dropped != len(versions) {
+		t.Errorf("expire dropped %d versions, want %d", dropped, len(versions))
+	}
+	if _, err := db.SnapshotAt(versions[0]); !errors.Is(err, ErrVersionGone) {
+		t.Errorf("SnapshotAt(%d) after expiry = %v, want %v", versions[0], err, ErrVersionGone)
+	}
+	if _, held := db.pager.ReaderStats(); held != 0 {
+		t.Errorf("%d pages still held after expiry", held)
+	}
+	snap, err := db.SnapshotAt(versions[len(versions)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+}
+
+func TestReadOnlyHandlesSeeWholeCommits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const nkeys = 200
+	writeGen := func(gen int) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for i := 0; i < nkeys; i++ {
+			if err := tx.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("gen%04d", gen))); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	if err := writeGen(0); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := make([]*DB, 2)
+	for i := range readers {
+		if readers[i], err = OpenReadOnly(path); err != nil {
+			t.Fatal(err)
+		}
+		defer readers[i].Close()
+	}
+	if err := readers[0].Set([]byte("key"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Set on a read-only handle = %v, want %v", err, ErrReadOnly)
+	}
+
+	const gens = 50
+	done := make(chan error, 1)
+	go func() {
+		for gen := 1; gen <= gens; gen++ {
+			if err := writeGen(gen); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Every complete scan has to come from a single commit.
+	scans := 0
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+		for _, r := range readers {
+			snap, err := r.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := map[string]int{}
+			err = snap.Range(nil, nil, func(key, val []byte) error {
+				seen[string(val)]++
+				return nil
+			})
+			snap.Release()
+			if errors.Is(err, ErrStale) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != 1 {
+				t.Fatalf("scan saw a mix of commits: %v", seen)
+			}
+			scans++
+		}
+	}
+	if scans == 0 {
+		t.Error("no scan completed")
+	}
+
+	for _, r := range readers {
+		val, err := r.Get([]byte("key0000"))
+		if err != nil || string(val) != fmt.Sprintf("gen%04d", gens) {
+			t.Errorf("Get after the last commit = %q, %v", val, err)
+		}
+	}
+}
+
+func TestConcurrentTxConflict(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"x", "y"} {
+		if err := db.Set([]byte(key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write skew: each reads both keys and clears one. Run serially, the second would
+	// see the first's write, so it has to be the one that fails.
+	tx1, _ := db.Begin()
+	tx2, _ := db.Begin()
+	for _, tx := range []*Tx{tx1, tx2} {
+		for _, key := range []string{"x", "y"} {
+			if _, err := tx.Get([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tx1.Set([]byte("x"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Set([]byte("y"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("second Commit = %v, want %v", err, ErrConflict)
+	}
+	if val, err := db.Get([]byte("y")); err != nil || string(val) != "1" {
+		t.Fatalf("Get(y) = %q, %v, want the conflicting write dropped", val, err)
+	}
+
+	// Blind writes conflict too: the first committer wins
+	tx1, _ = db.Begin()
+	tx2, _ = db.Begin()
+	tx1.Set([]byte("x"), []byte("a"))
+	tx2.Set([]byte("x"), []byte("b"))
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("second blind Commit = %v, want %v", err, ErrConflict)
+	}
+	if val, _ := db.Get([]byte("x")); string(val) != "a" {
+		t.Fatalf("Get(x) = %q, want the first commit to win", val)
+	}
+}
+
+func TestIsolationLevels(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	set := func(key, val string) {
+		t.Helper()
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(tx *Tx, key string) string {
+		t.Helper()
+		val, err := tx.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(val)
+	}
+	// Both read the counter, then both write it back incremented
+	increment := func(level IsolationLevel) (error, error) {
+		set("n", "0")
+		tx1, _ := db.BeginLevel(level)
+		tx2, _ := db.BeginLevel(level)
+		for _, tx := range []*Tx{tx1, tx2} {
+			n := get(tx, "n")
+			tx.Set([]byte("n"), []byte(n+"+1"))
+		}
+		return tx1.Commit(), tx2.Commit()
+	}
+
+	// Read committed: a second read sees a commit made in between, and an update is lost
+	set("k", "1")
+	tx, _ := db.BeginLevel(ISOLATION_READ_COMMITTED)
+	get(tx, "k")
+	set("k", "2")
+	if v := get(tx, "k"); v != "2" {
+		t.Fatalf("read committed: second read = %q, want 2", v)
+	}
+	tx.Rollback()
+	if err1, err2 := increment(ISOLATION_READ_COMMITTED); err1 != nil || err2 != nil {
+		t.Fatalf("read committed increments: %v, %v", err1, err2)
+	}
+
+	// Snapshot: reads repeat, the lost update is caught, write skew isn't
+	tx, _ = db.BeginLevel(ISOLATION_SNAPSHOT)
+	get(tx, "k")
+	set("k", "3")
+	if v := get(tx, "k"); v != "2" {
+		t.Fatalf("snapshot: second read = %q, want 2", v)
+	}
+	tx.Rollback()
+	if err1, err2 := increment(ISOLATION_SNAPSHOT); err1 != nil || !errors.Is(err2, ErrConflict) {
+		t.Fatalf("snapshot increments: %v, %v, want the second to conflict", err1, err2)
+	}
+	set("x", "1")
+	set("y", "1")
+	tx1, _ := db.BeginLevel(ISOLATION_SNAPSHOT)
+	tx2, _ := db.BeginLevel(ISOLATION_SNAPSHOT)
+	for _, tx := range []*Tx{tx1, tx2} {
+		get(tx, "x")
+		get(tx, "y")
+	}
+	tx1.Set([]byte("x"), []byte("0"))
+	tx2.Set([]byte("y"), []byte("0"))
+	if err1, err2 := tx1.Commit(), tx2.Commit(); err1 != nil || err2 != nil {
+		t.Fatalf("snapshot write skew: %v, %v, want both to commit", err1, err2)
+	}
+
+	// Single writer: other commits wait for it, and it never conflicts
+	writer, err := db.BeginLevel(ISOLATION_SINGLE_WRITER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := get(writer, "n")
+	done := make(chan error)
+	go func() {
+		done <- db.Set([]byte("n"), []byte("other"))
+	}()
+	go func() {
+		_, err := db.UpdateLevel(ISOLATION_SINGLE_WRITER, func(tx *Tx) error {
+			return tx.Set([]byte("z"), []byte("1"))
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("commit finished while a single writer was running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	writer.Set([]byte("n"), []byte(n+"+1"))
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, err := db.Get([]byte("n")); err != nil || string(val) != "other" {
+		t.Fatalf("Get(n) = %q, %v, want the waiting write last", val, err)
+	}
+}
+
+func TestSerializableSnapshotIsolation(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"x", "y"} {
+		if err := db.Set([]byte(key), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write skew through a range: each sees no booking for the room, and books it
+	tx1, _ := db.Begin()
+	tx2, _ := db.Begin()
+	for i, tx := range []*Tx{tx1, tx2} {
+		booked := 0
+		tx.Range([]byte("room1/"), []byte("room1/\xff"), func(_, _ []byte) error {
+			booked++
+			return nil
+		})
+		if booked == 0 {
+			tx.Set([]byte(fmt.Sprintf("room1/%d", i)), nil)
+		}
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("phantom Commit = %v, want %v", err, ErrConflict)
+	}
+
+	// Reading a key a concurrent commit then wrote is fine on its own: tx1 goes first
+	tx1, _ = db.Begin()
+	tx2, _ = db.Begin()
+	if _, err := tx1.Get([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	tx1.Set([]byte("y"), []byte("1"))
+	tx2.Set([]byte("x"), []byte("1"))
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("Commit after a concurrent write of a read key = %v", err)
+	}
+
+	// Unless a read-only transaction saw tx2's write but not tx1's, leaving no order
+	withdraw, _ := db.Begin()
+	withdraw.Get([]byte("x"))
+	withdraw.Get([]byte("y"))
+	if _, err := db.Update(func(tx *Tx) error {
+		y, err := tx.Get([]byte("y"))
+		if err != nil {
+			return err
+		}
+		return tx.Set([]byte("y"), append(y, '+'))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	report, _ := db.Begin()
+	report.Get([]byte("x"))
+	report.Get([]byte("y"))
+	if err := report.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	withdraw.Set([]byte("x"), []byte("-1"))
+	if err := withdraw.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit completing a read-only anomaly = %v, want %v", err, ErrConflict)
+	}
+}
+
+func TestConcurrentIncrementsRetry(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	increment := func() error {
+		for {
+			tx, err := db.Begin()
+			if err != nil {
+				return err
+			}
+			n := 0
+			val, err := tx.Get([]byte("counter"))
+			if err == nil {
+				fmt.Sscan(string(val), &n)
+			} else if !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+			err = tx.Set([]byte("counter"), []byte(fmt.Sprint(n+1)))
+			if err == nil {
+				err = tx.Commit()
+			}
+			tx.Rollback()
+			if !errors.Is(err, ErrConflict) {
+				return err
+			}
+		}
+	}
+
+	const workers, each = 8, 25
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < each; i++ {
+				if err := increment(); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, err := db.Get([]byte("counter")); err != nil || string(val) != fmt.Sprint(workers*each) {
+		t.Fatalf("counter = %q, %v, want %d", val, err, workers*each)
+	}
+	if len(db.commits) != 0 || len(db.active) != 0 {
+		t.Errorf("%d commits and %d transactions still tracked", len(db.commits), len(db.active))
+	}
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Index users by the city after the comma in their value
+	byCity := func(key, val []byte) [][]byte {
+		if i := bytes.IndexByte(val, ','); i >= 0 {
+			return [][]byte{val[i+1:]}
+		}
+		return nil
+	}
+	lookup := func(db *DB, city string) []string {
+		t.Helper()
+		pks, err := db.Lookup("city", []byte(city))
+		if err != nil {
+			t.Fatalf("Lookup(%s): %v", city, err)
+		}
+		var names []string
+		for _, pk := range pks {
+			names = append(names, string(pk))
+		}
+		return names
+	}
+
+	db.Set([]byte("alice"), []byte("30,paris"))
+	db.Set([]byte("bob"), []byte("25,london"))
+	if err := db.CreateIndex("city", byCity); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("carol"), []byte("41,paris"))
+	db.Set([]byte("bob"), []byte("25,paris"))
+	db.Del([]byte("alice"))
+	db.Set([]byte("dave"), []byte("no city"))
+
+	if got := fmt.Sprint(lookup(db, "paris")); got != "[bob carol]" {
+		t.Errorf("paris = %s, want [bob carol]", got)
+	}
+	if got := lookup(db, "london"); len(got) != 0 {
+		t.Errorf("london = %v, want none", got)
+	}
+	if err := db.Set([]byte{RESERVED_PREFIX, 'x'}, nil); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Set of a reserved key = %v, want %v", err, ErrReservedKey)
+	}
+	snap, _ := db.Snapshot()
+	count := 0
+	snap.Range(nil, nil, func(key, val []byte) error {
+		count++
+		return nil
+	})
+	snap.Release()
+	if count != 3 {
+		t.Errorf("Range saw %d keys, want only the 3 user keys", count)
+	}
+	db.Close()
+
+	// The index is in the file, but writes need it registered again
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("erin"), []byte("19,paris")); !errors.Is(err, ErrIndexNotRegistered) {
+		t.Fatalf("Set before registering = %v, want %v", err, ErrIndexNotRegistered)
+	}
+	if err := db.CreateIndex("city", byCity); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("erin"), []byte("19,paris")); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(lookup(db, "paris")); got != "[bob carol erin]" {
+		t.Errorf("paris after reopen = %s, want [bob carol erin]", got)
+	}
+
+	if err := db.DropIndex("city"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lookup("city", []byte("paris")); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Lookup after DropIndex = %v, want %v", err, ErrNoIndex)
+	}
+}
+
+func TestScanSample(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const n = 20000
+	tx, _ := db.Begin()
+	for i := 0; i < n; i++ {
+		tx.Set([]byte(fmt.Sprintf("key%06d", i)), []byte("0123456789"))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fraction := range []float64{0.05, 0.2} {
+		count := 0
+		seen := map[string]bool{}
+		err := db.ScanSample(fraction, func(key, val []byte) error {
+			if seen[string(key)] {
+				return fmt.Errorf("%s sampled twice", key)
+			}
+			seen[string(key)] = true
+			count++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Generous bounds; the estimate is random
+		if est := float64(count) / fraction; est < n/2 || est > n*2 {
+			t.Errorf("fraction %v: sampled %d pairs, estimating %.0f of %d", fraction, count, est, n)
+		}
+	}
+
+	count := 0
+	db.ScanSample(1, func(key, val []byte) error {
+		count++
+		return nil
+	})
+	if count != n {
+		t.Errorf("ScanSample(1) saw %d pairs, want %d", count, n)
+	}
+}
+
+func TestExportCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{KeyVersions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	big := bytes.Repeat([]byte("x"), 10000)
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.DeletePrefix([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("big"), big)
+
+	path := filepath.Join(dir, "checkpoint.db")
+	if err := db.ExportCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ExportCheckpoint(path); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("export over an existing file = %v, want %v", err, os.ErrExist)
+	}
+	db.Set([]byte("key0000"), []byte("after"))
+
+	cp, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	if val, err := cp.Get([]byte("big")); err != nil || !bytes.Equal(val, big) {
+		t.Fatalf("Get(big) = %d bytes, %v", len(val), err)
+	}
+	if val, version, err := cp.GetWithVersion([]byte("key0000")); err != nil || string(val) != "0" || version == 0 {
+		t.Fatalf("GetWithVersion(key0000) = %q, %d, %v, want the value as of the export", val, version, err)
+	}
+	n := 0
+	cp.Scan(nil, func(_, _ []byte) error {
+		n++
+		return nil
+	})
+	if n != 1001 {
+		t.Fatalf("checkpoint has %d keys, want 1001", n)
+	}
+	if r, err := cp.Verify(); err != nil || !r.OK() || r.FreeList.Free != 0 {
+		t.Fatalf("Verify = %+v, %v", r, err)
+	}
+
+	orig, _ := os.Stat(filepath.Join(dir, "test.db"))
+	exported, _ := os.Stat(path)
+	if exported.Size() >= orig.Size() || exported.Mode().Perm()&0222 != 0 {
+		t.Fatalf("checkpoint is %d bytes, mode %v, from %d bytes", exported.Size(), exported.Mode(), orig.Size())
+	}
+	if _, err := os.Stat(path + pager.WAL_SUFFIX); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint left a log: %v", err)
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		db.Set([]byte(fmt.Sprintf("city%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	path := filepath.Join(dir, "cities.db")
+	err = db.ExportCheckpoint(path)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{"data/cities.db": {Data: data}}
+	for name, open := range map[string]func() (*DB, error){
+		"OpenFS":       func() (*DB, error) { return OpenFS(fsys, "data/cities.db") },
+		"OpenReaderAt": func() (*DB, error) { return OpenReaderAt(bytes.NewReader(data)) },
+	} {
+		db, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if val, err := db.Get([]byte("city123")); err != nil || string(val) != "123" {
+			t.Errorf("%s: Get = %q, %v", name, val, err)
+		}
+		if err := db.Set([]byte("city999"), nil); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s: Set = %v, want %v", name, err, ErrReadOnly)
+		}
+		if err := db.Close(); err != nil {
+			t.Errorf("%s: Close = %v", name, err)
+		}
+	}
+	if _, err := OpenReaderAt(bytes.NewReader(data[:100])); err == nil {
+		t.Fatal("OpenReaderAt of a truncated file succeeded")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateIndex("by_val", func(key, val []byte) [][]byte { return [][]byte{val} }); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "backup.db")
+	if err := db.ExportCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Release()
+
+	db.Set([]byte("key0005"), []byte("changed"))
+	db.Del([]byte("key1000"))
+	db.Set([]byte("key1000a"), []byte("added"))
+	want := "[changed key0005 5 changed removed key1000 1000  added key1000a  added]"
+
+	diff := func(a, b *Snapshot) string {
+		var got []string
+		err := a.Diff(b, func(kind btree.DiffKind, key, aval, bval []byte) error {
+			got = append(got, fmt.Sprintf("%s %s %s %s", kind, key, aval, bval))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(got)
+	}
+	after, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Release()
+	if got := diff(before, after); got != want {
+		t.Fatalf("diff between snapshots = %s, want %s", got, want)
+	}
+
+	// Against the backup, which is another file; the index isn't compared
+	backup, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	old, err := backup.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Release()
+	if got := diff(old, after); got != want {
+		t.Fatalf("diff against the backup = %s, want %s", got, want)
+	}
+	if got := diff(old, before); got != "[]" {
+		t.Fatalf("diff of the backup and what it was taken from = %s", got)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{KeyVersions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	byVal := func(key, val []byte) [][]byte { return [][]byte{val[:1]} }
+	if err := db.CreateIndex("first", byVal); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := bytes.Repeat([]byte("9"), 20000)
+	db.Set([]byte("big"), big)
+	var dump bytes.Buffer
+	if err := db.Dump(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	// Into a file with bigger pages
+	restored, err := Open(filepath.Join(dir, "restored.db"), Options{Options: btree.Options{PageSize: 16384}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.Restore(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := db.Snapshot()
+	defer a.Release()
+	b, _ := restored.Snapshot()
+	defer b.Release()
+	err = a.Diff(b, func(kind btree.DiffKind, key, _, _ []byte) error {
+		return fmt.Errorf("%s %q", kind, key)
+	})
+	if err != nil {
+		t.Fatalf("restored copy differs: %v", err)
+	}
+	if err := restored.Set([]byte("new"), []byte("x")); !errors.Is(err, ErrIndexNotRegistered) {
+		t.Fatalf("Set before registering the index = %v, want %v", err, ErrIndexNotRegistered)
+	}
+	if err := restored.CreateIndex("first", byVal); err != nil {
+		t.Fatal(err)
+	}
+	if pks, err := restored.Lookup("first", []byte("9")); err != nil || len(pks) != 112 {
+		t.Fatalf("Lookup(9) = %d keys, %v, want 112", len(pks), err)
+	}
+	if _, version, err := restored.GetWithVersion([]byte("key0001")); err != nil || version == 0 {
+		t.Fatalf("GetWithVersion = %d, %v", version, err)
+	}
+	if err := restored.Restore(bytes.NewReader(dump.Bytes())); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("Restore into a full database = %v, want %v", err, ErrNotEmpty)
+	}
+
+	// Damaged dumps restore nothing
+	for name, bad := range map[string][]byte{
+		"truncated": dump.Bytes()[:dump.Len()/2],
+		"flipped":   append(append([]byte{}, dump.Bytes()[:100]...), append([]byte{dump.Bytes()[100] ^ 1}, dump.Bytes()[101:]...)...),
+		"not dump":  []byte("hello, world"),
+	} {
+		empty, err := Open(filepath.Join(dir, name+".db"), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := empty.Restore(bytes.NewReader(bad)); !errors.Is(err, ErrBadDump) {
+			t.Errorf("%s: Restore = %v, want %v", name, err, ErrBadDump)
+		}
+		if _, err := empty.Get([]byte("key0001")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s: Get after a failed restore = %v", name, err)
+		}
+		empty.Close()
+	}
+}
+
+func TestMerkleRepair(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := Open(filepath.Join(dir, "primary.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	replica, err := Open(filepath.Join(dir, "replica.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	for _, db := range []*DB{primary, replica} {
+		var b Batch
+		for i := 0; i < 5000; i++ {
+			b.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprint(i)))
+		}
+		if _, err := db.WriteBatch(&b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replica.Set([]byte("key00100"), []byte("stale"))
+	replica.Del([]byte("key02500"))
+	replica.Set([]byte("key04999a"), []byte("extra"))
+
+	compare := func() []*MerkleNode {
+		a, _ := primary.Snapshot()
+		defer a.Release()
+		b, _ := replica.Snapshot()
+		defer b.Release()
+		ta, err := a.MerkleTree(4, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tb, err := b.MerkleTreeLike(ta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ta.Keys != 5000 || len(ta.Children) != 4 {
+			t.Fatalf("tree has %d keys and %d children", ta.Keys, len(ta.Children))
+		}
+		diff, err := ta.Diff(tb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diff
+	}
+	diff := compare()
+	if len(diff) != 3 || string(diff[0].Start) != "key00100" || diff[2].End != nil {
+		t.Fatalf("differing ranges = %d, want the three leaves with changes", len(diff))
+	}
+
+	snap, _ := primary.Snapshot()
+	defer snap.Release()
+	repaired := 0
+	for _, leaf := range diff {
+		n, err := replica.RepairRange(leaf.Start, leaf.End, func(fn func(key, val []byte) error) error {
+			return snap.Range(leaf.Start, leaf.End, fn)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		repaired += n
+	}
+	if repaired != 3 {
+		t.Fatalf("repaired %d keys, want 3", repaired)
+	}
+	if diff := compare(); len(diff) != 0 {
+		t.Fatalf("%d ranges still differ after repair", len(diff))
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte("x"), 30000))
+	if _, err := db.DeletePrefix([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := db.Snapshot()
+	defer before.Release()
+
+	// Writes carry on while the copy is made, one for every page written
+	out := &writeDuring{db: db}
+	calls, last := 0, uint64(0)
+	err = db.Backup(context.Background(), out, func(done, total uint64) {
+		calls++
+		last = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.err != nil {
+		t.Fatal(out.err)
+	}
+	if calls == 0 || last != uint64(out.Len()/4096) {
+		t.Fatalf("progress called %d times, last with %d pages, for %d bytes", calls, last, out.Len())
+	}
+
+	path := filepath.Join(dir, "backup.db")
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if report, err := backup.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify of the backup = %v, %v", report.Violations, err)
+	}
+	snap, _ := backup.Snapshot()
+	defer snap.Release()
+	err = before.Diff(snap, func(kind btree.DiffKind, key, _, _ []byte) error {
+		return fmt.Errorf("%s %q", kind, key)
+	})
+	if err != nil {
+		t.Fatalf("backup differs from the commit it copied: %v", err)
+	}
+	// The copy is writable, reusing its free pages
+	if err := backup.Set([]byte("after"), []byte("restore")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Backup(ctx, io.Discard, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Backup with a cancelled context = %v", err)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "backup.db")
+	var full bytes.Buffer
+	if err := db.Backup(context.Background(), &full, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, full.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	since, _ := db.Version()
+
+	// Two rounds of changes, each carried over by an incremental much smaller than the database
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			db.Set([]byte(fmt.Sprintf("key%04d", i*97+round)), []byte("changed"))
+		}
+		db.Set([]byte(fmt.Sprintf("big%d", round)), bytes.Repeat([]byte("x"), 20000))
+		if _, err := db.DeletePrefix([]byte(fmt.Sprintf("key%d", round+3))); err != nil {
+			t.Fatal(err)
+		}
+
+		var incr bytes.Buffer
+		version, err := db.IncrementalBackup(context.Background(), &incr, since, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if incr.Len()*2 > full.Len() {
+			t.Fatalf("incremental of %d bytes for a %d byte database", incr.Len(), full.Len())
+		}
+		if round == 0 {
+			// A damaged incremental is refused, and the good one still applies afterwards
+			damaged := bytes.Clone(incr.Bytes())
+			damaged[len(damaged)-4]++
+			if _, err := ApplyIncremental(path, bytes.NewReader(damaged)); !errors.Is(err, ErrBadIncremental) {
+				t.Fatalf("ApplyIncremental of a damaged incremental = %v", err)
+			}
+		}
+		if got, err := ApplyIncremental(path, bytes.NewReader(incr.Bytes())); err != nil || got != version {
+			t.Fatalf("ApplyIncremental = %d, %v, want %d", got, err, version)
+		}
+		if _, err := ApplyIncremental(path, bytes.NewReader(incr.Bytes())); !errors.Is(err, ErrIncrementalBase) {
+			t.Fatalf("ApplyIncremental twice = %v", err)
+		}
+		since = version
+	}
+
+	backup, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if report, err := backup.Verify(); err != nil || !report.OK() {
+		t.Fatalf("Verify of the backup = %v, %v", report.Violations, err)
+	}
+	if v, _ := backup.Version(); v != since {
+		t.Fatalf("backup at version %d, want %d", v, since)
+	}
+	latest, _ := db.Snapshot()
+	defer latest.Release()
+	snap, _ := backup.Snapshot()
+	defer snap.Release()
+	err = latest.Diff(snap, func(kind btree.DiffKind, key, _, _ []byte) error {
+		return fmt.Errorf("%s %q", kind, key)
+	})
+	if err != nil {
+		t.Fatalf("backup differs from the database: %v", err)
+	}
+
+	if _, err := db.IncrementalBackup(context.Background(), io.Discard, since+1, nil); !errors.Is(err, ErrVersionAhead) {
+		t.Fatalf("IncrementalBackup from a future version = %v", err)
+	}
+}
+
+// Collects what is written to it, making a commit to db for every write
+type writeDuring struct {
+	bytes.Buffer
+	db  *DB
+	n   int
+	err error
+}
+
+func (w *writeDuring) Write(p []byte) (int, error) {
+	w.n++
+	if err := w.db.Set([]byte(fmt.Sprintf("during%d", w.n)), bytes.Repeat([]byte("y"), 500)); err != nil {
+		w.err = err
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestPointInTimeRecovery(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	db, err := Open(filepath.Join(dir, "test.db"), Options{WALArchive: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var full bytes.Buffer
+	if err := db.Backup(context.Background(), &full, nil); err != nil {
+		t.Fatal(err)
+	}
+	restore := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, full.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for i := 0; i < 50; i++ {
+		db.Set([]byte(fmt.Sprintf("key%04d", i*31)), []byte("changed"))
+	}
+	db.Set([]byte("big"), bytes.Repeat([]byte("x"), 20000))
+	good, _ := db.Version()
+	before, _ := db.Snapshot()
+	defer before.Release()
+	time.Sleep(10 * time.Millisecond)
+	goodTime := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// The mistake
+	if _, err := db.DeletePrefix([]byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Set([]byte("after"), []byte("1"))
+
+	check := func(path string) {
+		t.Helper()
+		recovered, err := Open(path, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer recovered.Close()
+		if report, err := recovered.Verify(); err != nil || !report.OK() {
+			t.Fatalf("Verify of the recovered database = %v, %v", report.Violations, err)
+		}
+		snap, _ := recovered.Snapshot()
+		defer snap.Release()
+		err = before.Diff(snap, func(kind btree.DiffKind, key, _, _ []byte) error {
+			return fmt.Errorf("%s %q", kind, key)
+		})
+		if err != nil {
+			t.Fatalf("recovered database differs from before the delete: %v", err)
+		}
+	}
+
+	byVersion := restore("version.db")
+	if got, err := RecoverTo(byVersion, archive, RecoveryTarget{Version: good}); err != nil || got != good {
+		t.Fatalf("RecoverTo version %d = %d, %v", good, got, err)
+	}
+	check(byVersion)
+	// Already there, so nothing to do
+	if got, err := RecoverTo(byVersion, archive, RecoveryTarget{Version: good}); err != nil || got != good {
+		t.Fatalf("RecoverTo again = %d, %v", got, err)
+	}
+
+	byTime := restore("time.db")
+	if got, err := RecoverTo(byTime, archive, RecoveryTarget{Time: goodTime}); err != nil || got != good {
+		t.Fatalf("RecoverTo %v = %d, %v, want %d", goodTime, got, err, good)
+	}
+	check(byTime)
+
+	latest := restore("latest.db")
+	if _, err := RecoverTo(latest, archive, RecoveryTarget{Version: good + 10}); !errors.Is(err, ErrArchiveGap) {
+		t.Fatalf("RecoverTo past the archive = %v", err)
+	}
+	version, _ := db.Version()
+	if got, err := RecoverTo(latest, archive, RecoveryTarget{}); err != nil || got != version {
+		t.Fatalf("RecoverTo the end = %d, %v, want %d", got, err, version)
+	}
+
+	// A commit missing from the archive stops recovery before it writes anything
+	gap := restore("gap.db")
+	a, err := wal.OpenArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Discard(good - 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverTo(gap, archive, RecoveryTarget{Version: good}); !errors.Is(err, ErrArchiveGap) {
+		t.Fatalf("RecoverTo over a gap = %v", err)
+	}
+	if b, err := os.ReadFile(gap); err != nil || !bytes.Equal(b, full.Bytes()) {
+		t.Fatalf("RecoverTo changed the file before failing: %v", err)
+	}
+}
+
+func TestInsertAutoKey(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert(nil, []byte("v")); !errors.Is(err, ErrNoAutoKey) {
+		t.Fatalf("Insert(nil) without AutoKey = %v, want %v", err, ErrNoAutoKey)
+	}
+	if key, err := db.Insert([]byte("given"), []byte("v")); err != nil || string(key) != "given" {
+		t.Fatalf("Insert with a key = %q, %v", key, err)
+	}
+	db.Close()
+
+	db, err = Open(filepath.Join(dir, "test.db"), Options{AutoKey: keys.ID_UUIDV7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var generated [][]byte
+	for i := 0; i < 3; i++ {
+		key, err := db.Insert(nil, []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated = append(generated, key)
+		time.Sleep(2 * time.Millisecond)
+	}
+	_, err = db.Update(func(tx *Tx) error {
+		key, err := tx.Insert(nil, []byte("3"))
+		generated = append(generated, key)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range generated {
+		if len(key) != 16 || key[0] == RESERVED_PREFIX {
+			t.Fatalf("generated key %x", key)
+		}
+		if i > 0 && bytes.Compare(generated[i-1], key) >= 0 {
+			t.Fatalf("generated keys out of time order: %x then %x", generated[i-1], key)
+		}
+		if val, err := db.Get(key); err != nil || string(val) != fmt.Sprint(i) {
+			t.Fatalf("Get(%x) = %q, %v", key, val, err)
+		}
+	}
+}
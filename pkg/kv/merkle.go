@@ -0,0 +1,239 @@
+package kv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+const (
+	// Children per inner node of a Merkle tree when not told otherwise
+	MERKLE_DEFAULT_FANOUT = 16
+	// Pairs per leaf of a Merkle tree when not told otherwise
+	MERKLE_DEFAULT_LEAF_KEYS = 1024
+)
+
+// Returned when comparing Merkle trees that don't split the key space the same way
+var ErrMerkleShape = errors.New("kv: merkle trees have different shapes")
+
+/*
+Two copies of a database, a replica and its primary say, find where they differ
+by comparing Merkle trees over their user keys: each leaf covers a range of keys
+and hashes the pairs in it, and each inner node hashes its children, so equal
+hashes high up rule out everything below. Both trees have to split the key space
+at the same keys, so one side builds its tree with MerkleTree, picking the splits
+from its own keys, and the other builds one over the same ranges with
+MerkleTreeLike. Diff of the two gives the leaf ranges that differ, which
+RepairRange can then copy across.
+
+Trees are computed on demand from a snapshot, reading every pair once; nothing is
+maintained as the database changes.
+*/
+type MerkleNode struct {
+	// The keys covered, [Start, End); nil Start is the first user key and nil End unbounded
+	Start, End []byte
+	// Pairs in the range
+	Keys     int
+	Hash     [sha256.Size]byte
+	Children []*MerkleNode
+}
+
+/*
+Build a Merkle tree over the snapshot's user keys, with leafKeys pairs per leaf (the
+last leaf may have fewer) and fanout children per inner node. Zero or less for
+either takes the defaults.
+*/
+func (s *Snapshot) MerkleTree(fanout, leafKeys int) (*MerkleNode, error) {
+	if fanout < 2 {
+		fanout = MERKLE_DEFAULT_FANOUT
+	}
+	if leafKeys < 1 {
+		leafKeys = MERKLE_DEFAULT_LEAF_KEYS
+	}
+
+	leaf := &MerkleNode{}
+	leaves := []*MerkleNode{leaf}
+	h := sha256.New()
+	err := s.Range(nil, nil, func(key, val []byte) error {
+		if leaf.Keys == leafKeys {
+			h.Sum(leaf.Hash[:0])
+			leaf.End = key
+			leaf = &MerkleNode{Start: key}
+			leaves = append(leaves, leaf)
+			h.Reset()
+		}
+		hashPair(h, key, val)
+		leaf.Keys++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.Sum(leaf.Hash[:0])
+
+	// Group each level under the one above until there's a single root
+	level := leaves
+	for len(level) > 1 {
+		var up []*MerkleNode
+		for i := 0; i < len(level); i += fanout {
+			up = append(up, merkleParent(level[i:min(i+fanout, len(level))]))
+		}
+		level = up
+	}
+	return level[0], nil
+}
+
+/*
+Build a Merkle tree over the snapshot's user keys with the same ranges as shape,
+typically a tree from MerkleTree on another copy of the database, ready to Diff
+against it.
+*/
+func (s *Snapshot) MerkleTreeLike(shape *MerkleNode) (*MerkleNode, error) {
+	// Copy the shape, collecting the leaves in key order
+	var leaves []*MerkleNode
+	var copyShape func(n *MerkleNode) *MerkleNode
+	copyShape = func(n *MerkleNode) *MerkleNode {
+		c := &MerkleNode{Start: n.Start, End: n.End}
+		if len(n.Children) == 0 {
+			leaves = append(leaves, c)
+		}
+		for _, child := range n.Children {
+			c.Children = append(c.Children, copyShape(child))
+		}
+		return c
+	}
+	root := copyShape(shape)
+
+	i := 0
+	h := sha256.New()
+	err := s.Range(leaves[0].Start, leaves[len(leaves)-1].End, func(key, val []byte) error {
+		for leaves[i].End != nil && bytes.Compare(key, leaves[i].End) >= 0 {
+			h.Sum(leaves[i].Hash[:0])
+			h.Reset()
+			i++
+		}
+		hashPair(h, key, val)
+		leaves[i].Keys++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for ; i < len(leaves); i++ {
+		h.Sum(leaves[i].Hash[:0])
+		h.Reset()
+	}
+
+	var rehash func(n *MerkleNode)
+	rehash = func(n *MerkleNode) {
+		if len(n.Children) == 0 {
+			return
+		}
+		for _, child := range n.Children {
+			rehash(child)
+		}
+		*n = *merkleParent(n.Children)
+	}
+	rehash(root)
+	return root, nil
+}
+
+/*
+The leaves of n whose pairs differ from other's, in key order. other must have the
+same ranges, as from MerkleTreeLike; otherwise ErrMerkleShape.
+*/
+func (n *MerkleNode) Diff(other *MerkleNode) ([]*MerkleNode, error) {
+	var out []*MerkleNode
+	var walk func(a, b *MerkleNode) error
+	walk = func(a, b *MerkleNode) error {
+		if !bytes.Equal(a.Start, b.Start) || !bytes.Equal(a.End, b.End) || len(a.Children) != len(b.Children) {
+			return fmt.Errorf("%w: [%q, %q) against [%q, %q)", ErrMerkleShape, a.Start, a.End, b.Start, b.End)
+		}
+		if a.Hash == b.Hash {
+			return nil
+		}
+		if len(a.Children) == 0 {
+			out = append(out, a)
+			return nil
+		}
+		for i := range a.Children {
+			if err := walk(a.Children[i], b.Children[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(n, other); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+/*
+Make the keys in [start, end) hold exactly the pairs source calls fn with, as read
+from another copy of the database: keys it doesn't produce are deleted, and only
+pairs that differ are written. Runs as one transaction, so source may be called
+again if it conflicts, and should produce the same pairs each time, in any order.
+Returns the number of keys written or deleted.
+*/
+func (db *DB) RepairRange(start, end []byte, source func(fn func(key, val []byte) error) error) (int, error) {
+	n := 0
+	_, err := db.Update(func(tx *Tx) error {
+		n = 0
+		have := map[string][]byte{}
+		err := tx.Range(start, end, func(key, val []byte) error {
+			have[string(key)] = val
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = source(func(key, val []byte) error {
+			if bytes.Compare(key, start) < 0 || (end != nil && bytes.Compare(key, end) >= 0) {
+				return fmt.Errorf("kv: repair of [%q, %q) got key %q outside it", start, end, key)
+			}
+			old, ok := have[string(key)]
+			delete(have, string(key))
+			if ok && bytes.Equal(old, val) {
+				return nil
+			}
+			n++
+			return tx.Set(key, val)
+		})
+		if err != nil {
+			return err
+		}
+		for key := range have {
+			if _, err := tx.Del([]byte(key)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Add a pair to a leaf's hash, with lengths so different splits of the same bytes differ.
+func hashPair(h hash.Hash, key, val []byte) {
+	h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+	h.Write(key)
+	h.Write(binary.AppendUvarint(nil, uint64(len(val))))
+	h.Write(val)
+}
+
+// The node over children, hashing their hashes in order.
+func merkleParent(children []*MerkleNode) *MerkleNode {
+	p := &MerkleNode{Start: children[0].Start, End: children[len(children)-1].End, Children: children}
+	h := sha256.New()
+	for _, c := range children {
+		p.Keys += c.Keys
+		h.Write(c.Hash[:])
+	}
+	h.Sum(p.Hash[:0])
+	return p
+}
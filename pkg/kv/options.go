@@ -0,0 +1,42 @@
+package kv
+
+import (
+	"database-go/pkg/btree"
+	"database-go/pkg/keys"
+	"time"
+)
+
+const (
+	// How often expired versions are collected, unless set in Options
+	DEFAULT_GC_INTERVAL = time.Second
+)
+
+type Options struct {
+	// Page and size limits of the file, fixed when it is created
+	btree.Options
+
+	// How long a commit stays readable through SnapshotAt after it is superseded.
+	// Zero keeps only the latest commit, plus whatever open snapshots pin.
+	RetainFor time.Duration
+	// How often the background collector drops versions older than RetainFor
+	GCInterval time.Duration
+
+	// Track a version for every key, for GetWithVersion and SetIfVersion. Once
+	// turned on for a file it stays on.
+	KeyVersions bool
+
+	// What Insert generates a key with when given none. A time-ordered kind
+	// (keys.ID_UUIDV7, keys.ID_ULID) keeps inserts in the rightmost leaves.
+	AutoKey keys.IDKind
+
+	// Directory to archive every commit's log batch in, for RecoverTo. Empty
+	// archives nothing.
+	WALArchive string
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.GCInterval == 0 {
+		opts.GCInterval = DEFAULT_GC_INTERVAL
+	}
+	return opts
+}
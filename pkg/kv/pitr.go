@@ -0,0 +1,125 @@
+package kv
+
+import (
+	"database-go/pkg/pager"
+	"database-go/pkg/wal"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Returned by RecoverTo when the archive is missing a commit between the base and the target
+var ErrArchiveGap = errors.New("kv: archive is missing commits")
+
+/*
+How far RecoverTo goes: the last commit at or before Version, and made at or before
+Time. Zero fields are no limit, so the zero RecoveryTarget replays everything the
+archive has.
+*/
+type RecoveryTarget struct {
+	Version uint64
+	Time    time.Time
+}
+
+/*
+Bring the database file at path forward to target by replaying the commits archived
+in directory archive (see Options.WALArchive) on top of it, one after another in the
+order they were made, and return the version it ends at. The file must be a copy of
+the same database made with Backup, and maybe brought forward with ApplyIncremental,
+at a version the archive goes on from; it must not be open meanwhile. With the
+commits up to that version kept somewhere else, this restores the database to how
+it was just before a mistake, rather than only to the latest state.
+
+Every segment needed is read and checked before anything is written. The file is
+moved to the target's commit in one step at the end, but pages of the commits
+replayed are written before that, so it is only of use for recovering again if this
+fails partway; keep the backup it came from. Open the recovered database with an
+archive of its own, not this one, since its commits from here on are a history
+apart from those in the archive.
+*/
+func RecoverTo(path, archive string, target RecoveryTarget) (uint64, error) {
+	if _, err := os.Stat(archive); err != nil {
+		return 0, err
+	}
+	a, err := wal.OpenArchive(archive)
+	if err != nil {
+		return 0, err
+	}
+	image, err := pager.OpenImage(path)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+	base := image.Meta().Seq
+
+	segments, err := recoverySegments(a, base, target)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return base, nil
+	}
+	for _, seg := range segments {
+		if err := seg.Replay(func(uint64, []byte) error { return nil }); err != nil {
+			return 0, err
+		}
+	}
+
+	var meta []byte
+	for _, seg := range segments {
+		err := seg.Replay(func(ptr uint64, page []byte) error {
+			if ptr == pager.META_PAGE {
+				meta = append(meta[:0], page...)
+				return nil
+			}
+			return image.WritePage(ptr, page)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := image.Finish(meta); err != nil {
+		return 0, err
+	}
+	return image.Meta().Seq, nil
+}
+
+// The segments to replay from base to target, which have to follow on from base without a gap.
+func recoverySegments(a *wal.Archive, base uint64, target RecoveryTarget) ([]wal.Segment, error) {
+	all, err := a.Segments()
+	if err != nil {
+		return nil, err
+	}
+	if target.Version != 0 && target.Version < base {
+		return nil, fmt.Errorf("%w: base is at %d, past the target %d", ErrArchiveGap, base, target.Version)
+	}
+	var segments []wal.Segment
+	next := base + 1
+	for _, seg := range all {
+		if seg.Seq < next {
+			continue
+		}
+		if target.Version != 0 && seg.Seq > target.Version {
+			break
+		}
+		if seg.Seq != next {
+			return nil, fmt.Errorf("%w: %d follows %d", ErrArchiveGap, seg.Seq, next-1)
+		}
+		if !target.Time.IsZero() {
+			at, err := seg.Time()
+			if err != nil {
+				return nil, err
+			}
+			if at.After(target.Time) {
+				return segments, nil
+			}
+		}
+		segments = append(segments, seg)
+		next++
+	}
+	if target.Version != 0 && next <= target.Version {
+		return nil, fmt.Errorf("%w: archive ends at %d, short of %d", ErrArchiveGap, next-1, target.Version)
+	}
+	return segments, nil
+}
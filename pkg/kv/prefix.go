@@ -0,0 +1,59 @@
+package kv
+
+import (
+	"database-go/pkg/btree"
+)
+
+/*
+Keys are often namespaced by prefix ("user:123:..."); these go over or delete one
+namespace with a range scan from the prefix to btree.PrefixEnd of it.
+*/
+
+// Call fn on every key starting with prefix in order, as of the snapshot.
+func (s *Snapshot) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	return s.Range(prefix, btree.PrefixEnd(prefix), fn)
+}
+
+// Call fn on every key starting with prefix in order, seeing the transaction's own writes.
+func (tx *Tx) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	return tx.Range(prefix, btree.PrefixEnd(prefix), fn)
+}
+
+// Scan over the last commit.
+func (db *DB) Scan(prefix []byte, fn func(key, val []byte) error) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return snap.Scan(prefix, fn)
+}
+
+/*
+Remove every key starting with prefix. Returns how many there were. The keys count
+as read, like Del, so a concurrent change to one of them conflicts.
+*/
+func (tx *Tx) DeletePrefix(prefix []byte) (int, error) {
+	n := 0
+	err := tx.Scan(prefix, func(key, _ []byte) error {
+		if _, err := tx.Del(key); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+/*
+DeletePrefix in its own transaction. The transaction buffers a delete for every key,
+so for a very large namespace use a Tx and commit every so often instead.
+*/
+func (db *DB) DeletePrefix(prefix []byte) (int, error) {
+	var n int
+	_, err := db.Update(func(tx *Tx) (err error) {
+		n, err = tx.DeletePrefix(prefix)
+		return err
+	})
+	return n, err
+}
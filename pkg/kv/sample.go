@@ -0,0 +1,87 @@
+package kv
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Random descents made per leaf a sample asks for before giving up on finding new ones
+	SAMPLE_PROBES_PER_LEAF = 4
+)
+
+/*
+Call fn on the pairs of roughly fraction of the leaves of the snapshot, like
+TABLESAMPLE SYSTEM: whole pages are sampled, found by random descents from the root,
+so the cost is proportional to the sample rather than to the size of the database.
+Pairs come in no particular order. A fraction of 1 or more reads everything.
+
+Scaling an aggregate over the sample by 1/fraction estimates it over everything; see
+RandomLeaf for why the estimate is only approximately unbiased.
+*/
+func (s *Snapshot) ScanSample(fraction float64, fn func(key, val []byte) error) error {
+	if fraction >= 1 {
+		return s.Range(nil, nil, fn)
+	}
+	if fraction <= 0 {
+		return nil
+	}
+
+	type pair struct{ key, val []byte }
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seen := map[uint64]bool{}
+	var total float64
+	for probes := 1; ; probes++ {
+		var pairs []pair
+		leaf, estimate, err := s.randomLeaf(rng, func(key, val []byte) error {
+			if bytes.Compare(key, userKeysStart()) >= 0 {
+				pairs = append(pairs, pair{append([]byte{}, key...), append([]byte{}, val...)})
+			}
+			return nil
+		})
+		if err != nil || leaf == 0 {
+			return err
+		}
+
+		if !seen[leaf] {
+			seen[leaf] = true
+			for _, p := range pairs {
+				if err := fn(p.key, p.val); err != nil {
+					return err
+				}
+			}
+		}
+
+		total += estimate
+		want := math.Ceil(fraction * total / float64(probes))
+		if float64(len(seen)) >= want || float64(probes) >= SAMPLE_PROBES_PER_LEAF*want {
+			return nil
+		}
+	}
+}
+
+// One random descent under the lock.
+func (s *Snapshot) randomLeaf(rng *rand.Rand, fn func(key, val []byte) error) (leaf uint64, estimate float64, err error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return 0, 0, err
+	}
+	err = s.read(func() (err error) {
+		leaf, estimate, err = s.tree.RandomLeaf(rng, fn)
+		return err
+	})
+	return leaf, estimate, err
+}
+
+// ScanSample over the last commit.
+func (db *DB) ScanSample(fraction float64, fn func(key, val []byte) error) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return snap.ScanSample(fraction, fn)
+}
@@ -0,0 +1,151 @@
+package kv
+
+import (
+	"bytes"
+	"database-go/pkg/btree"
+	"database-go/pkg/pager"
+	"errors"
+)
+
+// Returned by a snapshot after Release
+var ErrSnapshotReleased = errors.New("kv: snapshot has been released")
+
+/*
+A consistent read-only view of the database as of the commit it was taken at.
+Commits made afterwards, including by a transaction running alongside, aren't
+visible through it.
+
+On a handle from OpenReadOnly nothing stops the writer reusing the snapshot's pages,
+so reads return ErrStale once it has moved on. Take a new snapshot and start over.
+
+Reads only hold the database lock for one lookup or one step of a scan, so a long
+scan doesn't hold up the writer. The pages a snapshot can reach aren't reused until
+it is released, so the file grows while old snapshots are kept open.
+*/
+type Snapshot struct {
+	db       *DB
+	meta     pager.Meta
+	tree     *btree.BTree
+	released bool
+}
+
+// Take a snapshot of the last commit. It must be released when no longer needed.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		if _, err := db.pager.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+	meta := db.pager.Acquire()
+	return &Snapshot{db: db, meta: meta, tree: db.pager.TreeAt(meta)}, nil
+}
+
+// Look up the value stored under key as of the snapshot.
+func (s *Snapshot) Get(key []byte) (val []byte, err error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	err = s.read(func() (err error) {
+		val, err = getFrom(s.tree, key)
+		return err
+	})
+	return val, err
+}
+
+/*
+Call fn on every key in [start, end) in order, as of the snapshot. A nil end means
+no upper bound. Stops early if fn returns an error, returning that error.
+The key and value passed to fn are copies the caller may keep.
+*/
+func (s *Snapshot) Range(start, end []byte, fn func(key, val []byte) error) error {
+	if bytes.Compare(start, userKeysStart()) < 0 {
+		start = userKeysStart()
+	}
+	c := s.tree.NewCursor()
+	key, val, err := s.step(func() error { return c.Seek(start) }, c)
+	for ; err == nil && key != nil; key, val, err = s.step(c.Next, c) {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			return nil
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Move the cursor under the lock, returning copies of where it ends up, or a nil key at the end.
+func (s *Snapshot) step(move func() error, c *btree.Cursor) (key, val []byte, err error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+
+	err = s.read(func() error {
+		if err := move(); err != nil || !c.Valid() {
+			return err
+		}
+		key, val = append([]byte{}, c.Key()...), append([]byte{}, c.Value()...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, val, nil
+}
+
+// Let the pages only this snapshot could see be reused. Safe to call more than once.
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if s.db.pager != nil {
+		s.db.pager.Release(s.meta)
+	}
+}
+
+/*
+Run fn against the snapshot's pages. On a read-only handle the writer may have
+overwritten them while they were read, in which case the result is replaced with ErrStale.
+*/
+func (s *Snapshot) read(fn func() error) error {
+	err := func() (err error) {
+		defer recoverPageError(&err)
+		return fn()
+	}()
+	if !s.db.pager.ReadOnly() {
+		return err
+	}
+	stale, serr := s.db.pager.Stale(s.meta)
+	if serr != nil {
+		return serr
+	}
+	if stale {
+		return ErrStale
+	}
+	return err
+}
+
+func (s *Snapshot) check() error {
+	if s.released {
+		return ErrSnapshotReleased
+	}
+	if s.db.pager == nil {
+		return ErrClosed
+	}
+	return nil
+}
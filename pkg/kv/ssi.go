@@ -0,0 +1,170 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+Serializable transactions use serializable snapshot isolation (SSI). On top of
+snapshot isolation, where the first of two concurrent transactions writing a key
+wins, it looks for the pattern every non-serializable run of snapshot transactions
+contains: a transaction T with both a concurrent reader R of something it writes
+and a concurrent writer W of something it read,
+
+	R --rw--> T --rw--> W
+
+an rw edge meaning the first read a value the second then overwrote, so the first
+has to come before the second in any serial order. Such a T, the pivot, is only
+dangerous if W commits first, which is the only order Commit can see it in. Commit
+aborts whichever of the three hasn't committed yet; that may abort a transaction
+that would have been fine, but never lets a non-serializable one through.
+
+Reads are tracked as individual keys, plus the ranges scanned by Range, so a
+concurrent insert into a range that was read counts as overwriting it. Finished
+transactions are remembered, with their reads and edges, for as long as a
+transaction that overlapped them is running.
+*/
+
+// A scanned range, [start, end), unbounded above if end is nil.
+type keyRange struct {
+	start, end []byte
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= string(r.start) && (r.end == nil || key < string(r.end))
+}
+
+// Whether the transaction takes part in SSI.
+func (tx *Tx) ssi() bool {
+	return tx.level == ISOLATION_SERIALIZABLE || tx.level == ISOLATION_SINGLE_WRITER
+}
+
+// Whether the transaction read any of keys, or might have: all means any key at all.
+func (tx *Tx) readAny(keys map[string]struct{}, all bool) bool {
+	if all {
+		return len(tx.reads) > 0 || len(tx.ranges) > 0
+	}
+	for key := range keys {
+		if _, ok := tx.reads[key]; ok {
+			return true
+		}
+		for _, r := range tx.ranges {
+			if r.contains(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Find the rw edges committing tx would make with concurrent serializable
+transactions, and refuse if one of them completes a dangerous structure. Returns the
+transactions with an edge into tx and those it has an edge to, for markEdges once
+the commit has gone through. Called with db.mu held.
+*/
+func (tx *Tx) checkSSI(written map[string]struct{}) (in, out []*Tx, err error) {
+	db := tx.db
+	if tx.doomed {
+		return nil, nil, fmt.Errorf("%w: a later commit made it a pivot between concurrent transactions", ErrConflict)
+	}
+
+	// tx --rw--> C, for C committed since tx began writing something tx read
+	outConflict := false
+	for _, c := range db.commits {
+		if c.seq <= tx.start.Seq || !tx.readAny(c.keys, c.all) {
+			continue
+		}
+		outConflict = true
+		if c.tx == nil {
+			continue
+		}
+		if c.tx.outConflict {
+			return nil, nil, fmt.Errorf("%w: commit %d was a pivot", ErrConflict, c.seq)
+		}
+		out = append(out, c.tx)
+	}
+
+	// R --rw--> tx, for R running alongside tx that read something tx writes
+	inConflict := false
+	if len(written) > 0 {
+		check := func(r *Tx) error {
+			if r == tx || !r.readAny(written, false) {
+				return nil
+			}
+			inConflict = true
+			if r.done && r.inConflict {
+				return fmt.Errorf("%w: a committed transaction that read its writes was a pivot", ErrConflict)
+			}
+			in = append(in, r)
+			return nil
+		}
+		for r := range db.running {
+			if err := check(r); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, r := range db.finished {
+			if r.ended > tx.begun {
+				if err := check(r); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	if inConflict && outConflict {
+		return nil, nil, fmt.Errorf("%w: it would be a pivot between concurrent transactions", ErrConflict)
+	}
+	tx.inConflict, tx.outConflict = inConflict, outConflict
+	return in, out, nil
+}
+
+// Record the edges of a commit checked by checkSSI. Called with db.mu held.
+func (tx *Tx) markEdges(in, out []*Tx) {
+	for _, r := range in {
+		r.outConflict = true
+		// A running reader is now a pivot, and can't commit
+		if !r.done && r.inConflict {
+			r.doomed = true
+		}
+	}
+	for _, w := range out {
+		w.inConflict = true
+	}
+}
+
+// Record the part of a scan that was read. Called with db.mu held.
+func (tx *Tx) readRange(start, end []byte) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return
+	}
+	tx.ranges = append(tx.ranges, keyRange{append([]byte{}, start...), end})
+}
+
+/*
+Move a finished SSI transaction out of the running set, remembering it if it
+committed, and forget finished ones nothing running overlaps. Called with db.mu held.
+*/
+func (tx *Tx) finishSSI(committed bool) {
+	db := tx.db
+	db.clock++
+	tx.ended = db.clock
+	delete(db.running, tx)
+	if committed {
+		db.finished = append(db.finished, tx)
+	}
+
+	oldest, found := uint64(0), false
+	for r := range db.running {
+		if !found || r.begun < oldest {
+			oldest, found = r.begun, true
+		}
+	}
+	n := 0
+	for n < len(db.finished) && (!found || db.finished[n].ended < oldest) {
+		n++
+	}
+	db.finished = db.finished[n:]
+}
@@ -0,0 +1,53 @@
+package kv
+
+import (
+	"database-go/pkg/bufpool"
+)
+
+// A summary of a handle's state, for monitoring.
+type Stats struct {
+	// The last commit
+	Version uint64
+	// Size of the file in pages, including free ones
+	Pages    uint64
+	PageSize int
+	Cache    bufpool.Stats
+	// Pins on commits by snapshots and transactions, and pages held back from reuse for them
+	Readers   int
+	HeldPages int
+	// Running transactions
+	Running int
+	// Earlier commits readable through SnapshotAt
+	RetainedVersions int
+	KeyVersions      bool
+	ReadOnly         bool
+}
+
+func (db *DB) Stats() (Stats, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return Stats{}, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		if _, err := db.pager.Refresh(); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	meta := db.pager.Meta()
+	s := Stats{
+		Version:          meta.Seq,
+		Pages:            meta.NPages,
+		PageSize:         db.pager.PageSize(),
+		Cache:            db.pager.CacheStats(),
+		RetainedVersions: len(db.versions),
+		KeyVersions:      db.keyVersions,
+		ReadOnly:         db.pager.ReadOnly(),
+	}
+	s.Readers, s.HeldPages = db.pager.ReaderStats()
+	for _, n := range db.active {
+		s.Running += n
+	}
+	return s, nil
+}
@@ -0,0 +1,38 @@
+package kv
+
+import (
+	"context"
+)
+
+/*
+Make the transaction's reads and its commit from now on part of the request in ctx,
+so they show as spans of its trace, down to page reads and fsyncs; see pkg/trace.
+*/
+func (tx *Tx) SetContext(ctx context.Context) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.ctx = ctx
+}
+
+// The context set with SetContext, context.Background() if none was.
+func (tx *Tx) Context() context.Context {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// Trace the pager's I/O as part of the transaction's request until the function returned is called. Called with db.mu held.
+func (tx *Tx) traced() func() {
+	return tx.db.pager.Trace(tx.ctx)
+}
+
+// Update, with the transaction part of the request in ctx; see Tx.SetContext.
+func (db *DB) UpdateContext(ctx context.Context, change func(tx *Tx) error) (uint64, error) {
+	return db.Update(func(tx *Tx) error {
+		tx.SetContext(ctx)
+		return change(tx)
+	})
+}
@@ -0,0 +1,471 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"database-go/pkg/btree"
+	"database-go/pkg/pager"
+	"database-go/pkg/trace"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// Returned by every method of a transaction after Commit or Rollback
+	ErrTxDone = errors.New("kv: transaction has already been committed or rolled back")
+	// Returned by Commit when a key the transaction read was changed by a concurrent commit
+	ErrConflict = errors.New("kv: transaction conflicts with a concurrent commit")
+)
+
+/*
+A read-write transaction. Any number can run at once, and they are serializable:
+committing them has the same effect as running them one at a time in some order.
+
+A transaction reads the commit that was current when it began, plus its own writes.
+Writes are buffered in memory and only applied to the tree by Commit, which first
+checks that no commit since it began wrote a key it writes, and that what it read
+doesn't make the transactions running alongside it impossible to put in order (see
+ssi.go). If either check fails, Commit rolls it back and returns ErrConflict, and
+the whole transaction should be run again:
+
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		err = transfer(tx, from, to, amount)
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if !errors.Is(err, kv.ErrConflict) {
+			return err
+		}
+	}
+
+That is the default, ISOLATION_SERIALIZABLE. BeginLevel starts a transaction at a
+weaker level, which conflicts less, or at ISOLATION_SINGLE_WRITER, which never does.
+*/
+type Tx struct {
+	db    *DB
+	level IsolationLevel
+	// The commit the transaction reads, pinned until it finishes
+	start pager.Meta
+	tree  *btree.BTree
+	// Buffered writes by key; a nil entry is a delete
+	writes map[string]*[]byte
+	// Keys whose committed value the transaction depends on
+	reads map[string]struct{}
+	// Ranges scanned, so keys added to them count as read too
+	ranges []keyRange
+	// The commit of the transaction's writes, once made
+	version   uint64
+	done      bool
+	committed bool
+
+	// For SSI: when the transaction began and finished on db.clock, whether it has rw
+	// edges in and out, and whether a later commit has already made it fail
+	begun, ended            uint64
+	inConflict, outConflict bool
+	doomed                  bool
+
+	// The request the transaction is part of, for tracing; see SetContext
+	ctx context.Context
+}
+
+// The keys written by one commit, kept while a transaction that began before it is running
+type committedWrites struct {
+	seq  uint64
+	keys map[string]struct{}
+	// Set by commits that may have written any key, like BulkLoad
+	all bool
+	// The serializable transaction that made the commit, if it was one
+	tx *Tx
+}
+
+// Start a serializable transaction reading the last commit.
+func (db *DB) Begin() (*Tx, error) {
+	return db.BeginLevel(ISOLATION_SERIALIZABLE)
+}
+
+// Look up key, seeing the transaction's own writes.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return nil, err
+	}
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	defer tx.traced()()
+	return tx.get(key)
+}
+
+func (tx *Tx) get(key []byte) ([]byte, error) {
+	if val, ok := tx.writes[string(key)]; ok {
+		if val == nil {
+			return nil, ErrKeyNotFound
+		}
+		return *val, nil
+	}
+	tx.refresh()
+	val, err := getFrom(tx.tree, key)
+	if err == nil || errors.Is(err, ErrKeyNotFound) {
+		tx.reads[string(key)] = struct{}{}
+	}
+	return val, err
+}
+
+// Store val under key, replacing any existing value.
+func (tx *Tx) Set(key, val []byte) error {
+	return tx.write(key, &val)
+}
+
+/*
+Store val under key like Set, or if key is nil under a new key generated as
+Options.AutoKey says, and return the key. Returns ErrNoAutoKey for a nil key when
+AutoKey isn't set.
+*/
+func (tx *Tx) Insert(key, val []byte) ([]byte, error) {
+	if key == nil {
+		var err error
+		if key, err = tx.db.autoKey(); err != nil {
+			return nil, err
+		}
+	}
+	return key, tx.write(key, &val)
+}
+
+// Buffer a write of key without reading it; a nil val deletes it.
+func (tx *Tx) write(key []byte, val *[]byte) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if val == nil {
+		if err := tx.tree.CheckLimit(key, nil); err != nil {
+			return err
+		}
+		tx.writes[string(key)] = nil
+		return nil
+	}
+	if err := tx.tree.CheckLimit(key, *val); err != nil {
+		return err
+	}
+	defer tx.traced()()
+	if err := tx.db.checkIndexLimits(tx.tree, key, *val); err != nil {
+		return err
+	}
+	copied := append([]byte{}, *val...)
+	tx.writes[string(key)] = &copied
+	return nil
+}
+
+// Remove key. Returns whether it was there.
+func (tx *Tx) Del(key []byte) (bool, error) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return false, err
+	}
+	if err := checkUserKey(key); err != nil {
+		return false, err
+	}
+	if err := tx.tree.CheckLimit(key, nil); err != nil {
+		return false, err
+	}
+
+	defer tx.traced()()
+	_, err := tx.get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	tx.writes[string(key)] = nil
+	return true, nil
+}
+
+/*
+Call fn on every key in [start, end) in order, seeing the transaction's own writes.
+A nil end means no upper bound. fn may write through the transaction, but the scan
+only sees the writes made before it started.
+
+The part of the range the scan covers counts as read, up to the key fn stopped it at
+if it did, so a concurrent commit adding a key to it can conflict as much as one
+changing a key it returned. Under ISOLATION_READ_COMMITTED the scan reads the commit
+that was latest when it started.
+*/
+func (tx *Tx) Range(start, end []byte, fn func(key, val []byte) error) error {
+	if bytes.Compare(start, userKeysStart()) < 0 {
+		start = userKeysStart()
+	}
+
+	tx.db.mu.Lock()
+	if err := tx.check(); err != nil {
+		tx.db.mu.Unlock()
+		return err
+	}
+	tx.refresh()
+	// A read-committed transaction may move on while the scan runs, so it pins what it scans
+	tree, meta := tx.tree, tx.start
+	tx.db.pager.Pin(meta)
+	// The key fn stopped the scan at, if it did
+	var stopped []byte
+	defer func() {
+		tx.db.mu.Lock()
+		defer tx.db.mu.Unlock()
+		if tx.db.pager != nil {
+			tx.db.pager.Release(meta)
+		}
+		if !tx.done && stopped != nil {
+			tx.readRange(start, append(stopped, 0))
+		} else if !tx.done {
+			tx.readRange(start, end)
+		}
+	}()
+	var pending []string
+	writes := map[string]*[]byte{}
+	for key, val := range tx.writes {
+		if key >= string(start) && (end == nil || key < string(end)) {
+			pending = append(pending, key)
+			writes[key] = val
+		}
+	}
+	tx.db.mu.Unlock()
+	sort.Strings(pending)
+
+	c := tree.NewCursor()
+	key, val, err := tx.step(func() error { return c.Seek(start) }, c, end)
+	for err == nil && (key != nil || len(pending) > 0) {
+		if len(pending) > 0 && (key == nil || pending[0] <= string(key)) {
+			// The transaction's own write comes first, replacing the committed pair if it has the same key
+			wkey := pending[0]
+			pending = pending[1:]
+			if key != nil && wkey == string(key) {
+				key, val, err = tx.step(c.Next, c, end)
+			}
+			if wval := writes[wkey]; wval != nil {
+				if err := fn([]byte(wkey), append([]byte{}, *wval...)); err != nil {
+					stopped = []byte(wkey)
+					return err
+				}
+			}
+			continue
+		}
+		if err := fn(key, val); err != nil {
+			stopped = key
+			return err
+		}
+		key, val, err = tx.step(c.Next, c, end)
+	}
+	return err
+}
+
+/*
+Move the cursor under the lock, returning copies of where it ends up, or a nil key at
+the end or past end. The key isn't recorded as read on its own; Range records the
+whole range it covered.
+*/
+func (tx *Tx) step(move func() error, c *btree.Cursor, end []byte) (key, val []byte, err error) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return nil, nil, err
+	}
+	defer tx.traced()()
+
+	err = func() (err error) {
+		defer recoverPageError(&err)
+		if err := move(); err != nil || !c.Valid() {
+			return err
+		}
+		if end != nil && bytes.Compare(c.Key(), end) >= 0 {
+			return nil
+		}
+		key, val = append([]byte{}, c.Key()...), append([]byte{}, c.Value()...)
+		return nil
+	}()
+	if err != nil || key == nil {
+		return nil, nil, err
+	}
+	return key, val, nil
+}
+
+/*
+Validate the transaction against everything committed since it began, then apply its
+writes and make them durable. Returns ErrConflict if it has to be run again. The
+transaction is finished either way.
+*/
+func (tx *Tx) Commit() (err error) {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.check(); err != nil {
+		return err
+	}
+	ctx, span := trace.StartChild(tx.ctx, "kv.commit")
+	span.SetAttr("writes", len(tx.writes))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	if err := tx.db.waitForWriter(tx); err != nil {
+		return err
+	}
+	if err := tx.check(); err != nil {
+		return err
+	}
+	defer tx.finish()
+	defer tx.db.pager.Trace(ctx)()
+
+	written := make(map[string]struct{}, len(tx.writes))
+	for key := range tx.writes {
+		written[key] = struct{}{}
+	}
+	var in, out []*Tx
+	switch {
+	case tx.ssi():
+		// First committer wins, then look for dangerous structures. Even a read-only
+		// transaction can complete one.
+		if err := tx.validate(written); err != nil {
+			return err
+		}
+		var err error
+		if in, out, err = tx.checkSSI(written); err != nil {
+			return err
+		}
+	case tx.level == ISOLATION_SNAPSHOT:
+		if err := tx.validate(written); err != nil {
+			return err
+		}
+	}
+
+	if len(tx.writes) > 0 {
+		if err := tx.apply(); err != nil {
+			tx.db.pager.Rollback()
+			return err
+		}
+		tx.db.committed()
+	}
+	tx.markEdges(in, out)
+	tx.committed = true
+	return nil
+}
+
+// Check none of keys was written by a commit since the transaction began.
+func (tx *Tx) validate(keys map[string]struct{}) error {
+	for _, c := range tx.db.commits {
+		if c.seq <= tx.start.Seq {
+			continue
+		}
+		if c.all && len(keys) > 0 {
+			return fmt.Errorf("%w: commit %d may have written anything", ErrConflict, c.seq)
+		}
+		for key := range keys {
+			if _, ok := c.keys[key]; ok {
+				return fmt.Errorf("%w: %q was written by commit %d", ErrConflict, key, c.seq)
+			}
+		}
+	}
+	return nil
+}
+
+// Write the buffered changes onto the latest commit and commit them.
+func (tx *Tx) apply() (err error) {
+	defer recoverPageError(&err)
+
+	keys := make([]string, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tree := tx.db.pager.Tree()
+	if err := tx.db.applyWrites(tree, keys, tx.writes); err != nil {
+		return err
+	}
+	if err := tx.db.pager.Commit(tree.Root()); err != nil {
+		return err
+	}
+	tx.version = tx.db.pager.Meta().Seq
+
+	written := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		written[key] = struct{}{}
+	}
+	c := committedWrites{seq: tx.version, keys: written}
+	if tx.ssi() {
+		c.tx = tx
+	}
+	tx.db.commits = append(tx.db.commits, c)
+	return nil
+}
+
+// Discard the transaction. Does nothing if it is already finished, so it can always be deferred.
+func (tx *Tx) Rollback() {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.finish()
+}
+
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.db.pager == nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Unpin the transaction's commit and let other writers go ahead. Called with db.mu held.
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.writes = nil
+	if tx.ssi() {
+		tx.finishSSI(tx.committed)
+	}
+	if !tx.committed || !tx.ssi() {
+		// A committed serializable transaction's reads are kept while one it overlapped runs
+		tx.reads, tx.ranges = nil, nil
+	}
+	if tx.db.writer == tx {
+		tx.db.writer = nil
+		tx.db.writerDone.Broadcast()
+	}
+	if tx.db.pager != nil {
+		tx.unpin()
+	}
+}
+
+// Unpin the commit the transaction reads, and forget writes no running transaction
+// needs to check against any more. Called with db.mu held.
+func (tx *Tx) unpin() {
+	db := tx.db
+	db.pager.Release(tx.start)
+	if db.active[tx.start.Seq]--; db.active[tx.start.Seq] <= 0 {
+		delete(db.active, tx.start.Seq)
+	}
+
+	oldest, found := uint64(0), false
+	for seq := range db.active {
+		if !found || seq < oldest {
+			oldest, found = seq, true
+		}
+	}
+	n := 0
+	for n < len(db.commits) && (!found || db.commits[n].seq <= oldest) {
+		n++
+	}
+	db.commits = db.commits[n:]
+}
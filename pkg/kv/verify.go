@@ -0,0 +1,44 @@
+package kv
+
+import (
+	"database-go/pkg/btree"
+	"database-go/pkg/pager"
+)
+
+// What Verify found: the tree's report, with the free list's violations added to it.
+type VerifyReport struct {
+	btree.CheckReport
+	FreeList pager.FreeListReport
+}
+
+/*
+Check the whole file as of the last commit, like fsck: every page of the tree (see
+btree.Check) and the free list against it (see pager.CheckFreeList). Problems are
+collected in the report's Violations rather than returned; the error is only for a
+handle that can't be checked at all.
+
+Verify reads everything under the handle's lock, so other operations on it wait.
+*/
+func (db *DB) Verify() (*VerifyReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+
+	var r *VerifyReport
+	check := func() error {
+		r = &VerifyReport{CheckReport: *db.pager.Tree().Check()}
+		r.FreeList = db.pager.CheckFreeList(r.Pages)
+		r.Violations = append(r.Violations, r.FreeList.Violations...)
+		return nil
+	}
+	if db.pager.ReadOnly() {
+		if err := db.readLatest(check); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	check()
+	return r, nil
+}
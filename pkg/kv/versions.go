@@ -0,0 +1,174 @@
+package kv
+
+import (
+	"database-go/pkg/pager"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// Returned by SnapshotAt for a version that was never committed or has been collected
+	ErrVersionGone = errors.New("kv: version is no longer available")
+	// Returned by the AtLeast methods when the database hasn't got to the version yet
+	ErrVersionAhead = errors.New("kv: version has not been committed yet")
+)
+
+/*
+Every commit produces a new version of the database, numbered by its commit sequence
+number. A version stays readable while something pins its root: an open snapshot, or
+the DB itself for RetainFor after the commit. Pages only reachable from versions
+nobody pins are reused by later commits.
+
+The pins the DB holds are dropped by a collector goroutine, so old versions go away
+even when nothing is being written. Versions are held in memory only; after a
+restart just the latest one is available.
+*/
+type version struct {
+	meta pager.Meta
+	// When the version was committed
+	at time.Time
+}
+
+// The version of the last commit.
+func (db *DB) Version() (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return 0, ErrClosed
+	}
+	if db.pager.ReadOnly() {
+		if _, err := db.pager.Refresh(); err != nil {
+			return 0, err
+		}
+	}
+	return db.pager.Meta().Seq, nil
+}
+
+// Take a snapshot of an earlier version, if it is still retained.
+func (db *DB) SnapshotAt(seq uint64) (*Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return nil, ErrClosed
+	}
+	if seq == db.pager.Meta().Seq {
+		meta := db.pager.Acquire()
+		return &Snapshot{db: db, meta: meta, tree: db.pager.TreeAt(meta)}, nil
+	}
+	for _, v := range db.versions {
+		if v.meta.Seq == seq {
+			db.pager.Pin(v.meta)
+			return &Snapshot{db: db, meta: v.meta, tree: db.pager.TreeAt(v.meta)}, nil
+		}
+	}
+	return nil, ErrVersionGone
+}
+
+/*
+Versions double as consistency tokens. A write returns the version it committed (see
+Update and Tx.Version, and the Version of a sql.Result), and a read that must see it,
+perhaps through another API or another handle on the file, asks for at least that
+version. Versions of one file only ever increase.
+*/
+
+// Take a snapshot of the last commit, which must be version v or later.
+func (db *DB) SnapshotAtLeast(v uint64) (*Snapshot, error) {
+	s, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if s.meta.Seq < v {
+		s.Release()
+		return nil, fmt.Errorf("%w: want %d, at %d", ErrVersionAhead, v, s.meta.Seq)
+	}
+	return s, nil
+}
+
+// Start a transaction reading the last commit, which must be version v or later.
+func (db *DB) BeginAtLeast(v uint64) (*Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if tx.start.Seq < v {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: want %d, at %d", ErrVersionAhead, v, tx.start.Seq)
+	}
+	return tx, nil
+}
+
+/*
+The version the transaction reads, or once it has committed writes, the version of
+that commit.
+*/
+func (tx *Tx) Version() uint64 {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.version != 0 {
+		return tx.version
+	}
+	return tx.start.Seq
+}
+
+// Move the DB to a commit just made through its pager. Called with db.mu held.
+func (db *DB) committed() {
+	db.tree = db.pager.Tree()
+	if db.opts.RetainFor > 0 {
+		db.retain(time.Now())
+	}
+}
+
+// Pin the last commit for RetainFor. Called with db.mu held.
+func (db *DB) retain(now time.Time) {
+	db.versions = append(db.versions, version{meta: db.pager.Acquire(), at: now})
+}
+
+/*
+Drop the DB's pins on versions superseded more than RetainFor before now, letting
+their pages be reused once no snapshot holds them either. Returns how many were
+dropped. Called with db.mu held.
+*/
+func (db *DB) expire(now time.Time) int {
+	n := 0
+	// A version stops being current when the next one is committed
+	for n+1 < len(db.versions) && now.Sub(db.versions[n+1].at) >= db.opts.RetainFor {
+		db.pager.Release(db.versions[n].meta)
+		n++
+	}
+	db.versions = db.versions[n:]
+	return n
+}
+
+// Collect expired versions now rather than waiting for the collector. Returns how many were dropped.
+func (db *DB) GC() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pager == nil {
+		return 0, ErrClosed
+	}
+	return db.expire(time.Now()), nil
+}
+
+// The collector goroutine, running until Close.
+func (db *DB) collect() {
+	ticker := time.NewTicker(db.opts.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case now := <-ticker.C:
+			db.mu.Lock()
+			if db.pager != nil {
+				db.expire(now)
+			}
+			db.mu.Unlock()
+		}
+	}
+}
+
+// The version the snapshot reads.
+func (s *Snapshot) Version() uint64 {
+	return s.meta.Seq
+}
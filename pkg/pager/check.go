@@ -0,0 +1,68 @@
+package pager
+
+import (
+	"database-go/pkg/btree"
+	"fmt"
+)
+
+// What CheckFreeList found.
+type FreeListReport struct {
+	// Pages on the list, and pages holding it
+	Free      int
+	ListPages int
+	// Pages neither in use nor on the list
+	Leaked     int
+	Violations []btree.Violation
+}
+
+/*
+Check the committed free list, as it is in the file, against used, the pages the
+committed tree uses (see btree.CheckReport.Pages). Every page after the meta page
+has to be exactly one of: used, on the list, or holding the list. Pages freed while
+a snapshot still reads them are already on the list, so there is no slack for them.
+*/
+func (p *Pager) CheckFreeList(used []uint64) FreeListReport {
+	var r FreeListReport
+	fail := func(ptr uint64, format string, args ...interface{}) {
+		r.Violations = append(r.Violations, btree.Violation{Page: ptr, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	free, listPages, err := p.loadFreeList(p.meta.FreeHead)
+	if err != nil {
+		fail(0, "reading the free list: %v", err)
+		return r
+	}
+	r.Free, r.ListPages = len(free), len(listPages)
+
+	const (
+		USED = iota + 1
+		FREE
+		LIST
+	)
+	names := map[int]string{USED: "used by the tree", FREE: "on the free list", LIST: "holding the free list"}
+	owner := map[uint64]int{}
+	claim := func(ptrs []uint64, as int) {
+		for _, ptr := range ptrs {
+			if ptr == META_PAGE || ptr >= p.meta.NPages {
+				fail(ptr, "%s, but out of range", names[as])
+				continue
+			}
+			if prev, ok := owner[ptr]; ok {
+				fail(ptr, "%s, but also %s", names[as], names[prev])
+				continue
+			}
+			owner[ptr] = as
+		}
+	}
+	claim(used, USED)
+	claim(listPages, LIST)
+	claim(free, FREE)
+
+	for ptr := uint64(1); ptr < p.meta.NPages; ptr++ {
+		if _, ok := owner[ptr]; !ok {
+			r.Leaked++
+			fail(ptr, "neither used nor free")
+		}
+	}
+	return r
+}
@@ -0,0 +1,57 @@
+package pager
+
+import (
+	"database-go/pkg/btree"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Returned, wrapped with the page number, when a page read from the file fails its checksum
+var ErrChecksumMismatch = errors.New("pager: page checksum mismatch")
+
+/*
+Every page but the meta page ends in a trailer the tree leaves free:
+
+	| LSN | crc32 |
+
+The LSN (log sequence number) is the sequence number of the commit that wrote the
+page. The tree is copy-on-write, so a page keeps its contents from then until it is
+freed, and the pages a commit's tree uses with an LSN above n are exactly the ones
+written since commit n, which is what an incremental backup copies.
+
+The crc32 covers the rest of the page, LSN included, and the page number, so a page
+written to the wrong place fails too. Pages are sealed when they are committed and
+checked whenever one is read back from the file, so bit rot shows up as an error
+naming the page rather than as garbage handed to the tree.
+*/
+const (
+	PAGE_TRAILER_SIZE  = btree.PAGE_TRAILER_SIZE
+	PAGE_LSN_SIZE      = 8
+	PAGE_CHECKSUM_SIZE = PAGE_TRAILER_SIZE - PAGE_LSN_SIZE
+)
+
+func pageChecksum(ptr uint64, page []byte) uint32 {
+	var num [8]byte
+	binary.LittleEndian.PutUint64(num[:], ptr)
+	return crc32.Update(crc32.ChecksumIEEE(num[:]), crc32.IEEETable, page[:len(page)-PAGE_CHECKSUM_SIZE])
+}
+
+// Store lsn and the checksum of page in its trailer.
+func sealPage(ptr, lsn uint64, page []byte) {
+	binary.LittleEndian.PutUint64(page[len(page)-PAGE_TRAILER_SIZE:], lsn)
+	binary.LittleEndian.PutUint32(page[len(page)-PAGE_CHECKSUM_SIZE:], pageChecksum(ptr, page))
+}
+
+func checkPage(ptr uint64, page []byte) error {
+	if binary.LittleEndian.Uint32(page[len(page)-PAGE_CHECKSUM_SIZE:]) != pageChecksum(ptr, page) {
+		return fmt.Errorf("%w: page %d", ErrChecksumMismatch, ptr)
+	}
+	return nil
+}
+
+// The LSN of a committed page, as read with PageGet: the sequence number of the commit that wrote it.
+func PageLSN(page []byte) uint64 {
+	return binary.LittleEndian.Uint64(page[len(page)-PAGE_TRAILER_SIZE:])
+}
@@ -0,0 +1,99 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Node type for free list pages, next to btree.NODE and btree.LEAF
+	FREE_LIST = 3
+
+	// Free list page layout: | type | count | next | count x page numbers | ... | trailer |
+	FREE_LIST_HEADER = 2 + 2 + 8
+)
+
+/*
+The free list is a linked list of pages, each holding the numbers of as many unused
+pages as fit. The head is recorded in the meta page.
+
+The whole list is loaded into memory on open and rewritten on every commit. The new
+list is written into pages that were already free in the committed state (or
+appended), never into pages the committed state still depends on, so a crash before
+the meta page is updated leaves the old list intact.
+*/
+
+// Entries held by one list page.
+func (p *Pager) freeListCapacity() int {
+	return (p.pageSize - FREE_LIST_HEADER - PAGE_TRAILER_SIZE) / 8
+}
+
+// Number of list pages needed to hold count entries.
+func (p *Pager) freeListPagesFor(count int) int {
+	capacity := p.freeListCapacity()
+	return (count + capacity - 1) / capacity
+}
+
+// Read the list starting at head. Returns the free pages and the pages holding the list.
+func (p *Pager) loadFreeList(head uint64) ([]uint64, []uint64, error) {
+	var free, pages []uint64
+	for ptr := head; ptr != 0; {
+		if ptr >= p.flushed {
+			return nil, nil, fmt.Errorf("%w: free list page %d out of range", ErrCorrupt, ptr)
+		}
+		if len(pages) > int(p.flushed) {
+			return nil, nil, fmt.Errorf("%w: cycle in free list", ErrCorrupt)
+		}
+
+		page := make([]byte, p.pageSize)
+		if _, err := p.src.ReadAt(page, p.offset(ptr)); err != nil {
+			return nil, nil, err
+		}
+		if err := checkPage(ptr, page); err != nil {
+			return nil, nil, err
+		}
+		if binary.LittleEndian.Uint16(page[0:2]) != FREE_LIST {
+			return nil, nil, fmt.Errorf("%w: page %d is not a free list page", ErrCorrupt, ptr)
+		}
+		count := binary.LittleEndian.Uint16(page[2:4])
+		if int(count) > p.freeListCapacity() {
+			return nil, nil, fmt.Errorf("%w: free list page %d has %d entries", ErrCorrupt, ptr, count)
+		}
+		for i := 0; i < int(count); i++ {
+			entry := binary.LittleEndian.Uint64(page[FREE_LIST_HEADER+8*i:])
+			if entry == META_PAGE || entry >= p.flushed {
+				return nil, nil, fmt.Errorf("%w: free list page %d lists page %d", ErrCorrupt, ptr, entry)
+			}
+			free = append(free, entry)
+		}
+		pages = append(pages, ptr)
+		ptr = binary.LittleEndian.Uint64(page[4:12])
+	}
+	return free, pages, nil
+}
+
+// Encode entries into the given list pages, linking them in order.
+func (p *Pager) encodeFreeList(pages []uint64, entries []uint64) [][]byte {
+	encoded := make([][]byte, len(pages))
+	for i := range pages {
+		page := make([]byte, p.pageSize)
+		chunk := entries
+		if len(chunk) > p.freeListCapacity() {
+			chunk = chunk[:p.freeListCapacity()]
+		}
+		entries = entries[len(chunk):]
+
+		var next uint64
+		if i+1 < len(pages) {
+			next = pages[i+1]
+		}
+		binary.LittleEndian.PutUint16(page[0:2], FREE_LIST)
+		binary.LittleEndian.PutUint16(page[2:4], uint16(len(chunk)))
+		binary.LittleEndian.PutUint64(page[4:12], next)
+		for j, ptr := range chunk {
+			binary.LittleEndian.PutUint64(page[FREE_LIST_HEADER+8*j:], ptr)
+		}
+		encoded[i] = page
+	}
+	return encoded
+}
@@ -0,0 +1,141 @@
+package pager
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+A copy of the file as it was at a pinned commit can be assembled page by page while
+commits carry on: the pages the commit's tree uses are copied as they are, keeping
+their numbers, and everything else in the range is free. The free list is rebuilt
+for those free pages rather than copied, since the live file's list has moved on,
+and page 0 gets a meta page for the commit alone. Opening the copy needs no log.
+
+Such a copy can later be brought up to a newer commit of the same file by writing
+just the pages that commit's tree uses with an LSN above the copy's commit, along
+with its free list and meta page: copy-on-write means every other page it uses is
+still as the copy has it. See Image.
+*/
+
+// The meta page and free list pages of a copy of the file at m, whose tree uses the pages in used.
+func (p *Pager) ImagePages(m Meta, used []uint64) (meta []byte, list map[uint64][]byte) {
+	inUse := make(map[uint64]bool, len(used))
+	for _, ptr := range used {
+		inUse[ptr] = true
+	}
+	var free []uint64
+	for ptr := uint64(1); ptr < m.NPages; ptr++ {
+		if !inUse[ptr] {
+			free = append(free, ptr)
+		}
+	}
+
+	// The list goes in the first free pages, as many as it takes to hold the rest
+	n := 0
+	for n < len(free) && n < p.freeListPagesFor(len(free)-n) {
+		n++
+	}
+	listPages, entries := free[:n], free[n:]
+	list = map[uint64][]byte{}
+	for i, page := range p.encodeFreeList(listPages, entries) {
+		sealPage(listPages[i], m.Seq, page)
+		list[listPages[i]] = page
+	}
+
+	m.FreeHead = 0
+	if n > 0 {
+		m.FreeHead = listPages[0]
+	}
+	meta = make([]byte, p.pageSize)
+	copy(meta[m.slot()*META_SLOT_SIZE:], m.encode())
+	return meta, list
+}
+
+// A copy of page ptr of the tree, as read with PageGet, ready to write into an image.
+func (p *Pager) ImagePage(ptr uint64, page []byte) []byte {
+	page = append([]byte{}, page...)
+	sealPage(ptr, PageLSN(page), page)
+	return page
+}
+
+/*
+A copy of the file made from ImagePages and ImagePage, opened to bring it forward to
+a later commit. Pages are written in place with WritePage, and the copy only moves
+to the new commit when Finish writes its meta page, after syncing them.
+*/
+type Image struct {
+	file *os.File
+	meta Meta
+}
+
+// Open the copy at path for writing. It must not be open as a database meanwhile.
+func OpenImage(path string) (*Image, error) {
+	p, err := OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := p.Meta()
+	p.Close()
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Image{file: file, meta: meta}, nil
+}
+
+// The commit the copy holds.
+func (im *Image) Meta() Meta {
+	return im.meta
+}
+
+// Write page ptr, which must carry its checksum, as from ImagePages or ImagePage.
+func (im *Image) WritePage(ptr uint64, page []byte) error {
+	if ptr == META_PAGE || len(page) != im.meta.Options.PageSize {
+		return fmt.Errorf("%w: page %d of %d bytes", ErrPageOutOfRange, ptr, len(page))
+	}
+	if err := checkPage(ptr, page); err != nil {
+		return err
+	}
+	_, err := im.file.WriteAt(page, int64(ptr)*int64(len(page)))
+	return err
+}
+
+/*
+Move the copy to the commit in meta, a meta page from ImagePages, once every page
+it needs has been written. The commit has to be newer than the copy's, with the same
+options.
+*/
+func (im *Image) Finish(meta []byte) error {
+	m, err := decodeMetaPage(meta)
+	if err != nil {
+		return err
+	}
+	if m.Seq <= im.meta.Seq || m.Options != im.meta.Options || len(meta) != m.Options.PageSize {
+		return fmt.Errorf("%w: meta page for commit %d does not follow commit %d", ErrCorrupt, m.Seq, im.meta.Seq)
+	}
+	size := int64(m.NPages) * int64(len(meta))
+	if info, err := im.file.Stat(); err != nil {
+		return err
+	} else if info.Size() < size {
+		if err := im.file.Truncate(size); err != nil {
+			return err
+		}
+	}
+	if err := im.file.Sync(); err != nil {
+		return err
+	}
+	if _, err := im.file.WriteAt(meta, 0); err != nil {
+		return err
+	}
+	if err := im.file.Sync(); err != nil {
+		return err
+	}
+	im.meta = m
+	return nil
+}
+
+func (im *Image) Close() error {
+	return im.file.Close()
+}
@@ -0,0 +1,92 @@
+package pager
+
+import (
+	"bytes"
+	"database-go/pkg/btree"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	META_PAGE      = 0
+	META_SIGNATURE = "database-go/v5\x00\x00"
+
+	// Page 0 holds two meta slots, each in its own disk sector so writing one can never tear the other.
+	// The slots sit at the same offsets whatever the page size, so they can be read before it is known.
+	// Slot layout: | signature | sequence | root | number of pages | free list head |
+	//              | page size | max key size | max inline value size | max value size | crc32 |
+	META_SLOT_SIZE = 512
+	META_SLOTS     = 2
+	META_SIZE      = len(META_SIGNATURE) + 8*4 + 4*4 + 4
+)
+
+/*
+Everything needed to find the committed state of the file. Commits alternate between
+the two slots of page 0, so the previous meta always survives a torn write, and
+whichever valid slot has the higher sequence number wins on open.
+*/
+type Meta struct {
+	Seq      uint64
+	Root     uint64
+	NPages   uint64
+	FreeHead uint64
+	// Fixed when the file is created
+	Options btree.Options
+}
+
+func (m Meta) slot() int {
+	return int(m.Seq % META_SLOTS)
+}
+
+func (m Meta) encode() []byte {
+	buf := make([]byte, META_SLOT_SIZE)
+	pos := copy(buf, META_SIGNATURE)
+	binary.LittleEndian.PutUint64(buf[pos:], m.Seq)
+	binary.LittleEndian.PutUint64(buf[pos+8:], m.Root)
+	binary.LittleEndian.PutUint64(buf[pos+16:], m.NPages)
+	binary.LittleEndian.PutUint64(buf[pos+24:], m.FreeHead)
+	binary.LittleEndian.PutUint32(buf[pos+32:], uint32(m.Options.PageSize))
+	binary.LittleEndian.PutUint32(buf[pos+36:], uint32(m.Options.MaxKeySize))
+	binary.LittleEndian.PutUint32(buf[pos+40:], uint32(m.Options.MaxInlineValSize))
+	binary.LittleEndian.PutUint32(buf[pos+44:], uint32(m.Options.MaxValSize))
+	binary.LittleEndian.PutUint32(buf[pos+48:], crc32.ChecksumIEEE(buf[:pos+48]))
+	return buf
+}
+
+func decodeMeta(buf []byte) (Meta, bool) {
+	pos := len(META_SIGNATURE)
+	if !bytes.Equal(buf[:pos], []byte(META_SIGNATURE)) {
+		return Meta{}, false
+	}
+	if crc32.ChecksumIEEE(buf[:pos+48]) != binary.LittleEndian.Uint32(buf[pos+48:]) {
+		return Meta{}, false
+	}
+	return Meta{
+		Seq:      binary.LittleEndian.Uint64(buf[pos:]),
+		Root:     binary.LittleEndian.Uint64(buf[pos+8:]),
+		NPages:   binary.LittleEndian.Uint64(buf[pos+16:]),
+		FreeHead: binary.LittleEndian.Uint64(buf[pos+24:]),
+		Options: btree.Options{
+			PageSize:         int(binary.LittleEndian.Uint32(buf[pos+32:])),
+			MaxKeySize:       int(binary.LittleEndian.Uint32(buf[pos+36:])),
+			MaxInlineValSize: int(binary.LittleEndian.Uint32(buf[pos+40:])),
+			MaxValSize:       int(binary.LittleEndian.Uint32(buf[pos+44:])),
+		},
+	}, true
+}
+
+// Pick the newest valid slot out of a meta page.
+func decodeMetaPage(page []byte) (Meta, error) {
+	var best Meta
+	found := false
+	for i := 0; i < META_SLOTS; i++ {
+		m, ok := decodeMeta(page[i*META_SLOT_SIZE:])
+		if ok && (!found || m.Seq > best.Seq) {
+			best, found = m, true
+		}
+	}
+	if !found {
+		return Meta{}, ErrNotDatabase
+	}
+	return best, nil
+}
@@ -0,0 +1,550 @@
+package pager
+
+import (
+	"context"
+	"database-go/pkg/btree"
+	"database-go/pkg/bufpool"
+	"database-go/pkg/trace"
+	"database-go/pkg/wal"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotDatabase = errors.New("pager: not a database file, or both meta slots are corrupt")
+	ErrCorrupt     = errors.New("pager: corrupt file")
+	// Options passed to Open don't match the ones the file was created with
+	ErrOptionsMismatch = errors.New("pager: options do not match the file")
+	ErrPageOutOfRange  = errors.New("pager: page out of range")
+	ErrReadOnly        = errors.New("pager: opened read-only")
+)
+
+const (
+	// The write-ahead log lives next to the database file
+	WAL_SUFFIX = "-wal"
+
+	// Pages kept in the buffer pool, 4MB worth at the default page size
+	DEFAULT_CACHE_PAGES = 1024
+)
+
+/*
+Maps page numbers to offsets in a single file. Page n lives at n*page size, where the
+page size is chosen when the file is created and recorded in the meta page.
+
+The tree is copy-on-write, so a page the committed tree references is never
+modified. Pages created since the last Commit are kept in memory and written out
+together when the new root is committed. Deleted pages go to the free list and are
+handed out again by PageNew once the commit that dropped them is durable.
+
+Every page except the meta page carries the commit that wrote it and a checksum,
+verified when it is read from the file; see PAGE_TRAILER_SIZE.
+
+Every commit goes through the write-ahead log first, so a crash part way through
+copying pages into the file is repaired on the next Open. The file on its own is
+also always consistent: new pages are synced before the meta slot is flipped, so
+anything reading the file directly sees either the old commit or the new one.
+*/
+type Pager struct {
+	file dbFile
+	// Where committed pages are read from: the file, or what OpenReaderAt was given
+	src      io.ReaderAt
+	wal      *wal.Log
+	pageSize int
+	// The last commit
+	meta Meta
+	// Current contents of page 0, both slots
+	metaPage []byte
+	// Number of pages in the file as of the last commit, including the meta page
+	flushed uint64
+	// Number of pages including those appended since the last commit
+	npages uint64
+	// Cached pages, plus the dirty pages written since the last commit
+	pool *bufpool.Pool
+
+	// Pages that can be handed out right now
+	free []uint64
+	// free as of the last commit, for rolling back
+	committedFree []uint64
+	// Pages deleted since the last commit; the committed tree may still use them
+	freed []uint64
+	// Pages holding the committed free list
+	listPages []uint64
+
+	// Number of open snapshots of each commit, by sequence number
+	readers map[uint64]int
+	// Committed frees that an open snapshot may still read
+	held []heldPages
+
+	// Opened with OpenReadOnly
+	readOnly bool
+	// Where every commit's batch is archived, if anywhere
+	archive *wal.Archive
+	// The request reads and commits are for, set by Trace
+	trace context.Context
+}
+
+// What the pager needs of the database file: an *os.File, or in tests one that fails on cue.
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+/*
+Open the database file at path, creating it if it does not exist.
+opts only matters when creating a file; an existing file keeps the options it was
+created with, and it is an error to ask for different ones.
+*/
+func Open(path string, opts btree.Options) (*Pager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := wal.Open(path + WAL_SUFFIX)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	p := &Pager{file: file, src: file, wal: log, readers: map[uint64]int{}}
+	p.pool = bufpool.New(DEFAULT_CACHE_PAGES, p.readPage)
+	if err := p.recover(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if err := p.loadMeta(opts); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Finish copying any commit that was logged but not fully written to the file.
+func (p *Pager) recover() error {
+	replayed, err := p.wal.Replay(func(ptr uint64, page []byte) error {
+		_, err := p.file.WriteAt(page, int64(ptr)*int64(len(page)))
+		if err != nil || ptr != META_PAGE {
+			return err
+		}
+		// Pages freed before they were ever written aren't in the log, but still need space in the file.
+		meta, err := decodeMetaPage(page)
+		if err != nil {
+			return err
+		}
+		return p.file.Truncate(max(int64(meta.NPages)*int64(len(page)), p.fileSize()))
+	})
+	if err != nil {
+		return fmt.Errorf("replaying write-ahead log: %w", err)
+	}
+	if replayed > 0 {
+		if err := p.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return p.wal.Reset()
+}
+
+// Size of the file in bytes, or 0 if it can't be determined.
+func (p *Pager) fileSize() int64 {
+	info, err := p.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Byte offset of a page in the file.
+func (p *Pager) offset(ptr uint64) int64 {
+	return int64(ptr) * int64(p.pageSize)
+}
+
+// Grow the file to hold npages pages.
+func (p *Pager) extend(npages uint64) error {
+	if p.fileSize() >= p.offset(npages) {
+		return nil
+	}
+	return p.file.Truncate(p.offset(npages))
+}
+
+func (p *Pager) loadMeta(opts btree.Options) error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// A brand new file, reserve the meta page.
+	if info.Size() == 0 {
+		opts = opts.WithDefaults()
+		if err := opts.Validate(); err != nil {
+			return err
+		}
+		p.pageSize = opts.PageSize
+		p.metaPage = make([]byte, p.pageSize)
+		p.meta = Meta{NPages: 1, Options: opts}
+		p.flushed = 1
+		p.npages = 1
+		return nil
+	}
+
+	meta, err := p.readMeta()
+	if err != nil {
+		return err
+	}
+	if err := checkOptions(opts, meta.Options); err != nil {
+		return err
+	}
+	p.pageSize = meta.Options.PageSize
+	p.metaPage = make([]byte, p.pageSize)
+	if _, err := p.file.ReadAt(p.metaPage, 0); err != nil {
+		return fmt.Errorf("reading meta page: %w", err)
+	}
+
+	if meta.NPages < 1 || info.Size() < p.offset(meta.NPages) {
+		return fmt.Errorf("%w: file is smaller than the recorded page count", ErrCorrupt)
+	}
+	if meta.Root >= meta.NPages {
+		return fmt.Errorf("%w: root out of range", ErrCorrupt)
+	}
+	p.meta = meta
+	p.flushed = meta.NPages
+	p.npages = meta.NPages
+
+	free, listPages, err := p.loadFreeList(meta.FreeHead)
+	if err != nil {
+		return err
+	}
+	p.free = free
+	p.committedFree = append([]uint64{}, free...)
+	p.listPages = listPages
+	return nil
+}
+
+// Read the newest valid meta slot from the file.
+func (p *Pager) readMeta() (Meta, error) {
+	// The slots are at fixed offsets, so read them before knowing the page size.
+	slots := make([]byte, META_SLOTS*META_SLOT_SIZE)
+	if _, err := p.src.ReadAt(slots, 0); err == io.EOF {
+		return Meta{}, fmt.Errorf("%w: file is too short to hold a meta page", ErrNotDatabase)
+	} else if err != nil {
+		return Meta{}, fmt.Errorf("reading meta page: %w", err)
+	}
+	meta, err := decodeMetaPage(slots)
+	if err != nil {
+		return Meta{}, err
+	}
+	if err := meta.Options.Validate(); err != nil {
+		return Meta{}, fmt.Errorf("%w: meta page: %w", ErrCorrupt, err)
+	}
+	return meta, nil
+}
+
+// Any option the caller set explicitly has to match what the file was created with.
+func checkOptions(want, have btree.Options) error {
+	mismatch := func(name string, want, have int) error {
+		if want != 0 && want != have {
+			return fmt.Errorf("%w: file was created with %s %d, not %d", ErrOptionsMismatch, name, have, want)
+		}
+		return nil
+	}
+	return errors.Join(
+		mismatch("page size", want.PageSize, have.PageSize),
+		mismatch("max key size", want.MaxKeySize, have.MaxKeySize),
+		mismatch("max inline value size", want.MaxInlineValSize, have.MaxInlineValSize),
+		mismatch("max value size", want.MaxValSize, have.MaxValSize),
+	)
+}
+
+// The root committed by the last successful Commit.
+func (p *Pager) Root() uint64 {
+	return p.meta.Root
+}
+
+// The meta record of the last successful Commit.
+func (p *Pager) Meta() Meta {
+	return p.meta
+}
+
+// Bytes per page.
+func (p *Pager) PageSize() int {
+	return p.pageSize
+}
+
+// A tree reading and writing pages through this pager, starting at the committed root.
+func (p *Pager) Tree() *btree.BTree {
+	// The options were validated when the file was opened
+	tree, _ := btree.NewBTree(p.meta.Root, p.meta.Options, p.PageGet, p.PageNew, p.PageDel)
+	return tree
+}
+
+/*
+Read a page through the buffer pool. Pages not yet committed are always in the pool.
+Panics on an invalid page number or a failed read, since the tree callbacks have no
+way to report errors. The panic value is an error, so callers can recover it.
+*/
+func (p *Pager) PageGet(ptr uint64) []byte {
+	page, err := p.pool.Get(ptr)
+	if err != nil {
+		panic(fmt.Errorf("pager: %w", err))
+	}
+	return page
+}
+
+// Read a committed page from the file, for buffer pool misses.
+func (p *Pager) readPage(ptr uint64) ([]byte, error) {
+	if ptr == META_PAGE || ptr >= p.flushed {
+		return nil, fmt.Errorf("%w: %d", ErrPageOutOfRange, ptr)
+	}
+	_, span := trace.StartChild(p.trace, "pager.read")
+	span.SetAttr("page", ptr)
+	defer span.End()
+	page := make([]byte, p.pageSize)
+	if _, err := p.src.ReadAt(page, p.offset(ptr)); err != nil {
+		span.SetError(err)
+		return nil, fmt.Errorf("reading page %d: %w", ptr, err)
+	}
+	if err := checkPage(ptr, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Buffer pool hit/miss counters.
+func (p *Pager) CacheStats() bufpool.Stats {
+	return p.pool.Stats()
+}
+
+// Allocate a page holding a copy of node, reusing a free page if there is one.
+func (p *Pager) PageNew(node []byte) uint64 {
+	if p.readOnly {
+		panic(ErrReadOnly)
+	}
+	if len(node) > p.pageSize {
+		panic(fmt.Errorf("%w: node of %d bytes does not fit in a page", ErrPageOutOfRange, len(node)))
+	}
+	page := make([]byte, p.pageSize)
+	copy(page, node)
+
+	var ptr uint64
+	if n := len(p.free); n > 0 {
+		ptr = p.free[n-1]
+		p.free = p.free[:n-1]
+	} else {
+		ptr = p.npages
+		p.npages++
+	}
+	p.pool.PutDirty(ptr, page)
+	return ptr
+}
+
+// Deallocate a page.
+func (p *Pager) PageDel(ptr uint64) {
+	if p.readOnly {
+		panic(ErrReadOnly)
+	}
+	// Nothing committed refers to a page written in this transaction, so it can be reused immediately.
+	if p.pool.IsDirty(ptr) {
+		p.pool.Remove(ptr)
+		p.free = append(p.free, ptr)
+		return
+	}
+	p.freed = append(p.freed, ptr)
+}
+
+/*
+Write every page created since the last commit and the new free list, then flip the
+meta page to the new root. The commit is durable as soon as it is in the write-ahead
+log; the file itself is updated afterwards. If that fails the batch is taken out of
+the log again, so an error means the commit didn't happen; Rollback and carry on.
+*/
+func (p *Pager) Commit(root uint64) error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+
+	// Once this commit is durable the old list pages and everything freed are unused,
+	// though snapshots of older commits may still be reading the freed pages.
+	seq := p.meta.Seq + 1
+	held := p.held
+	if len(p.freed) > 0 {
+		held = append(held[:len(held):len(held)], heldPages{seq: seq, pages: p.freed})
+	}
+	pending := append([]uint64{}, p.listPages...)
+	for _, h := range held {
+		pending = append(pending, h.pages...)
+	}
+
+	// Store the new list in pages that are free in the committed state, appending if there aren't enough.
+	reusable := append([]uint64{}, p.free...)
+	var listPages []uint64
+	for len(listPages) < p.freeListPagesFor(len(reusable)+len(pending)) {
+		if n := len(reusable); n > 0 {
+			listPages = append(listPages, reusable[n-1])
+			reusable = reusable[:n-1]
+		} else {
+			listPages = append(listPages, p.npages)
+			p.npages++
+		}
+	}
+	entries := append(append([]uint64{}, reusable...), pending...)
+	for i, page := range p.encodeFreeList(listPages, entries) {
+		p.pool.PutDirty(listPages[i], page)
+	}
+
+	meta := Meta{Seq: seq, Root: root, NPages: p.npages, Options: p.meta.Options}
+	if len(listPages) > 0 {
+		meta.FreeHead = listPages[0]
+	}
+	slot := meta.encode()
+	metaPage := append([]byte{}, p.metaPage...)
+	copy(metaPage[meta.slot()*META_SLOT_SIZE:], slot)
+
+	writes := p.pool.Dirty()
+	for ptr, page := range writes {
+		sealPage(ptr, seq, page)
+	}
+	writes[META_PAGE] = metaPage
+	if err := p.traced("wal.append", len(writes), func() error { return p.wal.Append(writes) }); err != nil {
+		return p.abandon(err)
+	}
+
+	// Logged; now copy the pages into place, then flip the meta slot.
+	if err := p.extend(p.npages); err != nil {
+		return p.abandon(err)
+	}
+	err := p.traced("pager.write", len(writes)-1, func() error {
+		return p.pool.Flush(func(ptr uint64, page []byte) error {
+			_, err := p.file.WriteAt(page, p.offset(ptr))
+			return err
+		})
+	})
+	if err != nil {
+		return p.abandon(err)
+	}
+	if err := p.traced("pager.fsync", 0, p.file.Sync); err != nil {
+		return p.abandon(err)
+	}
+	if _, err := p.file.WriteAt(slot, int64(meta.slot()*META_SLOT_SIZE)); err != nil {
+		return p.abandonMeta(meta, err)
+	}
+	if err := p.traced("pager.fsync", 0, p.file.Sync); err != nil {
+		return p.abandonMeta(meta, err)
+	}
+	// Only archived once it has happened, so that the archive never holds a commit that didn't
+	if p.archive != nil {
+		err := p.traced("wal.archive", len(writes), func() error { return p.archive.Add(seq, time.Now(), writes) })
+		if err != nil {
+			return p.abandonMeta(meta, errors.Join(fmt.Errorf("archiving commit %d: %w", seq, err), p.archive.Discard(seq)))
+		}
+	}
+	// The commit is in the file now. A log that can't be reset is only replayed to the
+	// same effect on the next Open, or emptied by the next commit.
+	p.wal.Reset()
+
+	p.meta = meta
+	p.metaPage = metaPage
+	p.flushed = p.npages
+	p.free = append(reusable, p.listPages...)
+	p.freed = nil
+	p.listPages = listPages
+	p.held = held
+	p.reclaim()
+	p.committedFree = append([]uint64{}, p.free...)
+	return nil
+}
+
+/*
+Take back a commit that failed after its batch went into the log, so that it isn't
+replayed on the next Open either and the error means what it says. New pages it
+already wrote to the file are harmless, since nothing committed refers to them. If
+the log can't be emptied the commit may yet be recovered, and the error says so.
+*/
+func (p *Pager) abandon(err error) error {
+	if rerr := p.wal.Reset(); rerr != nil {
+		return fmt.Errorf("%w (and the commit may be recovered on the next open: %w)", err, rerr)
+	}
+	return err
+}
+
+// Like abandon, for a failure once the new meta slot may have been written: put back what the slot held.
+func (p *Pager) abandonMeta(meta Meta, err error) error {
+	off := meta.slot() * META_SLOT_SIZE
+	_, werr := p.file.WriteAt(p.metaPage[off:off+META_SLOT_SIZE], int64(off))
+	if werr == nil {
+		werr = p.file.Sync()
+	}
+	if werr != nil {
+		return fmt.Errorf("%w (and the commit may have reached the file: %w)", err, werr)
+	}
+	return p.abandon(err)
+}
+
+/*
+Make reads from the file and commits from now on spans of the request in ctx, until
+the function returned is called. For the one goroutine using the pager at a time,
+like every other method.
+*/
+func (p *Pager) Trace(ctx context.Context) (restore func()) {
+	prev := p.trace
+	p.trace = ctx
+	return func() { p.trace = prev }
+}
+
+// Run a step of a commit, writing pages pages, as a span of the request set by Trace.
+func (p *Pager) traced(name string, pages int, step func() error) error {
+	_, span := trace.StartChild(p.trace, name)
+	if pages > 0 {
+		span.SetAttr("pages", pages)
+	}
+	err := step()
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+/*
+Archive the log batch of every commit from now on in a, for point-in-time recovery,
+once the commit is in the file. A commit that fails to be archived is taken back. A
+segment a holds for the next commit is left over from one taken back whose segment
+couldn't be removed, and is discarded.
+
+A crash after a commit reaches the file but before it is archived leaves a gap in the
+archive, which RecoverTo reports rather than recovering across; take a new backup.
+*/
+func (p *Pager) SetArchive(a *wal.Archive) error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	if err := a.Discard(p.meta.Seq + 1); err != nil {
+		return err
+	}
+	p.archive = a
+	return nil
+}
+
+// Drop every page created or freed since the last commit.
+func (p *Pager) Rollback() {
+	p.npages = p.flushed
+	p.pool.DiscardDirty()
+	p.free = append([]uint64{}, p.committedFree...)
+	p.freed = nil
+}
+
+func (p *Pager) Close() error {
+	if p.file == nil {
+		if c, ok := p.src.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	}
+	if p.wal == nil {
+		return p.file.Close()
+	}
+	return errors.Join(p.wal.Close(), p.file.Close())
+}
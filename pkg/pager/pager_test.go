@@ -0,0 +1,733 @@
+package pager
+
+import (
+	"bytes"
+	"database-go/pkg/btree"
+	"database-go/pkg/wal"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Open path, insert keys numbered from up to to, each holding its own name, and commit.
+func commitKeys(t *testing.T, path string, from, to int) {
+	t.Helper()
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	tree := p.Tree()
+	for i := from; i < to; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := tree.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Commit(tree.Root()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Open path and check it holds exactly the keys commitKeys inserted below n.
+func checkKeys(t *testing.T, path string, n int) {
+	t.Helper()
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	tree := p.Tree()
+	if r := tree.Check(); !r.OK() || r.Keys != n+1 {
+		t.Fatalf("%d keys, want %d: %v", r.Keys-1, n, r.Violations)
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if val, ok, err := tree.Get(key); err != nil || !ok || !bytes.Equal(val, key) {
+			t.Fatalf("Get(%s) = %q, %v, %v", key, val, ok, err)
+		}
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Meta().Seq != 0 || p.Root() != 0 {
+		t.Fatalf("new file: meta %+v", p.Meta())
+	}
+	p.Close()
+
+	// Each commit survives closing the file, and builds on the one before
+	commitKeys(t, path, 0, 500)
+	checkKeys(t, path, 500)
+	commitKeys(t, path, 500, 1000)
+	checkKeys(t, path, 1000)
+
+	// Changes never committed are gone, whether rolled back or just left behind
+	p, err = Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Meta().Seq != 2 {
+		t.Fatalf("reopened at commit %d, want 2", p.Meta().Seq)
+	}
+	tree := p.Tree()
+	for i := 1000; i < 1100; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if err := tree.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := tree.Delete([]byte("key00000")); err != nil || !ok {
+		t.Fatalf("Delete(key00000) = %v, %v", ok, err)
+	}
+	p.Rollback()
+	if p.Tree().Root() != p.Root() {
+		t.Fatal("tree after Rollback isn't the committed one")
+	}
+	tree = p.Tree()
+	if err := tree.Insert([]byte("key01000"), nil); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	checkKeys(t, path, 1000)
+
+	// A file that isn't a database, or whose meta page doesn't describe it, is refused
+	write := func(data []byte) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := decodeMetaPage(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSlot := func(m Meta) []byte {
+		data := append([]byte{}, valid...)
+		copy(data[m.slot()*META_SLOT_SIZE:], m.encode())
+		return data
+	}
+	badOptions, badRoot, tooBig := meta, meta, meta
+	badOptions.Seq++
+	badOptions.Options.PageSize = 1000
+	badRoot.Seq++
+	badRoot.Root = meta.NPages
+	tooBig.Seq++
+	tooBig.NPages = meta.NPages + 10
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"garbage", bytes.Repeat([]byte("not a database "), 1000), ErrNotDatabase},
+		{"shorter than the meta slots", valid[:META_SLOT_SIZE+10], ErrNotDatabase},
+		{"truncated", valid[:len(valid)/2], ErrCorrupt},
+		{"bad options", withSlot(badOptions), ErrCorrupt},
+		{"root out of range", withSlot(badRoot), ErrCorrupt},
+		{"more pages than the file", withSlot(tooBig), ErrCorrupt},
+	} {
+		write(tt.data)
+		if _, err := Open(path, btree.Options{}); !errors.Is(err, tt.want) {
+			t.Fatalf("%s: Open = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// A torn write of the newest slot falls back to the commit before it
+	torn := append([]byte{}, valid...)
+	torn[meta.slot()*META_SLOT_SIZE+len(META_SIGNATURE)] ^= 0x01
+	write(torn)
+	p, err = Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Meta().Seq != 1 {
+		t.Fatalf("opened at commit %d after a torn meta write, want 1", p.Meta().Seq)
+	}
+	p.Close()
+	checkKeys(t, path, 500)
+}
+
+func TestFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	commitKeys(t, path, 0, 2000)
+	full := fileSize(t, path)
+
+	// Delete all but the first 100 keys; the pages they used go on the free list
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := p.Tree()
+	for i := 100; i < 2000; i++ {
+		if ok, err := tree.Delete([]byte(fmt.Sprintf("key%05d", i))); err != nil || !ok {
+			t.Fatalf("Delete(key%05d) = %v, %v", i, ok, err)
+		}
+	}
+	if err := p.Commit(tree.Root()); err != nil {
+		t.Fatal(err)
+	}
+	free := append([]uint64{}, p.free...)
+	if len(free) < 10 || p.Meta().FreeHead == 0 {
+		t.Fatalf("%d free pages, list at %d after deleting most keys", len(free), p.Meta().FreeHead)
+	}
+	p.Close()
+	// Copying the paths to the deleted keys takes new pages, though far fewer than it frees
+	deleted := fileSize(t, path)
+	if deleted > full+int64(len(free))*int64(p.PageSize())/4 {
+		t.Fatalf("file went from %d to %d bytes on deleting", full, deleted)
+	}
+
+	// The list survives reopening
+	p, err = Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.free) != len(free) {
+		t.Fatalf("reopened with %d free pages, want %d", len(p.free), len(free))
+	}
+	for i := range free {
+		if p.free[i] != free[i] {
+			t.Fatalf("reopened with free list %v, want %v", p.free, free)
+		}
+	}
+	p.Close()
+
+	// Filling the tree again takes the free pages rather than growing the file
+	commitKeys(t, path, 100, 2000)
+	checkKeys(t, path, 2000)
+	if size := fileSize(t, path); size > deleted {
+		t.Fatalf("file grew from %d to %d bytes refilling freed pages", deleted, size)
+	}
+}
+
+func TestCorruptFreeList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	commitKeys(t, path, 0, 1000)
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := p.Tree()
+	for i := 0; i < 900; i++ {
+		tree.Delete([]byte(fmt.Sprintf("key%05d", i)))
+	}
+	if err := p.Commit(tree.Root()); err != nil {
+		t.Fatal(err)
+	}
+	meta, pageSize := p.Meta(), p.PageSize()
+	head := meta.FreeHead
+	p.Close()
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head == 0 {
+		t.Fatal("no free list")
+	}
+
+	// Rewrite the head of the list, sealed so that only the damage done shows
+	edit := func(change func(page []byte)) []byte {
+		data := append([]byte{}, valid...)
+		page := data[int(head)*pageSize : int(head+1)*pageSize]
+		change(page)
+		sealPage(head, meta.Seq, page)
+		return data
+	}
+	setNext := func(next uint64) func([]byte) {
+		return func(page []byte) { binary.LittleEndian.PutUint64(page[4:12], next) }
+	}
+	torn := append([]byte{}, valid...)
+	torn[int(head)*pageSize+FREE_LIST_HEADER] ^= 0x01
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"bad checksum", torn, ErrChecksumMismatch},
+		{"not a list page", edit(func(page []byte) { binary.LittleEndian.PutUint16(page[0:2], btree.LEAF) }), ErrCorrupt},
+		{"too many entries", edit(func(page []byte) { binary.LittleEndian.PutUint16(page[2:4], 0xffff) }), ErrCorrupt},
+		{"next out of range", edit(setNext(meta.NPages)), ErrCorrupt},
+		{"cycle", edit(setNext(head)), ErrCorrupt},
+		{"meta page listed", edit(func(page []byte) { binary.LittleEndian.PutUint64(page[FREE_LIST_HEADER:], META_PAGE) }), ErrCorrupt},
+		{"entry out of range", edit(func(page []byte) { binary.LittleEndian.PutUint64(page[FREE_LIST_HEADER:], meta.NPages) }), ErrCorrupt},
+	} {
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(path, btree.Options{}); !errors.Is(err, tt.want) {
+			t.Fatalf("%s: Open = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestOverflowValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := btree.Options{MaxValSize: 1 << 20}
+	capacity := btree.BTREE_PAGE_SIZE_BYTES - PAGE_TRAILER_SIZE - btree.OVERFLOW_HEADER_SIZE
+	limit := opts.WithDefaults().MaxInlineValSize
+	value := func(tag string, size int) []byte {
+		return bytes.Repeat([]byte(tag), size/len(tag)+1)[:size]
+	}
+	want := map[string][]byte{}
+	// Commit the changes, then check a reopened file holds exactly want, in the pages it needs
+	commit := func(change func(tree *btree.BTree)) {
+		t.Helper()
+		p, err := Open(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := p.Tree()
+		change(tree)
+		if err := p.Commit(tree.Root()); err != nil {
+			t.Fatal(err)
+		}
+		p.Close()
+
+		p, err = Open(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		tree = p.Tree()
+		overflow := 0
+		for key, val := range want {
+			if got, ok, err := tree.Get([]byte(key)); err != nil || !ok || !bytes.Equal(got, val) {
+				t.Fatalf("Get(%s) = %d bytes, %v, %v; want %d bytes", key, len(got), ok, err, len(val))
+			}
+			if len(val) > limit {
+				overflow += (len(val) + capacity - 1) / capacity
+			}
+		}
+		if r := tree.Check(); !r.OK() || r.Keys != len(want)+1 || r.OverflowPages != overflow {
+			t.Fatalf("%d keys, %d overflow pages, want %d: %v", r.Keys-1, r.OverflowPages, overflow, r.Violations)
+		}
+	}
+	set := func(tree *btree.BTree, key string, val []byte) {
+		t.Helper()
+		if err := tree.Insert([]byte(key), val); err != nil {
+			t.Fatalf("Insert(%s): %v", key, err)
+		}
+		want[key] = val
+	}
+	del := func(tree *btree.BTree, key string) {
+		t.Helper()
+		if ok, err := tree.Delete([]byte(key)); err != nil || !ok {
+			t.Fatalf("Delete(%s) = %v, %v", key, ok, err)
+		}
+		delete(want, key)
+	}
+
+	commit(func(tree *btree.BTree) {
+		set(tree, "inline", value("i", limit))
+		set(tree, "just over", value("j", limit+1))
+		set(tree, "one page", value("o", capacity))
+		set(tree, "two pages", value("t", capacity+1))
+		set(tree, "many", value("many", 50*capacity+7))
+		set(tree, "max", value("max", opts.MaxValSize))
+		if err := tree.Insert([]byte("too big"), value("x", opts.MaxValSize+1)); !errors.Is(err, btree.ErrValTooLarge) {
+			t.Fatalf("Insert over the value limit = %v, want %v", err, btree.ErrValTooLarge)
+		}
+	})
+
+	// Overwriting swaps chains for other chains or inline values, and back
+	commit(func(tree *btree.BTree) {
+		set(tree, "inline", value("I", 3*capacity))
+		set(tree, "two pages", []byte("short"))
+		set(tree, "many", value("MANY", 20*capacity))
+		set(tree, "one page", value("O", capacity))
+	})
+	commit(func(tree *btree.BTree) {
+		del(tree, "max")
+		del(tree, "many")
+		del(tree, "just over")
+	})
+
+	// The pages of deleted and replaced chains are reused rather than the file growing
+	size := fileSize(t, path)
+	for i := 0; i < 5; i++ {
+		commit(func(tree *btree.BTree) {
+			set(tree, "big", value(fmt.Sprint("big", i), 100*capacity))
+			set(tree, "inline", value(fmt.Sprint("inline", i), 5*capacity))
+		})
+		if grown := fileSize(t, path); grown > size {
+			t.Fatalf("round %d: file grew from %d to %d bytes", i, size, grown)
+		}
+	}
+}
+
+func TestRecoverLoggedCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	commitKeys(t, path, 0, 1000)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitKeys(t, path, 1000, 2000)
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+		Put the file back as it was and log the second commit's pages, the meta page
+		included: a crash after the batch was synced to the log but before any of it
+		reached the file. A torn batch after it must be ignored.
+	*/
+	pageSize := btree.DefaultOptions().PageSize
+	batch := map[uint64][]byte{}
+	for off := 0; off < len(after); off += pageSize {
+		page := after[off : off+pageSize]
+		if off >= len(before) || !bytes.Equal(page, before[off:off+pageSize]) {
+			batch[uint64(off/pageSize)] = page
+		}
+	}
+	if _, ok := batch[META_PAGE]; !ok || len(batch) < 3 {
+		t.Fatalf("second commit wrote %d pages", len(batch))
+	}
+	if err := os.WriteFile(path, before, 0644); err != nil {
+		t.Fatal(err)
+	}
+	log, err := wal.Open(path + WAL_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Append(batch); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	f, err := os.OpenFile(path+WAL_SUFFIX, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("WALB torn"))
+	f.Close()
+
+	checkKeys(t, path, 2000)
+	if info, err := os.Stat(path + WAL_SUFFIX); err != nil || info.Size() != 0 {
+		t.Fatalf("log after recovery: %v, %v", info.Size(), err)
+	}
+	recovered, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, after) {
+		t.Fatal("recovered file differs from the one the commit wrote")
+	}
+
+	// The free list and page count came back too, so the file takes more commits
+	commitKeys(t, path, 2000, 2100)
+	checkKeys(t, path, 2100)
+}
+
+func TestMetaSlots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	readSlots := func() []byte {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		slots := make([]byte, META_SLOTS*META_SLOT_SIZE)
+		if _, err := f.ReadAt(slots, 0); err != nil {
+			t.Fatal(err)
+		}
+		return slots
+	}
+
+	// Each commit goes to the slot its sequence number picks, leaving the one before in the other
+	for seq := uint64(1); seq <= 3; seq++ {
+		commitKeys(t, path, int(seq-1)*100, int(seq)*100)
+		slots := readSlots()
+		cur, ok := decodeMeta(slots[(seq%META_SLOTS)*META_SLOT_SIZE:])
+		if !ok || cur.Seq != seq {
+			t.Fatalf("commit %d: slot %d holds %+v, %v", seq, seq%META_SLOTS, cur, ok)
+		}
+		if prev, ok := decodeMeta(slots[((seq-1)%META_SLOTS)*META_SLOT_SIZE:]); seq > 1 && (!ok || prev.Seq != seq-1) {
+			t.Fatalf("commit %d: other slot holds %+v, %v", seq, prev, ok)
+		}
+		if meta, err := decodeMetaPage(slots); err != nil || meta != cur {
+			t.Fatalf("commit %d: decodeMetaPage = %+v, %v", seq, meta, err)
+		}
+	}
+
+	// The higher sequence number wins wherever it is
+	slots := readSlots()
+	swapped := append(append([]byte{}, slots[META_SLOT_SIZE:]...), slots[:META_SLOT_SIZE]...)
+	if meta, err := decodeMetaPage(swapped); err != nil || meta.Seq != 3 {
+		t.Fatalf("swapped slots: decodeMetaPage = %+v, %v", meta, err)
+	}
+
+	// A torn write of the newest slot leaves the commit before it
+	corrupt := func(seq uint64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0xff}, int64((seq%META_SLOTS)*META_SLOT_SIZE)+int64(len(META_SIGNATURE))+3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(3)
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Meta().Seq != 2 {
+		t.Fatalf("opened at commit %d, want 2", p.Meta().Seq)
+	}
+	p.Close()
+	checkKeys(t, path, 200)
+
+	// The next commit is 3 again, and goes in the corrupt slot
+	commitKeys(t, path, 200, 250)
+	if meta, err := decodeMetaPage(readSlots()); err != nil || meta.Seq != 3 {
+		t.Fatalf("after recommitting: decodeMetaPage = %+v, %v", meta, err)
+	}
+	checkKeys(t, path, 250)
+
+	corrupt(2)
+	corrupt(3)
+	if _, err := Open(path, btree.Options{}); !errors.Is(err, ErrNotDatabase) {
+		t.Fatalf("Open with both slots corrupt = %v, want %v", err, ErrNotDatabase)
+	}
+}
+
+func TestStoredOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := btree.Options{PageSize: 8192, MaxInlineValSize: 1000}
+	p, err := Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := p.Tree()
+	// Inline at 8K pages, though not at the default page size
+	val := bytes.Repeat([]byte("v"), 1000)
+	if err := tree.Insert([]byte("key"), val); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Commit(tree.Root()); err != nil {
+		t.Fatal(err)
+	}
+	created := p.Meta().Options
+	p.Close()
+	if created != opts.WithDefaults() {
+		t.Fatalf("created with %+v, want %+v", created, opts.WithDefaults())
+	}
+
+	// Asking for anything else the file was created with fails
+	for _, bad := range []btree.Options{
+		{PageSize: 4096},
+		{PageSize: 16384},
+		{MaxInlineValSize: 2000},
+		{PageSize: 8192, MaxInlineValSize: 999},
+		{MaxKeySize: created.MaxKeySize + 1},
+	} {
+		if _, err := Open(path, bad); !errors.Is(err, ErrOptionsMismatch) {
+			t.Fatalf("Open with %+v = %v, want %v", bad, err, ErrOptionsMismatch)
+		}
+	}
+
+	// Zero options, or only the ones it was created with, take what the file has
+	for _, same := range []btree.Options{{}, opts, created} {
+		p, err := Open(path, same)
+		if err != nil {
+			t.Fatalf("Open with %+v: %v", same, err)
+		}
+		if p.PageSize() != 8192 || p.Meta().Options != created || p.Tree().Options() != created {
+			t.Fatalf("Open with %+v: page size %d, options %+v", same, p.PageSize(), p.Meta().Options)
+		}
+		if got, ok, err := p.Tree().Get([]byte("key")); err != nil || !ok || !bytes.Equal(got, val) {
+			t.Fatalf("Get(key) = %d bytes, %v, %v", len(got), ok, err)
+		}
+		if r := p.Tree().Check(); !r.OK() || r.OverflowPages != 0 {
+			t.Fatalf("reopened tree: %d overflow pages, %v", r.OverflowPages, r.Violations)
+		}
+		p.Close()
+	}
+}
+
+// A database file whose failAt'th write, sync or truncate from now on fails.
+type faultyFile struct {
+	dbFile
+	calls, failAt int
+}
+
+var errInjected = errors.New("injected write failure")
+
+func (f *faultyFile) fail() error {
+	if f.calls++; f.calls == f.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+func (f *faultyFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.fail(); err != nil {
+		return 0, err
+	}
+	return f.dbFile.WriteAt(b, off)
+}
+
+func (f *faultyFile) Sync() error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.dbFile.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.dbFile.Truncate(size)
+}
+
+func TestFailedCommitIsNotReplayed(t *testing.T) {
+	// Fail each step of copying a logged commit into the file in turn, until one commit gets through
+	for failAt := 1; ; failAt++ {
+		path := filepath.Join(t.TempDir(), "test.db")
+		commitKeys(t, path, 0, 500)
+
+		p, err := Open(path, btree.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := &faultyFile{dbFile: p.file, failAt: failAt}
+		p.file = file
+		tree := p.Tree()
+		for i := 500; i < 1500; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			if err := tree.Insert(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = p.Commit(tree.Root())
+		if err == nil {
+			p.Close()
+			if failAt < 5 {
+				t.Fatalf("commit went through with write %d failing", failAt)
+			}
+			checkKeys(t, path, 1500)
+			return
+		}
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("write %d failing: Commit = %v", failAt, err)
+		}
+		p.Rollback()
+		if p.Meta().Seq != 1 {
+			t.Fatalf("write %d failing: at commit %d after the failure", failAt, p.Meta().Seq)
+		}
+		if info, err := os.Stat(path + WAL_SUFFIX); err != nil || info.Size() != 0 {
+			t.Fatalf("write %d failing: log holds %d bytes after the failure", failAt, info.Size())
+		}
+
+		// The pager carries on from the last commit, and so does the file once reopened
+		file.failAt = 0
+		tree = p.Tree()
+		for i := 500; i < 600; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			if err := tree.Insert(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Commit(tree.Root()); err != nil {
+			t.Fatalf("write %d failing: next commit: %v", failAt, err)
+		}
+		p.Close()
+		checkKeys(t, path, 600)
+	}
+}
+
+func TestArchiveOnlyHoldsCommits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	dir := filepath.Join(t.TempDir(), "archive")
+	commitKeys(t, path, 0, 100)
+	archive, err := wal.OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := func() []uint64 {
+		t.Helper()
+		all, err := archive.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seqs []uint64
+		for _, seg := range all {
+			seqs = append(seqs, seg.Seq)
+		}
+		return seqs
+	}
+
+	p, err := Open(path, btree.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(from, to int) error {
+		tree := p.Tree()
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			if err := tree.Insert(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := p.Commit(tree.Root())
+		if err != nil {
+			p.Rollback()
+		}
+		return err
+	}
+
+	// A commit that fails on the way into the file leaves nothing in the archive
+	file := &faultyFile{dbFile: p.file, failAt: 3}
+	p.file = file
+	if err := commit(100, 200); !errors.Is(err, errInjected) {
+		t.Fatalf("Commit with a failing write = %v", err)
+	}
+	if seqs := segments(); len(seqs) != 0 {
+		t.Fatalf("archive holds %v after a failed commit", seqs)
+	}
+	file.failAt = 0
+	if err := commit(100, 200); err != nil {
+		t.Fatal(err)
+	}
+	if seqs := segments(); len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("archive holds %v, want [2]", seqs)
+	}
+
+	// And one that can't be archived is taken back
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(200, 300); err == nil {
+		t.Fatal("Commit with the archive gone succeeded")
+	}
+	if p.Meta().Seq != 2 {
+		t.Fatalf("at commit %d after failing to archive, want 2", p.Meta().Seq)
+	}
+	p.Close()
+	checkKeys(t, path, 200)
+}
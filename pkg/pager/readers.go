@@ -0,0 +1,77 @@
+package pager
+
+import "database-go/pkg/btree"
+
+/*
+Snapshots let readers keep using an old commit while new ones are made. Nothing in a
+commit is modified in place, so an old root stays readable for as long as the pages
+it reaches aren't handed out again.
+
+Pages freed by commit n were last reachable from commit n-1, so they are held back
+from PageNew until no snapshot older than n is open. They are recorded in the free
+list on disk straight away either way; snapshots don't survive a restart.
+*/
+
+// Pages freed by the commit with sequence number seq
+type heldPages struct {
+	seq   uint64
+	pages []uint64
+}
+
+// Pin the last commit for reading. Its pages stay allocated until Release is called with the returned meta.
+func (p *Pager) Acquire() Meta {
+	p.readers[p.meta.Seq]++
+	return p.meta
+}
+
+// Pin an older commit again. m must still be pinned by someone, or its pages may already be reused.
+func (p *Pager) Pin(m Meta) {
+	p.readers[m.Seq]++
+}
+
+// Unpin a commit pinned by Acquire or Pin.
+func (p *Pager) Release(m Meta) {
+	if p.readers[m.Seq]--; p.readers[m.Seq] <= 0 {
+		delete(p.readers, m.Seq)
+	}
+	p.reclaim()
+}
+
+// A read-only view of the tree as of a pinned commit.
+func (p *Pager) TreeAt(m Meta) *btree.BTree {
+	// The options were validated when the file was opened
+	tree, _ := btree.NewBTree(m.Root, p.meta.Options, p.PageGet, p.PageNew, p.PageDel)
+	return tree
+}
+
+// Number of open snapshots, and of pages held back for them.
+func (p *Pager) ReaderStats() (readers int, held int) {
+	for _, n := range p.readers {
+		readers += n
+	}
+	for _, h := range p.held {
+		held += len(h.pages)
+	}
+	return readers, held
+}
+
+// Make held pages reusable once no open snapshot can reach them.
+func (p *Pager) reclaim() {
+	oldest, found := uint64(0), false
+	for seq := range p.readers {
+		if !found || seq < oldest {
+			oldest, found = seq, true
+		}
+	}
+
+	n := 0
+	for _, h := range p.held {
+		if found && oldest < h.seq {
+			break
+		}
+		p.free = append(p.free, h.pages...)
+		p.committedFree = append(p.committedFree, h.pages...)
+		n++
+	}
+	p.held = p.held[n:]
+}
@@ -0,0 +1,92 @@
+package pager
+
+import (
+	"database-go/pkg/bufpool"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Read-only handles read the committed state straight from the file while another
+handle, possibly in another process, keeps writing it. The writer syncs every page
+of a commit before flipping the meta slot, so the file always holds a complete
+commit and the write-ahead log can be ignored.
+
+What a reader can't rely on is the pages of its commit staying put: pages freed by
+commit n are reused by commit n+1, which writes them before its meta slot shows up.
+So a reader of commit n can only trust what it read if the file still shows commit
+n afterwards. Check with Stale after reading, and Refresh and retry if it is.
+*/
+
+// Open an existing database without write access. Nothing is created or recovered.
+func OpenReadOnly(path string) (*Pager, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := OpenReaderAt(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.file = file
+	return p, nil
+}
+
+/*
+Open a database file held by r, for reading only, such as one embedded in the
+program. Close closes r if it is an io.Closer. A file that never changes needs no
+care; one being written is read as OpenReadOnly describes.
+*/
+func OpenReaderAt(r io.ReaderAt) (*Pager, error) {
+	p := &Pager{src: r, readOnly: true, readers: map[uint64]int{}}
+	p.pool = bufpool.New(DEFAULT_CACHE_PAGES, p.readPage)
+	if _, err := p.Refresh(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Whether this pager was opened with OpenReadOnly.
+func (p *Pager) ReadOnly() bool {
+	return p.readOnly
+}
+
+/*
+Move a read-only pager to the latest commit in the file. Returns whether it moved.
+Cached pages are dropped when it does, since they may have been reused.
+*/
+func (p *Pager) Refresh() (bool, error) {
+	if !p.readOnly {
+		return false, ErrReadOnly
+	}
+	meta, err := p.readMeta()
+	if err != nil {
+		return false, err
+	}
+	if p.metaPage != nil && meta.Seq == p.meta.Seq {
+		return false, nil
+	}
+	if meta.NPages < 1 || meta.Root >= meta.NPages {
+		return false, fmt.Errorf("%w: root out of range", ErrCorrupt)
+	}
+
+	p.meta = meta
+	p.pageSize = meta.Options.PageSize
+	p.metaPage = make([]byte, p.pageSize)
+	p.flushed = meta.NPages
+	p.npages = meta.NPages
+	p.pool = bufpool.New(DEFAULT_CACHE_PAGES, p.readPage)
+	return true, nil
+}
+
+// Whether the file has moved on from m, so pages read for m may have been overwritten since.
+func (p *Pager) Stale(m Meta) (bool, error) {
+	meta, err := p.readMeta()
+	if err != nil {
+		return false, err
+	}
+	return meta.Seq != m.Seq, nil
+}
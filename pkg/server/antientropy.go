@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"database-go/pkg/kv"
+	"errors"
+	"sync"
+	"time"
+)
+
+// How often a started AntiEntropy runs a round when Interval isn't set
+const ANTI_ENTROPY_DEFAULT_INTERVAL = time.Minute
+
+/*
+Keeps a replica, a database in this process, in line with a primary served by a
+Server elsewhere. The primary is the authority: wherever the two differ the
+replica is changed to match, including deleting keys the primary doesn't have.
+
+A round asks the primary for a Merkle tree of its keys (OP_MERKLE), builds the
+replica's over the same ranges and copies across each range whose hashes differ,
+read from the primary in one snapshot transaction and written to the replica with
+kv.DB.RepairRange. Only the tree and the differing ranges cross the network, so a
+round over copies that agree is cheap. Start runs rounds in the background every
+Interval; Round runs one now.
+
+Get is a read with read repair: it reads both copies, fixes the replica's if they
+differ, and returns the primary's.
+
+Fanout, LeafKeys and Interval must be set, if at all, before Start or the first round.
+*/
+type AntiEntropy struct {
+	db      *kv.DB
+	primary string
+
+	// See kv.Snapshot.MerkleTree; zero takes the defaults
+	Fanout, LeafKeys int
+	Interval         time.Duration
+
+	// Held for a whole round, so rounds don't overlap
+	round sync.Mutex
+	mu    sync.Mutex
+	// Connections for rounds and for Get, dialled when first needed
+	rounds, reads *Client
+	stats         AntiEntropyStats
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// What anti-entropy has found and done so far.
+type AntiEntropyStats struct {
+	Rounds       int
+	FailedRounds int
+	// Leaf ranges compared by rounds, and those found to differ
+	RangesCompared int
+	RangesDiverged int
+	// Keys written or deleted on the replica by rounds
+	KeysRepaired int
+	// Reads through Get, and those that found the replica out of date and fixed it
+	Reads       int
+	ReadRepairs int
+	LastRound   time.Time
+	// From the last round, nil if it succeeded
+	LastError error
+}
+
+// Anti-entropy for replica db against the Server at primary.
+func NewAntiEntropy(db *kv.DB, primary string) *AntiEntropy {
+	return &AntiEntropy{db: db, primary: primary}
+}
+
+// The connection in *conn, dialling it if need be.
+func (a *AntiEntropy) conn(conn **Client) (*Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if *conn != nil {
+		return *conn, nil
+	}
+	c, err := Dial(a.primary)
+	if err != nil {
+		return nil, err
+	}
+	*conn = c
+	return c, nil
+}
+
+/*
+Close the connection in *conn after err, so the next use dials again, unless err is
+one the primary sent back, which leaves the connection as good as it was.
+*/
+func (a *AntiEntropy) drop(conn **Client, c *Client, err error) {
+	if fromServer(err) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if *conn == c {
+		c.Close()
+		*conn = nil
+	}
+}
+
+/*
+Compare the replica with the primary once and repair what differs. Returns the
+number of keys written or deleted.
+*/
+func (a *AntiEntropy) Round() (int, error) {
+	a.round.Lock()
+	defer a.round.Unlock()
+	compared, diverged, repaired, err := a.runRound()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats.Rounds++
+	a.stats.RangesCompared += compared
+	a.stats.RangesDiverged += diverged
+	a.stats.KeysRepaired += repaired
+	a.stats.LastRound = time.Now()
+	a.stats.LastError = err
+	if err != nil {
+		a.stats.FailedRounds++
+	}
+	return repaired, err
+}
+
+func (a *AntiEntropy) runRound() (compared, diverged, repaired int, err error) {
+	c, err := a.conn(&a.rounds)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			a.drop(&a.rounds, c, err)
+		}
+	}()
+
+	theirs, err := c.MerkleTree(a.Fanout, a.LeafKeys)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	snap, err := a.db.Snapshot()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ours, err := snap.MerkleTreeLike(theirs)
+	snap.Release()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	leaves, err := theirs.Diff(ours)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	compared = countLeaves(theirs)
+
+	for _, leaf := range leaves {
+		n, err := a.db.RepairRange(leaf.Start, leaf.End, func(fn func(key, val []byte) error) error {
+			return scanSnapshot(c, leaf.Start, leaf.End, fn)
+		})
+		repaired += n
+		if err != nil {
+			return compared, len(leaves), repaired, err
+		}
+	}
+	return compared, len(leaves), repaired, nil
+}
+
+// Scan [start, end) on the server as of one commit.
+func scanSnapshot(c *Client, start, end []byte, fn func(key, val []byte) error) error {
+	if _, err := c.Begin(kv.ISOLATION_SNAPSHOT); err != nil {
+		return err
+	}
+	err := c.Scan(start, end, 0, fn)
+	if rerr := c.Rollback(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func countLeaves(n *kv.MerkleNode) int {
+	if len(n.Children) == 0 {
+		return 1
+	}
+	count := 0
+	for _, c := range n.Children {
+		count += countLeaves(c)
+	}
+	return count
+}
+
+/*
+Read key from the primary, and bring the replica's copy into line with it if it
+differs. Returns what the primary has, or kv.ErrKeyNotFound.
+*/
+func (a *AntiEntropy) Get(key []byte) ([]byte, error) {
+	c, err := a.conn(&a.reads)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := c.Get(key)
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		a.drop(&a.reads, c, err)
+		return nil, err
+	}
+	found := err == nil
+
+	ours, err := a.db.Get(key)
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, err
+	}
+	stale := (err == nil) != found || !bytes.Equal(ours, theirs)
+	if stale {
+		_, err := a.db.RepairRange(key, append(key[:len(key):len(key)], 0), func(fn func(key, val []byte) error) error {
+			if found {
+				return fn(key, theirs)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	a.mu.Lock()
+	a.stats.Reads++
+	if stale {
+		a.stats.ReadRepairs++
+	}
+	a.mu.Unlock()
+	if !found {
+		return nil, kv.ErrKeyNotFound
+	}
+	return theirs, nil
+}
+
+func (a *AntiEntropy) Stats() AntiEntropyStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats
+}
+
+// Run rounds in the background every Interval until Close. Errors are kept in Stats.
+func (a *AntiEntropy) Start() {
+	interval := a.Interval
+	if interval <= 0 {
+		interval = ANTI_ENTROPY_DEFAULT_INTERVAL
+	}
+	a.stop, a.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				return
+			case <-ticker.C:
+				a.Round()
+			}
+		}
+	}()
+}
+
+// Stop the background rounds, waiting for one under way, and close the connections.
+func (a *AntiEntropy) Close() error {
+	if a.stop != nil {
+		close(a.stop)
+		<-a.done
+		a.stop = nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	for _, conn := range []**Client{&a.rounds, &a.reads} {
+		if *conn != nil {
+			err = errors.Join(err, (*conn).Close())
+			*conn = nil
+		}
+	}
+	return err
+}
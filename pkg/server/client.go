@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/kv"
+	"database-go/pkg/trace"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Returned by a call that ran past its class's Timeout, and by every call after it on the connection
+var ErrTimeout = errors.New("server: call timed out")
+
+// Kinds of call, each with its own CallPolicy.
+type CallClass int
+
+const (
+	// Get and Scan, and MerkleTree, which is never hedged
+	CALL_READ CallClass = iota
+	// Set and Del
+	CALL_WRITE
+	// Begin, Commit and Rollback
+	CALL_TX
+	CALL_CLASSES
+)
+
+// How calls of one class are made. The zero policy waits as long as it takes.
+type CallPolicy struct {
+	// Longest a call may take, 0 for no limit
+	Timeout time.Duration
+	// For reads outside a transaction, how long to wait for an answer before asking a
+	// replica as well (see AddReplica), 0 never to. Only CALL_READ looks at it.
+	HedgeAfter time.Duration
+}
+
+// Counts of what a Client's policies have done.
+type ClientStats struct {
+	// Reads sent to a replica as well, and those the replica answered first
+	Hedged    int
+	HedgeWins int
+	Timeouts  int
+}
+
+/*
+A connection to a Server. Methods mirror kv.DB and kv.Tx: outside a transaction each
+call commits on its own, and between Begin and Commit or Rollback every call goes
+through the connection's transaction. Errors the server sends back for missing keys
+and conflicts are kv.ErrKeyNotFound and kv.ErrConflict.
+
+A Client is safe for use from multiple goroutines, but they share its one
+transaction; use a Client per goroutine for independent transactions.
+
+Each class of call can be given a timeout with SetPolicy. A call that times out
+fails with ErrTimeout and closes the connection, since its answer may still be on
+the way, so every later call fails the same way; Dial again to carry on. Reads can
+also be hedged: with replicas added by AddReplica, a read outside a transaction
+that hasn't been answered after HedgeAfter is sent to a replica too, and whichever
+answers first wins. The slower answer is still read and dropped, so the next call on
+the same connection waits for it. A replica may be behind the server, so a hedged
+read can see an older value; leave HedgeAfter at 0 where that matters.
+*/
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// Set once a call has timed out and closed the connection
+	broken error
+	// Whether Begin has opened a transaction not yet ended
+	inTx bool
+
+	// Guards everything below, which calls in flight on conn don't hold up
+	policyMu sync.Mutex
+	policies [CALL_CLASSES]CallPolicy
+	replicas []*Client
+	next     int
+	stats    ClientStats
+	// The request calls are part of, for tracing; see SetContext
+	ctx context.Context
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// Close the connection, rolling back any open transaction, and those to the replicas.
+func (c *Client) Close() error {
+	c.policyMu.Lock()
+	replicas := c.replicas
+	c.replicas = nil
+	c.policyMu.Unlock()
+	err := c.conn.Close()
+	for _, r := range replicas {
+		r.Close()
+	}
+	return err
+}
+
+// Make calls of class with policy from now on.
+func (c *Client) SetPolicy(class CallClass, policy CallPolicy) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.policies[class] = policy
+}
+
+func (c *Client) policy(class CallClass) CallPolicy {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	return c.policies[class]
+}
+
+/*
+Connect to a replica of the server at addr, such as one kept up to date by
+AntiEntropy, for hedged reads. Replicas take turns.
+*/
+func (c *Client) AddReplica(addr string) error {
+	r, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.replicas = append(c.replicas, r)
+	return nil
+}
+
+func (c *Client) Stats() ClientStats {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	return c.stats
+}
+
+// The replica whose turn it is, skipping any broken by a timeout; nil if there is none.
+func (c *Client) replica() *Client {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	for range c.replicas {
+		r := c.replicas[c.next%len(c.replicas)]
+		c.next++
+		r.mu.Lock()
+		ok := r.broken == nil
+		r.mu.Unlock()
+		if ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// Whether err came from the server, which leaves the connection as good as it was.
+func fromServer(err error) bool {
+	return errors.Is(err, ErrRemote) || errors.Is(err, kv.ErrKeyNotFound) || errors.Is(err, kv.ErrConflict) ||
+		errors.Is(err, ErrOverloaded)
+}
+
+/*
+Make calls from now on part of the request in ctx: each is a span of its trace, and
+takes the span's context to the server (see OP_TRACED), so the server's spans for it
+join the same trace; see pkg/trace. A nil ctx stops tracing calls.
+*/
+func (c *Client) SetContext(ctx context.Context) {
+	c.policyMu.Lock()
+	defer c.policyMu.Unlock()
+	c.ctx = ctx
+}
+
+/*
+Start the span for a call of req if calls are being traced, and return req with the
+span's context in it for the server.
+*/
+func (c *Client) traced(req encoder) (encoder, *trace.Span) {
+	c.policyMu.Lock()
+	ctx := c.ctx
+	c.policyMu.Unlock()
+	_, span := trace.Start(ctx, "client "+opName(req[0]))
+	if span == nil {
+		return req, nil
+	}
+	traced := span.Context.AppendBinary(encoder{req[0] | OP_TRACED})
+	return append(traced, req[1:]...), span
+}
+
+// Record how a traced call went and end its span.
+func endCall(span *trace.Span, err error) {
+	if !errors.Is(err, kv.ErrKeyNotFound) {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// Send a request of class under its policy's timeout and return the fields of a successful response.
+func (c *Client) call(class CallClass, req encoder) (*decoder, error) {
+	var deadline time.Time
+	if timeout := c.policy(class).Timeout; timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	req, span := c.traced(req)
+	d, err := c.roundTrip(req, deadline)
+	endCall(span, err)
+	return d, err
+}
+
+/*
+Send a read, and if it hasn't been answered after the policy's HedgeAfter send it to
+a replica as well, returning the first answer that isn't a failure to get one.
+*/
+func (c *Client) read(req encoder) (d *decoder, err error) {
+	policy := c.policy(CALL_READ)
+	c.mu.Lock()
+	inTx := c.inTx
+	c.mu.Unlock()
+	if policy.HedgeAfter <= 0 || inTx {
+		return c.call(CALL_READ, req)
+	}
+	var deadline time.Time
+	if policy.Timeout > 0 {
+		deadline = time.Now().Add(policy.Timeout)
+	}
+	req, span := c.traced(req)
+	defer func() { endCall(span, err) }()
+
+	type result struct {
+		d       *decoder
+		err     error
+		replica bool
+	}
+	// Room for both, so the loser never blocks
+	results := make(chan result, 2)
+	go func() {
+		d, err := c.roundTrip(req, deadline)
+		results <- result{d, err, false}
+	}()
+	timer := time.NewTimer(policy.HedgeAfter)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.d, r.err
+	case <-timer.C:
+	}
+
+	replica := c.replica()
+	if replica == nil {
+		r := <-results
+		return r.d, r.err
+	}
+	span.SetAttr("hedged", true)
+	go func() {
+		d, err := replica.roundTrip(req, deadline)
+		results <- result{d, err, true}
+	}()
+	r := <-results
+	if r.err != nil && !fromServer(r.err) {
+		r = <-results
+	}
+	c.policyMu.Lock()
+	c.stats.Hedged++
+	if r.replica && (r.err == nil || fromServer(r.err)) {
+		c.stats.HedgeWins++
+	}
+	c.policyMu.Unlock()
+	span.SetAttr("replica_won", r.replica)
+	return r.d, r.err
+}
+
+// Send a request and return the fields of a successful response, giving up at deadline if it isn't zero.
+func (c *Client) roundTrip(req encoder, deadline time.Time) (*decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken != nil {
+		return nil, c.broken
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	resp, err := func() ([]byte, error) {
+		if err := writeFrame(c.w, req); err != nil {
+			return nil, err
+		}
+		if err := c.w.Flush(); err != nil {
+			return nil, err
+		}
+		return readFrame(c.r)
+	}()
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		c.broken = fmt.Errorf("%w: connection closed after a call ran past its deadline", ErrTimeout)
+		c.conn.Close()
+		c.policyMu.Lock()
+		c.stats.Timeouts++
+		c.policyMu.Unlock()
+		return nil, c.broken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{buf: resp}
+	status := d.byte()
+	if status == STATUS_OK {
+		return d, nil
+	}
+	msg := string(d.bytes())
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	switch status {
+	case STATUS_NOT_FOUND:
+		return nil, fmt.Errorf("%w: %s", kv.ErrKeyNotFound, msg)
+	case STATUS_CONFLICT:
+		return nil, fmt.Errorf("%w: %s", kv.ErrConflict, msg)
+	case STATUS_OVERLOADED:
+		return nil, fmt.Errorf("%w: %s", ErrOverloaded, msg)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrRemote, msg)
+}
+
+func (c *Client) Get(key []byte) ([]byte, error) {
+	d, err := c.read(encoder{OP_GET}.bytes(key))
+	if err != nil {
+		return nil, err
+	}
+	val := d.bytes()
+	return val, d.finish()
+}
+
+// Store val under key. Returns the version committed, or 0 inside a transaction.
+func (c *Client) Set(key, val []byte) (uint64, error) {
+	d, err := c.call(CALL_WRITE, encoder{OP_SET}.bytes(key).bytes(val))
+	if err != nil {
+		return 0, err
+	}
+	version := d.uint64()
+	return version, d.finish()
+}
+
+// Remove key. Returns whether it was there.
+func (c *Client) Del(key []byte) (bool, error) {
+	d, err := c.call(CALL_WRITE, encoder{OP_DEL}.bytes(key))
+	if err != nil {
+		return false, err
+	}
+	deleted := d.byte() == 1
+	return deleted, d.finish()
+}
+
+/*
+Call fn on every pair in [start, end) in order, a nil end meaning no upper bound.
+Pairs are fetched limit at a time (0 for DEFAULT_SCAN_LIMIT), and outside a
+transaction each batch reads the latest commit, so a long scan isn't a single
+snapshot.
+*/
+func (c *Client) Scan(start, end []byte, limit int, fn func(key, val []byte) error) error {
+	for {
+		d, err := c.read(encoder{OP_SCAN}.bytes(start).bytes(end).uint32(uint32(limit)))
+		if err != nil {
+			return err
+		}
+		n := int(d.uint32())
+		var last []byte
+		for i := 0; i < n && d.err == nil; i++ {
+			key, val := d.bytes(), d.bytes()
+			if d.err != nil {
+				break
+			}
+			if err := fn(key, val); err != nil {
+				return err
+			}
+			last = key
+		}
+		more := d.byte() == 1
+		if err := d.finish(); err != nil {
+			return err
+		}
+		if !more || last == nil {
+			return nil
+		}
+		start = append(last[:len(last):len(last)], 0)
+	}
+}
+
+/*
+A Merkle tree over the server's latest commit, as from kv.Snapshot.MerkleTree, to
+compare with a local copy through kv.Snapshot.MerkleTreeLike.
+*/
+func (c *Client) MerkleTree(fanout, leafKeys int) (*kv.MerkleNode, error) {
+	d, err := c.call(CALL_READ, encoder{OP_MERKLE}.uint32(uint32(max(fanout, 0))).uint32(uint32(max(leafKeys, 0))))
+	if err != nil {
+		return nil, err
+	}
+	tree := d.merkle(1)
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// Start a transaction on the connection. Returns the version it reads.
+func (c *Client) Begin(level kv.IsolationLevel) (uint64, error) {
+	d, err := c.call(CALL_TX, encoder{OP_BEGIN}.byte(byte(level)))
+	if err != nil {
+		return 0, err
+	}
+	c.setTx(true)
+	version := d.uint64()
+	return version, d.finish()
+}
+
+/*
+Commit the connection's transaction. Returns the version of the commit, or 0 if it
+wrote nothing. On kv.ErrConflict the transaction has been rolled back and should be
+run again from Begin.
+*/
+func (c *Client) Commit() (uint64, error) {
+	d, err := c.call(CALL_TX, encoder{OP_COMMIT})
+	c.setTx(false)
+	if err != nil {
+		return 0, err
+	}
+	version := d.uint64()
+	return version, d.finish()
+}
+
+func (c *Client) Rollback() error {
+	d, err := c.call(CALL_TX, encoder{OP_ROLLBACK})
+	c.setTx(false)
+	if err != nil {
+		return err
+	}
+	return d.finish()
+}
+
+/*
+Run the connection's requests at priority from now on. Batch requests are the first
+to be shed, with ErrOverloaded, when the server is overloaded.
+*/
+func (c *Client) SetPriority(priority Priority) error {
+	d, err := c.call(CALL_TX, encoder{OP_PRIORITY}.byte(byte(priority)))
+	if err != nil {
+		return err
+	}
+	return d.finish()
+}
+
+func (c *Client) setTx(inTx bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inTx = inTx
+}
+
+// Run change in a transaction on the connection, running it again while it conflicts.
+func (c *Client) Update(level kv.IsolationLevel, change func() error) (uint64, error) {
+	for {
+		if _, err := c.Begin(level); err != nil {
+			return 0, err
+		}
+		if err := change(); err != nil {
+			c.Rollback()
+			return 0, err
+		}
+		version, err := c.Commit()
+		if !errors.Is(err, kv.ErrConflict) {
+			return version, err
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package server
+
+import "time"
+
+// No way to tell here, so LoadLimits.MaxCPU is never exceeded.
+func processCPUTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,644 @@
+package server
+
+import (
+	"database-go/pkg/btree"
+	"database-go/pkg/kv"
+	"database-go/pkg/trace"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+A JSON API over HTTP, for curl and light integrations:
+
+	GET    /v1/kv/{key}   the value, as the raw body
+	PUT    /v1/kv/{key}   store the body as the value      {"version": n}
+	DELETE /v1/kv/{key}   remove the key                   {"version": n}
+	GET    /v1/scan       pairs in key order               {"pairs": [{"key", "value"}...], "next": cursor}
+	POST   /v1/multi-get  {"keys": [...]}                  {"version": n, "pairs": [{"key", "value"}...]}
+	POST   /v1/multi-put  {"pairs": [...], "delete": [...]} {"version": n}
+	GET    /v1/stats      the DB's kv.Stats
+	GET    /v1/verify     run DB.Verify and report          {"ok": bool, "violations": [...], ...}
+
+Keys are the rest of the path, URL-escaped. Scan takes prefix, or start and end, plus
+limit (DEFAULT_SCAN_LIMIT by default) and cursor, the "next" of the batch before;
+"next" is missing after the last batch. Keys and values in scan results, and the
+parameters, are strings, or base64 with encoding=base64 for binary data; the same
+goes for the keys and values in the bodies of multi-get and multi-put.
+
+Multi-get reads up to MAX_SCAN_LIMIT keys from one snapshot, in the order asked, with
+a null value for each that is missing. Multi-put sets and deletes keys in a single
+transaction, so all of them happen or none do.
+
+A scan asked for with format=ndjson, or Accept: application/x-ndjson, streams its
+pairs one JSON object per line from one snapshot instead, with no limit unless one
+is given. If the limit stops it, the last line is {"next": cursor} to carry on from;
+an error partway through ends the stream with an {"error": message} line.
+
+With key versions on (kv.Options.KeyVersions), a key's version is its ETag. GET
+answers If-None-Match with 304 Not Modified, and PUT and DELETE only go ahead if
+If-Match (or If-None-Match: * for creating) holds, else 412 Precondition Failed,
+which is optimistic concurrency for web clients. If-Match: * and If-None-Match: *
+work without versions too. Errors come back as {"error": message}.
+
+A request with a W3C traceparent header is traced as a child of the span it names,
+and any other as a trace of its own, while tracing is on; see pkg/trace.
+
+Under load, requests may be shed with 503 Service Unavailable; see SetLoadLimits.
+Send X-Priority: batch for work that should give way to everything else.
+*/
+
+// A PUT or DELETE whose If-Match or If-None-Match doesn't hold
+var errPrecondition = errors.New("server: precondition failed")
+
+// Serve the HTTP API on ln until Close.
+func (s *Server) ServeREST(ln net.Listener) error {
+	hs := &http.Server{Handler: s.RESTHandler()}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.https = append(s.https, hs)
+	s.mu.Unlock()
+
+	if err := hs.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// Listen on addr and serve the HTTP API until Close.
+func (s *Server) ListenAndServeREST(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeREST(ln)
+}
+
+// The HTTP API as a handler, to mount on a server of one's own.
+func (s *Server) RESTHandler() http.Handler {
+	h := &restHandler{db: s.db}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/kv/{key...}", h.get)
+	mux.HandleFunc("PUT /v1/kv/{key...}", h.put)
+	mux.HandleFunc("DELETE /v1/kv/{key...}", h.del)
+	mux.HandleFunc("GET /v1/scan", h.scan)
+	mux.HandleFunc("POST /v1/multi-get", h.multiGet)
+	mux.HandleFunc("POST /v1/multi-put", h.multiPut)
+	mux.HandleFunc("GET /v1/stats", h.stats)
+	mux.HandleFunc("GET /v1/verify", h.verify)
+	return traceREST(s.shedREST(mux))
+}
+
+// Run each request h serves in a span, continuing the caller's trace if it sent one.
+func traceREST(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if sc, err := trace.ParseTraceparent(r.Header.Get(trace.TRACEPARENT_HEADER)); err == nil {
+			ctx = trace.WithRemote(ctx, sc)
+		}
+		ctx, span := trace.Start(ctx, "http "+r.Method)
+		if span == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type restHandler struct {
+	db *kv.DB
+}
+
+type restPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type restScan struct {
+	Pairs []restPair `json:"pairs"`
+	Next  string     `json:"next,omitempty"`
+}
+
+type restScanEnd struct {
+	Next string `json:"next"`
+}
+
+type restMultiGet struct {
+	Keys []string `json:"keys"`
+}
+
+// A pair multi-get looked up; Value is nil for a key that isn't there
+type restGot struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+}
+
+type restGotAll struct {
+	Version uint64    `json:"version"`
+	Pairs   []restGot `json:"pairs"`
+}
+
+type restMultiPut struct {
+	Pairs  []restPair `json:"pairs"`
+	Delete []string   `json:"delete"`
+}
+
+type restStats struct {
+	Version          uint64 `json:"version"`
+	Pages            uint64 `json:"pages"`
+	PageSize         int    `json:"page_size"`
+	CacheHits        uint64 `json:"cache_hits"`
+	CacheMisses      uint64 `json:"cache_misses"`
+	CacheEvictions   uint64 `json:"cache_evictions"`
+	CacheResident    int    `json:"cache_resident"`
+	CacheDirty       int    `json:"cache_dirty"`
+	Readers          int    `json:"readers"`
+	HeldPages        int    `json:"held_pages"`
+	Running          int    `json:"running_transactions"`
+	RetainedVersions int    `json:"retained_versions"`
+	KeyVersions      bool   `json:"key_versions"`
+	ReadOnly         bool   `json:"read_only"`
+}
+
+type restVerify struct {
+	OK            bool     `json:"ok"`
+	Depth         int      `json:"depth"`
+	Nodes         int      `json:"nodes"`
+	Leaves        int      `json:"leaves"`
+	Keys          int      `json:"keys"`
+	OverflowPages int      `json:"overflow_pages"`
+	FreePages     int      `json:"free_pages"`
+	FreeListPages int      `json:"free_list_pages"`
+	LeakedPages   int      `json:"leaked_pages"`
+	Violations    []string `json:"violations"`
+}
+
+func (h *restHandler) get(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	val, version, err := h.db.GetWithVersion(key)
+	if errors.Is(err, kv.ErrNoKeyVersions) {
+		val, err = h.db.GetContext(r.Context(), key)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if version != 0 {
+		w.Header().Set("ETag", etag(version))
+	}
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatches(match, version, true) {
+		writeJSONError(w, errPrecondition)
+		return
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, version, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(val)
+}
+
+func (h *restHandler) put(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	val, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_FRAME_SIZE))
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	version, err := h.db.UpdateContext(r.Context(), func(tx *kv.Tx) error {
+		if err := checkPreconditions(tx, key, r); err != nil {
+			return err
+		}
+		return tx.Set(key, val)
+	})
+	h.writeVersion(w, version, err)
+}
+
+func (h *restHandler) del(w http.ResponseWriter, r *http.Request) {
+	key := []byte(r.PathValue("key"))
+	version, err := h.db.UpdateContext(r.Context(), func(tx *kv.Tx) error {
+		if err := checkPreconditions(tx, key, r); err != nil {
+			return err
+		}
+		deleted, err := tx.Del(key)
+		if err == nil && !deleted {
+			return kv.ErrKeyNotFound
+		}
+		return err
+	})
+	h.writeVersion(w, version, err)
+}
+
+// Answer a write with the version it committed, which is the key's new ETag if versions are on.
+func (h *restHandler) writeVersion(w http.ResponseWriter, version uint64, err error) {
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if stats, err := h.db.Stats(); err == nil && stats.KeyVersions {
+		w.Header().Set("ETag", etag(version))
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"version": version})
+}
+
+/*
+Check the If-Match and If-None-Match headers of a write against key as the
+transaction sees it, so nothing can change it between the check and the write.
+*/
+func checkPreconditions(tx *kv.Tx, key []byte, r *http.Request) error {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	_, version, err := tx.GetWithVersion(key)
+	if errors.Is(err, kv.ErrNoKeyVersions) {
+		_, err = tx.Get(key)
+	}
+	exists := err == nil
+	if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+		return err
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, version, exists) {
+		return errPrecondition
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, version, exists) {
+		return errPrecondition
+	}
+	return nil
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// Whether a list of ETags, or *, matches a key at version; 0 means it has none.
+func etagMatches(header string, version uint64, exists bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return exists
+	}
+	if !exists || version == 0 {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// How keys and values in a request's parameters, body and results are written.
+type restEncoding struct {
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+func encodingOf(r *http.Request) (restEncoding, error) {
+	switch enc := r.URL.Query().Get("encoding"); enc {
+	case "", "utf8":
+		return restEncoding{
+			encode: func(b []byte) string { return string(b) },
+			decode: func(s string) ([]byte, error) { return []byte(s), nil },
+		}, nil
+	case "base64":
+		return restEncoding{base64.StdEncoding.EncodeToString, base64.StdEncoding.DecodeString}, nil
+	default:
+		return restEncoding{}, fmt.Errorf("%w: unknown encoding %q", ErrProtocol, enc)
+	}
+}
+
+// Decode each of ss, naming what they are in the error for one that doesn't decode.
+func (e restEncoding) decodeAll(what string, ss []string) ([][]byte, error) {
+	out := make([][]byte, len(ss))
+	for i, s := range ss {
+		var err error
+		if out[i], err = e.decode(s); err != nil {
+			return nil, fmt.Errorf("%w: %s %d: %v", ErrProtocol, what, i, err)
+		}
+	}
+	return out, nil
+}
+
+// What a scan request asks for.
+type scanRequest struct {
+	start, end []byte
+	// 0 for no limit
+	limit  int
+	enc    restEncoding
+	ndjson bool
+}
+
+func parseScan(r *http.Request) (scanRequest, error) {
+	q := r.URL.Query()
+	enc, err := encodingOf(r)
+	if err != nil {
+		return scanRequest{}, err
+	}
+	req := scanRequest{enc: enc, limit: DEFAULT_SCAN_LIMIT}
+	switch q.Get("format") {
+	case "":
+		req.ndjson = strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	case "json":
+	case "ndjson":
+		req.ndjson = true
+	default:
+		return scanRequest{}, fmt.Errorf("%w: unknown format %q", ErrProtocol, q.Get("format"))
+	}
+	if req.ndjson {
+		req.limit = 0
+	}
+
+	var params [3][]byte
+	for i, name := range []string{"prefix", "start", "end"} {
+		var err error
+		if params[i], err = enc.decode(q.Get(name)); err != nil {
+			return scanRequest{}, fmt.Errorf("%w: %s: %v", ErrProtocol, name, err)
+		}
+	}
+	req.start, req.end = params[1], params[2]
+	if len(req.end) == 0 {
+		req.end = nil
+	}
+	if prefix := params[0]; len(prefix) > 0 {
+		req.start, req.end = prefix, btree.PrefixEnd(prefix)
+	}
+	if cursor := q.Get("cursor"); cursor != "" {
+		next, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return scanRequest{}, fmt.Errorf("%w: bad cursor", ErrProtocol)
+		}
+		req.start = next
+	}
+	if q.Has("limit") {
+		n, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || n <= 0 || n > MAX_SCAN_LIMIT {
+			return scanRequest{}, fmt.Errorf("%w: limit must be 1 to %d", ErrProtocol, MAX_SCAN_LIMIT)
+		}
+		req.limit = n
+	}
+	return req, nil
+}
+
+// The cursor that resumes a scan just after key.
+func scanCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append(append([]byte{}, key...), 0))
+}
+
+func (h *restHandler) scan(w http.ResponseWriter, r *http.Request) {
+	req, err := parseScan(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	snap, err := h.db.Snapshot()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	defer snap.Release()
+	if req.ndjson {
+		streamScan(w, r, snap, req)
+		return
+	}
+
+	res := restScan{Pairs: []restPair{}}
+	var last []byte
+	err = snap.Range(req.start, req.end, func(key, val []byte) error {
+		if len(res.Pairs) == req.limit {
+			res.Next = scanCursor(last)
+			return errScanFull
+		}
+		res.Pairs = append(res.Pairs, restPair{req.enc.encode(key), req.enc.encode(val)})
+		last = key
+		return nil
+	})
+	if err != nil && !errors.Is(err, errScanFull) {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Write the scan as NDJSON, flushing every NDJSON_FLUSH_PAIRS pairs so the client can start on them.
+func streamScan(w http.ResponseWriter, r *http.Request, snap *kv.Snapshot, req scanRequest) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	var last []byte
+	err := snap.Range(req.start, req.end, func(key, val []byte) error {
+		if req.limit > 0 && n == req.limit {
+			return errScanFull
+		}
+		// A client that has gone away stops the scan
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(restPair{req.enc.encode(key), req.enc.encode(val)}); err != nil {
+			return err
+		}
+		if n++; flusher != nil && n%NDJSON_FLUSH_PAIRS == 0 {
+			flusher.Flush()
+		}
+		last = key
+		return nil
+	})
+	switch {
+	case errors.Is(err, errScanFull):
+		enc.Encode(restScanEnd{Next: scanCursor(last)})
+	case err != nil && r.Context().Err() == nil:
+		enc.Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+func (h *restHandler) multiGet(w http.ResponseWriter, r *http.Request) {
+	enc, err := encodingOf(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var req restMultiGet
+	if err := readJSON(w, r, &req); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if len(req.Keys) > MAX_SCAN_LIMIT {
+		writeJSONError(w, fmt.Errorf("%w: %d keys, limit is %d", ErrProtocol, len(req.Keys), MAX_SCAN_LIMIT))
+		return
+	}
+	keys, err := enc.decodeAll("key", req.Keys)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	snap, err := h.db.Snapshot()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	defer snap.Release()
+	res := restGotAll{Version: snap.Version(), Pairs: make([]restGot, len(keys))}
+	for i, key := range keys {
+		res.Pairs[i].Key = req.Keys[i]
+		val, err := snap.Get(key)
+		if errors.Is(err, kv.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		v := enc.encode(val)
+		res.Pairs[i].Value = &v
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *restHandler) multiPut(w http.ResponseWriter, r *http.Request) {
+	enc, err := encodingOf(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var req restMultiPut
+	if err := readJSON(w, r, &req); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	keys := make([]string, len(req.Pairs))
+	vals := make([]string, len(req.Pairs))
+	for i, p := range req.Pairs {
+		keys[i], vals[i] = p.Key, p.Value
+	}
+	setKeys, err := enc.decodeAll("key", keys)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	setVals, err := enc.decodeAll("value", vals)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	delKeys, err := enc.decodeAll("deleted key", req.Delete)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	version, err := h.db.UpdateContext(r.Context(), func(tx *kv.Tx) error {
+		for i, key := range setKeys {
+			if err := tx.Set(key, setVals[i]); err != nil {
+				return err
+			}
+		}
+		for _, key := range delKeys {
+			if _, err := tx.Del(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	h.writeVersion(w, version, err)
+}
+
+func (h *restHandler) stats(w http.ResponseWriter, r *http.Request) {
+	s, err := h.db.Stats()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, restStats{
+		Version:          s.Version,
+		Pages:            s.Pages,
+		PageSize:         s.PageSize,
+		CacheHits:        s.Cache.Hits,
+		CacheMisses:      s.Cache.Misses,
+		CacheEvictions:   s.Cache.Evictions,
+		CacheResident:    s.Cache.Resident,
+		CacheDirty:       s.Cache.Dirty,
+		Readers:          s.Readers,
+		HeldPages:        s.HeldPages,
+		Running:          s.Running,
+		RetainedVersions: s.RetainedVersions,
+		KeyVersions:      s.KeyVersions,
+		ReadOnly:         s.ReadOnly,
+	})
+}
+
+func (h *restHandler) verify(w http.ResponseWriter, r *http.Request) {
+	report, err := h.db.Verify()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	res := restVerify{
+		OK:            report.OK(),
+		Depth:         report.Depth,
+		Nodes:         report.Nodes,
+		Leaves:        report.Leaves,
+		Keys:          report.Keys,
+		OverflowPages: report.OverflowPages,
+		FreePages:     report.FreeList.Free,
+		FreeListPages: report.FreeList.ListPages,
+		LeakedPages:   report.FreeList.Leaked,
+		Violations:    []string{},
+	}
+	for _, v := range report.Violations {
+		res.Violations = append(res.Violations, v.String())
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Decode a JSON request body into v, of at most MAX_FRAME_SIZE bytes.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_FRAME_SIZE)).Decode(v)
+	var maxBytes *http.MaxBytesError
+	if err != nil && !errors.As(err, &maxBytes) {
+		return fmt.Errorf("%w: request body: %v", ErrProtocol, err)
+	}
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errPrecondition):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, kv.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, kv.ErrReservedKey), errors.Is(err, kv.ErrNoKeyVersions),
+		errors.Is(err, btree.ErrKeyTooLarge), errors.Is(err, ErrProtocol):
+		status = http.StatusBadRequest
+	case errors.As(err, &maxBytes):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, kv.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, kv.ErrClosed), errors.Is(err, ErrOverloaded):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
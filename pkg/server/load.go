@@ -0,0 +1,273 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// Returned for a request the server shed because it was overloaded; try again later
+var ErrOverloaded = errors.New("server: overloaded")
+
+// How urgent a connection's requests are; see OP_PRIORITY.
+type Priority byte
+
+const (
+	// Someone is waiting on the answer; the default
+	PRIORITY_INTERACTIVE Priority = iota
+	// Bulk work that can wait, shed first under load
+	PRIORITY_BATCH
+	PRIORITIES
+)
+
+const (
+	// How long an interactive request waits for a slot when LoadLimits.QueueWait isn't set
+	DEFAULT_QUEUE_WAIT = time.Second
+	// Share of the slots batch requests may take when LoadLimits.BatchShare isn't set
+	DEFAULT_BATCH_SHARE = 0.5
+	// How often CPU and memory use are sampled
+	LOAD_SAMPLE_INTERVAL = 100 * time.Millisecond
+	// Weight of the newest write in the write latency average
+	WRITE_LATENCY_WEIGHT = 0.2
+
+	// Header a REST request sets to "batch" to run at PRIORITY_BATCH
+	PRIORITY_HEADER = "X-Priority"
+)
+
+/*
+When the server counts as saturated, for SetLoadLimits. Zero fields are no limit.
+
+Only so many requests run at once. Interactive requests queue for a slot, for up to
+QueueWait, and are shed after that. Batch requests never queue: they only run while
+slots are free within their share, and only while CPU, memory and write latency are
+all under their limits, so batch work is shed first and leaves the rest of the
+capacity to interactive traffic.
+*/
+type LoadLimits struct {
+	// Requests running at once
+	MaxInFlight int
+	// Share of MaxInFlight batch requests may take, DEFAULT_BATCH_SHARE if 0
+	BatchShare float64
+	// Longest an interactive request waits for a slot, DEFAULT_QUEUE_WAIT if 0
+	QueueWait time.Duration
+	// Fraction of the CPUs (GOMAXPROCS) the process may use
+	MaxCPU float64
+	// Bytes of live and unswept heap objects
+	MaxHeapBytes uint64
+	// Average time a write, including its commit and fsync, takes; a measure of I/O load
+	MaxWriteLatency time.Duration
+}
+
+// What load shedding has seen and done.
+type LoadStats struct {
+	InFlight int
+	// Requests run and shed, by priority
+	Admitted [PRIORITIES]int
+	Shed     [PRIORITIES]int
+	// Interactive requests that had to wait for a slot
+	Queued int
+	// As last sampled
+	CPU          float64
+	HeapBytes    uint64
+	WriteLatency time.Duration
+}
+
+// Admission control for the server's requests; see LoadLimits.
+type loadShedder struct {
+	mu     sync.Mutex
+	limits LoadLimits
+	// One entry per request running, nil for no limit
+	slots chan struct{}
+	stats LoadStats
+	// Whether a limit on CPU, memory or write latency is exceeded
+	pressured bool
+
+	// Stops the sampler, if it is running
+	stop chan struct{}
+	// For the CPU sample
+	lastCPU  time.Duration
+	lastTime time.Time
+	// Writes since the last sample
+	writes int
+}
+
+/*
+Shed load beyond limits from now on, for requests over the protocol in proto.go, the
+HTTP API, RESP commands and Postgres statements. A REST request asks for
+PRIORITY_BATCH with the PRIORITY_HEADER header; a shed one gets 503 Service
+Unavailable. RESP and Postgres connections pick theirs as described in resp.go and
+pgwire.go. The zero LoadLimits turns shedding off.
+*/
+func (s *Server) SetLoadLimits(limits LoadLimits) {
+	l := &s.load
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits.BatchShare <= 0 || limits.BatchShare > 1 {
+		limits.BatchShare = DEFAULT_BATCH_SHARE
+	}
+	if limits.QueueWait <= 0 {
+		limits.QueueWait = DEFAULT_QUEUE_WAIT
+	}
+	l.limits = limits
+	l.slots = nil
+	if limits.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, limits.MaxInFlight)
+	}
+	l.pressured = false
+
+	sample := limits.MaxCPU > 0 || limits.MaxHeapBytes > 0 || limits.MaxWriteLatency > 0
+	if sample && l.stop == nil {
+		l.stop = make(chan struct{})
+		l.lastCPU, l.lastTime = processCPUTime(), time.Now()
+		go l.sampler(l.stop)
+	} else if !sample && l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
+
+func (s *Server) LoadStats() LoadStats {
+	s.load.mu.Lock()
+	defer s.load.mu.Unlock()
+	return s.load.stats
+}
+
+/*
+Wait for a request at priority to be let in. Returns a function to call when it is
+done, or ErrOverloaded if it is shed.
+*/
+func (l *loadShedder) admit(priority Priority) (func(), error) {
+	l.mu.Lock()
+	slots, limits := l.slots, l.limits
+	shed := priority == PRIORITY_BATCH &&
+		(l.pressured || (slots != nil && float64(len(slots)) >= limits.BatchShare*float64(cap(slots))))
+	if shed {
+		l.stats.Shed[priority]++
+		l.mu.Unlock()
+		return nil, ErrOverloaded
+	}
+	l.mu.Unlock()
+
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			if priority == PRIORITY_BATCH || !l.queue(slots, limits.QueueWait) {
+				l.mu.Lock()
+				l.stats.Shed[priority]++
+				l.mu.Unlock()
+				return nil, ErrOverloaded
+			}
+		}
+	}
+
+	l.mu.Lock()
+	l.stats.Admitted[priority]++
+	l.stats.InFlight++
+	l.mu.Unlock()
+	return func() {
+		if slots != nil {
+			<-slots
+		}
+		l.mu.Lock()
+		l.stats.InFlight--
+		l.mu.Unlock()
+	}, nil
+}
+
+// Wait up to wait for a slot. Returns whether one was taken.
+func (l *loadShedder) queue(slots chan struct{}, wait time.Duration) bool {
+	l.mu.Lock()
+	l.stats.Queued++
+	l.mu.Unlock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Fold the time a write took into the average.
+func (l *loadShedder) wrote(took time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	avg := &l.stats.WriteLatency
+	if *avg == 0 {
+		*avg = took
+	} else {
+		*avg += time.Duration(WRITE_LATENCY_WEIGHT * float64(took-*avg))
+	}
+	l.writes++
+	l.updatePressure()
+}
+
+/*
+Sample CPU and memory use every LOAD_SAMPLE_INTERVAL until stop is closed. The write
+latency average decays while there are no writes, so with batch writes shed and no
+others, it doesn't stay over the limit for good.
+*/
+func (l *loadShedder) sampler(stop chan struct{}) {
+	ticker := time.NewTicker(LOAD_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+	heap := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			metrics.Read(heap)
+			cpu := processCPUTime()
+
+			l.mu.Lock()
+			if heap[0].Value.Kind() == metrics.KindUint64 {
+				l.stats.HeapBytes = heap[0].Value.Uint64()
+			}
+			if wall := now.Sub(l.lastTime); wall > 0 && cpu > 0 {
+				l.stats.CPU = float64(cpu-l.lastCPU) / float64(wall) / float64(runtime.GOMAXPROCS(0))
+			}
+			l.lastCPU, l.lastTime = cpu, now
+			if l.writes == 0 {
+				l.stats.WriteLatency -= time.Duration(WRITE_LATENCY_WEIGHT * float64(l.stats.WriteLatency))
+			}
+			l.writes = 0
+			l.updatePressure()
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Called with l.mu held.
+func (l *loadShedder) updatePressure() {
+	limits, stats := l.limits, l.stats
+	l.pressured = (limits.MaxCPU > 0 && stats.CPU > limits.MaxCPU) ||
+		(limits.MaxHeapBytes > 0 && stats.HeapBytes > limits.MaxHeapBytes) ||
+		(limits.MaxWriteLatency > 0 && stats.WriteLatency > limits.MaxWriteLatency)
+}
+
+// Apply load shedding to the requests h serves.
+func (s *Server) shedREST(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := PRIORITY_INTERACTIVE
+		if r.Header.Get(PRIORITY_HEADER) == "batch" {
+			priority = PRIORITY_BATCH
+		}
+		done, err := s.load.admit(priority)
+		if err != nil {
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, err)
+			return
+		}
+		defer done()
+		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			start := time.Now()
+			defer func() { s.load.wrote(time.Since(start)) }()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/kv"
+	"database-go/pkg/sql"
+	"database-go/pkg/table"
+	"database-go/pkg/trace"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The Postgres wire protocol (version 3.0), so psql and Postgres drivers can run the
+SQL of pkg/sql. Only the simple query protocol is there: a Query message holds one or
+more statements separated by semicolons, and each gets its rows back as text. The
+extended protocol (Parse, Bind, Execute...) gets an error, so drivers have to be set
+to use simple queries. There is no authentication and no TLS; a client asking for
+TLS is told to go without.
+
+Outside BEGIN ... COMMIT every statement commits on its own, running again if it
+conflicts. Inside, a statement that fails leaves the transaction aborted until
+ROLLBACK or COMMIT, as in Postgres, and a COMMIT that conflicts reports SQLSTATE
+40001, which drivers know to retry.
+
+Column types map to int8, bytea, text and bool.
+
+Each statement but ROLLBACK is subject to load shedding (see Server.SetLoadLimits),
+and one that is shed fails with SQLSTATE 53300. A connection whose startup message
+sets the parameter priority to batch runs at PRIORITY_BATCH.
+*/
+
+const (
+	// Startup request codes
+	PG_PROTOCOL_VERSION = 3 << 16
+	PG_SSL_REQUEST      = 80877103
+	PG_GSSENC_REQUEST   = 80877104
+	PG_CANCEL_REQUEST   = 80877102
+
+	// Type OIDs
+	PG_TYPE_BOOL  = 16
+	PG_TYPE_BYTEA = 17
+	PG_TYPE_INT8  = 20
+	PG_TYPE_TEXT  = 25
+)
+
+// Error with its SQLSTATE code.
+type pgError struct {
+	code string
+	err  error
+}
+
+func (e *pgError) Error() string { return e.err.Error() }
+
+// Accept Postgres connections from ln until Close.
+func (s *Server) ServePG(ln net.Listener) error {
+	return s.serve(ln, s.servePGConn)
+}
+
+// Listen on addr and serve the Postgres protocol until Close.
+func (s *Server) ListenAndServePG(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServePG(ln)
+}
+
+// The state of one Postgres connection.
+type pgSession struct {
+	db *kv.DB
+	w  *bufio.Writer
+	// The transaction opened by BEGIN, if any, and whether a statement in it failed
+	tx       *kv.Tx
+	failed   bool
+	priority Priority
+	load     *loadShedder
+}
+
+func (s *Server) servePGConn(conn net.Conn) {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	sess := &pgSession{db: s.db, w: w, load: &s.load}
+	defer func() {
+		if sess.tx != nil {
+			sess.tx.Rollback()
+		}
+	}()
+	if ok := sess.startup(r); !ok {
+		return
+	}
+
+	// After an extended protocol message, everything up to the next Sync is skipped
+	skipping := false
+	for {
+		typ, body, err := readPGMessage(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case 'Q':
+			if skipping {
+				break
+			}
+			query, _, ok := strings.Cut(string(body), "\x00")
+			if !ok {
+				return
+			}
+			sess.query(query)
+		case 'S':
+			skipping = false
+			sess.ready()
+		case 'X':
+			return
+		case 'P', 'B', 'D', 'E', 'C', 'H':
+			if !skipping {
+				skipping = true
+				if sess.tx != nil {
+					sess.failed = true
+				}
+				sess.error(&pgError{"0A000", errors.New("the extended query protocol is not supported; use simple queries")})
+			}
+		default:
+			sess.error(&pgError{"08P01", fmt.Errorf("%w: unknown message type %q", ErrProtocol, typ)})
+			w.Flush()
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+/*
+Read the startup message, turning down any number of TLS and GSSAPI requests before
+it, and greet the client. Returns false if the connection should be closed.
+*/
+func (sess *pgSession) startup(r *bufio.Reader) bool {
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return false
+		}
+		if size < 8 || size > MAX_FRAME_SIZE {
+			return false
+		}
+		body := make([]byte, size-4)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return false
+		}
+
+		switch code := binary.BigEndian.Uint32(body); code {
+		case PG_SSL_REQUEST, PG_GSSENC_REQUEST:
+			if err := sess.w.WriteByte('N'); err != nil || sess.w.Flush() != nil {
+				return false
+			}
+			continue
+		case PG_PROTOCOL_VERSION:
+			// Name and value pairs, ending with an empty name
+			for params := string(body[4:]); ; {
+				var name, val string
+				name, params, _ = strings.Cut(params, "\x00")
+				if name == "" {
+					break
+				}
+				val, params, _ = strings.Cut(params, "\x00")
+				if name == "priority" && val == "batch" {
+					sess.priority = PRIORITY_BATCH
+				}
+			}
+		case PG_CANCEL_REQUEST:
+			// Queries run to the end
+			return false
+		default:
+			if code>>16 == 3 {
+				sess.error(&pgError{"08P01", fmt.Errorf("%w: protocol version 3.%d not supported", ErrProtocol, code&0xffff)})
+				sess.w.Flush()
+			}
+			return false
+		}
+
+		sess.message('R', binary.BigEndian.AppendUint32(nil, 0))
+		for _, param := range [][2]string{
+			{"server_version", "14.0 (database-go)"},
+			{"server_encoding", "UTF8"},
+			{"client_encoding", "UTF8"},
+			{"DateStyle", "ISO, MDY"},
+			{"integer_datetimes", "on"},
+			{"standard_conforming_strings", "on"},
+		} {
+			sess.message('S', pgString(pgString(nil, param[0]), param[1]))
+		}
+		sess.message('K', make([]byte, 8))
+		sess.ready()
+		return sess.w.Flush() == nil
+	}
+}
+
+// Run the statements of a Query message, then say the session is ready for another.
+func (sess *pgSession) query(src string) {
+	defer sess.ready()
+	ctx, span := trace.Start(context.Background(), "pg query")
+	defer span.End()
+	_, parse := trace.StartChild(ctx, "sql.parse")
+	stmts, err := sql.ParseAll(src)
+	parse.SetError(err)
+	parse.End()
+	span.SetAttr("statements", len(stmts))
+	if err != nil {
+		span.SetError(err)
+		if sess.tx != nil {
+			sess.failed = true
+		}
+		sess.error(err)
+		return
+	}
+	if len(stmts) == 0 {
+		sess.message('I', nil)
+		return
+	}
+	for _, stmt := range stmts {
+		if err := sess.run(ctx, stmt); err != nil {
+			span.SetError(err)
+			if sess.tx != nil {
+				sess.failed = true
+			}
+			sess.error(err)
+			return
+		}
+	}
+}
+
+// Run one statement at the connection's priority. ROLLBACK is never shed, so a transaction can always be ended.
+func (sess *pgSession) run(ctx context.Context, stmt sql.Statement) error {
+	if _, ok := stmt.(*sql.Rollback); !ok {
+		done, err := sess.load.admit(sess.priority)
+		if err != nil {
+			return err
+		}
+		defer done()
+	}
+	switch stmt.(type) {
+	case *sql.Insert, *sql.Update, *sql.Delete, *sql.Commit:
+		start := time.Now()
+		defer func() { sess.load.wrote(time.Since(start)) }()
+	}
+	return sess.exec(ctx, stmt)
+}
+
+// Run one statement and send its results.
+func (sess *pgSession) exec(ctx context.Context, stmt sql.Statement) error {
+	switch stmt := stmt.(type) {
+	case *sql.Begin:
+		if sess.tx != nil {
+			return &pgError{"25001", errors.New("there is already a transaction in progress")}
+		}
+		tx, err := sess.db.BeginLevel(stmt.Level)
+		if err != nil {
+			return err
+		}
+		sess.tx = tx
+		sess.complete("BEGIN")
+		return nil
+	case *sql.Commit, *sql.Rollback:
+		tx, failed := sess.tx, sess.failed
+		sess.tx, sess.failed = nil, false
+		if tx == nil {
+			// Postgres only warns
+			sess.complete(pgTag(stmt, nil))
+			return nil
+		}
+		if _, ok := stmt.(*sql.Rollback); ok || failed {
+			tx.Rollback()
+			sess.complete("ROLLBACK")
+			return nil
+		}
+		tx.SetContext(ctx)
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		sess.complete("COMMIT")
+		return nil
+	}
+
+	if sess.failed {
+		return &pgError{"25P02", errors.New("current transaction is aborted, commands ignored until end of transaction block")}
+	}
+	var res *sql.Result
+	var err error
+	if sess.tx != nil {
+		sess.tx.SetContext(ctx)
+		res, err = sql.ExecStmt(sess.tx, stmt)
+	} else {
+		_, err = sess.db.UpdateContext(ctx, func(tx *kv.Tx) (err error) {
+			res, err = sql.ExecStmt(tx, stmt)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	switch stmt.(type) {
+	case *sql.Select, *sql.Explain:
+		sess.rowDescription(res)
+		for _, row := range res.Rows {
+			sess.dataRow(row)
+		}
+	}
+	sess.complete(pgTag(stmt, res))
+	return nil
+}
+
+// The command tag of a CommandComplete for stmt, with its result if it has one.
+func pgTag(stmt sql.Statement, res *sql.Result) string {
+	if res == nil {
+		res = &sql.Result{}
+	}
+	switch stmt.(type) {
+	case *sql.CreateTable:
+		return "CREATE TABLE"
+	case *sql.CreateIndex:
+		return "CREATE INDEX"
+	case *sql.Insert:
+		return fmt.Sprintf("INSERT 0 %d", res.RowsAffected)
+	case *sql.Select:
+		return fmt.Sprintf("SELECT %d", len(res.Rows))
+	case *sql.Update:
+		return fmt.Sprintf("UPDATE %d", res.RowsAffected)
+	case *sql.Delete:
+		return fmt.Sprintf("DELETE %d", res.RowsAffected)
+	case *sql.Explain:
+		return "EXPLAIN"
+	case *sql.Commit:
+		return "COMMIT"
+	case *sql.Rollback:
+		return "ROLLBACK"
+	}
+	return ""
+}
+
+func (sess *pgSession) rowDescription(res *sql.Result) {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(res.Columns)))
+	for i, name := range res.Columns {
+		oid, size := uint32(PG_TYPE_TEXT), -1
+		if i < len(res.Types) {
+			switch res.Types[i] {
+			case table.COL_INT64:
+				oid, size = PG_TYPE_INT8, 8
+			case table.COL_BYTES:
+				oid = PG_TYPE_BYTEA
+			case table.COL_BOOL:
+				oid, size = PG_TYPE_BOOL, 1
+			}
+		}
+		msg = pgString(msg, name)
+		// Table OID and column number, none
+		msg = binary.BigEndian.AppendUint32(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		msg = binary.BigEndian.AppendUint32(msg, oid)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(size))
+		// No type modifier, text format
+		msg = binary.BigEndian.AppendUint32(msg, 0xffffffff)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+	}
+	sess.message('T', msg)
+}
+
+func (sess *pgSession) dataRow(row table.Row) {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(row)))
+	for _, v := range row {
+		var text string
+		switch v := v.(type) {
+		case nil:
+			msg = binary.BigEndian.AppendUint32(msg, 0xffffffff)
+			continue
+		case int64:
+			text = strconv.FormatInt(v, 10)
+		case []byte:
+			text = `\x` + hex.EncodeToString(v)
+		case bool:
+			text = "f"
+			if v {
+				text = "t"
+			}
+		default:
+			text = fmt.Sprint(v)
+		}
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(text)))
+		msg = append(msg, text...)
+	}
+	sess.message('D', msg)
+}
+
+func (sess *pgSession) complete(tag string) {
+	sess.message('C', pgString(nil, tag))
+}
+
+// ReadyForQuery, with the transaction status: idle, in a transaction, or in a failed one.
+func (sess *pgSession) ready() {
+	status := byte('I')
+	switch {
+	case sess.failed:
+		status = 'E'
+	case sess.tx != nil:
+		status = 'T'
+	}
+	sess.message('Z', []byte{status})
+}
+
+func (sess *pgSession) error(err error) {
+	code := "XX000"
+	var pgErr *pgError
+	switch {
+	case errors.As(err, &pgErr):
+		code = pgErr.code
+	case errors.Is(err, kv.ErrConflict):
+		code = "40001"
+	case errors.Is(err, sql.ErrSyntax):
+		code = "42601"
+	case errors.Is(err, table.ErrNoTable):
+		code = "42P01"
+	case errors.Is(err, sql.ErrNoColumn):
+		code = "42703"
+	case errors.Is(err, table.ErrTableExists):
+		code = "42P07"
+	case errors.Is(err, table.ErrRowExists):
+		code = "23505"
+	case errors.Is(err, sql.ErrBadValue):
+		code = "42804"
+	case errors.Is(err, ErrOverloaded):
+		code = "53300"
+	}
+	msg := pgString([]byte{'S'}, "ERROR")
+	msg = pgString(append(msg, 'V'), "ERROR")
+	msg = pgString(append(msg, 'C'), code)
+	msg = pgString(append(msg, 'M'), err.Error())
+	sess.message('E', append(msg, 0))
+}
+
+// Buffer one message: its type, a 4 byte big-endian length counting itself, and body.
+func (sess *pgSession) message(typ byte, body []byte) {
+	sess.w.WriteByte(typ)
+	binary.Write(sess.w, binary.BigEndian, uint32(len(body)+4))
+	sess.w.Write(body)
+}
+
+func readPGMessage(r *bufio.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size < 4 || size > MAX_FRAME_SIZE {
+		return 0, nil, fmt.Errorf("%w: message of %d bytes", ErrProtocol, size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// Append a null-terminated string.
+func pgString(buf []byte, s string) []byte {
+	return append(append(buf, s...), 0)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database-go/pkg/kv"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// A frame or field that doesn't decode
+	ErrProtocol = errors.New("server: protocol error")
+	// An error the server reported that has no local equivalent
+	ErrRemote = errors.New("server: remote error")
+)
+
+/*
+Every message, in either direction, is one frame: a 4 byte little-endian length
+followed by that many bytes. A request starts with its op and a response with its
+status; the rest is a sequence of fields, each either a fixed-size integer or a byte
+string with a 4 byte length in front:
+
+	request:  | op | fields... |
+	response: | status | fields... |
+
+	op           request fields                  response fields
+	OP_GET       key                             value
+	OP_SET       key, value                      version (0 inside a transaction)
+	OP_DEL       key                             deleted (1 byte)
+	OP_SCAN      start, end, limit (4 bytes)     count (4 bytes), count x (key, value), more (1 byte)
+	OP_BEGIN     isolation level (1 byte)        version read
+	OP_COMMIT                                    version (0 if nothing was written)
+	OP_ROLLBACK
+	OP_MERKLE    fanout, leaf keys (4 bytes each)
+	                                             nodes in preorder, each start, end, keys (8 bytes),
+	                                             hash, child count (4 bytes)
+	OP_PRIORITY  priority (1 byte)
+
+An empty end means no upper bound, and in OP_MERKLE an empty start the first key.
+Versions are 8 bytes. Any status but STATUS_OK has a message as its only field.
+OP_MERKLE builds the tree from the latest commit; see kv.MerkleNode.
+
+OP_PRIORITY sets the Priority of the connection's requests from then on, interactive
+to begin with. When the server is overloaded (see Server.SetLoadLimits) it sheds
+requests with STATUS_OVERLOADED, batch ones first; OP_PRIORITY and OP_ROLLBACK are
+never shed.
+
+An op with OP_TRACED set carries, between itself and its fields, the context of the
+span in the caller's trace the request is for, as SPAN_CONTEXT_SIZE bytes (see
+pkg/trace). The server's spans for the request, down to page reads and fsyncs, are
+children of that span, so a trace started in the client shows where the time went
+on the server.
+
+A connection has at most one transaction at a time. Between OP_BEGIN and OP_COMMIT
+or OP_ROLLBACK, every operation on the connection goes through it; otherwise each
+one commits on its own. Closing the connection rolls back an open transaction.
+*/
+const (
+	OP_GET = iota + 1
+	OP_SET
+	OP_DEL
+	OP_SCAN
+	OP_BEGIN
+	OP_COMMIT
+	OP_ROLLBACK
+	OP_MERKLE
+	OP_PRIORITY
+
+	// Set on an op whose request carries a span context
+	OP_TRACED = 0x80
+)
+
+// Names of the ops, for spans
+var opNames = map[byte]string{
+	OP_GET:      "GET",
+	OP_SET:      "SET",
+	OP_DEL:      "DEL",
+	OP_SCAN:     "SCAN",
+	OP_BEGIN:    "BEGIN",
+	OP_COMMIT:   "COMMIT",
+	OP_ROLLBACK: "ROLLBACK",
+	OP_MERKLE:   "MERKLE",
+	OP_PRIORITY: "PRIORITY",
+}
+
+const (
+	STATUS_OK = iota
+	STATUS_NOT_FOUND
+	// The transaction conflicted and was rolled back; run it again
+	STATUS_CONFLICT
+	STATUS_ERROR
+	// The request was shed under load, without running; try again later
+	STATUS_OVERLOADED
+)
+
+const (
+	// Largest frame either side accepts, enough for the largest value the kv layer allows
+	MAX_FRAME_SIZE = 128 << 20
+
+	// Pairs returned by one OP_SCAN when the request asks for 0, and the most it can ask for
+	DEFAULT_SCAN_LIMIT = 1000
+	MAX_SCAN_LIMIT     = 100000
+	// Pairs an NDJSON scan over HTTP writes between flushes
+	NDJSON_FLUSH_PAIRS = 100
+
+	// Bytes of an OP_MERKLE node besides its start and end
+	MERKLE_NODE_MIN_SIZE = 4 + 4 + 8 + 4 + sha256.Size + 4
+	// Deepest OP_MERKLE tree accepted; a fanout of 2 reaches this at 2^64 leaves
+	MERKLE_MAX_DEPTH = 64
+)
+
+func opName(op byte) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("op %d", op)
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(head[:])
+	if n == 0 || n > MAX_FRAME_SIZE {
+		return nil, fmt.Errorf("%w: frame of %d bytes", ErrProtocol, n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > MAX_FRAME_SIZE {
+		return fmt.Errorf("%w: frame of %d bytes", ErrProtocol, len(frame))
+	}
+	buf := make([]byte, 4, 4+len(frame))
+	binary.LittleEndian.PutUint32(buf, uint32(len(frame)))
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+// Builds the fields of a frame.
+type encoder []byte
+
+func (e encoder) byte(b byte) encoder {
+	return append(e, b)
+}
+
+func (e encoder) uint32(v uint32) encoder {
+	return binary.LittleEndian.AppendUint32(e, v)
+}
+
+func (e encoder) uint64(v uint64) encoder {
+	return binary.LittleEndian.AppendUint64(e, v)
+}
+
+func (e encoder) bytes(b []byte) encoder {
+	return append(e.uint32(uint32(len(b))), b...)
+}
+
+// Reads the fields of a frame in order. The first error sticks, and later reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = fmt.Errorf("%w: frame ends early", ErrProtocol)
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// The error from the first bad read, or from anything left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%w: %d bytes left over", ErrProtocol, len(d.buf))
+	}
+	return d.err
+}
+
+// Append n and everything under it, in preorder.
+func (e encoder) merkle(n *kv.MerkleNode) encoder {
+	e = e.bytes(n.Start).bytes(n.End).uint64(uint64(n.Keys)).bytes(n.Hash[:]).uint32(uint32(len(n.Children)))
+	for _, c := range n.Children {
+		e = e.merkle(c)
+	}
+	return e
+}
+
+func (d *decoder) merkle(depth int) *kv.MerkleNode {
+	if depth > MERKLE_MAX_DEPTH && d.err == nil {
+		d.err = fmt.Errorf("%w: merkle tree deeper than %d", ErrProtocol, MERKLE_MAX_DEPTH)
+	}
+	n := &kv.MerkleNode{Start: d.bytes(), End: d.bytes(), Keys: int(d.uint64())}
+	if len(n.Start) == 0 {
+		n.Start = nil
+	}
+	if len(n.End) == 0 {
+		n.End = nil
+	}
+	if hash := d.bytes(); len(hash) == len(n.Hash) {
+		copy(n.Hash[:], hash)
+	} else if d.err == nil {
+		d.err = fmt.Errorf("%w: merkle hash of %d bytes", ErrProtocol, len(hash))
+	}
+	count := int(d.uint32())
+	// Every child takes some bytes, which bounds how many there can be
+	if count > len(d.buf)/MERKLE_NODE_MIN_SIZE && d.err == nil {
+		d.err = fmt.Errorf("%w: %d merkle children in %d bytes", ErrProtocol, count, len(d.buf))
+	}
+	for i := 0; i < count && d.err == nil; i++ {
+		n.Children = append(n.Children, d.merkle(depth+1))
+	}
+	return n
+}
@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"database-go/pkg/kv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+RESP, the Redis protocol, so Redis clients in any language can use the store. The
+commands are GET, SET (with NX or XX), DEL, EXISTS, MGET and SCAN (with MATCH and
+COUNT), plus PING and QUIT. Commands come as arrays of bulk strings, or as inline
+lines of words for telnet.
+
+Every command but QUIT and CLIENT is subject to load shedding (see
+Server.SetLoadLimits), and one that is shed gets an error. CLIENT PRIORITY BATCH runs
+the connection's commands at PRIORITY_BATCH from then on, and CLIENT PRIORITY
+INTERACTIVE goes back to the default.
+
+Redis SCAN cursors are stateless; ours are numbers standing for the key to resume
+from, kept by the server for the last MAX_SCAN_CURSORS scans. A cursor that has
+been forgotten gets an error rather than a restart.
+*/
+
+var (
+	errRESPSyntax = errors.New("ERR syntax error")
+	errRESPCursor = errors.New("ERR invalid cursor")
+)
+
+const (
+	// Most bytes of bulk strings in one command, most arguments, and longest inline command
+	MAX_RESP_BULK   = MAX_FRAME_SIZE
+	MAX_RESP_ARRAY  = 4096
+	MAX_RESP_INLINE = 64 << 10
+
+	// SCAN cursors remembered; the oldest are dropped first
+	MAX_SCAN_CURSORS = 10000
+	// Keys a SCAN looks at when it isn't given a COUNT
+	DEFAULT_RESP_SCAN_COUNT = 10
+)
+
+// Accept RESP connections from ln until Close.
+func (s *Server) ServeRESP(ln net.Listener) error {
+	return s.serve(ln, s.serveRESPConn)
+}
+
+// Listen on addr and serve RESP until Close.
+func (s *Server) ListenAndServeRESP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeRESP(ln)
+}
+
+func (s *Server) serveRESPConn(conn net.Conn) {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	priority := PRIORITY_INTERACTIVE
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			// A malformed command leaves the stream out of step, so say why and hang up
+			if errors.Is(err, ErrProtocol) {
+				writeError(w, err)
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := false
+		switch strings.ToUpper(string(args[0])) {
+		case "QUIT":
+			quit = true
+			w.WriteString("+OK\r\n")
+		case "CLIENT":
+			priority = clientCommand(w, args, priority)
+		default:
+			s.runCommand(w, args, priority)
+		}
+		if err := w.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+// Read one command: an array of bulk strings, or an inline line of words.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > MAX_RESP_ARRAY {
+		return nil, fmt.Errorf("%w: bad array length %q", ErrProtocol, line[1:])
+	}
+	// Both lengths are only claims until the bytes arrive, so memory grows with what is read
+	var args [][]byte
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected a bulk string", ErrProtocol)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > MAX_RESP_BULK-total {
+			return nil, fmt.Errorf("%w: bad bulk length %q", ErrProtocol, line[1:])
+		}
+		total += size
+		var arg bytes.Buffer
+		arg.Grow(min(size+2, MAX_RESP_INLINE))
+		if _, err := io.CopyN(&arg, r, int64(size+2)); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg.Bytes(), []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not terminated", ErrProtocol)
+		}
+		args = append(args, arg.Bytes()[:size])
+	}
+	return args, nil
+}
+
+// A line without its CRLF.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, more, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > MAX_RESP_INLINE {
+			return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !more {
+			return line, nil
+		}
+	}
+}
+
+func writeError(w *bufio.Writer, err error) {
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+	if !strings.HasPrefix(msg, "ERR ") && !strings.HasPrefix(msg, "WRONGTYPE ") {
+		msg = "ERR " + msg
+	}
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// A bulk string, or the nil bulk string for nil.
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// CLIENT PRIORITY INTERACTIVE | BATCH. Returns the connection's priority from now on.
+func clientCommand(w *bufio.Writer, args [][]byte, priority Priority) Priority {
+	if len(args) < 2 || !strings.EqualFold(string(args[1]), "PRIORITY") {
+		writeError(w, errors.New("ERR unknown subcommand, try CLIENT PRIORITY INTERACTIVE | BATCH"))
+		return priority
+	}
+	if len(args) != 3 {
+		writeError(w, errors.New("ERR wrong number of arguments for 'client|priority' command"))
+		return priority
+	}
+	switch strings.ToUpper(string(args[2])) {
+	case "INTERACTIVE":
+		priority = PRIORITY_INTERACTIVE
+	case "BATCH":
+		priority = PRIORITY_BATCH
+	default:
+		writeError(w, errRESPSyntax)
+		return priority
+	}
+	w.WriteString("+OK\r\n")
+	return priority
+}
+
+func (s *Server) runCommand(w *bufio.Writer, args [][]byte, priority Priority) {
+	name := strings.ToUpper(string(args[0]))
+	arity := func(min int) bool {
+		if len(args) < min {
+			writeError(w, fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+			return false
+		}
+		return true
+	}
+
+	done, err := s.load.admit(priority)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer done()
+	if name == "SET" || name == "DEL" {
+		start := time.Now()
+		defer func() { s.load.wrote(time.Since(start)) }()
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			writeBulk(w, args[1])
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+
+	case "GET":
+		if !arity(2) {
+			return
+		}
+		val, err := s.db.Get(args[1])
+		switch {
+		case errors.Is(err, kv.ErrKeyNotFound):
+			writeBulk(w, nil)
+		case err != nil:
+			writeError(w, err)
+		default:
+			writeBulk(w, nonNil(val))
+		}
+
+	case "SET":
+		if !arity(3) {
+			return
+		}
+		s.set(w, args[1], args[2], args[3:])
+
+	case "DEL":
+		if !arity(2) {
+			return
+		}
+		n := 0
+		_, err := s.db.Update(func(tx *kv.Tx) error {
+			n = 0
+			for _, key := range args[1:] {
+				deleted, err := tx.Del(key)
+				if err != nil {
+					return err
+				}
+				if deleted {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeInt(w, n)
+
+	case "EXISTS", "MGET":
+		if !arity(2) {
+			return
+		}
+		// Read every key from the same commit
+		snap, err := s.db.Snapshot()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer snap.Release()
+		vals := make([][]byte, len(args)-1)
+		n := 0
+		for i, key := range args[1:] {
+			val, err := snap.Get(key)
+			if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+				writeError(w, err)
+				return
+			}
+			if err == nil {
+				vals[i] = nonNil(val)
+				n++
+			}
+		}
+		if name == "EXISTS" {
+			writeInt(w, n)
+			return
+		}
+		writeArrayHeader(w, len(vals))
+		for _, val := range vals {
+			writeBulk(w, val)
+		}
+
+	case "SCAN":
+		if !arity(2) {
+			return
+		}
+		s.scanRESP(w, args[1:])
+
+	default:
+		writeError(w, fmt.Errorf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// An empty value is still a value, not the nil reply.
+func nonNil(val []byte) []byte {
+	if val == nil {
+		return []byte{}
+	}
+	return val
+}
+
+// SET key value [NX | XX]
+func (s *Server) set(w *bufio.Writer, key, val []byte, opts [][]byte) {
+	var nx, xx bool
+	for _, opt := range opts {
+		switch strings.ToUpper(string(opt)) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			writeError(w, errRESPSyntax)
+			return
+		}
+	}
+	if nx && xx {
+		writeError(w, errRESPSyntax)
+		return
+	}
+
+	written := false
+	_, err := s.db.Update(func(tx *kv.Tx) error {
+		written = false
+		if nx || xx {
+			_, err := tx.Get(key)
+			if err != nil && !errors.Is(err, kv.ErrKeyNotFound) {
+				return err
+			}
+			if exists := err == nil; (nx && exists) || (xx && !exists) {
+				return nil
+			}
+		}
+		written = true
+		return tx.Set(key, val)
+	})
+	switch {
+	case err != nil:
+		writeError(w, err)
+	case written:
+		w.WriteString("+OK\r\n")
+	default:
+		writeBulk(w, nil)
+	}
+}
+
+// The key each SCAN cursor resumes from.
+type respCursors struct {
+	mu   sync.Mutex
+	last uint64
+	next map[uint64][]byte
+}
+
+func (c *respCursors) put(key []byte) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last++
+	c.next[c.last] = key
+	// Cursors are numbered in order, so the oldest is the lowest
+	if c.last > MAX_SCAN_CURSORS {
+		delete(c.next, c.last-MAX_SCAN_CURSORS)
+	}
+	return c.last
+}
+
+func (c *respCursors) get(cursor uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.next[cursor]
+	return key, ok
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func (s *Server) scanRESP(w *bufio.Writer, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		writeError(w, errRESPCursor)
+		return
+	}
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = s.cursors.get(cursor); !ok {
+			writeError(w, errRESPCursor)
+			return
+		}
+	}
+
+	var pattern []byte
+	count := DEFAULT_RESP_SCAN_COUNT
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			writeError(w, errRESPSyntax)
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				writeError(w, errors.New("ERR value is not an integer or out of range"))
+				return
+			}
+			count = min(count, MAX_SCAN_LIMIT)
+		default:
+			writeError(w, errRESPSyntax)
+			return
+		}
+	}
+
+	// Like Redis, COUNT bounds the keys looked at, not the ones that match
+	var keys [][]byte
+	var resume []byte
+	seen := 0
+	snap, err := s.db.Snapshot()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = snap.Range(start, nil, func(key, _ []byte) error {
+		if seen == count {
+			resume = key
+			return errScanFull
+		}
+		seen++
+		if pattern == nil || globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	snap.Release()
+	if err != nil && !errors.Is(err, errScanFull) {
+		writeError(w, err)
+		return
+	}
+
+	next := uint64(0)
+	if resume != nil {
+		next = s.cursors.put(resume)
+	}
+	writeArrayHeader(w, 2)
+	writeBulk(w, []byte(strconv.FormatUint(next, 10)))
+	writeArrayHeader(w, len(keys))
+	for _, key := range keys {
+		writeBulk(w, key)
+	}
+}
+
+/*
+Redis glob matching: * and ? for any run and any byte, [abc], [^a], [a-z], and \ to escape.
+Every element but * matches exactly one byte, so a mismatch only ever has to go back
+to the last * and let it take one more byte: O(len(pattern) * len(s)) at worst, where
+trying every split at every * is exponential in the number of them.
+*/
+func globMatch(pattern, s []byte) bool {
+	p, i := 0, 0
+	// Where to go back to on a mismatch: just after the last *, and the byte it took up to
+	star, starAt := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star, starAt = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if n, ok := globByte(pattern[p:], s[i]); ok {
+				p, i = p+n, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starAt++
+		p, i = star, starAt
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Whether the element pattern starts with, which isn't a *, matches c, and how many bytes of pattern it is.
+func globByte(pattern []byte, c byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := bytes.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// No closing bracket, so it is a plain '['
+			return 1, c == '['
+		}
+		class := pattern[1 : end+1]
+		negate := len(class) > 0 && class[0] == '^'
+		if negate {
+			class = class[1:]
+		}
+		matched := false
+		for i := 0; i < len(class); i++ {
+			if i+2 < len(class) && class[i+1] == '-' {
+				lo, hi := min(class[i], class[i+2]), max(class[i], class[i+2])
+				matched = matched || (c >= lo && c <= hi)
+				i += 2
+				continue
+			}
+			matched = matched || class[i] == c
+		}
+		return end + 2, matched != negate
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == c
+		}
+	}
+	return 1, pattern[0] == c
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/kv"
+	"database-go/pkg/trace"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("server: closed")
+	// OP_BEGIN on a connection that already has a transaction open
+	ErrTxOpen = errors.New("server: a transaction is already open on this connection")
+	// OP_COMMIT or OP_ROLLBACK without a transaction
+	ErrNoTx = errors.New("server: no transaction open on this connection")
+)
+
+// Stops a scan once it has its limit, plus one to tell whether there are more
+var errScanFull = errors.New("server: scan limit reached")
+
+/*
+Serves a kv.DB to other processes over TCP, using the protocol described in
+proto.go, RESP for Redis clients (see ServeRESP), the Postgres protocol for SQL (see
+ServePG) or JSON over HTTP (see ServeREST). Each connection is handled by its own
+goroutine; the DB does the rest of the synchronisation.
+*/
+type Server struct {
+	db *kv.DB
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	// Serving the HTTP API, which tracks its own connections
+	https  []*http.Server
+	closed bool
+	wg     sync.WaitGroup
+
+	// Where each SCAN cursor handed out over RESP resumes
+	cursors respCursors
+	load    loadShedder
+}
+
+func New(db *kv.DB) *Server {
+	return &Server{db: db, conns: map[net.Conn]struct{}{}, cursors: respCursors{next: map[uint64][]byte{}}}
+}
+
+// Listen on addr and serve until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Accept connections from ln until Close, which makes Serve return ErrServerClosed.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.serve(ln, s.serveConn)
+}
+
+// Accept connections from ln, handling each with handle in its own goroutine.
+func (s *Server) serve(ln net.Listener, handle func(conn net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				conn.Close()
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// Stop listening, drop every connection, rolling back their transactions, and wait for them to finish.
+// The DB is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for _, ln := range s.listeners {
+		err = errors.Join(err, ln.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	for _, hs := range s.https {
+		err = errors.Join(err, hs.Close())
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.SetLoadLimits(LoadLimits{})
+	return err
+}
+
+// The state of one connection.
+type session struct {
+	db *kv.DB
+	// The open transaction, if any
+	tx       *kv.Tx
+	priority Priority
+	load     *loadShedder
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{db: s.db, load: &s.load}
+	defer func() {
+		if sess.tx != nil {
+			sess.tx.Rollback()
+		}
+	}()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if err := writeFrame(w, sess.handle(req)); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Run one request and encode its response.
+func (sess *session) handle(req []byte) []byte {
+	d := &decoder{buf: req}
+	op := d.byte()
+	ctx := context.Background()
+	if op&OP_TRACED != 0 {
+		op &^= OP_TRACED
+		sc, err := trace.DecodeSpanContext(d.take(trace.SPAN_CONTEXT_SIZE))
+		if err != nil {
+			return errorResponse(fmt.Errorf("%w: %w", ErrProtocol, err))
+		}
+		ctx = trace.WithRemote(ctx, sc)
+	}
+	ctx, span := trace.Start(ctx, "server "+opName(op))
+	defer span.End()
+
+	if op != OP_PRIORITY && op != OP_ROLLBACK {
+		done, err := sess.load.admit(sess.priority)
+		if err != nil {
+			span.SetError(err)
+			return errorResponse(err)
+		}
+		defer done()
+	}
+	if op == OP_SET || op == OP_DEL || op == OP_COMMIT {
+		start := time.Now()
+		defer func() { sess.load.wrote(time.Since(start)) }()
+	}
+	resp, err := sess.dispatch(ctx, op, d)
+	if err != nil {
+		if !errors.Is(err, kv.ErrKeyNotFound) {
+			span.SetError(err)
+		}
+		return errorResponse(err)
+	}
+	return resp
+}
+
+func (sess *session) dispatch(ctx context.Context, op byte, d *decoder) (encoder, error) {
+	ok := encoder{STATUS_OK}
+	if sess.tx != nil {
+		sess.tx.SetContext(ctx)
+	}
+	switch op {
+	case OP_GET:
+		key := d.bytes()
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		var val []byte
+		var err error
+		if sess.tx != nil {
+			val, err = sess.tx.Get(key)
+		} else {
+			val, err = sess.db.GetContext(ctx, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ok.bytes(val), nil
+
+	case OP_SET:
+		key, val := d.bytes(), d.bytes()
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		if sess.tx != nil {
+			return ok.uint64(0), sess.tx.Set(key, val)
+		}
+		version, err := sess.db.UpdateContext(ctx, func(tx *kv.Tx) error {
+			return tx.Set(key, val)
+		})
+		return ok.uint64(version), err
+
+	case OP_DEL:
+		key := d.bytes()
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		var deleted bool
+		var err error
+		if sess.tx != nil {
+			deleted, err = sess.tx.Del(key)
+		} else {
+			_, err = sess.db.UpdateContext(ctx, func(tx *kv.Tx) (err error) {
+				deleted, err = tx.Del(key)
+				return err
+			})
+		}
+		if deleted {
+			return ok.byte(1), err
+		}
+		return ok.byte(0), err
+
+	case OP_SCAN:
+		start, end, limit := d.bytes(), d.bytes(), int(d.uint32())
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		return sess.scan(start, end, limit)
+
+	case OP_BEGIN:
+		level := kv.IsolationLevel(d.byte())
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		if sess.tx != nil {
+			return nil, ErrTxOpen
+		}
+		tx, err := sess.db.BeginLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		sess.tx = tx
+		return ok.uint64(tx.Version()), nil
+
+	case OP_COMMIT, OP_ROLLBACK:
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		if sess.tx == nil {
+			return nil, ErrNoTx
+		}
+		tx := sess.tx
+		sess.tx = nil
+		if op == OP_ROLLBACK {
+			tx.Rollback()
+			return ok, nil
+		}
+		start := tx.Version()
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		if version := tx.Version(); version != start {
+			return ok.uint64(version), nil
+		}
+		return ok.uint64(0), nil
+
+	case OP_MERKLE:
+		fanout, leafKeys := int(d.uint32()), int(d.uint32())
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		snap, err := sess.db.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		defer snap.Release()
+		tree, err := snap.MerkleTree(fanout, leafKeys)
+		if err != nil {
+			return nil, err
+		}
+		return ok.merkle(tree), nil
+
+	case OP_PRIORITY:
+		priority := Priority(d.byte())
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		if priority >= PRIORITIES {
+			return nil, fmt.Errorf("%w: unknown priority %d", ErrProtocol, priority)
+		}
+		sess.priority = priority
+		return ok, nil
+	}
+	return nil, fmt.Errorf("%w: unknown op %d", ErrProtocol, op)
+}
+
+// Up to limit pairs of [start, end), and whether there are more.
+func (sess *session) scan(start, end []byte, limit int) (encoder, error) {
+	switch {
+	case limit == 0:
+		limit = DEFAULT_SCAN_LIMIT
+	case limit > MAX_SCAN_LIMIT:
+		return nil, fmt.Errorf("%w: scan limit %d is over %d", ErrProtocol, limit, MAX_SCAN_LIMIT)
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+
+	var pairs [][2][]byte
+	fn := func(key, val []byte) error {
+		if len(pairs) == limit+1 {
+			return errScanFull
+		}
+		pairs = append(pairs, [2][]byte{key, val})
+		return nil
+	}
+	var err error
+	if sess.tx != nil {
+		err = sess.tx.Range(start, end, fn)
+	} else {
+		var snap *kv.Snapshot
+		if snap, err = sess.db.Snapshot(); err != nil {
+			return nil, err
+		}
+		err = snap.Range(start, end, fn)
+		snap.Release()
+	}
+	if err != nil && !errors.Is(err, errScanFull) {
+		return nil, err
+	}
+
+	more := len(pairs) > limit
+	if more {
+		pairs = pairs[:limit]
+	}
+	resp := encoder{STATUS_OK}.uint32(uint32(len(pairs)))
+	for _, p := range pairs {
+		resp = resp.bytes(p[0]).bytes(p[1])
+	}
+	if more {
+		return resp.byte(1), nil
+	}
+	return resp.byte(0), nil
+}
+
+func errorResponse(err error) []byte {
+	status := byte(STATUS_ERROR)
+	switch {
+	case errors.Is(err, kv.ErrKeyNotFound):
+		status = STATUS_NOT_FOUND
+	case errors.Is(err, kv.ErrConflict):
+		status = STATUS_CONFLICT
+	case errors.Is(err, ErrOverloaded):
+		status = STATUS_OVERLOADED
+	}
+	return encoder{status}.bytes([]byte(err.Error()))
+}
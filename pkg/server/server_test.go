@@ -0,0 +1,1133 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database-go/pkg/kv"
+	"database-go/pkg/sql"
+	"database-go/pkg/trace"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A server over a fresh DB on a local port, and a client for it.
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(db)
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		db.Close()
+	})
+	return srv, ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *Client {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClientOperations(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := dial(t, addr)
+
+	for i := 0; i < 25; i++ {
+		if _, err := c.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, err := c.Get([]byte("key07")); err != nil || string(val) != "7" {
+		t.Fatalf("Get(key07) = %q, %v", val, err)
+	}
+	if ok, err := c.Del([]byte("key07")); err != nil || !ok {
+		t.Fatalf("Del(key07) = %v, %v", ok, err)
+	}
+	if _, err := c.Get([]byte("key07")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("Get(deleted) = %v, want %v", err, kv.ErrKeyNotFound)
+	}
+	if _, err := c.Set([]byte{0}, nil); !errors.Is(err, ErrRemote) {
+		t.Fatalf("Set(reserved key) = %v, want %v", err, ErrRemote)
+	}
+
+	// Fetched 4 at a time, resuming after the last key of each batch
+	var got []string
+	err := c.Scan([]byte("key05"), []byte("key20"), 4, func(key, _ []byte) error {
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil || len(got) != 14 || got[0] != "key05" || got[2] != "key08" || got[13] != "key19" {
+		t.Fatalf("Scan = %v, %v", got, err)
+	}
+}
+
+func TestClientTransactions(t *testing.T) {
+	_, addr := newTestServer(t)
+	c1, c2 := dial(t, addr), dial(t, addr)
+	if _, err := c1.Set([]byte("n"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both read the counter and write it back; the second commit conflicts
+	for _, c := range []*Client{c1, c2} {
+		if _, err := c.Begin(kv.ISOLATION_SERIALIZABLE); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get([]byte("n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Set([]byte("n"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := c1.Commit(); err != nil || v == 0 {
+		t.Fatalf("first Commit = %d, %v", v, err)
+	}
+	if _, err := c2.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("second Commit = %v, want %v", err, kv.ErrConflict)
+	}
+	if _, err := c2.Commit(); !errors.Is(err, ErrRemote) {
+		t.Fatalf("Commit without a transaction = %v, want %v", err, ErrRemote)
+	}
+
+	// Writes in a transaction are only visible to other connections once committed
+	if _, err := c1.Begin(kv.ISOLATION_SNAPSHOT); err != nil {
+		t.Fatal(err)
+	}
+	c1.Set([]byte("t"), []byte("x"))
+	if _, err := c2.Get([]byte("t")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("uncommitted write seen: %v", err)
+	}
+	if err := c1.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dropped connection rolls its transaction back
+	c3 := dial(t, addr)
+	c3.Begin(kv.ISOLATION_SERIALIZABLE)
+	c3.Set([]byte("t"), []byte("x"))
+	c3.Close()
+	version, err := c2.Update(kv.ISOLATION_SERIALIZABLE, func() error {
+		if _, err := c2.Get([]byte("t")); !errors.Is(err, kv.ErrKeyNotFound) {
+			return fmt.Errorf("write of a dropped connection seen: %v", err)
+		}
+		_, err := c2.Set([]byte("t"), []byte("y"))
+		return err
+	})
+	if err != nil || version == 0 {
+		t.Fatalf("Update = %d, %v", version, err)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	_, addr := newTestServer(t)
+	c := dial(t, addr)
+	replica, err := kv.Open(filepath.Join(t.TempDir(), "replica.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	for i := 0; i < 200; i++ {
+		key, val := []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i))
+		if _, err := c.Set(key, val); err != nil {
+			t.Fatal(err)
+		}
+		// The replica misses a few, has a few wrong and one extra
+		switch {
+		case i%50 == 3:
+		case i%50 == 7:
+			val = []byte("stale")
+			fallthrough
+		default:
+			if err := replica.Set(key, val); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := replica.Set([]byte("key0455"), []byte("extra")); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAntiEntropy(replica, addr)
+	defer a.Close()
+	a.LeafKeys = 10
+	if n, err := a.Round(); err != nil || n != 9 {
+		t.Fatalf("Round = %d, %v, want 9", n, err)
+	}
+	stats := a.Stats()
+	if stats.Rounds != 1 || stats.RangesCompared != 20 || stats.RangesDiverged != 5 || stats.KeysRepaired != 9 {
+		t.Fatalf("stats after repair = %+v", stats)
+	}
+	if n, err := a.Round(); err != nil || n != 0 {
+		t.Fatalf("Round again = %d, %v, want 0", n, err)
+	}
+	if val, err := replica.Get([]byte("key107")); err != nil || string(val) != "107" {
+		t.Fatalf("repaired key107 = %q, %v", val, err)
+	}
+	if _, err := replica.Get([]byte("key0455")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("extra key after repair: %v", err)
+	}
+
+	// Reads fix the keys they touch
+	if _, err := c.Set([]byte("key010"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Del([]byte("key011")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := a.Get([]byte("key010")); err != nil || string(val) != "new" {
+		t.Fatalf("Get(key010) = %q, %v", val, err)
+	}
+	if _, err := a.Get([]byte("key011")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("Get(key011) = %v, want %v", err, kv.ErrKeyNotFound)
+	}
+	if _, err := a.Get([]byte("key012")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := replica.Get([]byte("key010")); err != nil || string(val) != "new" {
+		t.Fatalf("replica key010 = %q, %v", val, err)
+	}
+	if _, err := replica.Get([]byte("key011")); !errors.Is(err, kv.ErrKeyNotFound) {
+		t.Fatalf("replica key011 = %v", err)
+	}
+	if stats := a.Stats(); stats.Reads != 3 || stats.ReadRepairs != 2 {
+		t.Fatalf("stats after reads = %+v", stats)
+	}
+}
+
+func TestClientPolicies(t *testing.T) {
+	_, primary := newTestServer(t)
+	_, replica := newTestServer(t)
+	direct, other := dial(t, primary), dial(t, replica)
+	direct.Set([]byte("k"), []byte("primary"))
+	other.Set([]byte("k"), []byte("replica"))
+
+	// Every answer from the primary takes 200ms
+	c := dial(t, slowProxy(t, primary, 200*time.Millisecond))
+	if err := c.AddReplica(replica); err != nil {
+		t.Fatal(err)
+	}
+	c.SetPolicy(CALL_READ, CallPolicy{HedgeAfter: 20 * time.Millisecond})
+	start := time.Now()
+	if val, err := c.Get([]byte("k")); err != nil || string(val) != "replica" {
+		t.Fatalf("hedged Get = %q, %v", val, err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("hedged Get took %v", elapsed)
+	}
+	if stats := c.Stats(); stats.Hedged != 1 || stats.HedgeWins != 1 {
+		t.Fatalf("stats after a hedged read = %+v", stats)
+	}
+
+	// Reads in a transaction only go to the primary
+	if _, err := c.Begin(kv.ISOLATION_SNAPSHOT); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := c.Get([]byte("k")); err != nil || string(val) != "primary" {
+		t.Fatalf("Get in a transaction = %q, %v", val, err)
+	}
+	if err := c.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetPolicy(CALL_WRITE, CallPolicy{Timeout: 50 * time.Millisecond})
+	if _, err := c.Set([]byte("k"), []byte("late")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Set past its timeout = %v, want %v", err, ErrTimeout)
+	}
+	if _, err := c.Get([]byte("k")); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Get after a timeout = %v, want %v", err, ErrTimeout)
+	}
+	if stats := c.Stats(); stats.Timeouts != 1 {
+		t.Fatalf("stats after a timeout = %+v", stats)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	srv, addr := newTestServer(t)
+	interactive, batch := dial(t, addr), dial(t, addr)
+	if err := batch.SetPriority(PRIORITY_BATCH); err != nil {
+		t.Fatal(err)
+	}
+	interactive.Set([]byte("k"), []byte("v"))
+	srv.SetLoadLimits(LoadLimits{MaxInFlight: 2, QueueWait: 50 * time.Millisecond})
+
+	// With one of two slots taken, batch requests are past their share
+	hold, err := srv.load.admit(PRIORITY_INTERACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Get([]byte("k")); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("batch Get with half the slots taken = %v, want %v", err, ErrOverloaded)
+	}
+	if _, err := interactive.Get([]byte("k")); err != nil {
+		t.Fatalf("interactive Get with a slot free = %v", err)
+	}
+
+	// With both taken, interactive requests wait, and are shed if none comes free in time
+	hold2, err := srv.load.admit(PRIORITY_INTERACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := interactive.Get([]byte("k")); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("interactive Get with no slot free = %v, want %v", err, ErrOverloaded)
+	}
+	time.AfterFunc(10*time.Millisecond, hold2)
+	if _, err := interactive.Get([]byte("k")); err != nil {
+		t.Fatalf("interactive Get once a slot comes free = %v", err)
+	}
+	hold()
+
+	// Slow writes shed batch work, interactive work carries on
+	srv.SetLoadLimits(LoadLimits{MaxWriteLatency: time.Nanosecond})
+	if _, err := interactive.Set([]byte("k"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batch.Set([]byte("k"), []byte("v3")); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("batch Set with slow writes = %v, want %v", err, ErrOverloaded)
+	}
+	if val, err := interactive.Get([]byte("k")); err != nil || string(val) != "v2" {
+		t.Fatalf("interactive Get with slow writes = %q, %v", val, err)
+	}
+
+	hs := httptest.NewServer(srv.RESTHandler())
+	defer hs.Close()
+	req, _ := http.NewRequest("GET", hs.URL+"/v1/kv/k", nil)
+	req.Header.Set(PRIORITY_HEADER, "batch")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("batch REST request with slow writes = %d", resp.StatusCode)
+	}
+
+	stats := srv.LoadStats()
+	if stats.Shed != [PRIORITIES]int{1, 3} || stats.Queued != 2 || stats.InFlight != 0 {
+		t.Fatalf("load stats = %+v", stats)
+	}
+	srv.SetLoadLimits(LoadLimits{})
+	if _, err := batch.Set([]byte("k"), []byte("v3")); err != nil {
+		t.Fatalf("batch Set with no limits = %v", err)
+	}
+}
+
+func TestLoadSheddingRESPAndPG(t *testing.T) {
+	srv, _ := newTestServer(t)
+	_, resp := dialRESP(t, listen(t, srv.ServeRESP))
+	_, respBatch := dialRESP(t, listen(t, srv.ServeRESP))
+	pgAddr := listen(t, srv.ServePG)
+	pg, pgBatch := dialPG(t, pgAddr), dialPG(t, pgAddr, "priority", "batch")
+	if got := respBatch("CLIENT", "PRIORITY", "batch"); got != "+OK" {
+		t.Fatalf("CLIENT PRIORITY batch = %q", got)
+	}
+	for _, args := range [][]string{{"CLIENT"}, {"CLIENT", "PRIORITY"}, {"CLIENT", "PRIORITY", "urgent"}} {
+		if got := resp(args...); !strings.HasPrefix(got, "-ERR ") {
+			t.Fatalf("%v = %q", args, got)
+		}
+	}
+	resp("SET", "k", "v")
+	pg("CREATE TABLE t (id INT PRIMARY KEY)")
+	srv.SetLoadLimits(LoadLimits{MaxInFlight: 2, QueueWait: 50 * time.Millisecond})
+
+	// With one of two slots taken, batch commands and statements are past their share
+	hold, err := srv.load.admit(PRIORITY_INTERACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overloaded := "-ERR " + ErrOverloaded.Error()
+	if got := respBatch("GET", "k"); got != overloaded {
+		t.Fatalf("batch GET with half the slots taken = %q", got)
+	}
+	if got := pgBatch("SELECT * FROM t"); got != "E 53300; Z I" {
+		t.Fatalf("batch SELECT with half the slots taken = %q", got)
+	}
+	if got := resp("GET", "k"); got != "$1 v" {
+		t.Fatalf("interactive GET with a slot free = %q", got)
+	}
+	if got := pg("SELECT * FROM t"); got != "T id:20; C SELECT 0; Z I" {
+		t.Fatalf("interactive SELECT with a slot free = %q", got)
+	}
+
+	// With both taken, interactive ones are shed too, statement by statement
+	pg("BEGIN")
+	hold2, err := srv.load.admit(PRIORITY_INTERACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp("SET", "k", "v2"); got != overloaded {
+		t.Fatalf("interactive SET with no slot free = %q", got)
+	}
+	if got := resp("QUIT"); got != "+OK" {
+		t.Fatalf("QUIT with no slot free = %q", got)
+	}
+	if got := pg("INSERT INTO t VALUES (1)"); got != "E 53300; Z E" {
+		t.Fatalf("interactive INSERT with no slot free = %q", got)
+	}
+	// but a transaction can still be ended
+	if got := pg("ROLLBACK"); got != "C ROLLBACK; Z I" {
+		t.Fatalf("ROLLBACK with no slot free = %q", got)
+	}
+	hold2()
+	hold()
+
+	stats := srv.LoadStats()
+	if stats.Shed != [PRIORITIES]int{2, 2} || stats.InFlight != 0 {
+		t.Fatalf("load stats = %+v", stats)
+	}
+	if got := respBatch("GET", "k"); got != "$1 v" {
+		t.Fatalf("batch GET with every slot free = %q", got)
+	}
+	if got := pgBatch("INSERT INTO t VALUES (1)"); got != "C INSERT 0 1; Z I" {
+		t.Fatalf("batch INSERT with every slot free = %q", got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	srv, addr := newTestServer(t)
+	c := dial(t, addr)
+	rec := &trace.Recorder{}
+	trace.SetExporter(rec.Export)
+	defer trace.SetExporter(nil)
+
+	// The spans recorded so far named name under parent, which must be in root's trace
+	find := func(root trace.SpanContext, name string, parent trace.SpanID) *trace.Span {
+		t.Helper()
+		for _, span := range rec.Spans() {
+			if span.Name == name && span.Parent == parent {
+				if span.Context.TraceID != root.TraceID {
+					t.Fatalf("%s in trace %x, want %x", name, span.Context.TraceID, root.TraceID)
+				}
+				return span
+			}
+		}
+		t.Fatalf("no %s span under %x in %d spans", name, parent, len(rec.Spans()))
+		return nil
+	}
+
+	// Client, server and storage spans of a write all join the caller's trace
+	ctx, root := trace.Start(context.Background(), "test")
+	c.SetContext(ctx)
+	if _, err := c.Set([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+	sc := root.Context
+	call := find(sc, "client SET", sc.SpanID)
+	server := find(sc, "server SET", call.Context.SpanID)
+	if !server.Remote {
+		t.Fatal("server span's parent isn't marked remote")
+	}
+	commit := find(sc, "kv.commit", server.Context.SpanID)
+	for _, name := range []string{"wal.append", "pager.write", "pager.fsync"} {
+		find(sc, name, commit.Context.SpanID)
+	}
+
+	// Without a context the client sends none, and the server's span starts a trace of its own
+	c.SetContext(nil)
+	before := len(rec.Spans())
+	if _, err := c.Get([]byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	spans := rec.Spans()[before:]
+	if len(spans) != 1 || spans[0].Name != "server GET" || spans[0].Parent != (trace.SpanID{}) {
+		t.Fatalf("untraced Get made spans %+v", spans)
+	}
+
+	// SQL statements show their plan
+	ctx, root = trace.Start(context.Background(), "test")
+	sc = root.Context
+	_, err := srv.db.Update(func(tx *kv.Tx) error {
+		if _, err := sql.ExecTx(tx, "CREATE TABLE t (id INT PRIMARY KEY, name TEXT)"); err != nil {
+			return err
+		}
+		_, err := sql.ExecTx(tx, "INSERT INTO t VALUES (1, 'a')")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := srv.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.SetContext(ctx)
+	if _, err := sql.ExecTx(tx, "SELECT * FROM t WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	execute := find(sc, "sql.execute", sc.SpanID)
+	if execute.Attrs["statement"] != "SELECT" {
+		t.Fatalf("sql.execute attributes = %v", execute.Attrs)
+	}
+	if plan := find(sc, "sql.plan", execute.Context.SpanID); plan.Attrs["plan"] != "LOOKUP t (id = 1)" {
+		t.Fatalf("sql.plan attributes = %v", plan.Attrs)
+	}
+
+	// A traceparent header carries the trace into the HTTP API
+	hs := httptest.NewServer(srv.RESTHandler())
+	defer hs.Close()
+	_, root = trace.Start(context.Background(), "test")
+	sc = root.Context
+	req, _ := http.NewRequest("PUT", hs.URL+"/v1/kv/h", strings.NewReader("v"))
+	req.Header.Set(trace.TRACEPARENT_HEADER, sc.Traceparent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	put := find(sc, "http PUT", sc.SpanID)
+	find(sc, "kv.commit", put.Context.SpanID)
+
+	if got, err := trace.ParseTraceparent(sc.Traceparent()); err != nil || got != sc {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v", sc.Traceparent(), got, err)
+	}
+	for _, bad := range []string{"", "00-00000000000000000000000000000000-0000000000000001-01", "00-zz" + sc.Traceparent()[5:]} {
+		if _, err := trace.ParseTraceparent(bad); !errors.Is(err, trace.ErrBadSpanContext) {
+			t.Errorf("ParseTraceparent(%q) = %v", bad, err)
+		}
+	}
+}
+
+// A local address forwarding to addr, holding back everything addr sends for delay.
+func slowProxy(t *testing.T, addr string, delay time.Duration) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				return
+			}
+			go func() {
+				io.Copy(server, client)
+				server.Close()
+			}()
+			go func() {
+				defer client.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := server.Read(buf)
+					if err != nil {
+						return
+					}
+					time.Sleep(delay)
+					if _, err := client.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRESP(t *testing.T) {
+	srv, _ := newTestServer(t)
+	send, run := dialRESP(t, listen(t, srv.ServeRESP))
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"set", "b", ""}, "+OK"},
+		{[]string{"SET", "a", "2", "NX"}, "$-1"},
+		{[]string{"SET", "c", "3", "XX"}, "$-1"},
+		{[]string{"SET", "a", "2", "XX"}, "+OK"},
+		{[]string{"GET", "a"}, "$1 2"},
+		{[]string{"GET", "b"}, "$0 "},
+		{[]string{"GET", "c"}, "$-1"},
+		{[]string{"MGET", "a", "c", "b"}, "*3 $1 2 $-1 $0 "},
+		{[]string{"EXISTS", "a", "b", "c", "a"}, ":3"},
+		{[]string{"DEL", "a", "c"}, ":1"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tt := range tests {
+		if got := run(tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// SCAN through everything two keys at a time, and with a pattern
+	for i := 0; i < 5; i++ {
+		run("SET", fmt.Sprintf("user:%d", i), "x")
+		run("SET", fmt.Sprintf("item:%d", i), "x")
+	}
+	scan := func(args ...string) []string {
+		var keys []string
+		cursor := "0"
+		for {
+			reply := strings.Fields(run(append([]string{"SCAN", cursor}, args...)...))
+			// *2 $n cursor *m $k key...
+			cursor = reply[2]
+			for i := 5; i < len(reply); i += 2 {
+				keys = append(keys, reply[i])
+			}
+			if cursor == "0" {
+				return keys
+			}
+		}
+	}
+	if keys := scan("COUNT", "2"); len(keys) != 11 || keys[0] != "b" || keys[10] != "user:4" {
+		t.Fatalf("SCAN = %v", keys)
+	}
+	if keys := scan("MATCH", "user:[1-3]", "COUNT", "3"); strings.Join(keys, " ") != "user:1 user:2 user:3" {
+		t.Fatalf("SCAN MATCH = %v", keys)
+	}
+	if got := run("SCAN", "12345"); got != "-ERR invalid cursor" {
+		t.Fatalf("SCAN with an unknown cursor = %q", got)
+	}
+
+	// Inline commands work too
+	if got := send("GET b\r\n"); got != "$0 " {
+		t.Fatalf("inline GET = %q", got)
+	}
+}
+
+// Serve on a local port, returning its address.
+func listen(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(ln)
+	return ln.Addr().String()
+}
+
+// Connect to a RESP server. send writes a raw command and returns the reply; run sends
+// its arguments as an array of bulk strings.
+func dialRESP(t *testing.T, addr string) (send func(cmd string) string, run func(args ...string) string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+	send = func(cmd string) string {
+		t.Helper()
+		if _, err := io.WriteString(conn, cmd); err != nil {
+			t.Fatal(err)
+		}
+		return readReply(t, r)
+	}
+	run = func(args ...string) string {
+		t.Helper()
+		cmd := fmt.Sprintf("*%d\r\n", len(args))
+		for _, arg := range args {
+			cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+		}
+		return send(cmd)
+	}
+	return send, run
+}
+
+func TestRESPLimits(t *testing.T) {
+	read := func(input string) ([][]byte, error) {
+		return readCommand(bufio.NewReader(strings.NewReader(input)))
+	}
+	if args, err := read("*2\r\n$3\r\nGET\r\n$0\r\n\r\n"); err != nil || len(args) != 2 || string(args[0]) != "GET" || len(args[1]) != 0 {
+		t.Fatalf("readCommand = %q, %v", args, err)
+	}
+	for _, input := range []string{
+		fmt.Sprintf("*%d\r\n", MAX_RESP_ARRAY+1),
+		"*1048576\r\n",
+		fmt.Sprintf("*1\r\n$%d\r\n", MAX_RESP_BULK+1),
+		"*1\r\n$-1\r\n",
+		"*1\r\n$3\r\nGETxx",
+		"*1\r\n:3\r\n",
+	} {
+		if _, err := read(input); !errors.Is(err, ErrProtocol) {
+			t.Errorf("readCommand(%.20q) = %v, want %v", input, err, ErrProtocol)
+		}
+	}
+	// Bulk strings may each be under the limit while the command is over it
+	half := fmt.Sprintf("$%d\r\n", MAX_RESP_BULK/2+1)
+	r := bufio.NewReader(io.MultiReader(
+		strings.NewReader("*2\r\n"+half),
+		io.LimitReader(zeros{}, MAX_RESP_BULK/2+1),
+		strings.NewReader("\r\n"+half),
+	))
+	if _, err := readCommand(r); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("readCommand of a command over the limit = %v, want %v", err, ErrProtocol)
+	}
+
+	// Lengths that are claimed but never sent cost nothing to speak of
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 10; i++ {
+		if _, err := read(fmt.Sprintf("*%d\r\n$%d\r\nGET\r\n", MAX_RESP_ARRAY, MAX_RESP_BULK)); err == nil {
+			t.Fatal("readCommand of a truncated command succeeded")
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("10 truncated commands allocated %d bytes", allocated)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// Read one RESP reply, flattened to its lines joined by spaces.
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return line
+		}
+		var n int
+		fmt.Sscanf(line, "$%d", &n)
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return line + " " + string(buf[:n])
+	case '*':
+		var n int
+		fmt.Sscanf(line, "*%d", &n)
+		parts := []string{line}
+		for i := 0; i < n; i++ {
+			parts = append(parts, readReply(t, r))
+		}
+		return strings.Join(parts, " ")
+	}
+	return line
+}
+
+func TestPGWire(t *testing.T) {
+	srv, _ := newTestServer(t)
+	addr := listen(t, srv.ServePG)
+	query := dialPG(t, addr)
+
+	tests := []struct {
+		query, want string
+	}{
+		{"CREATE TABLE t (id INT PRIMARY KEY, name TEXT, data BLOB, ok BOOL)", "C CREATE TABLE; Z I"},
+		{"INSERT INTO t VALUES (1, 'a', x'01ff', TRUE), (2, 'b', x'', FALSE)", "C INSERT 0 2; Z I"},
+		{"SELECT * FROM t WHERE ok = TRUE", "T id:20 name:25 data:17 ok:16; D 1|a|\\x01ff|t; C SELECT 1; Z I"},
+		{"UPDATE t SET name = 'c' WHERE id = 2; SELECT name FROM t WHERE id = 2", "C UPDATE 1; T name:25; D c; C SELECT 1; Z I"},
+		{" ; ", "I; Z I"},
+		{"SELECT * FROM nope", "E 42P01; Z I"},
+		{"INSERT INTO t VALUES (1, 'x', x'', TRUE)", "E 23505; Z I"},
+		{"BEGIN; DELETE FROM t WHERE id = 1", "C BEGIN; C DELETE 1; Z T"},
+		{"SELEC 1", "E 42601; Z E"},
+		{"SELECT * FROM t", "E 25P02; Z E"},
+		{"COMMIT", "C ROLLBACK; Z I"},
+		{"SELECT id FROM t", "T id:20; D 1; D 2; C SELECT 2; Z I"},
+	}
+	for _, tt := range tests {
+		if got := query(tt.query); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// A conflicting COMMIT reports a serialization failure
+	other := dialPG(t, addr)
+	query("BEGIN")
+	other("BEGIN")
+	query("UPDATE t SET ok = TRUE WHERE id = 2")
+	other("UPDATE t SET ok = FALSE WHERE id = 2")
+	if got := query("COMMIT"); got != "C COMMIT; Z I" {
+		t.Fatalf("first COMMIT = %q", got)
+	}
+	if got := other("COMMIT"); got != "E 40001; Z I" {
+		t.Fatalf("second COMMIT = %q", got)
+	}
+}
+
+// Connect to a Postgres server with the startup parameters given as name and value
+// pairs, and return a function that runs a query and sums up the replies.
+func dialPG(t *testing.T, addr string, params ...string) func(query string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	r := bufio.NewReader(conn)
+
+	// Asking for TLS first, as psql does by default
+	conn.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), PG_SSL_REQUEST))
+	if b, err := r.ReadByte(); err != nil || b != 'N' {
+		t.Fatalf("SSLRequest answered %q, %v", b, err)
+	}
+	body := pgString(pgString(nil, "user"), "test")
+	for _, param := range params {
+		body = pgString(body, param)
+	}
+	body = pgString(body, "")
+	startup := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	startup = binary.BigEndian.AppendUint32(startup, PG_PROTOCOL_VERSION)
+	conn.Write(append(startup, body...))
+	if got := readPGReplies(t, r); !strings.HasPrefix(got, "R ") || !strings.HasSuffix(got, "Z I") {
+		t.Fatalf("startup replies = %q", got)
+	}
+
+	return func(query string) string {
+		t.Helper()
+		body := pgString(nil, query)
+		msg := append([]byte{'Q'}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+		if _, err := conn.Write(append(msg, body...)); err != nil {
+			t.Fatal(err)
+		}
+		return readPGReplies(t, r)
+	}
+}
+
+// Read backend messages up to ReadyForQuery, summed up one per message.
+func readPGReplies(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var parts []string
+	for {
+		typ, body, err := readPGMessage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cstring := func() string {
+			s, rest, _ := strings.Cut(string(body), "\x00")
+			body = []byte(rest)
+			return s
+		}
+		switch typ {
+		case 'T':
+			var cols []string
+			n := binary.BigEndian.Uint16(body)
+			for body = body[2:]; n > 0; n-- {
+				name := cstring()
+				cols = append(cols, fmt.Sprintf("%s:%d", name, binary.BigEndian.Uint32(body[6:])))
+				body = body[18:]
+			}
+			parts = append(parts, "T "+strings.Join(cols, " "))
+		case 'D':
+			var vals []string
+			n := binary.BigEndian.Uint16(body)
+			for body = body[2:]; n > 0; n-- {
+				size := binary.BigEndian.Uint32(body)
+				vals, body = append(vals, string(body[4:4+size])), body[4+size:]
+			}
+			parts = append(parts, "D "+strings.Join(vals, "|"))
+		case 'C':
+			parts = append(parts, "C "+cstring())
+		case 'E':
+			// Just the SQLSTATE
+			for len(body) > 0 && body[0] != 0 {
+				field := body[0]
+				body = body[1:]
+				if val := cstring(); field == 'C' {
+					parts = append(parts, "E "+val)
+				}
+			}
+		case 'Z':
+			return strings.Join(append(parts, "Z "+string(body)), "; ")
+		default:
+			parts = append(parts, strings.TrimSpace(fmt.Sprintf("%c %x", typ, body)))
+		}
+	}
+}
+
+func TestREST(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{KeyVersions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hs := httptest.NewServer(New(db).RESTHandler())
+	defer hs.Close()
+
+	// Make a request and return the status, ETag and body
+	do := func(method, path, body string, header ...string) (int, string, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("ETag"), strings.TrimSpace(string(b))
+	}
+
+	status, tag, body := do("PUT", "/v1/kv/a%2Fb", "one", "If-None-Match", "*")
+	if status != 200 || tag == "" {
+		t.Fatalf("PUT = %d %q %s", status, tag, body)
+	}
+	if status, _, body := do("PUT", "/v1/kv/a%2Fb", "two", "If-None-Match", "*"); status != 412 {
+		t.Fatalf("PUT of an existing key with If-None-Match: * = %d %s", status, body)
+	}
+	if status, got, body := do("GET", "/v1/kv/a%2Fb", ""); status != 200 || got != tag || body != "one" {
+		t.Fatalf("GET = %d %q %q", status, got, body)
+	}
+	if status, _, _ := do("GET", "/v1/kv/a%2Fb", "", "If-None-Match", tag); status != 304 {
+		t.Fatalf("GET with a matching If-None-Match = %d", status)
+	}
+
+	// A write with the ETag read goes through once; the second has a stale one
+	if status, _, body := do("PUT", "/v1/kv/a%2Fb", "two", "If-Match", tag); status != 200 {
+		t.Fatalf("PUT with If-Match = %d %s", status, body)
+	}
+	if status, _, body := do("PUT", "/v1/kv/a%2Fb", "three", "If-Match", tag); status != 412 {
+		t.Fatalf("PUT with a stale If-Match = %d %s", status, body)
+	}
+	if status, _, body := do("GET", "/v1/kv/missing", ""); status != 404 || !strings.Contains(body, `"error"`) {
+		t.Fatalf("GET of a missing key = %d %s", status, body)
+	}
+	if status, _, _ := do("DELETE", "/v1/kv/a%2Fb", ""); status != 200 {
+		t.Fatalf("DELETE = %d", status)
+	}
+	if status, _, _ := do("DELETE", "/v1/kv/a%2Fb", ""); status != 404 {
+		t.Fatalf("second DELETE = %d", status)
+	}
+
+	// Scan in batches of 2, following the cursor
+	for _, key := range []string{"k1", "k2", "k3", "l1"} {
+		db.Set([]byte(key), []byte("v"+key))
+	}
+	var got []string
+	for cursor := ""; ; {
+		_, _, body := do("GET", "/v1/scan?prefix=k&limit=2&cursor="+cursor, "")
+		var res struct {
+			Pairs []struct{ Key, Value string }
+			Next  string
+		}
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		for _, p := range res.Pairs {
+			got = append(got, p.Key+"="+p.Value)
+		}
+		if cursor = res.Next; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(got, " ") != "k1=vk1 k2=vk2 k3=vk3" {
+		t.Fatalf("scan = %v", got)
+	}
+	if _, _, body := do("GET", "/v1/scan?start=aw%3D%3D&encoding=base64", ""); !strings.Contains(body, `"key":"azE="`) {
+		t.Fatalf("base64 scan = %s", body)
+	}
+
+	if status, _, body := do("GET", "/v1/stats", ""); status != 200 || !strings.Contains(body, `"key_versions":true`) {
+		t.Fatalf("stats = %d %s", status, body)
+	}
+	if status, _, body := do("GET", "/v1/verify", ""); status != 200 || !strings.Contains(body, `"ok":true`) {
+		t.Fatalf("verify = %d %s", status, body)
+	}
+}
+
+func TestRESTBulk(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	hs := httptest.NewServer(New(db).RESTHandler())
+	defer hs.Close()
+
+	// Make a request and return the status and body
+	do := func(method, path, body string, header ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	var put struct{ Pairs []restPair }
+	for i := 0; i < 250; i++ {
+		put.Pairs = append(put.Pairs, restPair{fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i)})
+	}
+	body, _ := json.Marshal(put)
+	status, res := do("POST", "/v1/multi-put", string(body))
+	var version struct{ Version uint64 }
+	if err := json.Unmarshal([]byte(res), &version); status != 200 || err != nil || version.Version == 0 {
+		t.Fatalf("multi-put = %d %s", status, res)
+	}
+	if status, res := do("POST", "/v1/multi-put", `{"pairs": [{"key": "gone", "value": "x"}, {"key": "k001", "value": "new"}], "delete": ["k000"]}`); status != 200 {
+		t.Fatalf("multi-put with deletes = %d %s", status, res)
+	}
+	if status, res := do("POST", "/v1/multi-put?encoding=base64", `{"pairs": [{"key": "Af8=", "value": "AA=="}], "delete": ["Z29uZQ=="]}`); status != 200 {
+		t.Fatalf("base64 multi-put = %d %s", status, res)
+	}
+	// All or nothing: a reserved key fails the lot
+	if status, res := do("POST", "/v1/multi-put", `{"pairs": [{"key": "atomic", "value": "x"}, {"key": "\u0000x", "value": "x"}]}`); status != 400 {
+		t.Fatalf("multi-put with a reserved key = %d %s", status, res)
+	}
+	for _, bad := range []string{`{"pairs": [`, `{"pairs": "k"}`, ``} {
+		if status, res := do("POST", "/v1/multi-put", bad); status != 400 {
+			t.Fatalf("multi-put of %q = %d %s", bad, status, res)
+		}
+	}
+
+	status, res = do("POST", "/v1/multi-get", `{"keys": ["k001", "missing", "k249", "k000", "atomic", "gone"]}`)
+	want := `{"version":3,"pairs":[{"key":"k001","value":"new"},{"key":"missing","value":null},` +
+		`{"key":"k249","value":"v249"},{"key":"k000","value":null},{"key":"atomic","value":null},{"key":"gone","value":null}]}`
+	if status != 200 || strings.TrimSpace(res) != want {
+		t.Fatalf("multi-get = %d %s", status, res)
+	}
+	if status, res := do("POST", "/v1/multi-get?encoding=base64", `{"keys": ["Af8="]}`); status != 200 || !strings.Contains(res, `{"key":"Af8=","value":"AA=="}`) {
+		t.Fatalf("base64 multi-get = %d %s", status, res)
+	}
+	if status, res := do("POST", "/v1/multi-get?encoding=base64", `{"keys": ["!"]}`); status != 400 {
+		t.Fatalf("multi-get of a bad key = %d %s", status, res)
+	}
+
+	// Stream the k prefix, in pieces of 100 by following the cursor or all at once
+	stream := func(path string, header ...string) (keys []string, next string) {
+		t.Helper()
+		status, res := do("GET", path, "", header...)
+		if status != 200 {
+			t.Fatalf("GET %s = %d %s", path, status, res)
+		}
+		lines := strings.Split(strings.TrimSuffix(res, "\n"), "\n")
+		for i, line := range lines {
+			var pair struct{ Key, Value, Next string }
+			if err := json.Unmarshal([]byte(line), &pair); err != nil {
+				t.Fatalf("GET %s line %d: %v: %s", path, i, err, line)
+			}
+			if pair.Next != "" {
+				if i != len(lines)-1 {
+					t.Fatalf("GET %s: next on line %d of %d", path, i, len(lines))
+				}
+				return keys, pair.Next
+			}
+			keys = append(keys, pair.Key)
+		}
+		return keys, ""
+	}
+	all, next := stream("/v1/scan?prefix=k&format=ndjson")
+	if len(all) != 249 || all[0] != "k001" || all[248] != "k249" || next != "" {
+		t.Fatalf("ndjson scan: %d keys from %v, next %q", len(all), all[:1], next)
+	}
+	var pieces []string
+	for cursor, n := "", 0; ; n++ {
+		keys, next := stream("/v1/scan?prefix=k&limit=100&cursor="+cursor, "Accept", "application/x-ndjson")
+		if len(keys) != 100 && next != "" {
+			t.Fatalf("ndjson scan piece %d: %d keys", n, len(keys))
+		}
+		pieces = append(pieces, keys...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(pieces, " ") != strings.Join(all, " ") {
+		t.Fatalf("ndjson scan by cursor = %v", pieces)
+	}
+	if status, res := do("GET", "/v1/scan?format=xml", ""); status != 400 {
+		t.Fatalf("scan with an unknown format = %d %s", status, res)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"**", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:12", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "abcbc", true},
+		{"a*b*c", "acb", false},
+		{"a*c", "abcbcx", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a[b", "a[b", true},
+		{"a\\", "a\\", true},
+		{"*[0-9]", "key7", true},
+		{"*[0-9]", "key7x", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch([]byte(tt.pattern), []byte(tt.s)); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+
+	// Backtracking into every * would take ages here
+	pattern := []byte(strings.Repeat("a*", 30) + "b")
+	s := []byte(strings.Repeat("a", 10000))
+	start := time.Now()
+	if globMatch(pattern, s) {
+		t.Fatal("pathological pattern matched")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("pathological pattern took %v", elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+package sql
+
+import (
+	"database-go/pkg/kv"
+	"database-go/pkg/table"
+	"errors"
+)
+
+const (
+	DEFAULT_BATCH_SIZE = 1000
+)
+
+var errBatchFull = errors.New("sql: batch is full")
+
+type BatchOptions struct {
+	// Most rows changed by one transaction; DEFAULT_BATCH_SIZE if zero
+	BatchSize int
+	// Primary key of the row to start at, from the Progress of an earlier run
+	Resume []interface{}
+	// Called after each batch commits; returning an error stops the statement there
+	Progress func(Progress) error
+}
+
+type Progress struct {
+	// Batches committed and rows changed by them, counting from the start of this run
+	Batches      int
+	RowsAffected int
+	// Primary key of the next row to look at, to pass as BatchOptions.Resume to carry
+	// on after a failure; nil once the statement is finished
+	Resume []interface{}
+}
+
+/*
+Run an UPDATE or DELETE as a series of transactions that each change at most
+BatchSize rows, so a statement touching a huge number of them doesn't build one
+huge transaction (and one huge read set to conflict on). Batches go through the
+table in primary key order and are committed one after another.
+
+The statement as a whole isn't atomic: other commits can land between batches, and
+if one fails the batches before it stay committed. Since setting columns to constants
+and deleting can both safely be done twice, running the statement again with the
+last Progress.Resume finishes the job.
+*/
+func ExecBatched(db *kv.DB, src string, opts BatchOptions) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	switch stmt.(type) {
+	case *Update, *Delete:
+	default:
+		// Nothing to split up
+		return Exec(db, src)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DEFAULT_BATCH_SIZE
+	}
+
+	res := &Result{}
+	progress := Progress{Resume: opts.Resume}
+	for {
+		var changed int
+		var next []interface{}
+		version, err := db.Update(func(tx *kv.Tx) error {
+			changed, next = 0, nil
+			t, where, change, err := prepareChange(tx, stmt)
+			if err != nil {
+				return err
+			}
+			err = scanWhere(tx, t, where, progress.Resume, func(row table.Row) error {
+				if changed == opts.BatchSize {
+					next = row[:t.PKeys]
+					return errBatchFull
+				}
+				changed++
+				return change(row)
+			})
+			if errors.Is(err, errBatchFull) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+
+		res.RowsAffected += changed
+		res.Version = version
+		progress.Batches++
+		progress.RowsAffected += changed
+		progress.Resume = next
+		if opts.Progress != nil {
+			if err := opts.Progress(progress); err != nil {
+				return res, err
+			}
+		}
+		if next == nil {
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package sql
+
+import (
+	"bytes"
+	"database-go/pkg/kv"
+	"database-go/pkg/table"
+	"database-go/pkg/trace"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrNoColumn = errors.New("sql: no such column")
+	ErrBadValue = errors.New("sql: value does not match the column type")
+	// Rows are stored under their primary key, so changing it would be a delete and an insert
+	ErrKeyUpdate = errors.New("sql: primary key columns can't be updated")
+	// BEGIN, COMMIT or ROLLBACK given to ExecStmt, which runs in a transaction it doesn't own
+	ErrTxStatement = errors.New("sql: transaction statements need a session")
+)
+
+type Result struct {
+	// Names and types of the columns of Rows, for a SELECT
+	Columns []string
+	Types   []table.ColumnType
+	Rows    []table.Row
+	// Rows inserted, updated or deleted
+	RowsAffected int
+	// Version of the database the statement ran against, or if it wrote anything, of its
+	// commit; set by Exec and ExecBatched
+	Version uint64
+}
+
+// Run a statement in its own transaction, running it again if the commit conflicts.
+func Exec(db *kv.DB, src string) (*Result, error) {
+	return ExecAtLeast(db, 0, src)
+}
+
+/*
+Exec, against version v of the database or later, so it sees a write made through
+another API that returned v. Fails with kv.ErrVersionAhead if the database hasn't got
+that far.
+*/
+func ExecAtLeast(db *kv.DB, v uint64, src string) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	var res *Result
+	version, err := db.Update(func(tx *kv.Tx) (err error) {
+		if at := tx.Version(); at < v {
+			return fmt.Errorf("%w: want %d, at %d", kv.ErrVersionAhead, v, at)
+		}
+		res, err = ExecStmt(tx, stmt)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Version = version
+	return res, nil
+}
+
+// Run a statement in tx.
+func ExecTx(tx *kv.Tx, src string) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return ExecStmt(tx, stmt)
+}
+
+/*
+Run a parsed statement in tx. If tx is part of a traced request (see kv.Tx.SetContext)
+the statement is a span of it, with the plans it chose and the work it did under it.
+*/
+func ExecStmt(tx *kv.Tx, stmt Statement) (*Result, error) {
+	outer := tx.Context()
+	ctx, span := trace.StartChild(outer, "sql.execute")
+	if span == nil {
+		return execStmt(tx, stmt)
+	}
+	span.SetAttr("statement", strings.ToUpper(strings.TrimPrefix(fmt.Sprintf("%T", stmt), "*sql.")))
+	tx.SetContext(ctx)
+	res, err := execStmt(tx, stmt)
+	tx.SetContext(outer)
+	span.SetError(err)
+	span.End()
+	return res, err
+}
+
+func execStmt(tx *kv.Tx, stmt Statement) (*Result, error) {
+	switch stmt := stmt.(type) {
+	case *CreateTable:
+		// CreateTable assigns the ID, and the statement may be run more than once
+		t := *stmt.Table
+		return &Result{}, table.CreateTable(tx, &t)
+	case *CreateIndex:
+		_, err := table.CreateIndex(tx, stmt.Table, table.Index{Name: stmt.Name, Column: stmt.Column})
+		return &Result{}, err
+	case *Insert:
+		return execInsert(tx, stmt)
+	case *Select:
+		return execSelect(tx, stmt)
+	case *Update, *Delete:
+		return execChange(tx, stmt)
+	case *Explain:
+		return execExplain(tx, stmt.Stmt)
+	case *Begin, *Commit, *Rollback:
+		return nil, ErrTxStatement
+	}
+	return nil, fmt.Errorf("sql: unknown statement %T", stmt)
+}
+
+func execInsert(tx *kv.Tx, stmt *Insert) (*Result, error) {
+	t, err := table.GetTable(tx, stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Where each value goes in the row
+	order := make([]int, len(t.Columns))
+	for i := range order {
+		order[i] = i
+	}
+	if stmt.Columns != nil {
+		if len(stmt.Columns) != len(t.Columns) {
+			return nil, fmt.Errorf("%w: every column of %s needs a value", ErrBadValue, t.Name)
+		}
+		seen := map[int]bool{}
+		for i, name := range stmt.Columns {
+			col := t.ColumnIndex(name)
+			if col < 0 {
+				return nil, fmt.Errorf("%w: %s.%s", ErrNoColumn, t.Name, name)
+			}
+			if seen[col] {
+				return nil, fmt.Errorf("%w: %s is given twice", ErrBadValue, name)
+			}
+			seen[col] = true
+			order[i] = col
+		}
+	}
+
+	for _, vals := range stmt.Rows {
+		if len(vals) != len(t.Columns) {
+			return nil, fmt.Errorf("%w: %s has %d columns, got %d values", ErrBadValue, t.Name, len(t.Columns), len(vals))
+		}
+		row := make(table.Row, len(t.Columns))
+		for i, v := range vals {
+			if err := checkType(t.Columns[order[i]], v); err != nil {
+				return nil, err
+			}
+			row[order[i]] = v
+		}
+		if err := t.Insert(tx, row); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{RowsAffected: len(stmt.Rows)}, nil
+}
+
+func execSelect(tx *kv.Tx, stmt *Select) (*Result, error) {
+	t, err := table.GetTable(tx, stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	var cols []int
+	res := &Result{}
+	if stmt.Columns == nil {
+		for i, col := range t.Columns {
+			cols = append(cols, i)
+			res.Columns = append(res.Columns, col.Name)
+			res.Types = append(res.Types, col.Type)
+		}
+	}
+	for _, name := range stmt.Columns {
+		col := t.ColumnIndex(name)
+		if col < 0 {
+			return nil, fmt.Errorf("%w: %s.%s", ErrNoColumn, t.Name, name)
+		}
+		cols = append(cols, col)
+		res.Columns = append(res.Columns, name)
+		res.Types = append(res.Types, t.Columns[col].Type)
+	}
+
+	err = scanWhere(tx, t, stmt.Where, nil, func(row table.Row) error {
+		out := make(table.Row, len(cols))
+		for i, col := range cols {
+			out[i] = row[col]
+		}
+		res.Rows = append(res.Rows, out)
+		return nil
+	})
+	return res, err
+}
+
+func execChange(tx *kv.Tx, stmt Statement) (*Result, error) {
+	t, where, change, err := prepareChange(tx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	err = scanWhere(tx, t, where, nil, func(row table.Row) error {
+		if err := change(row); err != nil {
+			return err
+		}
+		res.RowsAffected++
+		return nil
+	})
+	return res, err
+}
+
+// The table an UPDATE or DELETE changes, which rows, and the change to make to each.
+func prepareChange(tx *kv.Tx, stmt Statement) (*table.Table, []Cond, func(row table.Row) error, error) {
+	switch stmt := stmt.(type) {
+	case *Update:
+		t, err := table.GetTable(tx, stmt.Table)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cols := make([]int, len(stmt.Set))
+		for i, set := range stmt.Set {
+			if cols[i] = t.ColumnIndex(set.Column); cols[i] < 0 {
+				return nil, nil, nil, fmt.Errorf("%w: %s.%s", ErrNoColumn, t.Name, set.Column)
+			}
+			if cols[i] < t.PKeys {
+				return nil, nil, nil, fmt.Errorf("%w: %s", ErrKeyUpdate, set.Column)
+			}
+			if err := checkType(t.Columns[cols[i]], set.Value); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		return t, stmt.Where, func(row table.Row) error {
+			updated := append(table.Row{}, row...)
+			for i, set := range stmt.Set {
+				updated[cols[i]] = set.Value
+			}
+			return t.Upsert(tx, updated)
+		}, nil
+	case *Delete:
+		t, err := table.GetTable(tx, stmt.Table)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return t, stmt.Where, func(row table.Row) error {
+			_, err := t.Delete(tx, row[:t.PKeys]...)
+			return err
+		}, nil
+	}
+	return nil, nil, nil, fmt.Errorf("sql: %T doesn't change rows", stmt)
+}
+
+// One row per line of the plan of stmt.
+func execExplain(tx *kv.Tx, stmt Statement) (*Result, error) {
+	var name string
+	var where []Cond
+	switch stmt := stmt.(type) {
+	case *Select:
+		name, where = stmt.Table, stmt.Where
+	case *Update:
+		name, where = stmt.Table, stmt.Where
+	case *Delete:
+		name, where = stmt.Table, stmt.Where
+	default:
+		return nil, fmt.Errorf("%w: only SELECT, UPDATE and DELETE can be explained", ErrSyntax)
+	}
+	t, err := table.GetTable(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := planWhere(t, where)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Columns: []string{"plan"}, Types: []table.ColumnType{table.COL_STRING}}
+	for _, line := range p.explain() {
+		res.Rows = append(res.Rows, table.Row{line})
+	}
+	return res, nil
+}
+
+func checkType(col table.Column, v interface{}) error {
+	ok := false
+	switch col.Type {
+	case table.COL_INT64:
+		_, ok = v.(int64)
+	case table.COL_BYTES:
+		_, ok = v.([]byte)
+	case table.COL_STRING:
+		_, ok = v.(string)
+	case table.COL_BOOL:
+		_, ok = v.(bool)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s is %v, got %v", ErrBadValue, col.Name, col.Type, v)
+	}
+	return nil
+}
+
+func equal(a, b interface{}) bool {
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+	return a == b
+}
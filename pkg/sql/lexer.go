@@ -0,0 +1,124 @@
+package sql
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrSyntax = errors.New("sql: syntax error")
+
+type tokenKind int
+
+const (
+	TOK_EOF tokenKind = iota
+	// Keywords and names; keywords are matched case-insensitively by the parser
+	TOK_IDENT
+	TOK_INT
+	TOK_STRING
+	TOK_BLOB
+	// One of ( ) , ; * =
+	TOK_PUNCT
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Decoded value of a literal
+	val interface{}
+	pos int
+}
+
+func (tok token) String() string {
+	if tok.kind == TOK_EOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", tok.text)
+}
+
+// Split a statement into tokens, ending with a TOK_EOF.
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && i+1 < len(src) && src[i+1] == '-':
+			// Comment to the end of the line
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case (c == 'x' || c == 'X') && i+1 < len(src) && src[i+1] == '\'':
+			text, s, n, err := lexQuoted(src, i+1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad blob literal at %d", ErrSyntax, i)
+			}
+			toks = append(toks, token{TOK_BLOB, "x" + text, b, i})
+			i = n
+		case isIdentStart(c):
+			j := i
+			for j < len(src) && (isIdentStart(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, token{TOK_IDENT, src[i:j], nil, i})
+			i = j
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1])):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			n, err := strconv.ParseInt(src[i:j], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad integer %s at %d", ErrSyntax, src[i:j], i)
+			}
+			toks = append(toks, token{TOK_INT, src[i:j], n, i})
+			i = j
+		case c == '\'':
+			text, s, n, err := lexQuoted(src, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{TOK_STRING, text, s, i})
+			i = n
+		case strings.IndexByte("(),;*=", c) >= 0:
+			toks = append(toks, token{TOK_PUNCT, src[i : i+1], nil, i})
+			i++
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, i)
+		}
+	}
+	return append(toks, token{TOK_EOF, "", nil, len(src)}), nil
+}
+
+// Read a '...' literal starting at i, where ” stands for a quote. Returns its text, value and end.
+func lexQuoted(src string, i int) (string, string, int, error) {
+	var sb strings.Builder
+	for j := i + 1; j < len(src); j++ {
+		if src[j] != '\'' {
+			sb.WriteByte(src[j])
+			continue
+		}
+		if j+1 < len(src) && src[j+1] == '\'' {
+			sb.WriteByte('\'')
+			j++
+			continue
+		}
+		return src[i : j+1], sb.String(), j + 1, nil
+	}
+	return "", "", 0, fmt.Errorf("%w: unterminated quote at %d", ErrSyntax, i)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,536 @@
+package sql
+
+import (
+	"database-go/pkg/kv"
+	"database-go/pkg/table"
+	"fmt"
+	"strings"
+)
+
+/*
+The statements understood, one per call:
+
+	CREATE TABLE name (col type [PRIMARY KEY], ... [, PRIMARY KEY (col, ...)])
+	CREATE INDEX name ON table (col)
+	INSERT INTO name [(col, ...)] VALUES (value, ...), ...
+	SELECT * | col, ... FROM name [WHERE col = value AND ...]
+	UPDATE name SET col = value, ... [WHERE col = value AND ...]
+	DELETE FROM name [WHERE col = value AND ...]
+	EXPLAIN statement
+	BEGIN [TRANSACTION] [ISOLATION LEVEL level], or START TRANSACTION ...
+	COMMIT (END), ROLLBACK (ABORT)
+
+Types are INT64 (or INT, INTEGER), BYTES (BLOB), STRING (TEXT) and BOOL (BOOLEAN).
+Values are integers, 'strings', x'hex' blobs, TRUE and FALSE. The primary key
+columns have to come first in a table, in key order.
+
+Isolation levels are SERIALIZABLE, REPEATABLE READ (snapshot isolation) and READ
+COMMITTED. The transaction statements are for sessions that keep a transaction open
+across statements, like the Postgres front end in pkg/server; ExecStmt refuses them.
+*/
+type Statement interface {
+	statement()
+}
+
+type CreateTable struct {
+	Table *table.Table
+}
+
+type CreateIndex struct {
+	Name   string
+	Table  string
+	Column string
+}
+
+type Insert struct {
+	Table string
+	// Nil means all of them, in table order
+	Columns []string
+	Rows    [][]interface{}
+}
+
+type Select struct {
+	Table string
+	// Nil means *
+	Columns []string
+	Where   []Cond
+}
+
+type Update struct {
+	Table string
+	Set   []Cond
+	Where []Cond
+}
+
+type Delete struct {
+	Table string
+	Where []Cond
+}
+
+// Shows how the statement would find its rows, without running it
+type Explain struct {
+	Stmt Statement
+}
+
+// Opens a transaction for the statements that follow, up to Commit or Rollback
+type Begin struct {
+	Level kv.IsolationLevel
+}
+
+type Commit struct{}
+
+type Rollback struct{}
+
+// Column = Value
+type Cond struct {
+	Column string
+	Value  interface{}
+}
+
+func (*CreateTable) statement() {}
+func (*CreateIndex) statement() {}
+func (*Insert) statement()      {}
+func (*Select) statement()      {}
+func (*Update) statement()      {}
+func (*Delete) statement()      {}
+func (*Explain) statement()     {}
+func (*Begin) statement()       {}
+func (*Commit) statement()      {}
+func (*Rollback) statement()    {}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// Parse one statement, optionally followed by a semicolon.
+func Parse(src string) (Statement, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	p.punct(";")
+	if p.peek().kind != TOK_EOF {
+		return nil, p.unexpected("end of statement")
+	}
+	return stmt, nil
+}
+
+// Parse any number of statements separated by semicolons; empty ones are skipped.
+func ParseAll(src string) ([]Statement, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	var stmts []Statement
+	for {
+		for p.punct(";") {
+		}
+		if p.peek().kind == TOK_EOF {
+			return stmts, nil
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if !p.punct(";") && p.peek().kind != TOK_EOF {
+			return nil, p.unexpected(`";" or end of input`)
+		}
+	}
+}
+
+func (p *parser) statement() (Statement, error) {
+	var err error
+	explain := p.keyword("EXPLAIN")
+	var stmt Statement
+	switch {
+	case p.keyword("CREATE"):
+		if p.keyword("INDEX") {
+			stmt, err = p.createIndex()
+		} else {
+			stmt, err = p.createTable()
+		}
+	case p.keyword("INSERT"):
+		stmt, err = p.insert()
+	case p.keyword("SELECT"):
+		stmt, err = p.selectStmt()
+	case p.keyword("UPDATE"):
+		stmt, err = p.update()
+	case p.keyword("DELETE"):
+		stmt, err = p.delete()
+	case !explain && p.keyword("BEGIN"):
+		p.keyword("TRANSACTION")
+		stmt, err = p.begin()
+	case !explain && p.keyword("START"):
+		if err := p.expectKeyword("TRANSACTION"); err != nil {
+			return nil, err
+		}
+		stmt, err = p.begin()
+	case !explain && (p.keyword("COMMIT") || p.keyword("END")):
+		p.keyword("TRANSACTION")
+		stmt = &Commit{}
+	case !explain && (p.keyword("ROLLBACK") || p.keyword("ABORT")):
+		p.keyword("TRANSACTION")
+		stmt = &Rollback{}
+	default:
+		return nil, p.unexpected("a statement")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if explain {
+		return &Explain{Stmt: stmt}, nil
+	}
+	return stmt, nil
+}
+
+// The rest of BEGIN or START TRANSACTION: an optional isolation level.
+func (p *parser) begin() (Statement, error) {
+	stmt := &Begin{Level: kv.ISOLATION_SERIALIZABLE}
+	if !p.keyword("ISOLATION") {
+		return stmt, nil
+	}
+	if err := p.expectKeyword("LEVEL"); err != nil {
+		return nil, err
+	}
+	switch {
+	case p.keyword("SERIALIZABLE"):
+	case p.keyword("REPEATABLE"):
+		if err := p.expectKeyword("READ"); err != nil {
+			return nil, err
+		}
+		stmt.Level = kv.ISOLATION_SNAPSHOT
+	case p.keyword("READ"):
+		if err := p.expectKeyword("COMMITTED"); err != nil {
+			return nil, err
+		}
+		stmt.Level = kv.ISOLATION_READ_COMMITTED
+	default:
+		return nil, p.unexpected("an isolation level")
+	}
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) unexpected(want string) error {
+	tok := p.peek()
+	return fmt.Errorf("%w: expected %s at %d, got %v", ErrSyntax, want, tok.pos, tok)
+}
+
+// Consume the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if tok := p.peek(); tok.kind == TOK_IDENT && strings.EqualFold(tok.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Consume the next token if it is the punctuation s.
+func (p *parser) punct(s string) bool {
+	if tok := p.peek(); tok.kind == TOK_PUNCT && tok.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.unexpected(kw)
+	}
+	return nil
+}
+
+func (p *parser) expectPunct(s string) error {
+	if !p.punct(s) {
+		return p.unexpected(fmt.Sprintf("%q", s))
+	}
+	return nil
+}
+
+func (p *parser) name() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_IDENT {
+		return "", p.unexpected("a name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// A parenthesized, comma-separated list of names.
+func (p *parser) names() ([]string, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.punct(",") {
+			break
+		}
+	}
+	return names, p.expectPunct(")")
+}
+
+func (p *parser) value() (interface{}, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == TOK_INT || tok.kind == TOK_STRING || tok.kind == TOK_BLOB:
+		p.pos++
+		return tok.val, nil
+	case p.keyword("TRUE"):
+		return true, nil
+	case p.keyword("FALSE"):
+		return false, nil
+	}
+	return nil, p.unexpected("a value")
+}
+
+func (p *parser) columnType() (table.ColumnType, error) {
+	tok := p.peek()
+	if tok.kind == TOK_IDENT {
+		p.pos++
+		switch strings.ToUpper(tok.text) {
+		case "INT64", "INT", "INTEGER":
+			return table.COL_INT64, nil
+		case "BYTES", "BLOB":
+			return table.COL_BYTES, nil
+		case "STRING", "TEXT":
+			return table.COL_STRING, nil
+		case "BOOL", "BOOLEAN":
+			return table.COL_BOOL, nil
+		}
+		p.pos--
+	}
+	return 0, p.unexpected("a column type")
+}
+
+func (p *parser) createTable() (Statement, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+
+	t := &table.Table{Name: name}
+	var pkey []string
+	for {
+		if p.keyword("PRIMARY") {
+			if err := p.expectKeyword("KEY"); err != nil {
+				return nil, err
+			}
+			if pkey != nil {
+				return nil, fmt.Errorf("%w: table %s has more than one primary key", ErrSyntax, name)
+			}
+			if pkey, err = p.names(); err != nil {
+				return nil, err
+			}
+		} else {
+			col, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			typ, err := p.columnType()
+			if err != nil {
+				return nil, err
+			}
+			t.Columns = append(t.Columns, table.Column{Name: col, Type: typ})
+			if p.keyword("PRIMARY") {
+				if err := p.expectKeyword("KEY"); err != nil {
+					return nil, err
+				}
+				if pkey != nil {
+					return nil, fmt.Errorf("%w: table %s has more than one primary key", ErrSyntax, name)
+				}
+				pkey = []string{col}
+			}
+		}
+		if !p.punct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	if len(pkey) == 0 {
+		return nil, fmt.Errorf("%w: table %s has no primary key", ErrSyntax, name)
+	}
+	for i, col := range pkey {
+		if i >= len(t.Columns) || t.Columns[i].Name != col {
+			return nil, fmt.Errorf("%w: primary key columns of %s must come first, in key order", ErrSyntax, name)
+		}
+	}
+	t.PKeys = len(pkey)
+	return &CreateTable{Table: t}, nil
+}
+
+func (p *parser) createIndex() (Statement, error) {
+	stmt := &CreateIndex{}
+	var err error
+	if stmt.Name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	cols, err := p.names()
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) != 1 {
+		return nil, fmt.Errorf("%w: index %s must be on one column", ErrSyntax, stmt.Name)
+	}
+	stmt.Column = cols[0]
+	return stmt, nil
+}
+
+func (p *parser) insert() (Statement, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Insert{Table: name}
+	if p.peek().kind == TOK_PUNCT && p.peek().text == "(" {
+		if stmt.Columns, err = p.names(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		var row []interface{}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, v)
+			if !p.punct(",") {
+				break
+			}
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.punct(",") {
+			break
+		}
+	}
+	return stmt, nil
+}
+
+func (p *parser) selectStmt() (Statement, error) {
+	stmt := &Select{}
+	if !p.punct("*") {
+		for {
+			col, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Columns = append(stmt.Columns, col)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+func (p *parser) update() (Statement, error) {
+	stmt := &Update{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	if stmt.Set, err = p.equalities(","); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+func (p *parser) delete() (Statement, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	stmt := &Delete{}
+	var err error
+	if stmt.Table, err = p.name(); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+// An optional WHERE clause: equalities joined by AND.
+func (p *parser) where() ([]Cond, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.equalities("AND")
+}
+
+// One or more col = value, separated by the keyword or punctuation sep.
+func (p *parser) equalities(sep string) ([]Cond, error) {
+	var conds []Cond
+	for {
+		col, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, Cond{Column: col, Value: v})
+		if !p.keyword(sep) && !p.punct(sep) {
+			return conds, nil
+		}
+	}
+}
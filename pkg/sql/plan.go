@@ -0,0 +1,211 @@
+package sql
+
+import (
+	"database-go/pkg/kv"
+	"database-go/pkg/table"
+	"database-go/pkg/trace"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type accessKind int
+
+const (
+	// Every row of the table
+	ACCESS_SCAN accessKind = iota
+	// The rows whose leading primary key columns have given values
+	ACCESS_PREFIX
+	// One row, by its whole primary key
+	ACCESS_LOOKUP
+	// The rows with one value of an indexed column
+	ACCESS_INDEX
+)
+
+/*
+How a statement finds the rows its WHERE clause matches. The planner picks the
+narrowest way the conditions allow, in order: a lookup by the whole primary key, an
+index on one of the columns, a scan of the rows sharing the leading primary key
+columns, and otherwise a scan of the whole table. Conditions the access doesn't
+take care of are checked on every row it finds.
+
+The access is also what a serializable transaction is taken to have read, keys that
+aren't there included: a lookup reads its one key, an index access the index entries
+for its value, and a scan its range of rows. A concurrent commit adding a row there
+conflicts as much as one changing a row that was found, so a row matching the WHERE
+clause can't appear behind a statement's back (a phantom). The narrower the access, the
+fewer commits that can conflict with it: a filtered scan of the whole table conflicts
+with any insert into the table, an index access only with those of its value.
+*/
+type plan struct {
+	table  *table.Table
+	access accessKind
+	// The leading primary key values, for ACCESS_PREFIX and ACCESS_LOOKUP
+	key []interface{}
+	// For ACCESS_INDEX
+	index *table.Index
+	value interface{}
+	// Conditions still to check on each row, with their column indexes
+	filter []Cond
+	cols   []int
+}
+
+func planWhere(t *table.Table, where []Cond) (*plan, error) {
+	p := &plan{table: t}
+	cols := make([]int, len(where))
+	// The first condition on each primary key column
+	pkCond := make([]int, t.PKeys)
+	for i := range pkCond {
+		pkCond[i] = -1
+	}
+	for i, cond := range where {
+		if cols[i] = t.ColumnIndex(cond.Column); cols[i] < 0 {
+			return nil, fmt.Errorf("%w: %s.%s", ErrNoColumn, t.Name, cond.Column)
+		}
+		if err := checkType(t.Columns[cols[i]], cond.Value); err != nil {
+			return nil, err
+		}
+		if cols[i] < t.PKeys && pkCond[cols[i]] < 0 {
+			pkCond[cols[i]] = i
+		}
+	}
+
+	// The conditions on the leading primary key columns
+	var prefix []int
+	for _, i := range pkCond {
+		if i < 0 {
+			break
+		}
+		prefix = append(prefix, i)
+	}
+	var used []int
+	index, indexCond := findIndex(t, where)
+	switch {
+	case len(prefix) == t.PKeys:
+		p.access, used = ACCESS_LOOKUP, prefix
+	case index != nil:
+		p.access, used = ACCESS_INDEX, []int{indexCond}
+		p.index, p.value = index, where[indexCond].Value
+	case len(prefix) > 0:
+		p.access, used = ACCESS_PREFIX, prefix
+	default:
+		p.access = ACCESS_SCAN
+	}
+	if p.access == ACCESS_LOOKUP || p.access == ACCESS_PREFIX {
+		for _, i := range prefix {
+			p.key = append(p.key, where[i].Value)
+		}
+	}
+
+	for i, cond := range where {
+		isUsed := false
+		for _, u := range used {
+			isUsed = isUsed || u == i
+		}
+		if !isUsed {
+			p.filter = append(p.filter, cond)
+			p.cols = append(p.cols, cols[i])
+		}
+	}
+	return p, nil
+}
+
+// The first index of t with a condition on its column, and that condition.
+func findIndex(t *table.Table, where []Cond) (*table.Index, int) {
+	for i := range t.Indexes {
+		for j, cond := range where {
+			if cond.Column == t.Indexes[i].Column {
+				return &t.Indexes[i], j
+			}
+		}
+	}
+	return nil, -1
+}
+
+/*
+Call fn on the rows of the plan, in primary key order from the row with primary key
+from, or the first if it is nil. A lookup ignores from.
+*/
+func (p *plan) run(tx *kv.Tx, from []interface{}, fn func(row table.Row) error) error {
+	filter := func(row table.Row) error {
+		for i, cond := range p.filter {
+			if !equal(row[p.cols[i]], cond.Value) {
+				return nil
+			}
+		}
+		return fn(row)
+	}
+
+	switch p.access {
+	case ACCESS_LOOKUP:
+		row, err := p.table.Get(tx, p.key...)
+		if errors.Is(err, table.ErrRowNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return filter(row)
+	case ACCESS_INDEX:
+		return p.table.LookupIndex(tx, p.index.Name, p.value, from, filter)
+	}
+	return p.table.ScanPrefix(tx, p.key, from, filter)
+}
+
+// Call fn on the rows of t matching every condition; see plan.
+func scanWhere(tx *kv.Tx, t *table.Table, where []Cond, from []interface{}, fn func(row table.Row) error) error {
+	_, span := trace.StartChild(tx.Context(), "sql.plan")
+	p, err := planWhere(t, where)
+	if err == nil && span != nil {
+		span.SetAttr("plan", strings.Join(p.explain(), "; "))
+	}
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return err
+	}
+	return p.run(tx, from, fn)
+}
+
+// The lines EXPLAIN shows for the plan.
+func (p *plan) explain() []string {
+	var lines []string
+	key := make([]string, len(p.key))
+	for i, v := range p.key {
+		key[i] = fmt.Sprintf("%s = %s", p.table.Columns[i].Name, formatValue(v))
+	}
+	switch p.access {
+	case ACCESS_LOOKUP:
+		lines = append(lines, fmt.Sprintf("LOOKUP %s (%s)", p.table.Name, strings.Join(key, ", ")))
+	case ACCESS_INDEX:
+		lines = append(lines, fmt.Sprintf("INDEX SCAN %s USING %s (%s = %s)", p.table.Name, p.index.Name, p.index.Column, formatValue(p.value)))
+	case ACCESS_PREFIX:
+		lines = append(lines, fmt.Sprintf("PREFIX SCAN %s (%s)", p.table.Name, strings.Join(key, ", ")))
+	default:
+		lines = append(lines, fmt.Sprintf("SCAN %s", p.table.Name))
+	}
+	if len(p.filter) > 0 {
+		conds := make([]string, len(p.filter))
+		for i, cond := range p.filter {
+			conds[i] = fmt.Sprintf("%s = %s", cond.Column, formatValue(cond.Value))
+		}
+		lines = append(lines, "FILTER "+strings.Join(conds, " AND "))
+	}
+	return lines
+}
+
+// A value as a SQL literal.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case []byte:
+		return fmt.Sprintf("x'%x'", v)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return fmt.Sprint(v)
+}
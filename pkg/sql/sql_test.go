@@ -0,0 +1,329 @@
+package sql
+
+import (
+	"database-go/pkg/kv"
+	"database-go/pkg/table"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStatements(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exec := func(src string) *Result {
+		t.Helper()
+		res, err := Exec(db, src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		return res
+	}
+	exec(`CREATE TABLE users (team INT, name TEXT, avatar BLOB, admin BOOL, PRIMARY KEY (team, name))`)
+	res := exec(`INSERT INTO users VALUES (1, 'ann', x'00ff', TRUE), (1, 'bob', x'', FALSE);`)
+	if res.RowsAffected != 2 {
+		t.Errorf("INSERT affected %d rows, want 2", res.RowsAffected)
+	}
+	exec(`INSERT INTO users (name, admin, team, avatar) VALUES ('o''neil', false, 2, X'01')`)
+
+	res = exec(`SELECT name, team FROM users`)
+	want := []table.Row{{"ann", int64(1)}, {"bob", int64(1)}, {"o'neil", int64(2)}}
+	if !reflect.DeepEqual(res.Columns, []string{"name", "team"}) || !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("SELECT name, team = %v %v, want %v", res.Columns, res.Rows, want)
+	}
+	res = exec(`select * from users where name = 'bob' and team = 1`)
+	want = []table.Row{{int64(1), "bob", []byte{}, false}}
+	if !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("SELECT by primary key = %#v, want %#v", res.Rows, want)
+	}
+	res = exec(`SELECT name FROM users WHERE admin = FALSE -- not a key column`)
+	want = []table.Row{{"bob"}, {"o'neil"}}
+	if !reflect.DeepEqual(res.Rows, want) {
+		t.Errorf("SELECT by admin = %v, want %v", res.Rows, want)
+	}
+
+	res = exec(`DELETE FROM users WHERE team = 1`)
+	if res.RowsAffected != 2 {
+		t.Errorf("DELETE affected %d rows, want 2", res.RowsAffected)
+	}
+	res = exec(`SELECT name FROM users`)
+	if !reflect.DeepEqual(res.Rows, []table.Row{{"o'neil"}}) {
+		t.Errorf("SELECT after DELETE = %v", res.Rows)
+	}
+
+	for src, want := range map[string]error{
+		`INSERT INTO users VALUES (2, 'o''neil', x'', TRUE)`:  table.ErrRowExists,
+		`INSERT INTO users VALUES ('2', 'x', x'', TRUE)`:      ErrBadValue,
+		`SELECT * FROM missing`:                               table.ErrNoTable,
+		`SELECT age FROM users`:                               ErrNoColumn,
+		`CREATE TABLE users (id INT PRIMARY KEY)`:             table.ErrTableExists,
+		`CREATE TABLE t (a INT, b INT, PRIMARY KEY (b))`:      ErrSyntax,
+		`SELECT * FROM users WHERE team > 1`:                  ErrSyntax,
+		`DELETE users`:                                        ErrSyntax,
+		`SELECT * FROM users; SELECT * FROM users`:            ErrSyntax,
+		`INSERT INTO users VALUES (1, 'unterminated, x'', 1)`: ErrSyntax,
+	} {
+		if _, err := Exec(db, src); !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", src, err, want)
+		}
+	}
+}
+
+func TestExecBatched(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Exec(db, `CREATE TABLE items (id INT PRIMARY KEY, kind TEXT, done BOOL)`); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Update(func(tx *kv.Tx) error {
+		items, err := table.GetTable(tx, "items")
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 250; i++ {
+			if err := items.Insert(tx, table.Row{i, []string{"a", "b"}[i%2], false}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batches []int
+	res, err := ExecBatched(db, `UPDATE items SET done = TRUE WHERE kind = 'a'`, BatchOptions{
+		BatchSize: 50,
+		Progress: func(p Progress) error {
+			batches = append(batches, p.RowsAffected)
+			return nil
+		},
+	})
+	if err != nil || res.RowsAffected != 125 {
+		t.Fatalf("batched UPDATE = %+v, %v", res, err)
+	}
+	if !reflect.DeepEqual(batches, []int{50, 100, 125}) {
+		t.Errorf("progress after each batch = %v", batches)
+	}
+	res, err = Exec(db, `SELECT id FROM items WHERE done = TRUE AND kind = 'b'`)
+	if err != nil || len(res.Rows) != 0 {
+		t.Fatalf("rows of the wrong kind updated: %v, %v", res, err)
+	}
+
+	// Stop after the first batch, then carry on from where it got to
+	stop := errors.New("stop")
+	var last Progress
+	_, err = ExecBatched(db, `DELETE FROM items WHERE done = FALSE`, BatchOptions{
+		BatchSize: 100,
+		Progress: func(p Progress) error {
+			last = p
+			return stop
+		},
+	})
+	if !errors.Is(err, stop) || last.RowsAffected != 100 || !reflect.DeepEqual(last.Resume, []interface{}{int64(201)}) {
+		t.Fatalf("interrupted DELETE = %v, progress %+v", err, last)
+	}
+	res, err = ExecBatched(db, `DELETE FROM items WHERE done = FALSE`, BatchOptions{BatchSize: 100, Resume: last.Resume})
+	if err != nil || res.RowsAffected != 25 {
+		t.Fatalf("resumed DELETE = %+v, %v", res, err)
+	}
+	res, err = Exec(db, `SELECT id FROM items WHERE kind = 'b'`)
+	if err != nil || len(res.Rows) != 0 {
+		t.Fatalf("rows left after DELETE: %v, %v", res, err)
+	}
+
+	if _, err := Exec(db, `UPDATE items SET id = 1`); !errors.Is(err, ErrKeyUpdate) {
+		t.Errorf("UPDATE of the key = %v, want %v", err, ErrKeyUpdate)
+	}
+}
+
+func TestConsistencyTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := kv.Open(path, kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	res, err := Exec(db, `CREATE TABLE t (id INT PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := res.Version
+	v, err := db.Update(func(tx *kv.Tx) error {
+		return tx.Set([]byte("direct"), []byte("write"))
+	})
+	if err != nil || v <= created {
+		t.Fatalf("Update = %d, %v after CREATE at %d", v, err, created)
+	}
+
+	// A reader on another handle asks to see the KV write
+	ro, err := kv.OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	snap, err := ro.SnapshotAtLeast(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := snap.Get([]byte("direct")); err != nil || string(val) != "write" {
+		t.Errorf("Get at version %d = %q, %v", v, val, err)
+	}
+	snap.Release()
+	if _, err := ro.SnapshotAtLeast(v + 1); !errors.Is(err, kv.ErrVersionAhead) {
+		t.Errorf("SnapshotAtLeast(%d) = %v, want %v", v+1, err, kv.ErrVersionAhead)
+	}
+
+	res, err = ExecAtLeast(db, v, `INSERT INTO t VALUES (1)`)
+	if err != nil || res.Version <= v {
+		t.Fatalf("ExecAtLeast(%d) = %+v, %v", v, res, err)
+	}
+	res, err = ExecAtLeast(db, res.Version, `SELECT * FROM t`)
+	if err != nil || len(res.Rows) != 1 {
+		t.Errorf("SELECT after INSERT = %+v, %v", res, err)
+	}
+	if _, err := ExecAtLeast(db, res.Version+1, `SELECT * FROM t`); !errors.Is(err, kv.ErrVersionAhead) {
+		t.Errorf("ExecAtLeast a later version = %v, want %v", err, kv.ErrVersionAhead)
+	}
+	if tx, err := db.BeginAtLeast(res.Version + 1); !errors.Is(err, kv.ErrVersionAhead) {
+		t.Errorf("BeginAtLeast a later version = %v, %v", tx, err)
+	}
+}
+
+func TestPlanner(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	query := func(src string) []table.Row {
+		t.Helper()
+		res, err := Exec(db, src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		return res.Rows
+	}
+	explain := func(src string, want ...string) {
+		t.Helper()
+		var got []string
+		for _, row := range query("EXPLAIN " + src) {
+			got = append(got, row[0].(string))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("EXPLAIN %s = %q, want %q", src, got, want)
+		}
+	}
+
+	query(`CREATE TABLE pets (owner TEXT, name TEXT, kind TEXT, PRIMARY KEY (owner, name))`)
+	query(`INSERT INTO pets VALUES ('ann', 'rex', 'dog'), ('ann', 'tom', 'cat'), ('bob', 'fido', 'dog'), ('cy', 'kit', 'cat')`)
+
+	explain(`SELECT * FROM pets`, "SCAN pets")
+	explain(`SELECT * FROM pets WHERE kind = 'dog'`, "SCAN pets", "FILTER kind = 'dog'")
+	explain(`SELECT * FROM pets WHERE owner = 'ann'`, "PREFIX SCAN pets (owner = 'ann')")
+	explain(`DELETE FROM pets WHERE name = 'rex' AND owner = 'ann'`, "LOOKUP pets (owner = 'ann', name = 'rex')")
+
+	query(`CREATE INDEX by_kind ON pets (kind)`)
+	explain(`SELECT name FROM pets WHERE kind = 'dog'`, "INDEX SCAN pets USING by_kind (kind = 'dog')")
+	explain(`UPDATE pets SET kind = 'cat' WHERE owner = 'ann' AND kind = 'dog'`,
+		"INDEX SCAN pets USING by_kind (kind = 'dog')", "FILTER owner = 'ann'")
+	if rows := query(`SELECT name FROM pets WHERE kind = 'dog'`); !reflect.DeepEqual(rows, []table.Row{{"rex"}, {"fido"}}) {
+		t.Errorf("dogs from the index built by CREATE INDEX = %v", rows)
+	}
+
+	// The index follows updates and deletes
+	query(`UPDATE pets SET kind = 'cat' WHERE owner = 'ann' AND kind = 'dog'`)
+	query(`DELETE FROM pets WHERE kind = 'cat' AND owner = 'cy'`)
+	query(`INSERT INTO pets VALUES ('dee', 'spot', 'dog')`)
+	if rows := query(`SELECT owner, name FROM pets WHERE kind = 'dog'`); !reflect.DeepEqual(rows, []table.Row{{"bob", "fido"}, {"dee", "spot"}}) {
+		t.Errorf("dogs after changes = %v", rows)
+	}
+	if rows := query(`SELECT owner, name FROM pets WHERE kind = 'cat'`); !reflect.DeepEqual(rows, []table.Row{{"ann", "rex"}, {"ann", "tom"}}) {
+		t.Errorf("cats after changes = %v", rows)
+	}
+
+	if _, err := Exec(db, `CREATE INDEX by_kind ON pets (name)`); !errors.Is(err, table.ErrIndexExists) {
+		t.Errorf("second CREATE INDEX by_kind = %v, want %v", err, table.ErrIndexExists)
+	}
+	if _, err := Exec(db, `CREATE INDEX by_age ON pets (age)`); !errors.Is(err, table.ErrBadSchema) {
+		t.Errorf("CREATE INDEX on a missing column = %v, want %v", err, table.ErrBadSchema)
+	}
+}
+
+func TestSerializablePredicates(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, src := range []string{
+		`CREATE TABLE doctors (name TEXT, oncall BOOL, PRIMARY KEY (name))`,
+		`INSERT INTO doctors VALUES ('alice', TRUE), ('bob', TRUE)`,
+		`CREATE TABLE bookings (id INT, room INT, PRIMARY KEY (id))`,
+		`CREATE INDEX bookings_room ON bookings (room)`,
+	} {
+		if _, err := Exec(db, src); err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+	exec := func(tx *kv.Tx, src string) *Result {
+		t.Helper()
+		res, err := ExecTx(tx, src)
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		return res
+	}
+
+	// Write skew: each sees two doctors on call, and takes a different one off
+	tx1, _ := db.Begin()
+	tx2, _ := db.Begin()
+	for tx, name := range map[*kv.Tx]string{tx1: "alice", tx2: "bob"} {
+		if res := exec(tx, `SELECT name FROM doctors WHERE oncall = TRUE`); len(res.Rows) != 2 {
+			t.Fatalf("on call = %v", res.Rows)
+		}
+		exec(tx, `UPDATE doctors SET oncall = FALSE WHERE name = '`+name+`'`)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("write skew Commit = %v, want %v", err, kv.ErrConflict)
+	}
+
+	// Phantom: each finds room 1 free through the index, and books it
+	book := func(id, room int) *kv.Tx {
+		tx, _ := db.Begin()
+		free := len(exec(tx, fmt.Sprintf(`SELECT id FROM bookings WHERE room = %d`, room)).Rows) == 0
+		if free {
+			exec(tx, fmt.Sprintf(`INSERT INTO bookings VALUES (%d, %d)`, id, room))
+		}
+		return tx
+	}
+	tx1, tx2 = book(1, 1), book(2, 1)
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("phantom Commit = %v, want %v", err, kv.ErrConflict)
+	}
+
+	// Bookings of different rooms only read their own part of the index, and both go through
+	tx1, tx2 = book(3, 2), book(4, 3)
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("Commit of another room = %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package table
+
+import (
+	"database-go/pkg/keys"
+	"database-go/pkg/kv"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrIndexExists = errors.New("table: index already exists")
+	ErrNoIndex     = errors.New("table: no such index")
+)
+
+/*
+A secondary index on one column. Each row has an entry whose key packs the index ID,
+the row's value of the column and its primary key, so the rows with one value are a
+contiguous range, in primary key order:
+
+	(index ID, value, pk columns...)  ->  empty
+
+Entries are written by the same transaction as the row, so they are never out of date.
+*/
+type Index struct {
+	Name   string
+	Column string
+	// Assigned by CreateIndex, from the same sequence as table IDs
+	ID int64
+}
+
+// The index with the given name.
+func (t *Table) Index(name string) (*Index, error) {
+	for i := range t.Indexes {
+		if t.Indexes[i].Name == name {
+			return &t.Indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s on %s", ErrNoIndex, name, t.Name)
+}
+
+// Add an index to table and build it from the existing rows.
+func CreateIndex(tx *kv.Tx, table string, idx Index) (*Table, error) {
+	t, err := GetTable(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.Index(idx.Name); err == nil {
+		return nil, fmt.Errorf("%w: %s on %s", ErrIndexExists, idx.Name, table)
+	}
+	if idx.ID, err = allocID(tx); err != nil {
+		return nil, err
+	}
+	t.Indexes = append(t.Indexes, idx)
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+
+	built := &t.Indexes[len(t.Indexes)-1]
+	err = t.Scan(tx, func(row Row) error {
+		return t.setIndexEntry(tx, built, row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, tx.Set(catalogKey(t.Name), t.encode())
+}
+
+/*
+Call fn on the rows whose indexed column equals val, in primary key order, starting
+at the row with primary key from, or the first if it is nil.
+*/
+func (t *Table) LookupIndex(tx *kv.Tx, name string, val interface{}, from []interface{}, fn func(row Row) error) error {
+	idx, err := t.Index(name)
+	if err != nil {
+		return err
+	}
+	col := t.ColumnIndex(idx.Column)
+	if val, err = checkValue(t.Columns[col], val); err != nil {
+		return err
+	}
+	begin, end, err := keys.Tuple{idx.ID, val}.Range()
+	if err != nil {
+		return err
+	}
+	if from != nil {
+		pk, err := t.pkValues(from)
+		if err != nil {
+			return err
+		}
+		if begin, err = append(keys.Tuple{idx.ID, val}, pk...).Pack(); err != nil {
+			return err
+		}
+	}
+
+	return tx.Range(begin, end, func(key, _ []byte) error {
+		entry, err := keys.Unpack(key)
+		if err != nil || len(entry) != 2+t.PKeys {
+			return fmt.Errorf("%w: bad entry in index %s", ErrBadRow, name)
+		}
+		row, err := t.Get(tx, entry[2:]...)
+		if err != nil {
+			return fmt.Errorf("index %s: %w", name, err)
+		}
+		return fn(row)
+	})
+}
+
+func (t *Table) indexKey(idx *Index, row Row) ([]byte, error) {
+	col := t.ColumnIndex(idx.Column)
+	val, err := checkValue(t.Columns[col], row[col])
+	if err != nil {
+		return nil, err
+	}
+	pk, err := t.pkValues(row[:t.PKeys])
+	if err != nil {
+		return nil, err
+	}
+	return append(keys.Tuple{idx.ID, val}, pk...).Pack()
+}
+
+func (t *Table) setIndexEntry(tx *kv.Tx, idx *Index, row Row) error {
+	key, err := t.indexKey(idx, row)
+	if err != nil {
+		return err
+	}
+	return tx.Set(key, nil)
+}
+
+// Write the index entries of row, or if del is set, remove them.
+func (t *Table) updateIndexes(tx *kv.Tx, row Row, del bool) error {
+	for i := range t.Indexes {
+		if !del {
+			if err := t.setIndexEntry(tx, &t.Indexes[i], row); err != nil {
+				return err
+			}
+			continue
+		}
+		key, err := t.indexKey(&t.Indexes[i], row)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Del(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package table
+
+import (
+	"bytes"
+	"database-go/pkg/keys"
+	"database-go/pkg/kv"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBadRow      = errors.New("table: row does not match the table")
+	ErrRowExists   = errors.New("table: row with this primary key already exists")
+	ErrRowNotFound = errors.New("table: row not found")
+)
+
+/*
+A row's values in column order. Each value must match its column: int64 for
+COL_INT64 (int is accepted and converted), []byte, string or bool.
+*/
+type Row []interface{}
+
+// Check a value against a column type, returning it in the form it is stored in.
+func checkValue(col Column, v interface{}) (interface{}, error) {
+	switch col.Type {
+	case COL_INT64:
+		if n, err := asInt64(v); err == nil {
+			return n, nil
+		}
+	case COL_BYTES:
+		if b, ok := v.([]byte); ok {
+			return b, nil
+		}
+	case COL_STRING:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case COL_BOOL:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: column %s is %v, got %T", ErrBadRow, col.Name, col.Type, v)
+}
+
+func asInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("%w: %T is not an integer", ErrBadRow, v)
+}
+
+// The key of the row with the given primary key values.
+func (t *Table) key(pk []interface{}) ([]byte, error) {
+	if len(pk) != t.PKeys {
+		return nil, fmt.Errorf("%w: table %s has %d primary key columns, got %d", ErrBadRow, t.Name, t.PKeys, len(pk))
+	}
+	vals, err := t.pkValues(pk)
+	if err != nil {
+		return nil, err
+	}
+	return append(keys.Tuple{t.ID}, vals...).Pack()
+}
+
+// Check the values of the first len(pk) primary key columns, returning them as stored.
+func (t *Table) pkValues(pk []interface{}) (keys.Tuple, error) {
+	if len(pk) > t.PKeys {
+		return nil, fmt.Errorf("%w: table %s has %d primary key columns, got %d", ErrBadRow, t.Name, t.PKeys, len(pk))
+	}
+	vals := keys.Tuple{}
+	for i, v := range pk {
+		v, err := checkValue(t.Columns[i], v)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func (t *Table) encodeRow(row Row) ([]byte, []byte, error) {
+	if len(row) != len(t.Columns) {
+		return nil, nil, fmt.Errorf("%w: table %s has %d columns, got %d", ErrBadRow, t.Name, len(t.Columns), len(row))
+	}
+	key, err := t.key(row[:t.PKeys])
+	if err != nil {
+		return nil, nil, err
+	}
+	vals := keys.Tuple{}
+	for i := t.PKeys; i < len(row); i++ {
+		v, err := checkValue(t.Columns[i], row[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		vals = append(vals, v)
+	}
+	val, err := vals.Pack()
+	return key, val, err
+}
+
+func (t *Table) decodeRow(key, val []byte) (Row, error) {
+	pk, err := keys.Unpack(key)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := keys.Unpack(val)
+	if err != nil {
+		return nil, err
+	}
+	if len(pk) != t.PKeys+1 || len(pk)-1+len(rest) != len(t.Columns) {
+		return nil, fmt.Errorf("%w: stored row of table %s has the wrong number of columns", ErrBadRow, t.Name)
+	}
+	return append(Row(pk[1:]), rest...), nil
+}
+
+// Add a row. Returns ErrRowExists if there is already one with the same primary key.
+func (t *Table) Insert(tx *kv.Tx, row Row) error {
+	key, val, err := t.encodeRow(row)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Get(key); err == nil {
+		return ErrRowExists
+	} else if !errors.Is(err, kv.ErrKeyNotFound) {
+		return err
+	}
+	if err := tx.Set(key, val); err != nil {
+		return err
+	}
+	return t.updateIndexes(tx, row, false)
+}
+
+// Add a row, replacing any with the same primary key.
+func (t *Table) Upsert(tx *kv.Tx, row Row) error {
+	key, val, err := t.encodeRow(row)
+	if err != nil {
+		return err
+	}
+	if len(t.Indexes) > 0 {
+		old, err := t.get(tx, key)
+		if err != nil && !errors.Is(err, ErrRowNotFound) {
+			return err
+		}
+		if err == nil {
+			if err := t.updateIndexes(tx, old, true); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Set(key, val); err != nil {
+		return err
+	}
+	return t.updateIndexes(tx, row, false)
+}
+
+// The row with the given primary key values.
+func (t *Table) Get(tx *kv.Tx, pk ...interface{}) (Row, error) {
+	key, err := t.key(pk)
+	if err != nil {
+		return nil, err
+	}
+	return t.get(tx, key)
+}
+
+func (t *Table) get(tx *kv.Tx, key []byte) (Row, error) {
+	val, err := tx.Get(key)
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, ErrRowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.decodeRow(key, val)
+}
+
+// Remove the row with the given primary key values. Returns whether there was one.
+func (t *Table) Delete(tx *kv.Tx, pk ...interface{}) (bool, error) {
+	key, err := t.key(pk)
+	if err != nil {
+		return false, err
+	}
+	if len(t.Indexes) > 0 {
+		old, err := t.get(tx, key)
+		if errors.Is(err, ErrRowNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := t.updateIndexes(tx, old, true); err != nil {
+			return false, err
+		}
+	}
+	return tx.Del(key)
+}
+
+// Call fn on every row in primary key order.
+func (t *Table) Scan(tx *kv.Tx, fn func(row Row) error) error {
+	return t.ScanPrefix(tx, nil, nil, fn)
+}
+
+/*
+Call fn on the rows whose leading primary key columns equal prefix, in primary key
+order, starting at the row with primary key from, or the next one after where it
+would be. A nil from starts at the first row with the prefix.
+*/
+func (t *Table) ScanPrefix(tx *kv.Tx, prefix, from []interface{}, fn func(row Row) error) error {
+	vals, err := t.pkValues(prefix)
+	if err != nil {
+		return err
+	}
+	// Range starts just after the packed prefix, which is a row's key if it is the whole primary key
+	begin, err := append(keys.Tuple{t.ID}, vals...).Pack()
+	if err != nil {
+		return err
+	}
+	_, end, err := append(keys.Tuple{t.ID}, vals...).Range()
+	if err != nil {
+		return err
+	}
+	if from != nil {
+		start, err := t.key(from)
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(start, begin) > 0 {
+			begin = start
+		}
+	}
+	return tx.Range(begin, end, func(key, val []byte) error {
+		row, err := t.decodeRow(key, val)
+		if err != nil {
+			return err
+		}
+		return fn(row)
+	})
+}
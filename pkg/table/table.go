@@ -0,0 +1,241 @@
+package table
+
+import (
+	"database-go/pkg/keys"
+	"database-go/pkg/kv"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrTableExists = errors.New("table: table already exists")
+	ErrNoTable     = errors.New("table: no such table")
+	ErrBadSchema   = errors.New("table: invalid table definition")
+)
+
+type ColumnType int
+
+const (
+	COL_INT64 ColumnType = iota + 1
+	COL_BYTES
+	COL_STRING
+	COL_BOOL
+)
+
+func (ct ColumnType) String() string {
+	switch ct {
+	case COL_INT64:
+		return "INT64"
+	case COL_BYTES:
+		return "BYTES"
+	case COL_STRING:
+		return "STRING"
+	case COL_BOOL:
+		return "BOOL"
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(ct))
+}
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+/*
+A table of rows with typed columns, stored in the key-value store. Each row is one
+pair: the key packs the table ID and the primary key columns, the value packs the
+rest, both with the tuple encoding so keys sort by primary key.
+
+	(table ID, pk columns...)  ->  (other columns...)
+
+Definitions are kept the same way in a catalog table with ID 0, so creating a table
+commits along with whatever else its transaction does.
+
+	(0, "table", name)  ->  (ID, PKeys, ((column name, type)...), ((index name, column, ID)...))
+	(0, "next_id")      ->  (next table or index ID)
+
+Tables, their indexes and the catalog are all ranges of the one B-tree, so there is
+a single root to publish however many of them a transaction touches. Its commit
+writes one meta page: after a crash, a failed commit or a conflict, either all of
+its changes to every table are there or none of them are, and a concurrent reader
+sees all or none of them too.
+*/
+type Table struct {
+	Name    string
+	Columns []Column
+	// The first PKeys columns make up the primary key
+	PKeys int
+	// Assigned by CreateTable
+	ID      int64
+	Indexes []Index
+}
+
+// ID of the catalog table
+const CATALOG_ID = 0
+
+func catalogKey(name string) []byte {
+	return keys.MustPack(keys.Tuple{int64(CATALOG_ID), "table", name})
+}
+
+var nextIDKey = keys.MustPack(keys.Tuple{int64(CATALOG_ID), "next_id"})
+
+func (t *Table) validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: table has no name", ErrBadSchema)
+	}
+	if len(t.Columns) == 0 {
+		return fmt.Errorf("%w: table %s has no columns", ErrBadSchema, t.Name)
+	}
+	if t.PKeys < 1 || t.PKeys > len(t.Columns) {
+		return fmt.Errorf("%w: table %s has %d primary key columns out of %d", ErrBadSchema, t.Name, t.PKeys, len(t.Columns))
+	}
+	names := map[string]bool{}
+	for _, col := range t.Columns {
+		if col.Name == "" || names[col.Name] {
+			return fmt.Errorf("%w: table %s has a missing or repeated column name %q", ErrBadSchema, t.Name, col.Name)
+		}
+		if col.Type < COL_INT64 || col.Type > COL_BOOL {
+			return fmt.Errorf("%w: column %s has unknown type %v", ErrBadSchema, col.Name, col.Type)
+		}
+		names[col.Name] = true
+	}
+	indexes := map[string]bool{}
+	for _, idx := range t.Indexes {
+		if idx.Name == "" || indexes[idx.Name] {
+			return fmt.Errorf("%w: table %s has a missing or repeated index name %q", ErrBadSchema, t.Name, idx.Name)
+		}
+		if !names[idx.Column] {
+			return fmt.Errorf("%w: index %s is on missing column %s", ErrBadSchema, idx.Name, idx.Column)
+		}
+		indexes[idx.Name] = true
+	}
+	return nil
+}
+
+// Index of the named column, or -1.
+func (t *Table) ColumnIndex(name string) int {
+	for i, col := range t.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add a table to the catalog, assigning its ID and those of its indexes.
+func CreateTable(tx *kv.Tx, t *Table) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+	if _, err := tx.Get(catalogKey(t.Name)); err == nil {
+		return fmt.Errorf("%w: %s", ErrTableExists, t.Name)
+	} else if !errors.Is(err, kv.ErrKeyNotFound) {
+		return err
+	}
+
+	id, err := allocID(tx)
+	if err != nil {
+		return err
+	}
+	t.ID = id
+	for i := range t.Indexes {
+		// The table is empty, so there is nothing to build
+		if t.Indexes[i].ID, err = allocID(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Set(catalogKey(t.Name), t.encode())
+}
+
+// Take the next unused table or index ID.
+func allocID(tx *kv.Tx) (int64, error) {
+	id := int64(CATALOG_ID + 1)
+	packed, err := tx.Get(nextIDKey)
+	if err == nil {
+		next, err := keys.Unpack(packed)
+		if err != nil || len(next) != 1 {
+			return 0, fmt.Errorf("%w: bad next table ID", ErrBadSchema)
+		}
+		if id, err = asInt64(next[0]); err != nil {
+			return 0, fmt.Errorf("%w: bad next table ID", ErrBadSchema)
+		}
+	} else if !errors.Is(err, kv.ErrKeyNotFound) {
+		return 0, err
+	}
+	return id, tx.Set(nextIDKey, keys.MustPack(keys.Tuple{id + 1}))
+}
+
+// Look a table up in the catalog.
+func GetTable(tx *kv.Tx, name string) (*Table, error) {
+	packed, err := tx.Get(catalogKey(name))
+	if errors.Is(err, kv.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNoTable, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeTable(name, packed)
+}
+
+func (t *Table) encode() []byte {
+	cols := keys.Tuple{}
+	for _, col := range t.Columns {
+		cols = append(cols, keys.Tuple{col.Name, int64(col.Type)})
+	}
+	indexes := keys.Tuple{}
+	for _, idx := range t.Indexes {
+		indexes = append(indexes, keys.Tuple{idx.Name, idx.Column, idx.ID})
+	}
+	return keys.MustPack(keys.Tuple{t.ID, int64(t.PKeys), cols, indexes})
+}
+
+func decodeTable(name string, packed []byte) (*Table, error) {
+	bad := fmt.Errorf("%w: catalog entry for %s is corrupt", ErrBadSchema, name)
+	def, err := keys.Unpack(packed)
+	if err != nil || len(def) < 3 || len(def) > 4 {
+		return nil, bad
+	}
+	id, err1 := asInt64(def[0])
+	pkeys, err2 := asInt64(def[1])
+	cols, ok := def[2].(keys.Tuple)
+	if err1 != nil || err2 != nil || !ok {
+		return nil, bad
+	}
+
+	t := &Table{Name: name, ID: id, PKeys: int(pkeys)}
+	for _, c := range cols {
+		col, ok := c.(keys.Tuple)
+		if !ok || len(col) != 2 {
+			return nil, bad
+		}
+		colName, ok := col[0].(string)
+		colType, err := asInt64(col[1])
+		if !ok || err != nil {
+			return nil, bad
+		}
+		t.Columns = append(t.Columns, Column{Name: colName, Type: ColumnType(colType)})
+	}
+	if len(def) == 4 {
+		indexes, ok := def[3].(keys.Tuple)
+		if !ok {
+			return nil, bad
+		}
+		for _, i := range indexes {
+			idx, ok := i.(keys.Tuple)
+			if !ok || len(idx) != 3 {
+				return nil, bad
+			}
+			idxName, ok1 := idx[0].(string)
+			idxCol, ok2 := idx[1].(string)
+			idxID, err := asInt64(idx[2])
+			if !ok1 || !ok2 || err != nil {
+				return nil, bad
+			}
+			t.Indexes = append(t.Indexes, Index{Name: idxName, Column: idxCol, ID: idxID})
+		}
+	}
+	if err := t.validate(); err != nil {
+		return nil, bad
+	}
+	return t, nil
+}
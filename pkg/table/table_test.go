@@ -0,0 +1,225 @@
+package table
+
+import (
+	"database-go/pkg/kv"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTablesAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := kv.Open(path, kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := &Table{
+		Name: "users",
+		Columns: []Column{
+			{"id", COL_INT64}, {"name", COL_STRING}, {"avatar", COL_BYTES}, {"admin", COL_BOOL},
+		},
+		PKeys: 1,
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateTable(tx, users); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateTable(tx, &Table{Name: "users", Columns: users.Columns, PKeys: 1}); !errors.Is(err, ErrTableExists) {
+		t.Fatalf("second CreateTable(users) = %v, want %v", err, ErrTableExists)
+	}
+	for i := 0; i < 100; i++ {
+		if err := users.Insert(tx, Row{i, "user", []byte{byte(i)}, i%10 == 0}); err != nil {
+			t.Fatalf("Insert(%d): %v", i, err)
+		}
+	}
+	if err := users.Insert(tx, Row{7, "again", []byte{}, false}); !errors.Is(err, ErrRowExists) {
+		t.Fatalf("duplicate Insert = %v, want %v", err, ErrRowExists)
+	}
+	if err := users.Insert(tx, Row{"8", "bad", []byte{}, false}); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("Insert with a string id = %v, want %v", err, ErrBadRow)
+	}
+	if err := users.Insert(tx, Row{8, "short"}); !errors.Is(err, ErrBadRow) {
+		t.Fatalf("Insert with missing columns = %v, want %v", err, ErrBadRow)
+	}
+	if ok, err := users.Delete(tx, 5); err != nil || !ok {
+		t.Fatalf("Delete(5) = %v, %v", ok, err)
+	}
+	if err := users.Upsert(tx, Row{6, "renamed", []byte("x"), true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = kv.Open(path, kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	got, err := GetTable(tx, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, users) {
+		t.Fatalf("GetTable(users) = %+v, want %+v", got, users)
+	}
+	if _, err := GetTable(tx, "missing"); !errors.Is(err, ErrNoTable) {
+		t.Fatalf("GetTable(missing) = %v, want %v", err, ErrNoTable)
+	}
+
+	row, err := got.Get(tx, 10)
+	if err != nil || !reflect.DeepEqual(row, Row{int64(10), "user", []byte{10}, true}) {
+		t.Errorf("Get(10) = %#v, %v", row, err)
+	}
+	row, err = got.Get(tx, int64(6))
+	if err != nil || !reflect.DeepEqual(row, Row{int64(6), "renamed", []byte("x"), true}) {
+		t.Errorf("Get(6) = %#v, %v", row, err)
+	}
+	if _, err := got.Get(tx, 5); !errors.Is(err, ErrRowNotFound) {
+		t.Errorf("Get(5) = %v, want %v", err, ErrRowNotFound)
+	}
+
+	// A second table gets the next ID, so its rows don't mix with the first's
+	other := &Table{Name: "other", Columns: []Column{{"id", COL_INT64}}, PKeys: 1}
+	if err := CreateTable(tx, other); err != nil {
+		t.Fatal(err)
+	}
+	if other.ID != users.ID+1 {
+		t.Errorf("second table has ID %d, want %d", other.ID, users.ID+1)
+	}
+	if err := CreateTable(tx, &Table{Name: "bad", Columns: []Column{{"id", COL_INT64}}, PKeys: 2}); !errors.Is(err, ErrBadSchema) {
+		t.Errorf("CreateTable with too many key columns = %v, want %v", err, ErrBadSchema)
+	}
+}
+
+func TestTransactionsAcrossTablesAreAtomic(t *testing.T) {
+	db, err := kv.Open(filepath.Join(t.TempDir(), "test.db"), kv.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	accounts := &Table{Name: "accounts", Columns: []Column{{"id", COL_INT64}, {"balance", COL_INT64}}, PKeys: 1}
+	ledger := &Table{Name: "ledger", Columns: []Column{{"seq", COL_INT64}, {"amount", COL_INT64}}, PKeys: 1}
+	_, err = db.Update(func(tx *kv.Tx) error {
+		if err := CreateTable(tx, accounts); err != nil {
+			return err
+		}
+		if err := CreateTable(tx, ledger); err != nil {
+			return err
+		}
+		return accounts.Insert(tx, Row{0, 0})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The balance always equals the sum of the ledger
+	check := func(tx *kv.Tx) error {
+		row, err := accounts.Get(tx, 0)
+		if err != nil {
+			return err
+		}
+		var sum int64
+		err = ledger.Scan(tx, func(row Row) error {
+			sum += row[1].(int64)
+			return nil
+		})
+		if err == nil && sum != row[1].(int64) {
+			err = fmt.Errorf("balance %d, ledger adds up to %d", row[1], sum)
+		}
+		return err
+	}
+	deposit := func(tx *kv.Tx, seq, amount int64) error {
+		row, err := accounts.Get(tx, 0)
+		if err != nil {
+			return err
+		}
+		if err := ledger.Insert(tx, Row{seq, amount}); err != nil {
+			return err
+		}
+		return accounts.Upsert(tx, Row{0, row[1].(int64) + amount})
+	}
+
+	// Rolled back and conflicting transactions leave both tables alone
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deposit(tx, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deposit(tx, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Update(func(tx *kv.Tx) error { return deposit(tx, 1, 5) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, kv.ErrConflict) {
+		t.Fatalf("conflicting Commit = %v, want %v", err, kv.ErrConflict)
+	}
+
+	// Readers running alongside never see one table changed without the other
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tx, err := db.Begin()
+			if err == nil {
+				err = check(tx)
+				tx.Rollback()
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for seq := int64(2); seq < 200; seq++ {
+		if _, err := db.Update(func(tx *kv.Tx) error { return deposit(tx, seq, seq) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := check(tx); err != nil {
+		t.Fatal(err)
+	}
+	if row, err := accounts.Get(tx, 0); err != nil || row[1] != int64(5+199*200/2-1) {
+		t.Errorf("final balance = %v, %v", row, err)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Spans of work, so that one trace follows a request from the client library through
+the server down into the storage engine and shows where its time went.
+
+Trace and span IDs and the way they are carried between processes follow W3C Trace
+Context, as OpenTelemetry does: a span context arriving in a traceparent header can
+be the parent of spans here, and spans handed to the exporter can be forwarded into
+an OpenTelemetry pipeline as they are. Nothing is recorded until SetExporter is
+called. Until then Start returns a nil *Span, whose methods do nothing, so tracing
+costs next to nothing when it is off.
+*/
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The HTTP header a span context travels in
+	TRACEPARENT_HEADER = "traceparent"
+	// Bytes of a span context in binary: trace ID, span ID and flags
+	SPAN_CONTEXT_SIZE = 16 + 8 + 1
+	// The traceparent flag for a sampled trace
+	FLAG_SAMPLED = 0x01
+)
+
+// Returned by ParseTraceparent and DecodeSpanContext for a span context that doesn't parse
+var ErrBadSpanContext = errors.New("trace: bad span context")
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// What identifies a span to its children, here or in another process.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Whether the trace is being recorded
+	Sampled bool
+}
+
+// A span of work. Fields are only to be read once the span has ended.
+type Span struct {
+	Name    string
+	Context SpanContext
+	// Zero for the root of a trace
+	Parent SpanID
+	// Whether the parent is in another process
+	Remote   bool
+	Start    time.Time
+	Duration time.Duration
+	Attrs    map[string]any
+	// What the work failed with, if it did
+	Err error
+}
+
+type contextKey struct{}
+
+// The span a context carries, and whether it came from another process.
+type parent struct {
+	sc     SpanContext
+	remote bool
+}
+
+var exporter atomic.Pointer[func(span *Span)]
+
+/*
+Call export with every span as it ends, from then on; nil stops recording. export is
+called from many goroutines at once, and should be quick.
+*/
+func SetExporter(export func(span *Span)) {
+	if export == nil {
+		exporter.Store(nil)
+		return
+	}
+	exporter.Store(&export)
+}
+
+/*
+Start a span named name, a child of the span in ctx or else the root of a new trace,
+and return a context carrying it. Returns nil and ctx as it is when nothing is being
+recorded, or ctx's trace isn't sampled.
+*/
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, true)
+}
+
+/*
+Like Start, but only starts a span if ctx already has one; for work that is only of
+interest as part of a larger request, like page I/O.
+*/
+func StartChild(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, false)
+}
+
+func start(ctx context.Context, name string, root bool) (context.Context, *Span) {
+	if exporter.Load() == nil || ctx == nil {
+		return ctx, nil
+	}
+	p, ok := ctx.Value(contextKey{}).(parent)
+	if (!ok && !root) || (ok && !p.sc.Sampled) {
+		return ctx, nil
+	}
+	span := &Span{Name: name, Start: time.Now()}
+	span.Context.SpanID = newSpanID()
+	span.Context.Sampled = true
+	if ok {
+		span.Context.TraceID = p.sc.TraceID
+		span.Parent = p.sc.SpanID
+		span.Remote = p.remote
+	} else {
+		binary.LittleEndian.PutUint64(span.Context.TraceID[:8], rand.Uint64())
+		binary.LittleEndian.PutUint64(span.Context.TraceID[8:], rand.Uint64())
+	}
+	return context.WithValue(ctx, contextKey{}, parent{sc: span.Context}), span
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		binary.LittleEndian.PutUint64(id[:], rand.Uint64())
+	}
+	return id
+}
+
+// The context of the span in ctx, the zero SpanContext if there isn't one.
+func FromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	p, _ := ctx.Value(contextKey{}).(parent)
+	return p.sc
+}
+
+// A context whose spans are children of sc, a span in another process.
+func WithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, parent{sc: sc, remote: true})
+}
+
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.Attrs == nil {
+		s.Attrs = map[string]any{}
+	}
+	s.Attrs[key] = value
+}
+
+// Record err, if not nil, as what the span's work failed with.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Err = err
+}
+
+// End the span and hand it to the exporter. It must not be touched afterwards.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Duration = time.Since(s.Start)
+	if export := exporter.Load(); export != nil {
+		(*export)(s)
+	}
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) flags() byte {
+	if sc.Sampled {
+		return FLAG_SAMPLED
+	}
+	return 0
+}
+
+// The span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), sc.flags())
+}
+
+// Parse a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// version - trace ID - span ID - flags; later versions may add fields after a dash
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return sc, fmt.Errorf("%w: %q", ErrBadSpanContext, s)
+	}
+	var version, flags [1]byte
+	_, err := hex.Decode(version[:], []byte(s[0:2]))
+	if err == nil {
+		_, err = hex.Decode(sc.TraceID[:], []byte(s[3:35]))
+	}
+	if err == nil {
+		_, err = hex.Decode(sc.SpanID[:], []byte(s[36:52]))
+	}
+	if err == nil {
+		_, err = hex.Decode(flags[:], []byte(s[53:55]))
+	}
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(s) != 55) || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("%w: %q", ErrBadSpanContext, s)
+	}
+	sc.Sampled = flags[0]&FLAG_SAMPLED != 0
+	return sc, nil
+}
+
+// Append the span context to b in SPAN_CONTEXT_SIZE bytes: | trace ID | span ID | flags |
+func (sc SpanContext) AppendBinary(b []byte) []byte {
+	b = append(b, sc.TraceID[:]...)
+	b = append(b, sc.SpanID[:]...)
+	return append(b, sc.flags())
+}
+
+// Decode a span context written by AppendBinary.
+func DecodeSpanContext(b []byte) (SpanContext, error) {
+	var sc SpanContext
+	if len(b) != SPAN_CONTEXT_SIZE {
+		return sc, fmt.Errorf("%w: %d bytes", ErrBadSpanContext, len(b))
+	}
+	copy(sc.TraceID[:], b[:16])
+	copy(sc.SpanID[:], b[16:24])
+	sc.Sampled = b[24]&FLAG_SAMPLED != 0
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("%w: zero ID", ErrBadSpanContext)
+	}
+	return sc, nil
+}
+
+// Keeps the spans it is given, for looking at in tests or a debug page. Its Export is for SetExporter.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *Recorder) Export(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// The spans ended so far, in the order they ended.
+func (r *Recorder) Spans() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Span{}, r.spans...)
+}
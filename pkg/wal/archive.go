@@ -0,0 +1,198 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Segment layout: | sequence number | commit time (unix nanoseconds) | crc32 of both | batch |
+	SEGMENT_HEADER_SIZE = 8 + 8 + CHECKSUM_SIZE
+	SEGMENT_SUFFIX      = ".wal"
+)
+
+// Returned when a segment in an archive is damaged, or isn't where its name says
+var ErrBadSegment = errors.New("wal: bad archive segment")
+
+/*
+An archive keeps every batch the log has held, each in a segment file of its own
+named after the sequence number of its commit, so the commits a file went through
+can be replayed later onto an older copy of it: point-in-time recovery. Segments
+are never removed but by Discard; old ones are the operator's to prune, once there
+is a backup from after them.
+
+Segments are written to a temporary name, synced and renamed into place, so a
+segment is either whole or missing.
+*/
+type Archive struct {
+	dir string
+}
+
+// One segment's commit, as listed by Segments.
+type Segment struct {
+	Seq  uint64
+	Path string
+}
+
+// Open the archive in directory dir, creating it if need be.
+func OpenArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{dir: dir}, nil
+}
+
+func (a *Archive) segmentPath(seq uint64) string {
+	return filepath.Join(a.dir, fmt.Sprintf("%020d%s", seq, SEGMENT_SUFFIX))
+}
+
+// Durably add the batch of commit seq, committed at at. A segment already there for seq is replaced.
+func (a *Archive) Add(seq uint64, at time.Time, pages map[uint64][]byte) error {
+	b, err := encodeBatch(pages)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, SEGMENT_HEADER_SIZE)
+	binary.LittleEndian.PutUint64(header[0:8], seq)
+	binary.LittleEndian.PutUint64(header[8:16], uint64(at.UnixNano()))
+	binary.LittleEndian.PutUint32(header[16:20], crc32.Checksum(header[:16], castagnoli))
+
+	path := a.segmentPath(seq)
+	tmp, err := os.CreateTemp(a.dir, ".segment-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(header, b...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(a.dir)
+}
+
+// The archive's segments in order of sequence number.
+func (a *Archive) Segments() ([]Segment, error) {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []Segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), SEGMENT_SUFFIX)
+		if !ok || e.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, Segment{Seq: seq, Path: filepath.Join(a.dir, e.Name())})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Seq < segments[j].Seq })
+	return segments, nil
+}
+
+/*
+Remove the segment for commit seq, if there is one: for a commit taken back after it
+was archived, or one past the file's last commit when the file is opened.
+*/
+func (a *Archive) Discard(seq uint64) error {
+	err := os.Remove(a.segmentPath(seq))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(a.dir)
+}
+
+// Call apply for each page of the segment's batch, in page order, if it is intact; ErrBadSegment otherwise.
+func (s Segment) Replay(apply func(ptr uint64, page []byte) error) error {
+	b, err := s.read()
+	if err != nil {
+		return err
+	}
+	return b.each(apply)
+}
+
+// When the segment's commit was made.
+func (s Segment) Time() (time.Time, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	header := make([]byte, SEGMENT_HEADER_SIZE)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s: %v", ErrBadSegment, s.Path, err)
+	}
+	return s.header(header)
+}
+
+func (s Segment) header(header []byte) (time.Time, error) {
+	if crc32.Checksum(header[:16], castagnoli) != binary.LittleEndian.Uint32(header[16:20]) {
+		return time.Time{}, fmt.Errorf("%w: %s: header checksum mismatch", ErrBadSegment, s.Path)
+	}
+	if seq := binary.LittleEndian.Uint64(header[0:8]); seq != s.Seq {
+		return time.Time{}, fmt.Errorf("%w: %s holds commit %d", ErrBadSegment, s.Path, seq)
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(header[8:16]))), nil
+}
+
+func (s Segment) read() (batch, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return batch{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return batch{}, err
+	}
+
+	r := bufio.NewReader(file)
+	header := make([]byte, SEGMENT_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return batch{}, fmt.Errorf("%w: %s: %v", ErrBadSegment, s.Path, err)
+	}
+	if _, err := s.header(header); err != nil {
+		return batch{}, err
+	}
+	remaining := info.Size() - SEGMENT_HEADER_SIZE
+	b, ok := readBatch(r, remaining)
+	if !ok || b.size() != remaining {
+		return batch{}, fmt.Errorf("%w: %s: damaged batch", ErrBadSegment, s.Path)
+	}
+	return b, nil
+}
+
+// Make renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,187 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	BATCH_MAGIC = 0x424c4157 // "WALB"
+
+	// Batch layout: | magic | page size | count | count x (page number | page) | crc32 |
+	BATCH_HEADER_SIZE = 4 + 4 + 4
+	ENTRY_HEADER_SIZE = 8
+	CHECKSUM_SIZE     = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+Write-ahead log of full page images.
+
+Every commit appends one batch holding each page it writes (including the meta
+page) and fsyncs it before the main file is touched. Once the pages have been copied
+into the main file the log is reset. If the process dies in between, Replay hands the
+logged pages back so they can be copied again. A batch whose checksum doesn't match
+was torn by the crash and is ignored, along with anything after it.
+*/
+type Log struct {
+	file *os.File
+}
+
+// Open the log at path, creating it if it does not exist.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: file}, nil
+}
+
+// Durably append one batch of page writes. Every page in a batch must be the same size.
+func (l *Log) Append(pages map[uint64][]byte) error {
+	batch, err := encodeBatch(pages)
+	if err != nil {
+		return err
+	}
+	end, err := l.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.WriteAt(batch, end); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func encodeBatch(pages map[uint64][]byte) ([]byte, error) {
+	ptrs := make([]uint64, 0, len(pages))
+	for ptr := range pages {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+
+	pageSize := 0
+	if len(ptrs) > 0 {
+		pageSize = len(pages[ptrs[0]])
+	}
+	size := BATCH_HEADER_SIZE + len(ptrs)*(ENTRY_HEADER_SIZE+pageSize) + CHECKSUM_SIZE
+	batch := make([]byte, size)
+	binary.LittleEndian.PutUint32(batch[0:4], BATCH_MAGIC)
+	binary.LittleEndian.PutUint32(batch[4:8], uint32(pageSize))
+	binary.LittleEndian.PutUint32(batch[8:12], uint32(len(ptrs)))
+	pos := BATCH_HEADER_SIZE
+	for _, ptr := range ptrs {
+		page := pages[ptr]
+		if len(page) != pageSize {
+			return nil, errors.New("wal: pages in a batch must all be the same size")
+		}
+		binary.LittleEndian.PutUint64(batch[pos:], ptr)
+		copy(batch[pos+ENTRY_HEADER_SIZE:], page)
+		pos += ENTRY_HEADER_SIZE + pageSize
+	}
+	binary.LittleEndian.PutUint32(batch[pos:], crc32.Checksum(batch[:pos], castagnoli))
+	return batch, nil
+}
+
+/*
+Call apply for every page of every complete batch, in the order they were logged.
+Returns the number of batches replayed.
+*/
+func (l *Log) Replay(apply func(ptr uint64, page []byte) error) (int, error) {
+	info, err := l.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(l.file)
+
+	batches := 0
+	for remaining := info.Size(); ; {
+		b, ok := readBatch(reader, remaining)
+		if !ok {
+			// Clean end of log, or a batch torn by a crash
+			return batches, nil
+		}
+		if err := b.each(apply); err != nil {
+			return batches, err
+		}
+		batches++
+		remaining -= b.size()
+	}
+}
+
+// One batch as read back, checked against its checksum.
+type batch struct {
+	pageSize int
+	// The entries and the checksum
+	body []byte
+}
+
+/*
+Read one batch of at most remaining bytes from r. Returns false if there isn't a
+whole, intact batch there.
+*/
+func readBatch(r *bufio.Reader, remaining int64) (batch, bool) {
+	header := make([]byte, BATCH_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return batch{}, false
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != BATCH_MAGIC {
+		return batch{}, false
+	}
+
+	pageSize := int(binary.LittleEndian.Uint32(header[4:8]))
+	count := int64(binary.LittleEndian.Uint32(header[8:12]))
+	bodySize := count*int64(ENTRY_HEADER_SIZE+pageSize) + CHECKSUM_SIZE
+	// Don't trust a torn count enough to allocate for it
+	if BATCH_HEADER_SIZE+bodySize > remaining {
+		return batch{}, false
+	}
+	body := make([]byte, bodySize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return batch{}, false
+	}
+
+	crc := crc32.Checksum(header, castagnoli)
+	crc = crc32.Update(crc, castagnoli, body[:len(body)-CHECKSUM_SIZE])
+	if crc != binary.LittleEndian.Uint32(body[len(body)-CHECKSUM_SIZE:]) {
+		return batch{}, false
+	}
+	return batch{pageSize: pageSize, body: body}, true
+}
+
+func (b batch) size() int64 {
+	return int64(BATCH_HEADER_SIZE + len(b.body))
+}
+
+// Call apply for every page in the batch, in page order.
+func (b batch) each(apply func(ptr uint64, page []byte) error) error {
+	for pos := 0; pos < len(b.body)-CHECKSUM_SIZE; pos += ENTRY_HEADER_SIZE + b.pageSize {
+		ptr := binary.LittleEndian.Uint64(b.body[pos:])
+		page := b.body[pos+ENTRY_HEADER_SIZE : pos+ENTRY_HEADER_SIZE+b.pageSize]
+		if err := apply(ptr, page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard everything in the log, once its pages are safely in the main file.
+func (l *Log) Reset() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,188 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A batch of pages of size bytes, each filled with its number and tag
+func testBatch(tag byte, size int, ptrs ...uint64) map[uint64][]byte {
+	pages := map[uint64][]byte{}
+	for _, ptr := range ptrs {
+		pages[ptr] = bytes.Repeat([]byte{byte(ptr), tag}, size/2)
+	}
+	return pages
+}
+
+type replayed struct {
+	ptr  uint64
+	page []byte
+}
+
+// Replay the log at path, returning the batch count and every page in order
+func replayAll(t *testing.T, path string) (int, []replayed) {
+	t.Helper()
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	var pages []replayed
+	n, err := log.Replay(func(ptr uint64, page []byte) error {
+		pages = append(pages, replayed{ptr, append([]byte{}, page...)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, pages
+}
+
+func checkReplayed(t *testing.T, got []replayed, batches ...map[uint64][]byte) {
+	t.Helper()
+	var want []replayed
+	for _, b := range batches {
+		// Pages come back in page order within a batch
+		var ptrs []uint64
+		for ptr := range b {
+			ptrs = append(ptrs, ptr)
+		}
+		sort.Slice(ptrs, func(i, j int) bool { return ptrs[i] < ptrs[j] })
+		for _, ptr := range ptrs {
+			want = append(want, replayed{ptr, b[ptr]})
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d pages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ptr != want[i].ptr || !bytes.Equal(got[i].page, want[i].page) {
+			t.Fatalf("page %d replayed as page %d, want page %d", i, got[i].ptr, want[i].ptr)
+		}
+	}
+}
+
+func TestLogRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db-wal")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := log.Replay(func(uint64, []byte) error { return nil }); err != nil || n != 0 {
+		t.Fatalf("Replay of an empty log = %d, %v", n, err)
+	}
+	first := testBatch('a', 64, 9, 0, 3)
+	second := testBatch('b', 64, 3, 200)
+	for _, b := range []map[uint64][]byte{first, second, {}} {
+		if err := log.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := log.Append(map[uint64][]byte{1: make([]byte, 64), 2: make([]byte, 32)}); err == nil {
+		t.Fatal("Append of pages of different sizes succeeded")
+	}
+	log.Close()
+
+	n, pages := replayAll(t, path)
+	if n != 3 {
+		t.Fatalf("replayed %d batches, want 3", n)
+	}
+	checkReplayed(t, pages, first, second)
+
+	// The error apply returns stops the replay
+	log, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	stop := errors.New("stop")
+	if _, err := log.Replay(func(uint64, []byte) error { return stop }); err != stop {
+		t.Fatalf("Replay = %v, want %v", err, stop)
+	}
+	if err := log.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := replayAll(t, path); n != 0 {
+		t.Fatalf("replayed %d batches after Reset", n)
+	}
+}
+
+func TestLogTornTail(t *testing.T) {
+	first := testBatch('a', 64, 0, 1, 2)
+	second := testBatch('b', 64, 0, 5)
+	full, err := encodeBatch(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash can leave any prefix of the last batch, including a header whose count runs past the end
+	for _, cut := range []int{1, BATCH_HEADER_SIZE - 1, BATCH_HEADER_SIZE, BATCH_HEADER_SIZE + 20, len(full) - 1} {
+		path := filepath.Join(t.TempDir(), "test.db-wal")
+		log, err := Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Append(first); err != nil {
+			t.Fatal(err)
+		}
+		log.Close()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(full[:cut])
+		f.Close()
+
+		n, pages := replayAll(t, path)
+		if n != 1 {
+			t.Fatalf("cut at %d: replayed %d batches, want 1", cut, n)
+		}
+		checkReplayed(t, pages, first)
+	}
+}
+
+func TestLogBadChecksum(t *testing.T) {
+	batches := []map[uint64][]byte{testBatch('a', 64, 0, 1), testBatch('b', 64, 0, 2), testBatch('c', 64, 0, 3)}
+	var sizes []int
+	path := filepath.Join(t.TempDir(), "test.db-wal")
+	log, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range batches {
+		if err := log.Append(b); err != nil {
+			t.Fatal(err)
+		}
+		encoded, _ := encodeBatch(b)
+		sizes = append(sizes, len(encoded))
+	}
+	log.Close()
+
+	// Damage a page image in the second batch; it and everything after it are dropped
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[sizes[0]+BATCH_HEADER_SIZE+ENTRY_HEADER_SIZE+10] ^= 0x01
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, pages := replayAll(t, path)
+	if n != 1 {
+		t.Fatalf("replayed %d batches, want 1", n)
+	}
+	checkReplayed(t, pages, batches[0])
+
+	// As is a batch that doesn't start with the magic number
+	raw[sizes[0]+BATCH_HEADER_SIZE+ENTRY_HEADER_SIZE+10] ^= 0x01
+	raw[0] ^= 0x01
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := replayAll(t, path); n != 0 {
+		t.Fatalf("replayed %d batches after a bad magic number, want 0", n)
+	}
+}